@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+// HubHostName returns the hub's host name, names without
+// a domain are completed with the public cloud one.
+func HubHostName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".azure-devices.net"
+}
+
+// AADCredential returns a token credential that uses the client credentials
+// flow when $AZURE_TENANT_ID, $AZURE_CLIENT_ID and $AZURE_CLIENT_SECRET are set
+// ($AZURE_AUTHORITY_HOST overrides the login endpoint) and falls back
+// to the signed in Azure CLI account otherwise.
+func AADCredential() iotservice.TokenCredential {
+	tenant, client, secret := os.Getenv("AZURE_TENANT_ID"),
+		os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && client != "" && secret != "" {
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = "https://login.microsoftonline.com"
+		}
+		return clientSecretCredential(
+			strings.TrimRight(authority, "/")+"/"+url.PathEscape(tenant)+"/oauth2/v2.0/token",
+			client, secret,
+		)
+	}
+	return azureCLICredential
+}
+
+func clientSecretCredential(endpoint, client, secret string) iotservice.TokenCredential {
+	return func(ctx context.Context, scope string) (*iotservice.AccessToken, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint,
+			strings.NewReader(url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {client},
+				"client_secret": {secret},
+				"scope":         {scope},
+			}.Encode()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		var v struct {
+			AccessToken      string `json:"access_token"`
+			ExpiresIn        int    `json:"expires_in"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if err = json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("token request: %s %s", res.Status, b)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("token request: %s %s", res.Status, v.ErrorDescription)
+		}
+		return &iotservice.AccessToken{
+			Token:     v.AccessToken,
+			ExpiresOn: time.Now().Add(time.Duration(v.ExpiresIn) * time.Second),
+		}, nil
+	}
+}
+
+func azureCLICredential(ctx context.Context, scope string) (*iotservice.AccessToken, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx,
+		"az", "account", "get-access-token", "--scope", scope, "--output", "json",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("az: %s", msg)
+		}
+		return nil, fmt.Errorf("az: %w", err)
+	}
+	return parseAzureCLIToken(stdout.Bytes())
+}
+
+// parseAzureCLIToken parses `az account get-access-token` output, expires_on
+// is a unix timestamp that only newer versions of the Azure CLI output,
+// expiresOn is local time.
+func parseAzureCLIToken(b []byte) (*iotservice.AccessToken, error) {
+	var v struct {
+		AccessToken string          `json:"accessToken"`
+		ExpiresOn   string          `json:"expiresOn"`
+		ExpiresOnTS json.RawMessage `json:"expires_on"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	if v.AccessToken == "" {
+		return nil, errors.New("az: access token is missing")
+	}
+	tok := &iotservice.AccessToken{Token: v.AccessToken}
+	if len(v.ExpiresOnTS) != 0 {
+		ts, err := strconv.ParseInt(strings.Trim(string(v.ExpiresOnTS), `"`), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("az: malformed expires_on: %w", err)
+		}
+		tok.ExpiresOn = time.Unix(ts, 0)
+		return tok, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", v.ExpiresOn, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("az: malformed expiresOn: %w", err)
+	}
+	tok.ExpiresOn = t
+	return tok, nil
+}
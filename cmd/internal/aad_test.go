@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHubHostName(t *testing.T) {
+	for name, want := range map[string]string{
+		"hub":                   "hub.azure-devices.net",
+		"hub.azure-devices.net": "hub.azure-devices.net",
+		"hub.azure-devices.cn":  "hub.azure-devices.cn",
+	} {
+		if got := HubHostName(name); got != want {
+			t.Errorf("HubHostName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseAzureCLIToken(t *testing.T) {
+	tok, err := parseAzureCLIToken([]byte(`{"accessToken":"a","expiresOn":"2030-01-02 03:04:05.000000","expires_on":1893553445}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Token != "a" || !tok.ExpiresOn.Equal(time.Unix(1893553445, 0)) {
+		t.Errorf("token = %+v", tok)
+	}
+
+	tok, err = parseAzureCLIToken([]byte(`{"accessToken":"b","expiresOn":"2030-01-02 03:04:05.000000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.Local); !tok.ExpiresOn.Equal(want) {
+		t.Errorf("ExpiresOn = %s, want %s", tok.ExpiresOn, want)
+	}
+
+	if _, err = parseAzureCLIToken([]byte(`{}`)); err == nil {
+		t.Error("parseAzureCLIToken({}) = nil error, want an error")
+	}
+}
+
+func TestClientSecretCredential(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error_description":"invalid secret"}`))
+			return
+		}
+		if got := r.Form.Get("scope"); got != "scope" {
+			t.Errorf("scope = %q, want %q", got, "scope")
+		}
+		_, _ = w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	tok, err := clientSecretCredential(srv.URL, "id", "secret")(context.Background(), "scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Token != "token" || time.Until(tok.ExpiresOn) < 59*time.Minute {
+		t.Errorf("token = %+v", tok)
+	}
+	if _, err = clientSecretCredential(srv.URL, "id", "wrong")(context.Background(), "scope"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -1,21 +1,23 @@
 package internal
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // ErrInvalidUsage when returned by a Handler the usage message is displayed.
 var ErrInvalidUsage = errors.New("invalid usage")
 
-// Command is a cli subcommand.
+// Command is a cli subcommand, trailing Args
+// enclosed in square brackets are optional.
 type Command struct {
 	Name      string
+	Aliases   []string // previous names kept for compatibility
 	Args      []string
 	Desc      string
 	Handler   HandlerFunc
@@ -30,6 +32,7 @@ type FlagFunc func(fs *flag.FlagSet)
 
 // CLI is a cli subcommands executor.
 type CLI struct {
+	name string
 	desc string
 	cmds []*Command
 	main FlagFunc
@@ -37,11 +40,12 @@ type CLI struct {
 
 // New creates new cli executor.
 func New(desc string, f FlagFunc, cmds []*Command) *CLI {
-	return &CLI{
+	r := &CLI{
 		desc: desc,
-		cmds: cmds,
 		main: f,
 	}
+	r.cmds = append(cmds, r.completionCommand())
+	return r
 }
 
 // Run runs one or the given commands based on argv.
@@ -55,7 +59,8 @@ func (r *CLI) Run(argv []string) error {
 		panic("empty argv")
 	}
 
-	sm := flag.NewFlagSet(filepath.Base(argv[0]), flag.ContinueOnError)
+	r.name = filepath.Base(argv[0])
+	sm := flag.NewFlagSet(r.name, flag.ContinueOnError)
 	if r.main != nil {
 		r.main(sm)
 	}
@@ -116,7 +121,7 @@ Commands:
 		}
 		return err
 	}
-	if len(cmd.Args) != sc.NArg() {
+	if n := sc.NArg(); n < cmd.minArgs() || n > len(cmd.Args) {
 		sc.Usage()
 		return ErrInvalidUsage
 	}
@@ -129,6 +134,16 @@ Commands:
 	return nil
 }
 
+func (c *Command) minArgs() int {
+	n := 0
+	for _, arg := range c.Args {
+		if !strings.HasPrefix(arg, "[") {
+			n++
+		}
+	}
+	return n
+}
+
 func hasFlags(fs *flag.FlagSet) bool {
 	var has bool
 	fs.VisitAll(func(f *flag.Flag) {
@@ -142,6 +157,11 @@ func (r *CLI) findCommand(k string) *Command {
 		if cmd.Name == k {
 			return cmd
 		}
+		for _, alias := range cmd.Aliases {
+			if alias == k {
+				return cmd
+			}
+		}
 	}
 	return nil
 }
@@ -152,15 +172,28 @@ func OutputLine(format string) error {
 	return err
 }
 
+var (
+	outputMu sync.Mutex
+	outputs  = map[string]*Printer{} // stdout printers by format
+)
+
+// Output prints v to stdout in the given format, see Printer.
+//
+// Printers are kept for the command invocation,
+// so values printed one by one share the table header.
 func Output(v interface{}, format string) error {
-	switch format {
-	case "json":
-		return json.NewEncoder(os.Stdout).Encode(v)
-	case "json-pretty":
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "\t")
-		return enc.Encode(v)
-	default:
-		return fmt.Errorf("unknown output format: %q", format)
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	p, ok := outputs[format]
+	if !ok {
+		var err error
+		if p, err = NewPrinter(os.Stdout, format); err != nil {
+			return err
+		}
+		outputs[format] = p
+	}
+	if err := p.Print(v); err != nil {
+		return err
 	}
+	return p.Flush()
 }
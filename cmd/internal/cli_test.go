@@ -49,6 +49,57 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunAlias(t *testing.T) {
+	var called bool
+	cli := New("test desc", nil, []*Command{
+		{
+			Name:    "test",
+			Aliases: []string{"old-test"},
+			Handler: func(args []string) error {
+				called = true
+				return nil
+			},
+		},
+	})
+	if err := cli.Run([]string{"run", "old-test"}); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Error("command is not called by its alias")
+	}
+}
+
+func TestRunOptionalArgs(t *testing.T) {
+	var have []string
+	cli := New("test desc", nil, []*Command{
+		{
+			Name: "test",
+			Args: []string{"A", "[B]"},
+			Handler: func(args []string) error {
+				have = args
+				return nil
+			},
+		},
+	})
+	for _, args := range [][]string{{"a"}, {"a", "b"}} {
+		if err := cli.Run(append([]string{"run", "test"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(have, "") != strings.Join(args, "") {
+			t.Errorf("args = %v, want %v", have, args)
+		}
+	}
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	for _, args := range [][]string{{}, {"a", "b", "c"}} {
+		if err := cli.Run(append([]string{"run", "test"}, args...)); err != ErrInvalidUsage {
+			t.Errorf("Run(%v) = %v, want %v", args, err, ErrInvalidUsage)
+		}
+	}
+}
+
 // capture stdout
 func capture(fn func() error) ([]byte, error) {
 	f, err := os.CreateTemp("", "")
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completionCommand is added to every CLI, it prints a completion
+// script for subcommands and their flags of the given shell.
+func (r *CLI) completionCommand() *Command {
+	return &Command{
+		Name: "completion",
+		Args: []string{"SHELL"},
+		Desc: "print completion script <bash|zsh|fish>",
+		Handler: func(args []string) error {
+			return r.Completion(os.Stdout, args[0])
+		},
+	}
+}
+
+// Completion writes a completion script of the given shell to w.
+func (r *CLI) Completion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return r.bashCompletion(w, false)
+	case "zsh":
+		return r.bashCompletion(w, true)
+	case "fish":
+		return r.fishCompletion(w)
+	default:
+		return fmt.Errorf("unsupported shell %q", shell)
+	}
+}
+
+// compFlag is a flag description for completion scripts.
+type compFlag struct {
+	name  string
+	usage string
+	value bool // flag takes a value
+}
+
+func flagsOf(fn func(*flag.FlagSet)) []compFlag {
+	if fn == nil {
+		return nil
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fn(fs)
+	var flags []compFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, compFlag{
+			name:  f.Name,
+			usage: f.Usage,
+			value: !ok || !b.IsBoolFlag(),
+		})
+	})
+	return flags
+}
+
+func flagNames(flags []compFlag) string {
+	names := make([]string, 0, len(flags))
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+	}
+	return strings.Join(names, " ")
+}
+
+// bashCompletion writes a bash completion script,
+// zsh uses it through bashcompinit.
+func (r *CLI) bashCompletion(w io.Writer, zsh bool) error {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(r.name)
+	main := flagsOf(r.main)
+	cmds := make([]string, 0, len(r.cmds))
+	for _, cmd := range r.cmds {
+		cmds = append(cmds, cmd.Name)
+	}
+	var skip []string // common flags consuming the next word
+	for _, f := range main {
+		if f.value {
+			skip = append(skip, "-"+f.name)
+		}
+	}
+
+	var b strings.Builder
+	if zsh {
+		b.WriteString("autoload -U +X bashcompinit && bashcompinit\n\n")
+	}
+	fmt.Fprintf(&b, `%s() {
+	local cur=${COMP_WORDS[COMP_CWORD]} cmd="" i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		%s) ((i++)) ;;
+		-*) ;;
+		*) cmd=${COMP_WORDS[i]}; break ;;
+		esac
+	done
+	if [[ -z $cmd ]]; then
+		if [[ $cur == -* ]]; then
+			COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		fi
+		return
+	fi
+	[[ $cur == -* ]] || return
+	case $cmd in
+`, fn, orPattern(skip), flagNames(main), strings.Join(cmds, " "))
+	for _, cmd := range r.cmds {
+		if flags := flagsOf(cmd.ParseFunc); len(flags) != 0 {
+			fmt.Fprintf(&b, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n",
+				cmd.Name, flagNames(flags))
+		}
+	}
+	fmt.Fprintf(&b, "\tesac\n}\n\ncomplete -o default -F %s %s\n", fn, r.name)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// orPattern returns a case pattern matching any of words,
+// or a pattern that never matches when it's empty.
+func orPattern(words []string) string {
+	if len(words) == 0 {
+		return "''"
+	}
+	return strings.Join(words, "|")
+}
+
+func (r *CLI) fishCompletion(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "complete -c %s -f\n", r.name)
+	for _, f := range flagsOf(r.main) {
+		fmt.Fprintf(&b, "complete -c %s -o %s -d %s\n", r.name, f.name, fishQuote(f.usage))
+	}
+	for _, cmd := range r.cmds {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n",
+			r.name, cmd.Name, fishQuote(cmd.Desc))
+		for _, f := range flagsOf(cmd.ParseFunc) {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from %s' -o %s -d %s\n",
+				r.name, cmd.Name, f.name, fishQuote(f.usage))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
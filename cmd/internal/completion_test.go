@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestCompletion(t *testing.T) {
+	cli := New("test desc", func(f *flag.FlagSet) {
+		f.String("format", "", "output format")
+	}, []*Command{
+		{
+			Name: "send",
+			Desc: "send it",
+			ParseFunc: func(f *flag.FlagSet) {
+				f.Bool("force", false, "don't ask")
+				f.String("mid", "", "message id")
+			},
+		},
+	})
+	cli.name = "test-cli"
+
+	for shell, want := range map[string][]string{
+		"bash": {
+			"-format) ((i++)) ;;",
+			`compgen -W "send completion"`,
+			`send) COMPREPLY=($(compgen -W "-force -mid" -- "$cur")) ;;`,
+			"complete -o default -F _test_cli test-cli",
+		},
+		"zsh": {
+			"bashcompinit",
+			"complete -o default -F _test_cli test-cli",
+		},
+		"fish": {
+			"complete -c test-cli -o format -d 'output format'",
+			"complete -c test-cli -n __fish_use_subcommand -a send -d 'send it'",
+			`complete -c test-cli -n '__fish_seen_subcommand_from send' -o force -d 'don\'t ask'`,
+		},
+	} {
+		var b bytes.Buffer
+		if err := cli.Completion(&b, shell); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range want {
+			if !strings.Contains(b.String(), s) {
+				t.Errorf("%s completion doesn't contain %q:\n%s", shell, s, b.String())
+			}
+		}
+	}
+	if err := cli.Completion(&bytes.Buffer{}, "tcsh"); err == nil {
+		t.Error("Completion(tcsh) = nil error, want an error")
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// RunContext runs fn with a context that's cancelled by the first SIGINT,
+// the second one terminates the process, and after the timeout when it's
+// non-zero. Errors caused by SIGINT are discarded so interrupted commands
+// exit gracefully, timeouts are reported with the timeout value.
+func RunContext(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-sigc:
+			signal.Reset(os.Interrupt)
+			close(interrupted)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := fn(ctx)
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-interrupted:
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+	default:
+	}
+	if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunContext(t *testing.T) {
+	want := errors.New("failure")
+	if err := RunContext(context.Background(), 0, func(ctx context.Context) error {
+		return want
+	}); err != want {
+		t.Errorf("RunContext() = %v, want %v", err, want)
+	}
+
+	err := RunContext(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("RunContext() = %v, want a timeout error", err)
+	}
+}
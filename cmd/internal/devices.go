@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+// ReadDevices reads device identities from r in the given format.
+//
+// The json format is an array of registry device objects, the csv format
+// requires a header row with the deviceId column and can have authType,
+// primaryKey, secondaryKey, primaryThumbprint, secondaryThumbprint,
+// status, statusReason, edge and tags (JSON object) columns.
+// When authType is empty it's inferred from keys and thumbprints.
+func ReadDevices(r io.Reader, format string) ([]*iotservice.Device, error) {
+	switch format {
+	case "json":
+		var devices []*iotservice.Device
+		if err := json.NewDecoder(r).Decode(&devices); err != nil {
+			return nil, err
+		}
+		for i, dev := range devices {
+			if dev.DeviceID == "" {
+				return nil, fmt.Errorf("device %d: deviceId is empty", i)
+			}
+		}
+		return devices, nil
+	case "csv":
+		return readDevicesCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown devices format: %q", format)
+	}
+}
+
+func readDevicesCSV(r io.Reader) ([]*iotservice.Device, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("csv: header is missing")
+		}
+		return nil, err
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		switch name {
+		case "deviceId", "authType", "primaryKey", "secondaryKey",
+			"primaryThumbprint", "secondaryThumbprint",
+			"status", "statusReason", "edge", "tags":
+		default:
+			return nil, fmt.Errorf("csv: unknown column %q", name)
+		}
+		cols[name] = i
+	}
+	if _, ok := cols["deviceId"]; !ok {
+		return nil, errors.New("csv: deviceId column is missing")
+	}
+
+	var devices []*iotservice.Device
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return devices, nil
+		} else if err != nil {
+			return nil, err
+		}
+		get := func(name string) string {
+			if i, ok := cols[name]; ok {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		line, _ := cr.FieldPos(0)
+		dev, err := csvDevice(get)
+		if err != nil {
+			return nil, fmt.Errorf("csv: line %d: %w", line, err)
+		}
+		devices = append(devices, dev)
+	}
+}
+
+func csvDevice(get func(name string) string) (*iotservice.Device, error) {
+	dev := &iotservice.Device{
+		DeviceID:       get("deviceId"),
+		Status:         iotservice.DeviceStatus(get("status")),
+		StatusReason:   get("statusReason"),
+		Authentication: &iotservice.Authentication{Type: iotservice.AuthType(get("authType"))},
+	}
+	if dev.DeviceID == "" {
+		return nil, errors.New("deviceId is empty")
+	}
+	if k1, k2 := get("primaryKey"), get("secondaryKey"); k1 != "" || k2 != "" {
+		dev.Authentication.SymmetricKey = &iotservice.SymmetricKey{
+			PrimaryKey:   k1,
+			SecondaryKey: k2,
+		}
+	}
+	if t1, t2 := get("primaryThumbprint"), get("secondaryThumbprint"); t1 != "" || t2 != "" {
+		dev.Authentication.X509Thumbprint = &iotservice.X509Thumbprint{
+			PrimaryThumbprint:   t1,
+			SecondaryThumbprint: t2,
+		}
+	}
+	if dev.Authentication.Type == "" {
+		switch {
+		case dev.Authentication.X509Thumbprint != nil:
+			if dev.Authentication.SymmetricKey != nil {
+				return nil, errors.New("both keys and thumbprints are set")
+			}
+			dev.Authentication.Type = iotservice.AuthSelfSigned
+		default:
+			dev.Authentication.Type = iotservice.AuthSAS
+		}
+	}
+	if s := get("edge"); s != "" {
+		edge, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("edge: %w", err)
+		}
+		if edge {
+			dev.Capabilities = map[string]interface{}{"iotEdge": true}
+		}
+	}
+	if s := get("tags"); s != "" {
+		if err := json.Unmarshal([]byte(s), &dev.Tags); err != nil {
+			return nil, fmt.Errorf("tags: %w", err)
+		}
+	}
+	return dev, nil
+}
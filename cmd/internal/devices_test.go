@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+func TestReadDevicesCSV(t *testing.T) {
+	devices, err := ReadDevices(strings.NewReader(`deviceId,primaryKey,primaryThumbprint,edge,tags
+dev1,,,,
+dev2,a2V5,,true,"{""site"":""a""}"
+dev3,,ABCD,,
+`), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*iotservice.Device{
+		{
+			DeviceID:       "dev1",
+			Authentication: &iotservice.Authentication{Type: iotservice.AuthSAS},
+		},
+		{
+			DeviceID: "dev2",
+			Authentication: &iotservice.Authentication{
+				Type:         iotservice.AuthSAS,
+				SymmetricKey: &iotservice.SymmetricKey{PrimaryKey: "a2V5"},
+			},
+			Capabilities: map[string]interface{}{"iotEdge": true},
+			Tags:         map[string]interface{}{"site": "a"},
+		},
+		{
+			DeviceID: "dev3",
+			Authentication: &iotservice.Authentication{
+				Type:           iotservice.AuthSelfSigned,
+				X509Thumbprint: &iotservice.X509Thumbprint{PrimaryThumbprint: "ABCD"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("ReadDevices() = %v, want %v", devices, want)
+	}
+
+	for _, s := range []string{
+		"",
+		"id\ndev1\n",
+		"deviceId\n\n,\n",
+		"deviceId,primaryKey,primaryThumbprint\ndev1,a2V5,ABCD\n",
+	} {
+		if _, err := ReadDevices(strings.NewReader(s), "csv"); err == nil {
+			t.Errorf("ReadDevices(%q) = nil error, want an error", s)
+		}
+	}
+}
+
+func TestReadDevicesJSON(t *testing.T) {
+	devices, err := ReadDevices(strings.NewReader(`[{"deviceId":"dev1","tags":{"a":1}}]`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].DeviceID != "dev1" || devices[0].Tags["a"] != float64(1) {
+		t.Errorf("ReadDevices() = %v, want dev1 with tags", devices)
+	}
+	if _, err = ReadDevices(strings.NewReader(`[{"status":"enabled"}]`), "json"); err == nil {
+		t.Error("ReadDevices() with no deviceId = nil error, want an error")
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"text/template"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// EventFilter matches messages by their origin and properties,
+// device ids and property values are path.Match patterns.
+type EventFilter struct {
+	DeviceIDs     []string
+	MessageSource string
+	Properties    map[string]string
+}
+
+// Match reports whether the message satisfies all the filter's conditions,
+// a message matches any of DeviceIDs and all of Properties.
+func (f *EventFilter) Match(msg *common.Message) bool {
+	if len(f.DeviceIDs) != 0 && !matchAny(f.DeviceIDs, msg.ConnectionDeviceID) {
+		return false
+	}
+	if f.MessageSource != "" && f.MessageSource != msg.MessageSource {
+		return false
+	}
+	for k, pattern := range f.Properties {
+		v, ok := msg.Properties[k]
+		if !ok || !match(pattern, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, s string) bool {
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+// ParseTemplate parses an output template, besides the standard
+// functions templates can use `json` for encoding values and
+// `str` for converting byte slices like payloads to strings.
+func ParseTemplate(s string) (*template.Template, error) {
+	return template.New("output").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"str": func(b []byte) string {
+			return string(b)
+		},
+	}).Parse(s)
+}
+
+// OutputTemplate prints v formatted with the template to stdout
+// appending a new-line char.
+func OutputTemplate(tpl *template.Template, v interface{}) error {
+	if err := tpl.Execute(os.Stdout, v); err != nil {
+		return err
+	}
+	return OutputLine("")
+}
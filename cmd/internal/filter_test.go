@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+func TestEventFilter(t *testing.T) {
+	msg := &common.Message{
+		ConnectionDeviceID: "sensor-1",
+		MessageSource:      "Telemetry",
+		Properties:         map[string]string{"level": "warning"},
+	}
+	for _, tc := range []struct {
+		filter EventFilter
+		want   bool
+	}{
+		{EventFilter{}, true},
+		{EventFilter{DeviceIDs: []string{"pump", "sensor-*"}}, true},
+		{EventFilter{DeviceIDs: []string{"pump"}}, false},
+		{EventFilter{MessageSource: "Telemetry"}, true},
+		{EventFilter{MessageSource: "twinChangeEvents"}, false},
+		{EventFilter{Properties: map[string]string{"level": "warn*"}}, true},
+		{EventFilter{Properties: map[string]string{"level": "error"}}, false},
+		{EventFilter{Properties: map[string]string{"missing": "*"}}, false},
+	} {
+		if have := tc.filter.Match(msg); have != tc.want {
+			t.Errorf("%+v.Match() = %t, want %t", tc.filter, have, tc.want)
+		}
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tpl, err := ParseTemplate(`{{.ConnectionDeviceID}} {{str .Payload}} {{json .Properties}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err = tpl.Execute(&b, &common.Message{
+		ConnectionDeviceID: "dev",
+		Payload:            []byte("hello"),
+		Properties:         map[string]string{"a": "b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := b.String(), `dev hello {"a":"b"}`; have != want {
+		t.Errorf("template output = %q, want %q", have, want)
+	}
+}
@@ -92,3 +92,19 @@ func (f *TimeFlag) Set(s string) error {
 func (f *TimeFlag) String() string {
 	return (*time.Time)(f).Format(time.RFC3339)
 }
+
+// StringsFlag is a repeatable flag that also accepts comma-separated values.
+type StringsFlag []string
+
+func (f *StringsFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+func (f *StringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
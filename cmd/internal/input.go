@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadArg returns contents of an argument that can be passed in place,
+// as `@FILE` to read it from the named file or as `-` to read it from STDIN.
+func ReadArg(s string) ([]byte, error) {
+	switch {
+	case s == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(s, "@"):
+		return os.ReadFile(s[1:])
+	default:
+		return []byte(s), nil
+	}
+}
+
+// ReadPayload returns a message payload that's either the first of args,
+// where `-` stands for STDIN, or contents of the named file when it's set.
+func ReadPayload(args []string, file string) ([]byte, error) {
+	switch {
+	case file != "" && len(args) != 0:
+		return nil, errors.New("PAYLOAD and -f are mutually exclusive")
+	case file == "-":
+		return io.ReadAll(os.Stdin)
+	case file != "":
+		return os.ReadFile(file)
+	case len(args) == 0:
+		return nil, ErrInvalidUsage
+	case args[0] == "-":
+		return io.ReadAll(os.Stdin)
+	default:
+		return []byte(args[0]), nil
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadArg(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "patch.json")
+	if err := os.WriteFile(name, []byte(`[{"op":"add"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for arg, want := range map[string]string{
+		`{"a":1}`:  `{"a":1}`,
+		"@" + name: `[{"op":"add"}]`,
+	} {
+		b, err := ReadArg(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("ReadArg(%q) = %q, want %q", arg, b, want)
+		}
+	}
+	if _, err := ReadArg("@" + name + ".missing"); err == nil {
+		t.Error("ReadArg with a missing file = nil error, want an error")
+	}
+}
+
+func TestReadPayload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(name, []byte{0, 1, 2}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadPayload(nil, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "\x00\x01\x02" {
+		t.Errorf("ReadPayload(nil, %q) = %q, want binary contents", name, b)
+	}
+	if b, err = ReadPayload([]string{"hello"}, ""); err != nil || string(b) != "hello" {
+		t.Errorf("ReadPayload([hello], \"\") = %q, %v, want %q", b, err, "hello")
+	}
+	if _, err = ReadPayload([]string{"hello"}, name); err == nil {
+		t.Error("ReadPayload with both argument and file = nil error, want an error")
+	}
+	if _, err = ReadPayload(nil, ""); err != ErrInvalidUsage {
+		t.Errorf("ReadPayload(nil, \"\") = %v, want %v", err, ErrInvalidUsage)
+	}
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Printer prints values in one of the supported formats: json, json-pretty,
+// ndjson or jsonl (one compact object per line), csv and table.
+//
+// Tabular formats flatten nested objects into dot-separated columns and
+// are buffered until Flush, because columns depend on all printed rows.
+// The header is printed by the first Flush only, so streams of values can
+// be flushed one by one, columns of the first flush are used for them.
+type Printer struct {
+	w      io.Writer
+	format string
+	rows   []map[string]string
+	cols   []string // columns of the first flush
+}
+
+// NewPrinter creates a printer of the given format writing to w.
+func NewPrinter(w io.Writer, format string) (*Printer, error) {
+	switch format {
+	case "json", "json-pretty", "ndjson", "jsonl", "csv", "table":
+		return &Printer{w: w, format: format}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %q", format)
+	}
+}
+
+// Print prints v or buffers it for tabular formats,
+// every element of slices is a separate row then.
+func (p *Printer) Print(v interface{}) error {
+	switch p.format {
+	case "json", "ndjson", "jsonl":
+		return json.NewEncoder(p.w).Encode(v)
+	case "json-pretty":
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(v)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var x interface{}
+	if err = dec.Decode(&x); err != nil {
+		return err
+	}
+	if a, ok := x.([]interface{}); ok {
+		for _, e := range a {
+			p.rows = append(p.rows, flatten(e))
+		}
+	} else {
+		p.rows = append(p.rows, flatten(x))
+	}
+	return nil
+}
+
+// Flush writes buffered rows of tabular formats.
+func (p *Printer) Flush() error {
+	if len(p.rows) == 0 {
+		return nil
+	}
+	header := p.cols == nil
+	if header {
+		p.cols = columns(p.rows)
+	}
+	cols := p.cols
+	rows := p.rows
+	p.rows = nil
+	switch p.format {
+	case "csv":
+		w := csv.NewWriter(p.w)
+		if header {
+			if err := w.Write(cols); err != nil {
+				return err
+			}
+		}
+		for _, row := range rows {
+			if err := w.Write(cells(cols, row)); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case "table":
+		var b bytes.Buffer
+		w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, join(cols))
+		for _, row := range rows {
+			fmt.Fprintln(w, join(cells(cols, row)))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		// cut padding of empty trailing cells, the header is always
+		// aligned so cells are at least as wide as column names
+		for i, line := range bytes.SplitAfter(b.Bytes(), []byte{'\n'}) {
+			line = bytes.TrimRight(line, " \n")
+			if len(line) == 0 || i == 0 && !header {
+				continue
+			}
+			if _, err := fmt.Fprintf(p.w, "%s\n", line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flatten converts a decoded JSON value into a row,
+// nested objects keys are joined with dots.
+func flatten(v interface{}) map[string]string {
+	row := map[string]string{}
+	if m, ok := v.(map[string]interface{}); ok {
+		flattenInto(row, "", m)
+	} else {
+		row["value"] = cell(v)
+	}
+	return row
+}
+
+func flattenInto(row map[string]string, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if n, ok := v.(map[string]interface{}); ok && len(n) != 0 {
+			flattenInto(row, prefix+k+".", n)
+			continue
+		}
+		row[prefix+k] = cell(v)
+	}
+}
+
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// columns returns sorted names of all columns, identity columns go first.
+func columns(rows []map[string]string) []string {
+	set := map[string]bool{}
+	for _, row := range rows {
+		for k := range row {
+			set[k] = true
+		}
+	}
+	cols := make([]string, 0, len(set))
+	for k := range set {
+		cols = append(cols, k)
+	}
+	sort.Slice(cols, func(i, j int) bool {
+		if ri, rj := rank(cols[i]), rank(cols[j]); ri != rj {
+			return ri < rj
+		}
+		return cols[i] < cols[j]
+	})
+	return cols
+}
+
+func rank(col string) int {
+	switch col {
+	case "deviceId":
+		return 0
+	case "moduleId":
+		return 1
+	default:
+		return 2
+	}
+}
+
+func cells(cols []string, row map[string]string) []string {
+	r := make([]string, len(cols))
+	for i, col := range cols {
+		r[i] = row[col]
+	}
+	return r
+}
+
+func join(cells []string) string {
+	var b bytes.Buffer
+	for i, c := range cells {
+		if i != 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrinter(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{
+			"status":   "enabled",
+			"deviceId": "dev1",
+			"tags":     map[string]interface{}{"site": "a"},
+		},
+		map[string]interface{}{
+			"deviceId": "device2",
+			"version":  3,
+		},
+	}
+	for format, want := range map[string]string{
+		"jsonl": `{"deviceId":"dev1","status":"enabled","tags":{"site":"a"}}
+{"deviceId":"device2","version":3}
+`,
+		"ndjson": `{"deviceId":"dev1","status":"enabled","tags":{"site":"a"}}
+{"deviceId":"device2","version":3}
+`,
+		"csv": `deviceId,status,tags.site,version
+dev1,enabled,a,
+device2,,,3
+`,
+		"table": `deviceId  status   tags.site  version
+dev1      enabled  a
+device2                       3
+`,
+	} {
+		var b bytes.Buffer
+		p, err := NewPrinter(&b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err = p.Print(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = p.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if have := b.String(); have != want {
+			t.Errorf("%s output = %q, want %q", format, have, want)
+		}
+	}
+
+	if _, err := NewPrinter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("NewPrinter(xml) = nil error, want an error")
+	}
+}
+
+func TestPrinterStream(t *testing.T) {
+	for format, want := range map[string]string{
+		"csv": `deviceId,status
+dev1,enabled
+device2,disabled
+`,
+		"table": `deviceId  status
+dev1      enabled
+device2   disabled
+`,
+	} {
+		var b bytes.Buffer
+		p, err := NewPrinter(&b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range []map[string]string{
+			{"deviceId": "dev1", "status": "enabled"},
+			{"deviceId": "device2", "status": "disabled"},
+		} {
+			if err = p.Print(row); err != nil {
+				t.Fatal(err)
+			}
+			if err = p.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if have := b.String(); have != want {
+			t.Errorf("%s output = %q, want %q", format, have, want)
+		}
+	}
+}
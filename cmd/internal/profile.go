@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv overrides the default configuration file location.
+const ConfigFileEnv = "IOTHUB_CONFIG"
+
+// ProfileEnv names the profile to use when the -profile flag is not set.
+const ProfileEnv = "IOTHUB_PROFILE"
+
+// Config is the CLI configuration file, e.g.:
+//
+//	default: dev
+//	profiles:
+//	  dev:
+//	    service_connection_string: HostName=dev.azure-devices.net;...
+//	    device_connection_string: HostName=dev.azure-devices.net;DeviceId=...
+//	  prod:
+//	    service_connection_string: HostName=prod.azure-devices.net;...
+type Config struct {
+	Default  string              `yaml:"default"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// Profile is a named set of credentials of a hub.
+type Profile struct {
+	ServiceConnectionString string `yaml:"service_connection_string"`
+	DeviceConnectionString  string `yaml:"device_connection_string"`
+}
+
+// ConfigPath returns the configuration file path,
+// that's $IOTHUB_CONFIG or iothub/config.yaml in the user config dir.
+func ConfigPath() (string, error) {
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "iothub", "config.yaml"), nil
+}
+
+// LoadProfile loads the named profile from the configuration file,
+// when name is empty $IOTHUB_PROFILE or the file's default profile is used.
+//
+// It returns nil without an error when no profile is requested
+// and there's no configuration file or default profile.
+func LoadProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = os.Getenv(ProfileEnv)
+	}
+	path, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && name == "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg Config
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if name == "" {
+		if cfg.Default == "" {
+			return nil, nil
+		}
+		name = cfg.Default
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok || p == nil {
+		return nil, fmt.Errorf("%s: profile %q not found", path, name)
+	}
+	return p, nil
+}
+
+// LookupConnectionString returns the connection string stored in the env
+// variable unless a profile is named explicitly, otherwise it's taken
+// from the profile with the given field function.
+func LookupConnectionString(profile, env string, field func(p *Profile) string) (string, error) {
+	if profile == "" {
+		if cs := os.Getenv(env); cs != "" {
+			return cs, nil
+		}
+	}
+	p, err := LoadProfile(profile)
+	if err != nil || p == nil {
+		return "", err
+	}
+	return field(p), nil
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv(ProfileEnv, "")
+
+	// no config file
+	p, err := LoadProfile("")
+	if err != nil || p != nil {
+		t.Fatalf("LoadProfile(\"\") = %v, %v, want nil, nil", p, err)
+	}
+	if _, err = LoadProfile("dev"); err == nil {
+		t.Fatal("LoadProfile(dev) = nil error, want an error")
+	}
+
+	if err = os.WriteFile(path, []byte(`default: dev
+profiles:
+  dev:
+    service_connection_string: HostName=dev
+  prod:
+    service_connection_string: HostName=prod
+    device_connection_string: HostName=prod;DeviceId=d
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"":     "HostName=dev",
+		"prod": "HostName=prod",
+	} {
+		p, err := LoadProfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ServiceConnectionString != want {
+			t.Errorf("LoadProfile(%q).ServiceConnectionString = %q, want %q",
+				name, p.ServiceConnectionString, want)
+		}
+	}
+
+	t.Setenv(ProfileEnv, "prod")
+	if p, err = LoadProfile(""); err != nil || p.DeviceConnectionString != "HostName=prod;DeviceId=d" {
+		t.Errorf("LoadProfile with %s = %v, %v, want the prod profile", ProfileEnv, p, err)
+	}
+	if _, err = LoadProfile("stage"); err == nil {
+		t.Error("LoadProfile(stage) = nil error, want an error")
+	}
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+)
+
+// NewProgressReader wraps r to report how much of size bytes
+// has been read to w every time the percentage changes.
+func NewProgressReader(r io.Reader, w io.Writer, name string, size int64) *ProgressReader {
+	return &ProgressReader{r: r, w: w, name: name, size: size, pct: -1}
+}
+
+// ProgressReader is an io.Reader that reports reading progress.
+type ProgressReader struct {
+	r    io.Reader
+	w    io.Writer
+	name string
+	size int64
+	n    int64
+	pct  int64
+}
+
+func (p *ProgressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	pct := int64(100)
+	if p.size > 0 && p.n < p.size {
+		pct = p.n * 100 / p.size
+	}
+	if pct != p.pct && (n != 0 || err == io.EOF) {
+		p.pct = pct
+		fmt.Fprintf(p.w, "\r%s: %d/%d bytes (%d%%)", p.name, p.n, p.size, pct)
+		if pct == 100 {
+			fmt.Fprintln(p.w)
+		}
+	}
+	return n, err
+}
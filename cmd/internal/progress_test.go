@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProgressReader(t *testing.T) {
+	var w bytes.Buffer
+	r := NewProgressReader(iotest.OneByteReader(strings.NewReader("abcd")), &w, "f", 4)
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abcd" {
+		t.Errorf("read %q, want %q", b, "abcd")
+	}
+	want := "\rf: 1/4 bytes (25%)\rf: 2/4 bytes (50%)\rf: 3/4 bytes (75%)\rf: 4/4 bytes (100%)\n"
+	if w.String() != want {
+		t.Errorf("progress = %q, want %q", w.String(), want)
+	}
+}
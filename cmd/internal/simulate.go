@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// DefaultTelemetryTemplate is the payload template used by simulations
+// when no template is given.
+const DefaultTelemetryTemplate = `{"device":{{.Device}},"seq":{{.Seq}},` +
+	`"temperature":{{randFloat 20 30 | printf "%.2f"}},"humidity":{{randInt 30 70}},` +
+	`"time":{{json .Time}}}`
+
+// ParsePayloadTemplate parses a telemetry payload template that is executed
+// with SimulationData, besides the standard functions templates can use
+// `randInt MIN MAX`, `randFloat MIN MAX` and `choice VALUE...`
+// for randomized values and `json` for encoding values.
+func ParsePayloadTemplate(s string) (*template.Template, error) {
+	return template.New("payload").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"randInt": func(min, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + rand.Intn(max-min+1)
+		},
+		"randFloat": func(min, max float64) float64 {
+			return min + rand.Float64()*(max-min)
+		},
+		"choice": func(vv ...interface{}) (interface{}, error) {
+			if len(vv) == 0 {
+				return nil, errors.New("choice requires at least one value")
+			}
+			return vv[rand.Intn(len(vv))], nil
+		},
+	}).Parse(s)
+}
+
+// SimulationData is the data payload templates are executed with.
+type SimulationData struct {
+	Device   int    // virtual device number starting from 0
+	DeviceID string // actual device id messages are sent as
+	Seq      int    // message number of the virtual device starting from 0
+	Time     time.Time
+}
+
+// Simulation sends templated telemetry on behalf of a number of virtual
+// devices in parallel, each of them sends a message every interval until
+// it has sent count messages, the duration elapses or the context is done.
+type Simulation struct {
+	Template *template.Template
+	DeviceID string
+	Devices  int           // virtual devices, 1 when zero
+	Interval time.Duration // between messages of a virtual device
+	Count    int           // messages per virtual device, 0 means unlimited
+	Duration time.Duration // 0 means unlimited
+	Send     func(ctx context.Context, payload []byte) error
+}
+
+// SimulationStats is the simulation summary.
+type SimulationStats struct {
+	Sent    int64   `json:"sent"`
+	Failed  int64   `json:"failed"`
+	Elapsed string  `json:"elapsed"`
+	Rate    float64 `json:"rate"` // sent messages per second
+	Error   string  `json:"lastError,omitempty"`
+}
+
+// Run runs the simulation and blocks until all virtual devices are done,
+// failed sends are counted and don't stop the simulation.
+func (s *Simulation) Run(ctx context.Context) (*SimulationStats, error) {
+	if s.Count == 0 && s.Duration == 0 && ctx.Done() == nil {
+		return nil, errors.New("simulation needs a count, a duration or a cancellable context")
+	}
+	if s.Interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.Duration > 0 {
+		var cancelDuration context.CancelFunc
+		ctx, cancelDuration = context.WithTimeout(ctx, s.Duration)
+		defer cancelDuration()
+	}
+	n := s.Devices
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		sent, failed int64
+		mu           sync.Mutex
+		lastErr      error
+		tplErr       error // template errors abort the simulation
+		wg           sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(device int) {
+			defer wg.Done()
+			ticker := time.NewTicker(s.Interval)
+			defer ticker.Stop()
+			var b bytes.Buffer
+			for seq := 0; s.Count == 0 || seq < s.Count; seq++ {
+				if seq != 0 {
+					select {
+					case <-ticker.C:
+					case <-ctx.Done():
+						return
+					}
+				}
+				b.Reset()
+				if err := s.Template.Execute(&b, &SimulationData{
+					Device:   device,
+					DeviceID: s.DeviceID,
+					Seq:      seq,
+					Time:     time.Now().UTC(),
+				}); err != nil {
+					mu.Lock()
+					tplErr = err
+					mu.Unlock()
+					cancel()
+					return
+				}
+				if err := s.Send(ctx, b.Bytes()); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					atomic.AddInt64(&failed, 1)
+					mu.Lock()
+					lastErr = err
+					mu.Unlock()
+					continue
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if tplErr != nil {
+		return nil, tplErr
+	}
+
+	elapsed := time.Since(start)
+	stats := &SimulationStats{
+		Sent:    sent,
+		Failed:  failed,
+		Elapsed: elapsed.Round(time.Millisecond).String(),
+		Rate:    float64(sent) / elapsed.Seconds(),
+	}
+	if lastErr != nil {
+		stats.Error = lastErr.Error()
+	}
+	return stats, nil
+}
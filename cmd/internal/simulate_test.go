@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSimulation(t *testing.T) {
+	tpl, err := ParsePayloadTemplate(DefaultTelemetryTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	seen := map[int]int{}
+	calls := 0
+	sim := &Simulation{
+		Template: tpl,
+		Devices:  3,
+		Interval: time.Millisecond,
+		Count:    2,
+		Send: func(ctx context.Context, payload []byte) error {
+			var v struct {
+				Device      int     `json:"device"`
+				Temperature float64 `json:"temperature"`
+				Humidity    int     `json:"humidity"`
+			}
+			if err := json.Unmarshal(payload, &v); err != nil {
+				t.Errorf("payload %q: %s", payload, err)
+			}
+			if v.Temperature < 20 || v.Temperature > 30 || v.Humidity < 30 || v.Humidity > 70 {
+				t.Errorf("random values are out of range: %s", payload)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			seen[v.Device]++
+			if calls++; calls == 1 {
+				return errors.New("send failed")
+			}
+			return nil
+		},
+	}
+	stats, err := sim.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Sent != 5 || stats.Failed != 1 || stats.Error != "send failed" {
+		t.Errorf("stats = %+v, want 5 sent and 1 failed", stats)
+	}
+	for i := 0; i < 3; i++ {
+		if seen[i] != 2 {
+			t.Errorf("device %d sent %d messages, want 2", i, seen[i])
+		}
+	}
+}
+
+func TestSimulationTemplateError(t *testing.T) {
+	tpl, err := ParsePayloadTemplate(`{{choice}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = (&Simulation{
+		Template: tpl,
+		Interval: time.Millisecond,
+		Duration: time.Second,
+		Send: func(ctx context.Context, payload []byte) error {
+			return nil
+		},
+	}).Run(context.Background()); err == nil {
+		t.Error("Run() = nil error, want a template error")
+	}
+}
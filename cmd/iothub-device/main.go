@@ -3,20 +3,28 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/amenzhinsky/iothub/cmd/internal"
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/dps"
 	"github.com/amenzhinsky/iothub/iotdevice"
 	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/amqp"
 	"github.com/amenzhinsky/iothub/iotdevice/transport/http"
 	"github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	"github.com/amenzhinsky/iothub/logger"
 )
 
 var transports = map[string]func() (transport.Transport, error){
@@ -24,34 +32,95 @@ var transports = map[string]func() (transport.Transport, error){
 		return mqtt.New(mqtt.WithWebSocket(wsFlag)), nil
 	},
 	"amqp": func() (transport.Transport, error) {
-		return nil, errors.New("not implemented")
+		if c2dAckFlag == "" {
+			return amqp.New(), nil
+		}
+		d, err := amqp.ParseDisposition(c2dAckFlag)
+		if err != nil {
+			return nil, err
+		}
+		return amqp.New(amqp.WithC2DDisposition(d, reportSettlement)), nil
 	},
 	"http": func() (transport.Transport, error) {
 		return http.New(), nil
 	},
 }
 
+// moduleTransports are transports that support modules,
+// they subscribe to module topics and handle edgeHub TLS.
+var moduleTransports = map[string]func() (transport.Transport, error){
+	"mqtt": func() (transport.Transport, error) {
+		return mqtt.NewModuleTransport(mqtt.WithWebSocket(wsFlag)), nil
+	},
+}
+
+// newModuleTransport creates the -transport transport for module clients.
+func newModuleTransport() (transport.Transport, error) {
+	mk, ok := moduleTransports[transportFlag]
+	if !ok {
+		return nil, fmt.Errorf("transport %q doesn't support modules", transportFlag)
+	}
+	return mk()
+}
+
 var (
 	wsFlag           bool
 	debugFlag        bool
 	formatFlag       string
+	profileFlag      string
+	connStrFlag      string
+	cmdTimeoutFlag   time.Duration
 	quiteFlag        bool
 	transportFlag    string
 	midFlag          string
 	cidFlag          string
 	qosFlag          int
+	fileFlag         string
 	creationTimeFlag time.Time
 	expiryTimeFlag   time.Time
 
 	// x509 flags
-	tlsCertFlag  string
-	tlsKeyFlag   string
-	deviceIDFlag string
-	hostnameFlag string
+	tlsCertFlag        string
+	tlsKeyFlag         string
+	tlsPfxFlag         string
+	tlsPfxPasswordFlag string
+	deviceIDFlag       string
+	hostnameFlag       string
+
+	moduleIDFlag string
 
 	propsFlag map[string]string
 
 	twinPropsFlag map[string]interface{}
+
+	// watch-events
+	c2dAckFlag string
+
+	// watch-twin
+	twinPathFlag string
+
+	// direct methods
+	responseFileFlag string
+	statusFlag       int
+
+	// file upload
+	blobPrefixFlag string
+
+	// simulate
+	templateFlag    string
+	devicesFlag     int
+	rateFlag        float64
+	countFlag       int
+	durationFlag    time.Duration
+	contentTypeFlag string
+
+	// dps
+	scopeIDFlag        string
+	registrationIDFlag string
+	symmetricKeyFlag   string
+	groupKeyFlag       string
+	dpsEndpointFlag    string
+	dpsPayloadFlag     string
 )
 
 func main() {
@@ -64,24 +133,36 @@ func main() {
 }
 
 const help = `iothub-device helps iothub devices to communicate with the cloud.
- $IOTHUB_DEVICE_CONNECTION_STRING environment variable is required unless you use x509 authentication.`
+ $IOTHUB_DEVICE_CONNECTION_STRING environment variable is required unless you use x509 authentication,
+ pass -c or use device_connection_string of a profile in ~/.config/iothub/config.yaml ($IOTHUB_CONFIG overrides the path),
+ profiles are selected with -profile or $IOTHUB_PROFILE.
+
+ Module mode is enabled by module connection strings, e.g. $IOTHUB_MODULE_CONNECTION_STRING, -module-id
+ or IOTEDGE_* environment variables set by the IoT Edge runtime when no connection string is provided.`
 
 func run() error {
 	ctx := context.Background()
 	return internal.New(help, func(f *flag.FlagSet) {
 		f.BoolVar(&wsFlag, "ws", false, "enable MQTT-over-WebSocket transport")
 		f.BoolVar(&debugFlag, "debug", false, "enable debug mode")
-		f.StringVar(&formatFlag, "format", "json-pretty", "data output format <json|json-pretty>")
+		f.StringVar(&formatFlag, "format", "json-pretty", "data output format <json|json-pretty|ndjson|csv|table>")
+		f.StringVar(&profileFlag, "profile", "", "configuration profile `name`, see the help message")
+		f.StringVar(&connStrFlag, "c", "", "device connection `string` (alias for -connection-string)")
+		f.StringVar(&connStrFlag, "connection-string", "", "device connection `string`, overrides the environment and profiles")
+		f.DurationVar(&cmdTimeoutFlag, "timeout", 0, "abort commands that take longer than the `duration`, e.g. 30s")
 		f.StringVar(&transportFlag, "transport", "mqtt", "transport to use <mqtt|amqp|http>")
 		f.StringVar(&tlsCertFlag, "tls-cert", "", "path to x509 cert file")
 		f.StringVar(&tlsKeyFlag, "tls-key", "", "path to x509 key file")
-		f.StringVar(&deviceIDFlag, "device-id", "", "device id, required for x509")
-		f.StringVar(&hostnameFlag, "hostname", "", "hostname to connect to, required for x509")
+		f.StringVar(&tlsPfxFlag, "tls-pfx", "", "path to x509 PKCS#12 (PFX) `bundle` with the cert and key")
+		f.StringVar(&tlsPfxPasswordFlag, "tls-pfx-password", "", "PKCS#12 bundle `password`, default is $IOTHUB_TLS_PFX_PASSWORD")
+		f.StringVar(&deviceIDFlag, "device-id", "", "device id, required for x509 unless it's the cert's common name")
+		f.StringVar(&hostnameFlag, "hostname", "", "hostname to connect to, required for x509 without a connection string")
+		f.StringVar(&moduleIDFlag, "module-id", "", "module `id` to act as, the connection string's key has to be the module's one")
 	}, []*internal.Command{
 		{
 			Name:    "send",
-			Args:    []string{"PAYLOAD"},
-			Desc:    "send a message to the cloud (D2C)",
+			Args:    []string{"[PAYLOAD]"},
+			Desc:    "send a message to the cloud (D2C), - PAYLOAD reads it from STDIN",
 			Handler: wrap(ctx, send),
 			ParseFunc: func(f *flag.FlagSet) {
 				f.StringVar(&midFlag, "mid", "", "identifier for the message")
@@ -90,25 +171,53 @@ func run() error {
 				f.Var((*internal.StringsMapFlag)(&propsFlag), "prop", "custom property, key=value")
 				f.Var((*timeValue)(&expiryTimeFlag), "exp", "message expiration `time`")
 				f.Var((*timeValue)(&creationTimeFlag), "ctime", "message creation `time`")
+				f.StringVar(&fileFlag, "f", "", "read payload from the `file`, - for STDIN")
 			},
 		},
 		{
 			Name:    "watch-events",
 			Desc:    "subscribe to messages sent from the cloud (C2D)",
 			Handler: wrap(ctx, watchEvents),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&c2dAckFlag, "ack", "", "settle messages with the `outcome` <complete|abandon|reject|none> and print results (amqp only)")
+			},
+		},
+		{
+			Name:    "send-output",
+			Args:    []string{"OUTPUT", "[PAYLOAD]"},
+			Desc:    "send a message to the module output (module mode only)",
+			Handler: wrapModule(ctx, sendOutput),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&midFlag, "mid", "", "identifier for the message")
+				f.StringVar(&cidFlag, "cid", "", "message identifier in a request-reply")
+				f.IntVar(&qosFlag, "qos", mqtt.DefaultQoS, "QoS value, 0 or 1 (mqtt only)")
+				f.Var((*internal.StringsMapFlag)(&propsFlag), "prop", "custom property, key=value")
+				f.StringVar(&fileFlag, "f", "", "read payload from the `file`, - for STDIN")
+			},
+		},
+		{
+			Name:    "watch-inputs",
+			Args:    []string{"[INPUT]"},
+			Desc:    "subscribe to messages routed to the module inputs (module mode only)",
+			Handler: wrapModule(ctx, watchInputs),
 		},
 		{
 			Name:    "watch-twin",
 			Desc:    "subscribe to desired twin state updates",
 			Handler: wrap(ctx, watchTwin),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&twinPathFlag, "path", "", "print only changes of the dot-separated property `path`, e.g. desired.config.interval, * matches any property")
+			},
 		},
 		{
 			Name:    "direct-method",
 			Args:    []string{"NAME"},
-			Desc:    "handle the named direct method, reads responses from STDIN",
+			Desc:    "handle the named direct method, reads responses from STDIN unless -response-file is set",
 			Handler: wrap(ctx, directMethod),
 			ParseFunc: func(f *flag.FlagSet) {
 				f.BoolVar(&quiteFlag, "quite", false, "disable additional hints")
+				f.StringVar(&responseFileFlag, "response-file", "", "respond to all calls with the JSON object from the `file`")
+				f.IntVar(&statusFlag, "status", 200, "response status `code`")
 			},
 		},
 		{
@@ -125,54 +234,238 @@ func run() error {
 				f.Var((*internal.JSONMapFlag)(&twinPropsFlag), "prop", "custom property, key=value")
 			},
 		},
+		{
+			Name:    "simulate",
+			Desc:    "send templated telemetry on behalf of virtual devices for load testing",
+			Handler: wrap(ctx, simulate),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&templateFlag, "template", internal.DefaultTelemetryTemplate, "payload `template` in Go text/template syntax with randInt, randFloat and choice functions")
+				f.IntVar(&devicesFlag, "devices", 1, "`number` of parallel virtual devices")
+				f.Float64Var(&rateFlag, "rate", 1, "messages per second sent by each virtual device")
+				f.IntVar(&countFlag, "count", 0, "messages sent by each virtual device, 0 means unlimited")
+				f.DurationVar(&durationFlag, "duration", 0, "stop after the `duration`, runs until interrupted by default")
+				f.Var((*internal.StringsMapFlag)(&propsFlag), "prop", "custom property, key=value")
+				f.IntVar(&qosFlag, "qos", mqtt.DefaultQoS, "QoS value, 0 or 1 (mqtt only)")
+				f.StringVar(&contentTypeFlag, "content-type", "application/json", "payload content `type`")
+			},
+		},
+		{
+			Name: "dps-register",
+			Desc: "register the device with the provisioning service and print its connection string",
+			Handler: func(args []string) error {
+				return internal.RunContext(ctx, cmdTimeoutFlag, dpsRegister)
+			},
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&scopeIDFlag, "scope-id", "", "provisioning service id scope")
+				f.StringVar(&registrationIDFlag, "registration-id", "", "registration `id`, defaults to the certificate's common name")
+				f.StringVar(&tlsCertFlag, "cert", "", "path to x509 cert `file`")
+				f.StringVar(&tlsKeyFlag, "key", "", "path to x509 key `file`")
+				f.StringVar(&tlsPfxFlag, "pfx", "", "path to x509 PKCS#12 (PFX) `bundle` with the cert and key")
+				f.StringVar(&tlsPfxPasswordFlag, "pfx-password", "", "PKCS#12 bundle `password`, default is $IOTHUB_TLS_PFX_PASSWORD")
+				f.StringVar(&symmetricKeyFlag, "symmetric-key", "", "symmetric `key` of an individual enrollment (base64)")
+				f.StringVar(&groupKeyFlag, "group-key", "", "symmetric `key` of a group enrollment to derive the device key from (base64)")
+				f.StringVar(&dpsEndpointFlag, "endpoint", dps.DefaultEndpoint, "provisioning service `host`")
+				f.StringVar(&dpsPayloadFlag, "payload", "", "custom allocation JSON payload, @FILE reads it from the file and - from STDIN")
+			},
+		},
+		{
+			Name:    "upload-file",
+			Args:    []string{"BLOBNAME", "PATH"},
+			Desc:    "upload the file at PATH to the hub's storage as BLOBNAME",
+			Handler: wrap(ctx, uploadFile),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&blobPrefixFlag, "prefix", "", "destination blob path `prefix`, e.g. logs/2006-01-02")
+				f.BoolVar(&quiteFlag, "quite", false, "disable progress output")
+			},
+		},
 		{
 			Name:    "file-upload",
 			Args:    []string{"FILE"},
-			Desc:    "upload a file using IoT fiel upload",
-			Handler: wrap(ctx, uploadFile),
+			Desc:    "upload a file named after its base name (deprecated, use upload-file)",
+			Handler: wrap(ctx, fileUpload),
 		},
 	}).Run(os.Args)
 }
 
 func wrap(ctx context.Context, fn func(context.Context, *iotdevice.Client, []string) error) internal.HandlerFunc {
 	return func(args []string) error {
-		mk, ok := transports[transportFlag]
-		if !ok {
-			return fmt.Errorf("unknown transport %q", transportFlag)
+		client, _, err := newClient()
+		if err != nil {
+			return err
 		}
-		t, err := mk()
+		defer client.Close()
+		return internal.RunContext(ctx, cmdTimeoutFlag, func(ctx context.Context) error {
+			if err := client.Connect(ctx); err != nil {
+				return err
+			}
+			return fn(ctx, client, args)
+		})
+	}
+}
+
+// wrapModule is wrap for commands that are available only in module mode.
+func wrapModule(ctx context.Context, fn func(context.Context, *iotdevice.ModuleClient, []string) error) internal.HandlerFunc {
+	return func(args []string) error {
+		client, module, err := newClient()
 		if err != nil {
 			return err
 		}
+		defer client.Close()
+		if module == nil {
+			return errors.New("the command requires a module connection string, -module-id or the IoT Edge environment")
+		}
+		return internal.RunContext(ctx, cmdTimeoutFlag, func(ctx context.Context) error {
+			if err := client.Connect(ctx); err != nil {
+				return err
+			}
+			return fn(ctx, module, args)
+		})
+	}
+}
+
+// newClient creates a device client or a module client in module mode,
+// that is when the connection string has ModuleId, -module-id is set or
+// no connection string is provided and the IoT Edge environment is detected,
+// client is the module's embedded client then.
+func newClient() (*iotdevice.Client, *iotdevice.ModuleClient, error) {
+	mk, ok := transports[transportFlag]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown transport %q", transportFlag)
+	}
+
+	var err error
+	cs := connStrFlag
+	if cs == "" && profileFlag == "" && os.Getenv("IOTHUB_DEVICE_CONNECTION_STRING") == "" {
+		cs = os.Getenv("IOTHUB_MODULE_CONNECTION_STRING")
+	}
+	if cs == "" {
+		cs, err = internal.LookupConnectionString(profileFlag, "IOTHUB_DEVICE_CONNECTION_STRING",
+			func(p *internal.Profile) string {
+				return p.DeviceConnectionString
+			},
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-		var client *iotdevice.Client
-		if tlsCertFlag != "" && tlsKeyFlag != "" {
-			if hostnameFlag == "" {
-				return errors.New("hostname is required for x509 authentication")
+	useX509 := tlsCertFlag != "" && tlsKeyFlag != "" || tlsPfxFlag != ""
+	if cs == "" && !useX509 && os.Getenv("IOTEDGE_MODULEID") != "" {
+		mt, err := newModuleTransport()
+		if err != nil {
+			return nil, nil, err
+		}
+		module, err := iotdevice.NewModuleFromEnvironment(mt,
+			os.Getenv("IOTEDGE_GATEWAYHOSTNAME") != "",
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &module.Client, module, nil
+	}
+	if cs != "" && !useX509 {
+		m, err := common.ParseConnectionString(cs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if moduleIDFlag != "" || m["ModuleId"] != "" {
+			switch {
+			case m["ModuleId"] == "":
+				cs += ";ModuleId=" + moduleIDFlag
+			case moduleIDFlag != "" && moduleIDFlag != m["ModuleId"]:
+				return nil, nil, fmt.Errorf(
+					"-module-id %q doesn't match the connection string's %q", moduleIDFlag, m["ModuleId"],
+				)
 			}
-			if deviceIDFlag == "" {
-				return errors.New("device-id is required for x509 authentication")
+			mt, err := newModuleTransport()
+			if err != nil {
+				return nil, nil, err
 			}
-			client, err = iotdevice.NewFromX509FromFile(
-				t, deviceIDFlag, hostnameFlag, tlsCertFlag, tlsKeyFlag,
-			)
-		} else {
-			client, err = iotdevice.NewFromConnectionString(
-				t, os.Getenv("IOTHUB_DEVICE_CONNECTION_STRING"),
+			module, err := iotdevice.NewModuleFromConnectionString(
+				mt, cs, m["GatewayHostName"], "", "", m["GatewayHostName"] != "",
 			)
+			if err != nil {
+				return nil, nil, err
+			}
+			return &module.Client, module, nil
 		}
+	}
+	if moduleIDFlag != "" {
+		return nil, nil, errors.New("-module-id requires a connection string")
+	}
+
+	t, err := mk()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !useX509 {
+		client, err := iotdevice.NewFromConnectionString(t, cs)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		if err := client.Connect(ctx); err != nil {
-			return err
+		return client, nil, nil
+	}
+
+	crt, err := loadCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hostnameFlag == "" && cs != "" {
+		client, err := iotdevice.NewFromX509ConnectionString(t, cs, crt)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, nil, nil
+	}
+	if hostnameFlag == "" {
+		return nil, nil, errors.New("hostname is required for x509 authentication")
+	}
+	deviceID := deviceIDFlag
+	if deviceID == "" && crt.Leaf != nil {
+		deviceID = crt.Leaf.Subject.CommonName
+	}
+	if deviceID == "" {
+		return nil, nil, errors.New("device-id is required for x509 authentication")
+	}
+	client, err := iotdevice.NewFromX509Cert(t, deviceID, hostnameFlag, crt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, nil, nil
+}
+
+// loadCertificate loads the x509 client certificate either
+// from the PEM cert and key files or from the PKCS#12 bundle.
+func loadCertificate() (*tls.Certificate, error) {
+	if tlsPfxFlag != "" {
+		if tlsCertFlag != "" || tlsKeyFlag != "" {
+			return nil, errors.New("PKCS#12 bundles and PEM cert and key files are mutually exclusive")
+		}
+		password := tlsPfxPasswordFlag
+		if password == "" {
+			password = os.Getenv("IOTHUB_TLS_PFX_PASSWORD")
+		}
+		return common.LoadPKCS12(tlsPfxFlag, password)
+	}
+	crt, err := tls.LoadX509KeyPair(tlsCertFlag, tlsKeyFlag)
+	if err != nil {
+		return nil, err
+	}
+	if crt.Leaf == nil {
+		if crt.Leaf, err = x509.ParseCertificate(crt.Certificate[0]); err != nil {
+			return nil, err
 		}
-		return fn(ctx, client, args)
 	}
+	return &crt, nil
 }
 
 func send(ctx context.Context, c *iotdevice.Client, args []string) error {
-	return c.SendEvent(ctx, []byte(args[0]),
+	payload, err := internal.ReadPayload(args, fileFlag)
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, payload,
 		iotdevice.WithSendProperties(propsFlag),
 		iotdevice.WithSendMessageID(midFlag),
 		iotdevice.WithSendCorrelationID(cidFlag),
@@ -182,7 +475,114 @@ func send(ctx context.Context, c *iotdevice.Client, args []string) error {
 	)
 }
 
+func dpsRegister(ctx context.Context) error {
+	opts := []dps.ClientOption{
+		dps.WithEndpoint(dpsEndpointFlag),
+	}
+	if debugFlag {
+		opts = append(opts, dps.WithLogger(logger.New(logger.LevelDebug, nil)))
+	}
+	if dpsPayloadFlag != "" {
+		b, err := internal.ReadArg(dpsPayloadFlag)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(b) {
+			return errors.New("-payload is not valid JSON")
+		}
+		opts = append(opts, dps.WithPayload(json.RawMessage(b)))
+	}
+
+	var (
+		c   *dps.Client
+		crt *tls.Certificate
+		key string
+		err error
+	)
+	switch {
+	case tlsCertFlag != "" || tlsKeyFlag != "" || tlsPfxFlag != "":
+		if symmetricKeyFlag != "" || groupKeyFlag != "" {
+			return errors.New("x509 certificates and symmetric keys are mutually exclusive")
+		}
+		if crt, err = loadCertificate(); err != nil {
+			return err
+		}
+		c, err = dps.NewFromX509(scopeIDFlag, registrationIDFlag, crt, opts...)
+	case groupKeyFlag != "":
+		if symmetricKeyFlag != "" {
+			return errors.New("-symmetric-key and -group-key are mutually exclusive")
+		}
+		if key, err = dps.DeriveSymmetricKey(groupKeyFlag, registrationIDFlag); err != nil {
+			return err
+		}
+		c, err = dps.NewFromSymmetricKey(scopeIDFlag, registrationIDFlag, key, opts...)
+	case symmetricKeyFlag != "":
+		c, err = dps.NewFromSymmetricKey(scopeIDFlag, registrationIDFlag, symmetricKeyFlag, opts...)
+	default:
+		return errors.New("either -cert and -key, -pfx, -symmetric-key or -group-key is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	s, err := c.Register(ctx)
+	if err != nil {
+		return err
+	}
+	cs, err := c.ConnectionString(s)
+	if err != nil {
+		return err
+	}
+	return internal.Output(&struct {
+		*dps.RegistrationState
+		ConnectionString string `json:"connectionString"`
+	}{s, cs}, formatFlag)
+}
+
+func simulate(ctx context.Context, c *iotdevice.Client, args []string) error {
+	if rateFlag <= 0 {
+		return errors.New("-rate must be positive")
+	}
+	tpl, err := internal.ParsePayloadTemplate(templateFlag)
+	if err != nil {
+		return err
+	}
+	sim := &internal.Simulation{
+		Template: tpl,
+		DeviceID: c.DeviceID(),
+		Devices:  devicesFlag,
+		Interval: time.Duration(float64(time.Second) / rateFlag),
+		Count:    countFlag,
+		Duration: durationFlag,
+		Send: func(ctx context.Context, payload []byte) error {
+			return c.SendEvent(ctx, payload,
+				iotdevice.WithSendProperties(propsFlag),
+				iotdevice.WithSendQoS(qosFlag),
+				iotdevice.WithSendContentType(contentTypeFlag),
+			)
+		},
+	}
+	stats, err := sim.Run(ctx)
+	if err != nil {
+		return err
+	}
+	return internal.Output(stats, formatFlag)
+}
+
+// reportSettlement prints C2D settlement results to STDERR
+// to keep them apart from messages themselves.
+func reportSettlement(msg *common.Message, d amqp.Disposition, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: error: %s\n", d, msg.MessageID, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s %s: ok\n", d, msg.MessageID)
+}
+
 func watchEvents(ctx context.Context, c *iotdevice.Client, args []string) error {
+	if c2dAckFlag != "" && transportFlag != "amqp" {
+		return errors.New("-ack requires the amqp transport, mqtt and http complete messages on delivery")
+	}
 	sub, err := c.SubscribeEvents(ctx)
 	if err != nil {
 		return err
@@ -195,7 +595,44 @@ func watchEvents(ctx context.Context, c *iotdevice.Client, args []string) error
 	return sub.Err()
 }
 
+func sendOutput(ctx context.Context, c *iotdevice.ModuleClient, args []string) error {
+	payload, err := internal.ReadPayload(args[1:], fileFlag)
+	if err != nil {
+		return err
+	}
+	return c.SendOutputEvent(ctx, args[0], payload,
+		iotdevice.WithSendProperties(propsFlag),
+		iotdevice.WithSendMessageID(midFlag),
+		iotdevice.WithSendCorrelationID(cidFlag),
+		iotdevice.WithSendQoS(qosFlag),
+	)
+}
+
+func watchInputs(ctx context.Context, c *iotdevice.ModuleClient, args []string) error {
+	var (
+		sub *iotdevice.EventSub
+		err error
+	)
+	if len(args) != 0 {
+		sub, err = c.SubscribeInput(ctx, args[0])
+	} else {
+		sub, err = c.SubscribeInputs(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for msg := range sub.C() {
+		if err = internal.Output(msg, formatFlag); err != nil {
+			return err
+		}
+	}
+	return sub.Err()
+}
+
 func watchTwin(ctx context.Context, c *iotdevice.Client, args []string) error {
+	if twinPathFlag != "" {
+		return watchTwinPath(ctx, c)
+	}
 	sub, err := c.SubscribeTwinUpdates(ctx)
 	if err != nil {
 		return err
@@ -208,7 +645,55 @@ func watchTwin(ctx context.Context, c *iotdevice.Client, args []string) error {
 	return sub.Err()
 }
 
+// twinPathChange is a watch-twin -path output item.
+type twinPathChange struct {
+	Path    string      `json:"path"`
+	Value   interface{} `json:"value"`
+	Version int         `json:"$version"`
+}
+
+// watchTwinPath prints only changes of the property path
+// along with the value it's been set to, null means removal.
+func watchTwinPath(ctx context.Context, c *iotdevice.Client) error {
+	sub, err := c.SubscribeTwinUpdatesFiltered(ctx, twinPathFlag)
+	if err != nil {
+		return err
+	}
+	path := strings.Split(twinPathFlag, ".")
+	if path[0] == "desired" {
+		path = path[1:]
+	}
+	for twin := range sub.C() {
+		if err = internal.Output(&twinPathChange{
+			Path:    twinPathFlag,
+			Value:   twinPathValue(twin, path),
+			Version: twin.Version(),
+		}, formatFlag); err != nil {
+			return err
+		}
+	}
+	return sub.Err()
+}
+
+// twinPathValue descends the filtered patch down to the first wildcard
+// segment, so wildcard paths yield all of the matching properties.
+func twinPathValue(twin iotdevice.TwinState, path []string) interface{} {
+	var v interface{} = map[string]interface{}(twin)
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok || k == "*" {
+			break
+		}
+		v = m[k]
+	}
+	return v
+}
+
 func directMethod(ctx context.Context, c *iotdevice.Client, args []string) error {
+	if responseFileFlag != "" {
+		return respondMethod(ctx, c, args[0])
+	}
+
 	// if an error occurs during the method invocation,
 	// immediately return and display the error.
 	errc := make(chan error, 1)
@@ -242,11 +727,44 @@ func directMethod(ctx context.Context, c *iotdevice.Client, args []string) error
 				errc <- errors.New("unable to parse json input")
 				return 0, nil, err
 			}
-			return 200, v, nil
+			return statusFlag, v, nil
+		}); err != nil {
+		return err
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// respondMethod handles the named method non-interactively, every call
+// is printed out and answered with the response file contents.
+func respondMethod(ctx context.Context, c *iotdevice.Client, name string) error {
+	b, err := os.ReadFile(responseFileFlag)
+	if err != nil {
+		return err
+	}
+	var res map[string]interface{}
+	if err = json.Unmarshal(b, &res); err != nil {
+		return fmt.Errorf("%s: response has to be a JSON object: %w", responseFileFlag, err)
+	}
+
+	var mu sync.Mutex
+	if err = c.RegisterMethod(ctx, name,
+		func(p map[string]interface{}) (int, map[string]interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err := internal.Output(p, formatFlag); err != nil {
+				return 0, nil, err
+			}
+			return statusFlag, res, nil
 		}); err != nil {
 		return err
 	}
-	return <-errc
+	<-ctx.Done()
+	return ctx.Err()
 }
 
 func twin(ctx context.Context, c *iotdevice.Client, args []string) error {
@@ -280,26 +798,32 @@ func updateTwin(ctx context.Context, c *iotdevice.Client, args []string) error {
 }
 
 func uploadFile(ctx context.Context, c *iotdevice.Client, args []string) error {
-	filePath := args[0]
-	blobName := path.Base(filePath)
+	blobName := args[0]
+	if blobPrefixFlag != "" {
+		blobName = path.Join(blobPrefixFlag, blobName)
+	}
 
-	file, err := os.Open(filePath)
+	file, err := os.Open(args[1])
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	stat, err := os.Stat(filePath)
+	stat, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
-	err = c.UploadFile(ctx, blobName, file, stat.Size())
-	if err != nil {
-		return err
+	var r io.Reader = file
+	if !quiteFlag {
+		r = internal.NewProgressReader(file, os.Stderr, blobName, stat.Size())
 	}
+	return c.UploadFile(ctx, blobName, r, stat.Size())
+}
 
-	return nil
+func fileUpload(ctx context.Context, c *iotdevice.Client, args []string) error {
+	quiteFlag = true
+	return uploadFile(ctx, c, []string{path.Base(args[0]), args[0]})
 }
 
 type timeValue time.Time
@@ -9,10 +9,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/amenzhinsky/iothub/cmd/internal"
+	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/eventhub"
 	"github.com/amenzhinsky/iothub/iotservice"
 	"github.com/amenzhinsky/iothub/logger"
@@ -21,14 +24,20 @@ import (
 // globally accessible by command handlers, is it a good idea?
 var (
 	// common
-	formatFlag   string
-	logLevelFlag = logger.LevelWarn
+	formatFlag     string
+	profileFlag    string
+	connStrFlag    string
+	hubFlag        string
+	aadFlag        bool
+	cmdTimeoutFlag time.Duration
+	logLevelFlag   = logger.LevelWarn
 
 	// send
 	uidFlag             string
 	midFlag             string
 	cidFlag             string
 	expFlag             time.Duration
+	fileFlag            string
 	ackFlag             iotservice.AckType
 	connectTimeoutFlag  uint
 	responseTimeoutFlag uint
@@ -56,16 +65,41 @@ var (
 	durationFlag time.Duration
 
 	// watch events
-	ehcsFlag string
-	ehcgFlag string
+	ehcsFlag      string
+	ehcgFlag      string
+	wsFlag        bool
+	sinceFlag     string
+	offsetFlag    string
+	partitionFlag []string
+	deviceFlag    []string
+	sourceFlag    string
+	matchFlag     map[string]string
+	templateFlag  string
+
+	// digital twins
+	componentFlag string
+
+	// bulk operations
+	chunkFlag       int
+	concurrencyFlag int
 
 	// twins
 	tagsFlag      map[string]interface{}
 	twinPropsFlag map[string]interface{}
+	patchFileFlag string
 
 	// modules
 	managedByFlag string
 
+	// clone device
+	cloneTwinFlag bool
+
+	// edge module logs
+	tailFlag        int
+	untilFlag       string
+	regexFlag       string
+	logSeverityFlag int
+
 	// configuration
 	schemaVersionFlag   string
 	priorityFlag        uint
@@ -75,6 +109,15 @@ var (
 	devicesContentFlag  map[string]interface{}
 	metricsFlag         map[string]string
 
+	modulesContentFileFlag string
+	devicesContentFileFlag string
+	replaceFlag            bool
+
+	// query
+	outputFlag       string
+	topFlag          int
+	continuationFlag string
+
 	// export
 	excludeKeysFlag bool
 
@@ -105,18 +148,29 @@ func main() {
 }
 
 const help = `Helps with interacting and managing your iothub devices.
-The $IOTHUB_SERVICE_CONNECTION_STRING environment variable is required for authentication.`
+The $IOTHUB_SERVICE_CONNECTION_STRING environment variable is required for authentication,
+unless -c is passed or service_connection_string of a profile in ~/.config/iothub/config.yaml
+is used ($IOTHUB_CONFIG overrides the path), profiles are selected with -profile or $IOTHUB_PROFILE.
+
+-hub NAME -aad authenticates with Azure AD, using the client credentials flow when
+$AZURE_TENANT_ID, $AZURE_CLIENT_ID and $AZURE_CLIENT_SECRET are set or the Azure CLI account otherwise.`
 
 func run() error {
 	ctx := context.Background()
 	return internal.New(help, func(f *flag.FlagSet) {
-		f.StringVar(&formatFlag, "format", "json-pretty", "data output format <json|json-pretty>")
+		f.StringVar(&formatFlag, "format", "json-pretty", "data output format <json|json-pretty|ndjson|csv|table>")
+		f.StringVar(&profileFlag, "profile", "", "configuration profile `name`, see the help message")
+		f.StringVar(&connStrFlag, "c", "", "service connection `string` (alias for -connection-string)")
+		f.StringVar(&connStrFlag, "connection-string", "", "service connection `string`, overrides the environment and profiles")
+		f.StringVar(&hubFlag, "hub", "", "hub `name` or host name to authenticate to with -aad")
+		f.BoolVar(&aadFlag, "aad", false, "authenticate with Azure AD instead of a connection string")
 		f.Var((*internal.LogLevelFlag)(&logLevelFlag), "log-level", "log `level` <error|warn|info|debug>")
+		f.DurationVar(&cmdTimeoutFlag, "timeout", 0, "abort commands that take longer than the `duration`, e.g. 30s")
 	}, []*internal.Command{
 		{
 			Name:    "send",
-			Args:    []string{"DEVICE", "PAYLOAD"},
-			Desc:    "send cloud-to-device message",
+			Args:    []string{"DEVICE", "[PAYLOAD]"},
+			Desc:    "send cloud-to-device message, - PAYLOAD reads it from STDIN",
 			Handler: wrap(ctx, send),
 			ParseFunc: func(f *flag.FlagSet) {
 				f.StringVar((*string)(&ackFlag), "ack", "", "type of ack feedback <none|positive|negative|full>")
@@ -125,6 +179,7 @@ func run() error {
 				f.StringVar(&cidFlag, "cid", "", "message identifier in a request-reply")
 				f.DurationVar(&expFlag, "exp", 0, "message lifetime")
 				f.Var((*internal.StringsMapFlag)(&propsFlag), "prop", "custom property, key=value")
+				f.StringVar(&fileFlag, "f", "", "read payload from the `file`, - for STDIN")
 			},
 		},
 		{
@@ -133,7 +188,16 @@ func run() error {
 			Handler: wrap(ctx, watchEvents),
 			ParseFunc: func(f *flag.FlagSet) {
 				f.StringVar(&ehcsFlag, "ehcs", "", "custom eventhub connection string")
-				f.StringVar(&ehcgFlag, "ehcg", "$Default", "eventhub consumer group")
+				f.StringVar(&ehcgFlag, "ehcg", "$Default", "eventhub consumer group (alias for -consumer-group)")
+				f.StringVar(&ehcgFlag, "consumer-group", "$Default", "consumer group to receive events with")
+				f.StringVar(&sinceFlag, "since", "", "replay events enqueued after the RFC3339 `time` or within the duration, e.g. 15m")
+				f.StringVar(&offsetFlag, "offset", "", "start after the partition offset, -1 stands for the earliest retained event")
+				f.Var((*internal.StringsFlag)(&partitionFlag), "partition", "receive events only from the partition, can be repeated")
+				f.BoolVar(&wsFlag, "ws", false, "use AMQP-over-WebSocket on port 443")
+				f.Var((*internal.StringsFlag)(&deviceFlag), "device", "show only events of the device, glob patterns are accepted, can be repeated")
+				f.StringVar(&sourceFlag, "source", "", "show only events with the message source <Telemetry|twinChangeEvents|deviceLifecycleEvents|...>")
+				f.Var((*internal.StringsMapFlag)(&matchFlag), "match", "show only events with the property matching a glob pattern, key=pattern")
+				f.StringVar(&templateFlag, "template", "", "output `template` in Go text/template syntax, e.g. '{{.ConnectionDeviceID}} {{str .Payload}}'")
 			},
 		},
 		{
@@ -184,6 +248,24 @@ func run() error {
 				f.BoolVar(&edgeFlag, "edge", false, "create an IoT Edge device (same as -capability=iotEdge=true)")
 			},
 		},
+		{
+			Name:    "clone-device",
+			Args:    []string{"SOURCE", "DEVICE"},
+			Desc:    "create a device with the source device's settings, e.g. for replacing hardware",
+			Handler: wrap(ctx, cloneDevice),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.BoolVar(&cloneTwinFlag, "twin", true, "copy tags and desired properties")
+			},
+		},
+		{
+			Name:    "create-devices",
+			Desc:    "create devices in bulk listed in a CSV or JSON file",
+			Handler: wrap(ctx, createDevices),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&fileFlag, "f", "", "devices `file` (.csv or .json), - for STDIN in JSON format")
+				f.IntVar(&chunkFlag, "chunk", iotservice.MaxBulkDevices, "number of devices per request")
+			},
+		},
 		{
 			Name:    "update-device",
 			Args:    []string{"DEVICE"},
@@ -210,6 +292,34 @@ func run() error {
 				f.BoolVar(&forceFlag, "force", false, "force update")
 			},
 		},
+		{
+			Name:    "delete-devices",
+			Desc:    "delete devices in bulk listed in a CSV or JSON file",
+			Handler: wrap(ctx, deleteDevices),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&fileFlag, "f", "", "devices `file` (.csv or .json), - for STDIN in JSON format")
+				f.IntVar(&chunkFlag, "chunk", iotservice.MaxBulkDevices, "number of devices per request")
+				f.BoolVar(&forceFlag, "force", false, "force delete")
+			},
+		},
+		{
+			Name:    "set-parent",
+			Args:    []string{"DEVICE", "PARENT"},
+			Desc:    "make the IoT Edge device PARENT the parent of the named device",
+			Handler: wrap(ctx, setParent),
+		},
+		{
+			Name:    "remove-parent",
+			Args:    []string{"DEVICE"},
+			Desc:    "detach the named device from its parent",
+			Handler: wrap(ctx, removeParent),
+		},
+		{
+			Name:    "children",
+			Args:    []string{"DEVICE"},
+			Desc:    "list children of the named IoT Edge device",
+			Handler: wrap(ctx, listChildren),
+		},
 		{
 			Name:    "call-module",
 			Args:    []string{"DEVICE", "MODULE", "METHOD", "PAYLOAD"},
@@ -220,12 +330,47 @@ func run() error {
 				f.UintVar(&responseTimeoutFlag, "response-timeout", 30, "response timeout in seconds")
 			},
 		},
+		{
+			Name:    "restart-module",
+			Args:    []string{"DEVICE", "MODULE"},
+			Desc:    "restart the named module on an IoT Edge device",
+			Handler: wrap(ctx, restartModule),
+		},
+		{
+			Name:    "module-logs",
+			Args:    []string{"DEVICE", "MODULE"},
+			Desc:    "print logs of modules matching the MODULE regexp on an IoT Edge device",
+			Handler: wrap(ctx, getModuleLogs),
+			ParseFunc: func(f *flag.FlagSet) {
+				moduleLogsFlags(f)
+			},
+		},
+		{
+			Name:    "upload-module-logs",
+			Args:    []string{"DEVICE", "MODULE", "SASURL"},
+			Desc:    "upload logs of modules matching the MODULE regexp to a blob container",
+			Handler: wrap(ctx, uploadModuleLogs),
+			ParseFunc: func(f *flag.FlagSet) {
+				moduleLogsFlags(f)
+			},
+		},
+		{
+			Name:    "ping-edge",
+			Args:    []string{"DEVICE"},
+			Desc:    "check that the edge agent of an IoT Edge device is running",
+			Handler: wrap(ctx, pingEdge),
+		},
 		{
 			Name:    "modules",
 			Args:    []string{"DEVICE"},
 			Desc:    "list the named device's modules",
 			Handler: wrap(ctx, listModules),
 		},
+		{
+			Name:    "all-modules",
+			Desc:    "list modules of all devices",
+			Handler: wrap(ctx, listAllModules),
+		},
 		{
 			Name:    "create-module",
 			Args:    []string{"DEVICE", "MODULE"},
@@ -290,6 +435,18 @@ func run() error {
 			ParseFunc: func(f *flag.FlagSet) {
 				f.Var((*internal.JSONMapFlag)(&twinPropsFlag), "prop", "property to update, key=value")
 				f.Var((*internal.JSONMapFlag)(&tagsFlag), "tag", "custom tag, key=value")
+				f.StringVar(&patchFileFlag, "patch-file", "", "JSON `file` with desired properties to update, - for STDIN")
+			},
+		},
+		{
+			Name:    "update-twins-where",
+			Args:    []string{"CONDITION"},
+			Desc:    "update desired properties of twins matching the query condition",
+			Handler: wrap(ctx, updateTwinsWhere),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.Var((*internal.JSONMapFlag)(&twinPropsFlag), "prop", "property to update, key=value")
+				f.StringVar(&patchFileFlag, "patch-file", "", "JSON `file` with desired properties to update, - for STDIN")
+				f.IntVar(&concurrencyFlag, "concurrency", iotservice.DefaultUpdateTwinsConcurrency, "number of twins updated at a time")
 			},
 		},
 		{
@@ -299,6 +456,8 @@ func run() error {
 			Handler: wrap(ctx, updateModuleTwin),
 			ParseFunc: func(f *flag.FlagSet) {
 				f.Var((*internal.JSONMapFlag)(&twinPropsFlag), "prop", "property to update, key=value")
+				f.Var((*internal.JSONMapFlag)(&tagsFlag), "tag", "custom tag, key=value")
+				f.StringVar(&patchFileFlag, "patch-file", "", "JSON `file` with desired properties to update, - for STDIN")
 				f.BoolVar(&forceFlag, "force", false, "force update")
 			},
 		},
@@ -311,9 +470,20 @@ func run() error {
 		{
 			Name:    "update-digital-twin",
 			Args:    []string{"DEVICE", "PATCH"},
-			Desc:    "update the named digital twin",
+			Desc:    "update the named digital twin with a JSON patch, @FILE or - for STDIN",
 			Handler: wrap(ctx, updateDigitalTwin),
 		},
+		{
+			Name: "invoke-command",
+			Args: []string{"DEVICE", "COMMAND", "PAYLOAD"},
+			Desc: "invoke the digital twin command, PAYLOAD can be @FILE or - for STDIN",
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&componentFlag, "component", "", "component the command belongs to")
+				f.UintVar(&connectTimeoutFlag, "connect-timeout", 0, "connect timeout in seconds")
+				f.UintVar(&responseTimeoutFlag, "response-timeout", 30, "response timeout in seconds")
+			},
+			Handler: wrap(ctx, invokeCommand),
+		},
 		{
 			Name: "call-digital-twin",
 			Args: []string{"DEVICE", "COMMAND", "PAYLOAD"},
@@ -359,6 +529,12 @@ func run() error {
 			Desc:    "retrieve the named configuration",
 			Handler: wrap(ctx, getConfiguration),
 		},
+		{
+			Name:    "configuration-status",
+			Args:    []string{"CONFIGURATION"},
+			Desc:    "count devices targeted and applied by the named configuration",
+			Handler: wrap(ctx, getConfigurationStatus),
+		},
 		{
 			Name:    "update-configuration",
 			Args:    []string{"CONFIGURATION"},
@@ -383,6 +559,20 @@ func run() error {
 				f.BoolVar(&forceFlag, "force", false, "force update")
 			},
 		},
+		{
+			Name:    "export-configurations",
+			Desc:    "print all configurations and deployments as NDJSON",
+			Handler: wrap(ctx, exportConfigurations),
+		},
+		{
+			Name:    "import-configurations",
+			Args:    []string{"FILE"},
+			Desc:    "create configurations from export-configurations output, - for STDIN",
+			Handler: wrap(ctx, importConfigurations),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.BoolVar(&replaceFlag, "replace", false, "replace existing configurations (not atomic)")
+			},
+		},
 		{
 			Name:    "apply-configuration",
 			Args:    []string{"DEVICE"},
@@ -391,6 +581,8 @@ func run() error {
 			ParseFunc: func(f *flag.FlagSet) {
 				f.Var((*internal.JSONMapFlag)(&devicesContentFlag), "device-prop", "device property, key=value")
 				f.Var((*internal.JSONMapFlag)(&modulesContentFlag), "module-prop", "module property, key=value")
+				f.StringVar(&devicesContentFileFlag, "device-content-file", "", "JSON `file` with device content, - for STDIN")
+				f.StringVar(&modulesContentFileFlag, "modules-content-file", "", "JSON `file` with modules content (deployment manifest), - for STDIN")
 			},
 		},
 		{
@@ -420,6 +612,11 @@ func run() error {
 			Args:    []string{"SQL"},
 			Desc:    "execute sql query on devices",
 			Handler: wrap(ctx, query),
+			ParseFunc: func(f *flag.FlagSet) {
+				f.StringVar(&outputFlag, "output", "", "results output format <json|json-pretty|ndjson|csv|table>, default is -format")
+				f.IntVar(&topFlag, "top", 0, "return at most N results, the continuation token is printed to STDERR when more are available")
+				f.StringVar(&continuationFlag, "continuation", "", "continue a query stopped by -top from the `token`")
+			},
 		},
 		{
 			Name:    "device-statistics",
@@ -431,6 +628,11 @@ func run() error {
 			Desc:    "get service statistics of the identity registry",
 			Handler: wrap(ctx, serviceStats),
 		},
+		{
+			Name:    "check-health",
+			Desc:    "check REST and AMQP connectivity of the hub",
+			Handler: wrap(ctx, checkHealth),
+		},
 		{
 			Name:    "import",
 			Desc:    "import devices from a blob",
@@ -446,6 +648,11 @@ func run() error {
 				f.BoolVar(&excludeKeysFlag, "exclude-keys", false, "exclude keys in the export blob file")
 			},
 		},
+		{
+			Name:    "snapshot",
+			Desc:    "print identities and twins of all devices as NDJSON",
+			Handler: wrap(ctx, snapshot),
+		},
 		{
 			Name:    "jobs",
 			Desc:    "list the last import/export jobs",
@@ -474,38 +681,39 @@ func run() error {
 			},
 		},
 		{
-			Name:    "get-schedule-job",
+			Name:    "job-status",
+			Aliases: []string{"get-schedule-job"},
 			Args:    []string{"JOB"},
-			Desc:    "retrieve the named job information from the registry",
+			Desc:    "retrieve the named scheduled job status",
 			Handler: wrap(ctx, getScheduleJob),
 		},
 		{
-			Name:    "cancel-schedule-job",
+			Name:    "cancel-scheduled-job",
+			Aliases: []string{"cancel-schedule-job"},
 			Args:    []string{"JOB"},
-			Desc:    "cancel the named job",
+			Desc:    "cancel the named scheduled job",
 			Handler: wrap(ctx, cancelScheduleJob),
 		},
 		{
-			Name:    "schedule-method-call",
+			Name:    "schedule-method",
+			Aliases: []string{"schedule-method-call"},
 			Args:    []string{"METHOD", "PAYLOAD"},
+			Desc:    "schedule a direct method call on devices matching the query condition",
 			Handler: wrap(ctx, scheduleMethodCall),
 			ParseFunc: func(f *flag.FlagSet) {
-				f.StringVar(&jobIDFlag, "job-id", "", "unique job id")
-				f.StringVar(&queryFlag, "query", "*", "query condition")
-				f.Var((*internal.TimeFlag)(&startTimeFlag), "start-time", "start time in RFC3339")
+				scheduleFlags(f)
 				f.UintVar(&timeoutFlag, "connect-timeout", 0, "connection timeout in seconds")
-				f.UintVar(&maxExecTimeFlag, "exec-timeout", 30, "maximal execution time in seconds")
 			},
 		},
 		{
 			Name:    "schedule-twin-update",
-			Args:    []string{}, // TODO
+			Desc:    "schedule a twin update on devices matching the query condition",
 			Handler: wrap(ctx, scheduleTwinUpdate),
 			ParseFunc: func(f *flag.FlagSet) {
-				f.StringVar(&jobIDFlag, "job-id", "", "unique job id")
-				f.StringVar(&queryFlag, "query", "*", "query condition")
-				f.Var((*internal.TimeFlag)(&startTimeFlag), "start-time", "start time in RFC3339")
-				f.UintVar(&maxExecTimeFlag, "exec-timeout", 30, "maximal execution time in seconds")
+				scheduleFlags(f)
+				f.Var((*internal.JSONMapFlag)(&twinPropsFlag), "prop", "desired property to update, key=value")
+				f.Var((*internal.JSONMapFlag)(&tagsFlag), "tag", "custom tag, key=value")
+				f.StringVar(&patchFileFlag, "patch-file", "", "JSON `file` with desired properties to update, - for STDIN")
 			},
 		},
 		{
@@ -540,44 +748,54 @@ func run() error {
 	}).Run(os.Args)
 }
 
+// newClient creates a client with -c, Azure AD or
+// the environment and profiles credentials in this order.
+func newClient(opts ...iotservice.ClientOption) (*iotservice.Client, error) {
+	if aadFlag || hubFlag != "" {
+		if !aadFlag || hubFlag == "" {
+			return nil, errors.New("-hub and -aad have to be used together")
+		}
+		if connStrFlag != "" {
+			return nil, errors.New("-aad and -connection-string are mutually exclusive")
+		}
+		return iotservice.NewFromTokenCredential(
+			internal.HubHostName(hubFlag), internal.AADCredential(), opts...,
+		)
+	}
+
+	cs := connStrFlag
+	if cs == "" {
+		var err error
+		cs, err = internal.LookupConnectionString(profileFlag, "IOTHUB_SERVICE_CONNECTION_STRING",
+			func(p *internal.Profile) string {
+				return p.ServiceConnectionString
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return iotservice.NewFromConnectionString(cs, opts...)
+}
+
 func wrap(
 	ctx context.Context,
 	fn func(context.Context, *iotservice.Client, []string) error,
 ) internal.HandlerFunc {
 	return func(args []string) error {
-		c, err := iotservice.NewFromConnectionString(
-			os.Getenv("IOTHUB_SERVICE_CONNECTION_STRING"),
+		c, err := newClient(
 			iotservice.WithLogger(
 				logger.New(logLevelFlag, nil),
 			),
+			iotservice.WithWebSocket(wsFlag),
 		)
 		if err != nil {
 			return err
 		}
 		defer c.Close()
-
-		// handle first SIGINT and try to exit gracefully
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, os.Interrupt)
-		go func() {
-			<-sigc
-			signal.Reset(os.Interrupt)
-			close(sigc)
-			cancel()
-		}()
-		if err := fn(ctx, c, args); err != nil {
-			select {
-			case <-sigc:
-				if err == context.Canceled {
-					return nil
-				}
-			default:
-			}
-			return err
-		}
-		return nil
+		return internal.RunContext(ctx, cmdTimeoutFlag, func(ctx context.Context) error {
+			return fn(ctx, c, args)
+		})
 	}
 }
 
@@ -589,6 +807,10 @@ func listDevices(ctx context.Context, c *iotservice.Client, args []string) error
 	return output(c.ListDevices(ctx))
 }
 
+func cloneDevice(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.CloneDevice(ctx, args[0], args[1], cloneTwinFlag))
+}
+
 func createDevice(ctx context.Context, c *iotservice.Client, args []string) error {
 	if edgeFlag {
 		if capabilitiesFlag == nil {
@@ -610,6 +832,78 @@ func createDevice(ctx context.Context, c *iotservice.Client, args []string) erro
 	return output(c.CreateDevice(ctx, device))
 }
 
+func createDevices(ctx context.Context, c *iotservice.Client, args []string) error {
+	return bulkDevices(ctx, c.CreateDevices)
+}
+
+func deleteDevices(ctx context.Context, c *iotservice.Client, args []string) error {
+	return bulkDevices(ctx, func(ctx context.Context, devices []*iotservice.Device) (*iotservice.BulkResult, error) {
+		return c.DeleteDevices(ctx, devices, forceFlag)
+	})
+}
+
+// bulkSummary is a report of a bulk operation split into multiple requests.
+type bulkSummary struct {
+	Total     int                     `json:"total"`
+	Succeeded int                     `json:"succeeded"`
+	Failed    int                     `json:"failed"`
+	Skipped   int                     `json:"skipped,omitempty"` // not processed due to a chunk error
+	Errors    []*iotservice.BulkError `json:"errors,omitempty"`
+}
+
+// bulkDevices reads devices from the -f file and applies fn
+// to chunks of them, printing the summary at the end, when a chunk
+// fails the summary of the processed ones is printed before the error.
+func bulkDevices(
+	ctx context.Context,
+	fn func(context.Context, []*iotservice.Device) (*iotservice.BulkResult, error),
+) error {
+	if fileFlag == "" {
+		return internal.ErrInvalidUsage
+	}
+	if chunkFlag < 1 || chunkFlag > iotservice.MaxBulkDevices {
+		return fmt.Errorf("-chunk must be between 1 and %d", iotservice.MaxBulkDevices)
+	}
+	devices, err := readDevicesFile(fileFlag)
+	if err != nil {
+		return err
+	}
+
+	s := &bulkSummary{Total: len(devices)}
+	for i := 0; i < len(devices); i += chunkFlag {
+		j := i + chunkFlag
+		if j > len(devices) {
+			j = len(devices)
+		}
+		res, err := fn(ctx, devices[i:j])
+		if err != nil {
+			s.Skipped = s.Total - i
+			s.Failed = len(s.Errors)
+			s.Succeeded = i - s.Failed
+			if oerr := output(s, nil); oerr != nil {
+				return oerr
+			}
+			return fmt.Errorf("devices %d-%d: %w", i+1, j, err)
+		}
+		s.Errors = append(s.Errors, res.Errors...)
+	}
+	s.Failed = len(s.Errors)
+	s.Succeeded = s.Total - s.Failed
+	return output(s, nil)
+}
+
+func readDevicesFile(name string) ([]*iotservice.Device, error) {
+	if name == "-" {
+		return internal.ReadDevices(os.Stdin, "json")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return internal.ReadDevices(f, strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
 func updateDevice(ctx context.Context, c *iotservice.Client, args []string) error {
 	device, err := c.GetDevice(ctx, args[0])
 	if err != nil {
@@ -631,6 +925,18 @@ func updateDevice(ctx context.Context, c *iotservice.Client, args []string) erro
 	return output(c.UpdateDevice(ctx, device))
 }
 
+func setParent(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.SetParent(ctx, args[0], args[1]))
+}
+
+func removeParent(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.RemoveParent(ctx, args[0]))
+}
+
+func listChildren(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.ListChildren(ctx, args[0]))
+}
+
 func updateAuth(auth *iotservice.Authentication) error {
 	switch {
 	case sasPrimaryFlag != "" || sasSecondaryFlag != "":
@@ -678,6 +984,10 @@ func listModules(ctx context.Context, c *iotservice.Client, args []string) error
 	return output(c.ListModules(ctx, args[0]))
 }
 
+func listAllModules(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.ListAllModules(ctx))
+}
+
 func getModule(ctx context.Context, c *iotservice.Client, args []string) error {
 	return output(c.GetModule(ctx, args[0], args[1]))
 }
@@ -775,17 +1085,26 @@ func createConfiguration(ctx context.Context, c *iotservice.Client, args []strin
 
 // https://github.com/Azure/azure-iot-cli-extension/blob/v0.8.7/azext_iot/assets/edge-deploy-2.0.schema.json
 func createDeployment(ctx context.Context, c *iotservice.Client, args []string) error {
-	env := make(map[string]interface{}, len(envFlag))
+	env := make(map[string]string, len(envFlag))
 	for k, v := range envFlag {
-		env[k] = map[string]interface{}{
-			"value": v,
+		if s, ok := v.(string); ok {
+			env[k] = s
+		} else {
+			env[k] = fmt.Sprint(v)
 		}
 	}
-	createOptions, err := json.Marshal(createOptionsFlag)
+	content, err := iotservice.NewDeploymentManifest().
+		AddModule(args[1], &iotservice.EdgeModule{
+			Image:             args[2],
+			CreateOptions:     createOptionsFlag,
+			Env:               env,
+			Version:           "1.0",
+			DesiredProperties: modulesContentFlag,
+		}).
+		ModulesContent()
 	if err != nil {
 		return err
 	}
-
 	return output(c.CreateConfiguration(ctx, &iotservice.Configuration{
 		ID:              args[0],
 		SchemaVersion:   schemaVersionFlag,
@@ -793,75 +1112,7 @@ func createDeployment(ctx context.Context, c *iotservice.Client, args []string)
 		Labels:          labelsFlag,
 		TargetCondition: targetConditionFlag,
 		Content: &iotservice.ConfigurationContent{
-			ModulesContent: map[string]interface{}{
-				"$edgeAgent": map[string]interface{}{
-					"properties.desired": map[string]interface{}{
-						"modules": map[string]interface{}{
-							args[1]: map[string]interface{}{
-								"type": "docker",
-								"settings": map[string]interface{}{
-									"image":         args[2],
-									"createOptions": string(createOptions),
-								},
-								"env":           env,
-								"status":        "running",
-								"restartPolicy": "always",
-								"version":       "1.0",
-							},
-						},
-
-						"runtime": map[string]interface{}{
-							"type": "docker",
-							"settings": map[string]interface{}{
-								"minDockerVersion":    "v1.25",
-								"registryCredentials": map[string]interface{}{
-									// TODO: "REGISTRYNAME": map[string]interface{}{
-									// TODO: 	"address":  "docker.com",
-									// TODO: 	"password": "pwd",
-									// TODO: 	"username": "test",
-									// TODO: },
-								},
-							},
-						},
-
-						"schemaVersion": "1.0",
-						"systemModules": map[string]interface{}{
-							"edgeAgent": map[string]interface{}{
-								"settings": map[string]interface{}{
-									"image":         "mcr.microsoft.com/azureiotedge-agent:1.0",
-									"createOptions": "",
-								},
-								"type": "docker",
-							},
-							"edgeHub": map[string]interface{}{
-								"settings": map[string]interface{}{
-									"image":         "mcr.microsoft.com/azureiotedge-hub:1.0",
-									"createOptions": "{\"HostConfig\":{\"PortBindings\":{\"8883/tcp\":[{\"HostPort\":\"8883\"}],\"5671/tcp\":[{\"HostPort\":\"5671\"}],\"443/tcp\":[{\"HostPort\":\"443\"}]}}}",
-								},
-								"type":          "docker",
-								"status":        "running",
-								"restartPolicy": "always",
-							},
-						},
-					},
-				},
-
-				"$edgeHub": map[string]interface{}{
-					"properties.desired": map[string]interface{}{
-						"routes":        map[string]interface{}{},
-						"schemaVersion": "1.0",
-						"storeAndForwardConfiguration": map[string]interface{}{
-							"timeToLiveSecs": 7200,
-						},
-					},
-				},
-
-				// TODO: "testmodulename": map[string]interface{}{
-				// TODO: 	"properties.desired.test": map[string]interface{}{
-				// TODO: 		"foo": "bar",
-				// TODO: 	},
-				// TODO: },
-			},
+			ModulesContent: content,
 		},
 		Metrics: &iotservice.ConfigurationMetrics{
 			Queries: metricsFlag,
@@ -869,6 +1120,10 @@ func createDeployment(ctx context.Context, c *iotservice.Client, args []string)
 	}))
 }
 
+func getConfigurationStatus(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.GetConfigurationStatus(ctx, args[0]))
+}
+
 func updateConfiguration(ctx context.Context, c *iotservice.Client, args []string) error {
 	config, err := c.GetConfiguration(ctx, args[0])
 	if err != nil {
@@ -904,21 +1159,87 @@ func deleteConfiguration(ctx context.Context, c *iotservice.Client, args []strin
 	return c.DeleteConfiguration(ctx, config)
 }
 
+func exportConfigurations(ctx context.Context, c *iotservice.Client, args []string) error {
+	return c.ExportConfigurations(ctx, os.Stdout)
+}
+
+func importConfigurations(ctx context.Context, c *iotservice.Client, args []string) error {
+	if args[0] == "-" {
+		return c.ImportConfigurations(ctx, os.Stdin, replaceFlag)
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.ImportConfigurations(ctx, f, replaceFlag)
+}
+
 func applyConfiguration(ctx context.Context, c *iotservice.Client, args []string) error {
+	if modulesContentFileFlag == "-" && devicesContentFileFlag == "-" {
+		return errors.New("only one content file can be read from STDIN")
+	}
+	modules, err := readJSONMapFile("-modules-content-file", modulesContentFileFlag)
+	if err != nil {
+		return err
+	}
+	device, err := readJSONMapFile("-device-content-file", devicesContentFileFlag)
+	if err != nil {
+		return err
+	}
+	mergeMapJSON(modules, modulesContentFlag)
+	mergeMapJSON(device, devicesContentFlag)
+	if len(modules) == 0 && len(device) == 0 {
+		return errors.New("no content to apply, use content files or properties")
+	}
 	return c.ApplyConfigurationContentOnDevice(
 		ctx,
 		args[0],
 		&iotservice.ConfigurationContent{
-			ModulesContent: modulesContentFlag,
-			DeviceContent:  devicesContentFlag,
+			ModulesContent: modules,
+			DeviceContent:  device,
 		},
 	)
 }
 
 func query(ctx context.Context, c *iotservice.Client, args []string) error {
-	return c.QueryDevices(ctx, args[0], func(v map[string]interface{}) error {
-		return output(v, nil)
-	})
+	format := outputFlag
+	if format == "" {
+		format = formatFlag
+	}
+	p, err := internal.NewPrinter(os.Stdout, format)
+	if err != nil {
+		return err
+	}
+	if topFlag < 0 {
+		return errors.New("-top cannot be negative")
+	}
+	next := continuationFlag
+	for n := 0; ; {
+		size := 0 // hub's default
+		if topFlag > 0 {
+			size = topFlag - n
+		}
+		var items []map[string]interface{}
+		items, next, err = c.QueryDevicesPage(ctx, args[0], size, next)
+		if err != nil {
+			return err
+		}
+		for _, v := range items {
+			if err = p.Print(v); err != nil {
+				return err
+			}
+		}
+		n += len(items)
+		if next == "" {
+			break
+		}
+		if topFlag > 0 && n >= topFlag {
+			fmt.Fprintf(os.Stderr, "continuation: %s\n", next)
+			break
+		}
+	}
+	return p.Flush()
 }
 
 func deviceStats(ctx context.Context, c *iotservice.Client, args []string) error {
@@ -929,6 +1250,10 @@ func serviceStats(ctx context.Context, c *iotservice.Client, args []string) erro
 	return output(c.ServiceStats(ctx))
 }
 
+func checkHealth(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output("ok", c.CheckHealth(ctx))
+}
+
 func importFromBlob(ctx context.Context, c *iotservice.Client, args []string) error {
 	return output(c.CreateJob(ctx, &iotservice.Job{
 		Type:                   iotservice.JobImport,
@@ -945,6 +1270,10 @@ func exportToBlob(ctx context.Context, c *iotservice.Client, args []string) erro
 	}))
 }
 
+func snapshot(ctx context.Context, c *iotservice.Client, args []string) error {
+	return c.ExportSnapshot(ctx, os.Stdout)
+}
+
 func getDeviceTwin(ctx context.Context, c *iotservice.Client, args []string) error {
 	return output(c.GetDeviceTwin(ctx, args[0]))
 }
@@ -961,11 +1290,29 @@ func updateDeviceTwin(ctx context.Context, c *iotservice.Client, args []string)
 	if forceFlag {
 		twin.ETag = ""
 	}
-	mergeMapJSON(twin.Tags, tagsFlag)
-	mergeMapJSON(twin.Properties.Desired, twinPropsFlag)
+	if err = updateTwinMaps(&twin.Tags, &twin.Properties.Desired); err != nil {
+		return err
+	}
 	return output(c.UpdateDeviceTwin(ctx, twin))
 }
 
+func updateTwinsWhere(ctx context.Context, c *iotservice.Client, args []string) error {
+	if concurrencyFlag < 1 {
+		return errors.New("-concurrency must be positive")
+	}
+	patch, err := readJSONMapFile("-patch-file", patchFileFlag)
+	if err != nil {
+		return err
+	}
+	mergeMapJSON(patch, twinPropsFlag)
+	if len(patch) == 0 {
+		return errors.New("-prop or -patch-file is required")
+	}
+	return output(c.UpdateTwinsWhere(ctx, args[0], patch,
+		iotservice.WithUpdateTwinsConcurrency(concurrencyFlag),
+	))
+}
+
 func updateModuleTwin(ctx context.Context, c *iotservice.Client, args []string) error {
 	twin, err := c.GetModuleTwin(ctx, args[0], args[1])
 	if err != nil {
@@ -974,17 +1321,63 @@ func updateModuleTwin(ctx context.Context, c *iotservice.Client, args []string)
 	if forceFlag {
 		twin.ETag = ""
 	}
-	mergeMapJSON(twin.Properties.Desired, twinPropsFlag)
+	if err = updateTwinMaps(&twin.Tags, &twin.Properties.Desired); err != nil {
+		return err
+	}
 	return output(c.UpdateModuleTwin(ctx, twin))
 }
 
+// updateTwinMaps applies -patch-file, -prop and -tag flags to the twin's
+// tags and desired properties, flags take precedence over the patch file.
+func updateTwinMaps(tags, desired *map[string]interface{}) error {
+	if *tags == nil {
+		*tags = map[string]interface{}{}
+	}
+	if *desired == nil {
+		*desired = map[string]interface{}{}
+	}
+	patch, err := readJSONMapFile("-patch-file", patchFileFlag)
+	if err != nil {
+		return err
+	}
+	mergeMapJSON(*desired, patch)
+	mergeMapJSON(*tags, tagsFlag)
+	mergeMapJSON(*desired, twinPropsFlag)
+	return nil
+}
+
+// readJSONMapFile reads a JSON object from the named file or STDIN
+// when name is `-`, an empty map is returned when name is empty.
+func readJSONMapFile(flagName, name string) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	if name == "" {
+		return m, nil
+	}
+	arg := "@" + name
+	if name == "-" {
+		arg = name
+	}
+	b, err := internal.ReadArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", flagName, err)
+	}
+	return m, nil
+}
+
 func getDigitalTwin(ctx context.Context, c *iotservice.Client, args []string) error {
 	return output(c.GetDigitalTwin(ctx, args[0]))
 }
 
 func updateDigitalTwin(ctx context.Context, c *iotservice.Client, args []string) error {
+	b, err := internal.ReadArg(args[1])
+	if err != nil {
+		return err
+	}
 	var patch []map[string]interface{}
-	if err := json.Unmarshal([]byte(args[1]), &patch); err != nil {
+	if err := json.Unmarshal(b, &patch); err != nil {
 		return err
 	}
 	return output(c.UpdateDigitalTwin(ctx, args[0], patch))
@@ -1012,6 +1405,24 @@ func callDigitalTwinComponent(ctx context.Context, c *iotservice.Client, args []
 	return output(v, nil)
 }
 
+func invokeCommand(ctx context.Context, c *iotservice.Client, args []string) error {
+	payload, err := internal.ReadArg(args[2])
+	if err != nil {
+		return err
+	}
+	opts := []iotservice.CallDigitalTwinOption{
+		iotservice.WithCallDigitalTwinConnectTimeout(int(connectTimeoutFlag)),
+		iotservice.WithCallDigitalTwinResponseTimeout(int(responseTimeoutFlag)),
+	}
+	var v map[string]interface{}
+	if componentFlag != "" {
+		_, v, err = c.CallDigitalTwinComponent(ctx, args[0], componentFlag, args[1], payload, opts...)
+	} else {
+		_, v, err = c.CallDigitalTwin(ctx, args[0], args[1], payload, opts...)
+	}
+	return output(v, err)
+}
+
 func callDevice(ctx context.Context, c *iotservice.Client, args []string) error {
 	call, err := mkcall(args[1], args[2])
 	if err != nil {
@@ -1028,25 +1439,87 @@ func callModule(ctx context.Context, c *iotservice.Client, args []string) error
 	return output(c.CallModuleMethod(ctx, args[0], args[1], call))
 }
 
+func moduleLogsFlags(f *flag.FlagSet) {
+	f.IntVar(&tailFlag, "tail", 0, "number of last log lines, all when zero")
+	f.StringVar(&sinceFlag, "since", "", "only logs since the given timestamp or duration, e.g. 10m")
+	f.StringVar(&untilFlag, "until", "", "only logs until the given timestamp or duration")
+	f.StringVar(&regexFlag, "regex", "", "only log lines matching the regular expression")
+	f.IntVar(&logSeverityFlag, "log-level", -1, "only log lines of the given syslog severity level")
+}
+
+func moduleLogsItems(module string) []*iotservice.ModuleLogsItem {
+	filter := &iotservice.ModuleLogsFilter{
+		Tail:  tailFlag,
+		Since: sinceFlag,
+		Until: untilFlag,
+		Regex: regexFlag,
+	}
+	if logSeverityFlag >= 0 {
+		filter.LogLevel = &logSeverityFlag
+	}
+	return []*iotservice.ModuleLogsItem{{ID: module, Filter: filter}}
+}
+
+func restartModule(ctx context.Context, c *iotservice.Client, args []string) error {
+	return c.RestartModule(ctx, args[0], args[1])
+}
+
+func getModuleLogs(ctx context.Context, c *iotservice.Client, args []string) error {
+	logs, err := c.GetModuleLogs(ctx, args[0], &iotservice.GetModuleLogsRequest{
+		Items:       moduleLogsItems(args[1]),
+		Encoding:    iotservice.LogEncodingNone,
+		ContentType: iotservice.LogContentText,
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		var s string
+		if err = json.Unmarshal(l.Payload, &s); err != nil {
+			return fmt.Errorf("%s: malformed logs: %w", l.ID, err)
+		}
+		if _, err = fmt.Print(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadModuleLogs(ctx context.Context, c *iotservice.Client, args []string) error {
+	return output(c.UploadModuleLogs(ctx, args[0], &iotservice.UploadModuleLogsRequest{
+		SASURL:      args[2],
+		Items:       moduleLogsItems(args[1]),
+		Encoding:    iotservice.LogEncodingNone,
+		ContentType: iotservice.LogContentText,
+	}))
+}
+
+func pingEdge(ctx context.Context, c *iotservice.Client, args []string) error {
+	return c.PingEdgeAgent(ctx, args[0])
+}
+
 func mkcall(method, payload string) (*iotservice.MethodCall, error) {
-	var p map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &p); err != nil {
-		return nil, err
+	if !json.Valid([]byte(payload)) {
+		return nil, errors.New("payload is not valid json")
 	}
 	return &iotservice.MethodCall{
 		MethodName:      method,
 		ConnectTimeout:  connectTimeoutFlag,
 		ResponseTimeout: responseTimeoutFlag,
-		Payload:         p,
+		Payload:         json.RawMessage(payload),
 	}, nil
 }
 
 func send(ctx context.Context, c *iotservice.Client, args []string) error {
+	payload, err := internal.ReadPayload(args[1:], fileFlag)
+	if err != nil {
+		return err
+	}
 	expiryTime := time.Time{}
 	if expFlag != 0 {
 		expiryTime = time.Now().Add(expFlag)
 	}
-	return c.SendEvent(ctx, args[0], []byte(args[1]),
+	return c.SendEvent(ctx, args[0], payload,
 		iotservice.WithSendMessageID(midFlag),
 		iotservice.WithSendAck(ackFlag),
 		iotservice.WithSendProperties(propsFlag),
@@ -1057,24 +1530,97 @@ func send(ctx context.Context, c *iotservice.Client, args []string) error {
 }
 
 func watchEvents(ctx context.Context, c *iotservice.Client, args []string) error {
+	printEvent, err := eventPrinter()
+	if err != nil {
+		return err
+	}
+	if offsetFlag != "" && sinceFlag != "" {
+		return errors.New("-since and -offset are mutually exclusive")
+	}
+	since, err := parseSince(sinceFlag)
+	if err != nil {
+		return err
+	}
 	if ehcsFlag != "" {
-		return watchEventHubEvents(ctx, ehcsFlag, ehcgFlag)
+		return watchEventHubEvents(ctx, ehcsFlag, ehcgFlag, since, printEvent)
+	}
+	opts := []iotservice.SubscribeEventsOption{
+		iotservice.WithSubscribeEventsConsumerGroup(ehcgFlag),
+		iotservice.WithSubscribeEventsPartitions(partitionFlag...),
+		iotservice.WithSubscribeEventsSince(since),
+	}
+	if offsetFlag != "" {
+		opts = append(opts, iotservice.WithSubscribeEventsOffset(offsetFlag))
 	}
 	return c.SubscribeEvents(ctx, func(msg *iotservice.Event) error {
+		return printEvent(msg.Message)
+	}, opts...)
+}
+
+// parseSince parses either an RFC3339 time or
+// a duration that's subtracted from the current time.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-since: %q is neither a time nor a duration", s)
+	}
+	return t, nil
+}
+
+// eventPrinter returns a function that prints events
+// matching the filter flags in the requested format.
+func eventPrinter() (func(msg *common.Message) error, error) {
+	var tpl *template.Template
+	if templateFlag != "" {
+		var err error
+		if tpl, err = internal.ParseTemplate(templateFlag); err != nil {
+			return nil, err
+		}
+	}
+	filter := &internal.EventFilter{
+		DeviceIDs:     deviceFlag,
+		MessageSource: sourceFlag,
+		Properties:    matchFlag,
+	}
+	return func(msg *common.Message) error {
+		if !filter.Match(msg) {
+			return nil
+		}
+		if tpl != nil {
+			return internal.OutputTemplate(tpl, msg)
+		}
 		return output(msg, nil)
-	})
+	}, nil
 }
 
-func watchEventHubEvents(ctx context.Context, cs, group string) error {
-	c, err := eventhub.DialConnectionStringContext(ctx, cs)
+func watchEventHubEvents(
+	ctx context.Context,
+	cs, group string,
+	since time.Time,
+	printEvent func(msg *common.Message) error,
+) error {
+	c, err := eventhub.DialConnectionStringContext(ctx, cs,
+		eventhub.WithWebSocket(wsFlag),
+	)
 	if err != nil {
 		return err
 	}
+	start := eventhub.WithSubscribeSince(since)
+	if offsetFlag != "" {
+		start = eventhub.WithSubscribeOffset(offsetFlag, false)
+	}
 	return c.Subscribe(ctx, func(m *eventhub.Event) error {
-		return output(iotservice.FromAMQPMessage(m.Message), nil)
+		return printEvent(iotservice.FromAMQPMessage(m.Message))
 	},
 		eventhub.WithSubscribeConsumerGroup(group),
-		eventhub.WithSubscribeSince(time.Now()),
+		eventhub.WithSubscribePartitions(partitionFlag...),
+		start,
 	)
 }
 
@@ -1119,12 +1665,32 @@ func cancelScheduleJob(ctx context.Context, c *iotservice.Client, args []string)
 	return output(c.CancelJobV2(ctx, args[0]))
 }
 
+// scheduleFlags sets flags shared by the job scheduling commands.
+func scheduleFlags(f *flag.FlagSet) {
+	f.StringVar(&jobIDFlag, "job-id", "", "unique job id, generated when empty")
+	f.StringVar(&queryFlag, "query-condition", "*", "devices query condition, e.g. \"tags.site = 'a'\"")
+	f.StringVar(&queryFlag, "query", "*", "alias for -query-condition")
+	f.Var((*internal.TimeFlag)(&startTimeFlag), "start-time", "start `time` in RFC3339, default is now")
+	f.UintVar(&maxExecTimeFlag, "exec-timeout", 30, "maximal execution time in seconds")
+}
+
+func scheduleStartTime() time.Time {
+	if startTimeFlag.IsZero() {
+		return time.Now()
+	}
+	return startTimeFlag
+}
+
 func scheduleMethodCall(ctx context.Context, c *iotservice.Client, args []string) error {
 	if jobIDFlag == "" {
 		jobIDFlag = genID()
 	}
+	b, err := internal.ReadArg(args[1])
+	if err != nil {
+		return err
+	}
 	var payload interface{}
-	if err := json.Unmarshal([]byte(args[1]), &payload); err != nil {
+	if err := json.Unmarshal(b, &payload); err != nil {
 		return err
 	}
 	return output(c.CreateJobV2(ctx, &iotservice.JobV2{
@@ -1136,7 +1702,7 @@ func scheduleMethodCall(ctx context.Context, c *iotservice.Client, args []string
 			TimeoutInSeconds: timeoutFlag,
 		},
 		QueryCondition:            queryFlag,
-		StartTime:                 startTimeFlag,
+		StartTime:                 scheduleStartTime(),
 		MaxExecutionTimeInSeconds: maxExecTimeFlag,
 	}))
 }
@@ -1145,23 +1711,25 @@ func scheduleTwinUpdate(ctx context.Context, c *iotservice.Client, args []string
 	if jobIDFlag == "" {
 		jobIDFlag = genID()
 	}
+	var tags, desired map[string]interface{}
+	if err := updateTwinMaps(&tags, &desired); err != nil {
+		return err
+	}
+	if len(tags) == 0 && len(desired) == 0 {
+		return errors.New("nothing to update, use -prop, -tag or -patch-file")
+	}
 	return output(c.CreateJobV2(ctx, &iotservice.JobV2{
 		JobID: jobIDFlag,
 		Type:  iotservice.JobTypeUpdateTwin,
-
-		// TODO: should be the same as updateTwin action, query is not applied here
 		UpdateTwin: map[string]interface{}{
-			"etag":     "*",
-			"deviceId": "",
-			"tags":     map[string]interface{}{},
+			"etag": "*",
+			"tags": tags,
 			"properties": map[string]interface{}{
-				"desired": map[string]interface{}{
-					"scheduled": 1,
-				},
+				"desired": desired,
 			},
 		},
 		QueryCondition:            queryFlag,
-		StartTime:                 startTimeFlag,
+		StartTime:                 scheduleStartTime(),
 		MaxExecutionTimeInSeconds: maxExecTimeFlag,
 	}))
 }
@@ -1,6 +1,12 @@
 package common
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -31,6 +37,10 @@ type Message struct {
 	// It contains the deviceId of the device that sent the message.
 	ConnectionDeviceID string `json:"ConnectionDeviceId,omitempty"`
 
+	// ConnectionModuleID is an ID set by IoT Hub or edgeHub on messages sent by modules.
+	// It contains the moduleId of the module that sent the message.
+	ConnectionModuleID string `json:"ConnectionModuleId,omitempty"`
+
 	// ConnectionDeviceGenerationID is an ID set by IoT Hub on device-to-cloud messages.
 	// It contains the generationId (as per Device identity properties)
 	// of the device that sent the message.
@@ -44,6 +54,28 @@ type Message struct {
 	// MessageSource determines a device-to-cloud message transport.
 	MessageSource string `json:"MessageSource,omitempty"`
 
+	// ContentType is the payload's content type, e.g. application/json,
+	// it's required for routing queries on the message body.
+	ContentType string `json:"ContentType,omitempty"`
+
+	// ContentEncoding is the payload's content encoding, e.g. utf-8.
+	ContentEncoding string `json:"ContentEncoding,omitempty"`
+
+	// OutputName is the module output a device-to-cloud message is sent to,
+	// it's used by IoT Edge routes, e.g. FROM /messages/modules/m/outputs/o.
+	OutputName string `json:"OutputName,omitempty"`
+
+	// InputName is the module input a message has been routed to by IoT Edge.
+	InputName string `json:"InputName,omitempty"`
+
+	// InterfaceID is the interface the message is sent on behalf of,
+	// e.g. Defender for IoT security messages.
+	InterfaceID string `json:"InterfaceId,omitempty"`
+
+	// ComponentName is the IoT Plug and Play component
+	// the telemetry belongs to, it's empty for the default component.
+	ComponentName string `json:"ComponentName,omitempty"`
+
 	// Payload is message data.
 	Payload []byte `json:"Payload,omitempty"`
 
@@ -60,3 +92,142 @@ type ConnectionAuthMethod struct {
 	Type   string `json:"type"`
 	Issuer string `json:"issuer"`
 }
+
+// MessageFormatVersion is the version of the MarshalMessage format.
+const MessageFormatVersion = 1
+
+type messageEnvelope struct {
+	Version int `json:"Version"`
+	*Message
+}
+
+// MarshalMessage encodes the message into the canonical JSON format
+// meant for persisting messages in offline queues and test fixtures
+// or passing them between processes.
+//
+// All system properties are preserved except TransportOptions, the payload
+// is base64 encoded, times are in UTC and property keys are sorted,
+// so equal messages always produce equal output.
+func MarshalMessage(msg *Message) ([]byte, error) {
+	m := *msg
+	m.ExpiryTime = utc(m.ExpiryTime)
+	m.EnqueuedTime = utc(m.EnqueuedTime)
+	return json.Marshal(&messageEnvelope{Version: MessageFormatVersion, Message: &m})
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// UnmarshalMessage decodes a message encoded with MarshalMessage.
+func UnmarshalMessage(b []byte) (*Message, error) {
+	env := messageEnvelope{Message: &Message{}}
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	if env.Version < 1 || env.Version > MessageFormatVersion {
+		return nil, fmt.Errorf("unsupported message format version %d", env.Version)
+	}
+	return env.Message, nil
+}
+
+// IoT Hub message size limits including system and application properties.
+const (
+	MaxD2CMessageSize = 256 * 1024
+	MaxC2DMessageSize = 64 * 1024
+)
+
+// ErrMessageTooLarge is returned by Message.Validate when
+// the message doesn't fit into the hub's size limit.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// Size returns the message size the way IoT Hub accounts it,
+// that is the payload plus values of system properties plus
+// names and values of application properties.
+func (m *Message) Size() int {
+	n := len(m.Payload)
+	for _, s := range []string{
+		m.MessageID, m.To, m.CorrelationID, m.UserID, m.ContentType,
+		m.ContentEncoding, m.OutputName, m.InterfaceID, m.ComponentName,
+	} {
+		n += len(s)
+	}
+	if m.ExpiryTime != nil {
+		n += len(m.ExpiryTime.UTC().Format(time.RFC3339Nano))
+	}
+	for k, v := range m.Properties {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// Validate checks that the message can be accepted by the hub before
+// it's sent, maxSize is MaxD2CMessageSize or MaxC2DMessageSize.
+//
+// Application property names must be non-empty and must not start with
+// reserved `$` and `iothub-` prefixes, except for system properties set
+// through the property bag like iothub-ack, names and values must not
+// contain control characters. Size errors wrap ErrMessageTooLarge.
+func (m *Message) Validate(maxSize int) error {
+	keys := make([]string, 0, len(m.Properties))
+	for k := range m.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch {
+		case k == "":
+			return errors.New("message property name is empty")
+		case !systemProperties[strings.ToLower(k)] && (strings.HasPrefix(k, "$") ||
+			strings.HasPrefix(strings.ToLower(k), "iothub-")):
+			return fmt.Errorf("message property %q: $ and iothub- prefixes are reserved", k)
+		case hasControlChars(k):
+			return fmt.Errorf("message property %q: name contains control characters", k)
+		case hasControlChars(m.Properties[k]):
+			return fmt.Errorf("message property %q: value contains control characters", k)
+		}
+	}
+	if n := m.Size(); n > maxSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, n, maxSize)
+	}
+	return nil
+}
+
+// systemProperties are reserved properties that are
+// legitimately passed in the property bag, e.g. by iotservice.WithSendAck.
+var systemProperties = map[string]bool{
+	"iothub-ack": true,
+}
+
+// ReadPayload reads a message payload of exactly size bytes from r into
+// a buffer. Sizes exceeding maxSize are rejected with ErrMessageTooLarge
+// before anything is read, bytes after size are left unread.
+func ReadPayload(r io.Reader, size int64, maxSize int) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative payload size %d", size)
+	}
+	if size > int64(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, size, maxSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read payload: %w", err)
+	}
+	return b, nil
+}
+
+func hasControlChars(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
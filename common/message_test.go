@@ -0,0 +1,115 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarshalMessage(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	want := &Message{
+		MessageID:          "1",
+		ExpiryTime:         &now,
+		EnqueuedTime:       &now,
+		ConnectionDeviceID: "dev",
+		ConnectionAuthMethod: &ConnectionAuthMethod{
+			Scope: "device", Type: "sas",
+		},
+		ContentType: "application/octet-stream",
+		Payload:     []byte{0x00, 0xff, 0x10},
+		Properties:  map[string]string{"b": "2", "a": "1"},
+	}
+	b, err := MarshalMessage(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := UnmarshalMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("UnmarshalMessage(MarshalMessage(want)) = %+v, want %+v", have, want)
+	}
+
+	// encoding is stable regardless of the time zone
+	local := now.In(time.FixedZone("X", 3600))
+	want.ExpiryTime = &local
+	c, err := MarshalMessage(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(c) {
+		t.Fatalf("MarshalMessage = %s, want %s", c, b)
+	}
+
+	if _, err = UnmarshalMessage([]byte(`{"Version":2}`)); err == nil {
+		t.Fatal("expected an error for unknown versions")
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	msg := &Message{
+		MessageID:  "1",
+		Payload:    []byte("hello"),
+		Properties: map[string]string{"a": "bc"},
+	}
+	if n := msg.Size(); n != 9 {
+		t.Errorf("Size() = %d, want 9", n)
+	}
+	if err := msg.Validate(MaxD2CMessageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, props := range map[string]map[string]string{
+		"empty":   {"": "v"},
+		"dollar":  {"$to": "v"},
+		"iothub":  {"IoTHub-status": "v"},
+		"control": {"k": "a\nb"},
+	} {
+		m := &Message{Properties: props}
+		if err := m.Validate(MaxD2CMessageSize); err == nil {
+			t.Errorf("%s: Validate() = nil, want an error", name)
+		}
+	}
+
+	msg = &Message{Properties: map[string]string{"iothub-ack": "full"}}
+	if err := msg.Validate(MaxC2DMessageSize); err != nil {
+		t.Errorf("Validate() with iothub-ack = %v, want nil", err)
+	}
+
+	msg = &Message{Payload: bytes.Repeat([]byte{'a'}, MaxC2DMessageSize+1)}
+	if err := msg.Validate(MaxD2CMessageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Validate(MaxC2DMessageSize); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Validate() = %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestReadPayload(t *testing.T) {
+	r := strings.NewReader("hello world")
+	b, err := ReadPayload(r, 5, MaxD2CMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" || r.Len() != 6 {
+		t.Errorf("payload = %q, %d bytes left, want %q, 6", b, r.Len(), "hello")
+	}
+	if _, err = ReadPayload(strings.NewReader("hi"), 5, MaxD2CMessageSize); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("short read error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err = ReadPayload(strings.NewReader(""), 5, MaxD2CMessageSize); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("empty read error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err = ReadPayload(r, MaxC2DMessageSize+1, MaxC2DMessageSize); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("large payload error = %v, want %v", err, ErrMessageTooLarge)
+	}
+	if r.Len() != 6 {
+		t.Errorf("rejected payload is read")
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewRateLimiter creates a token bucket limiter that allows rate events
+// per second on average with bursts of up to burst events, the bucket
+// starts full. Panics when rate isn't positive or burst is less than one.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		panic("rate must be positive")
+	}
+	if burst < 1 {
+		panic("burst must be at least one")
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// RateLimiter is a token bucket rate limiter safe for concurrent use,
+// waiters are served in the order they call Wait.
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64 // negative when tokens are reserved by waiters
+	last   time.Time
+}
+
+// Wait blocks until an event is allowed or the context is done,
+// in the latter case the reserved token is returned to the bucket.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(50, 5)
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 5 burst events are immediate and 10 more take 200ms at 50/s
+	if d := time.Since(start); d < 180*time.Millisecond || d > time.Second {
+		t.Errorf("15 events took %s, want about 200ms", d)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	l = NewRateLimiter(1, 1)
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the cancelled waiter's token is returned
+	if l.tokens < -0.1 {
+		t.Errorf("tokens = %f, want about zero", l.tokens)
+	}
+}
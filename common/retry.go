@@ -0,0 +1,29 @@
+package common
+
+import "time"
+
+// Retry calls fn until it succeeds or the given number of attempts is
+// exhausted, waiting backoff between attempts that's doubled after each
+// failure up to maxBackoff. It returns the last error early when done
+// is closed, fn receives the attempt number starting with 1.
+func Retry(
+	done <-chan struct{}, attempts int, backoff, maxBackoff time.Duration,
+	fn func(attempt int) error,
+) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-done:
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
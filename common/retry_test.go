@@ -0,0 +1,41 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	fail := errors.New("fail")
+	var n int
+	if err := Retry(nil, 5, time.Millisecond, 2*time.Millisecond, func(attempt int) error {
+		if n++; attempt != n {
+			t.Errorf("attempt = %d, want %d", attempt, n)
+		}
+		if n < 3 {
+			return fail
+		}
+		return nil
+	}); err != nil || n != 3 {
+		t.Errorf("Retry = %v after %d attempts, want nil after 3", err, n)
+	}
+
+	n = 0
+	if err := Retry(nil, 4, time.Millisecond, time.Millisecond, func(int) error {
+		n++
+		return fail
+	}); err != fail || n != 4 {
+		t.Errorf("Retry = %v after %d attempts, want %v after 4", err, n, fail)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	n = 0
+	if err := Retry(done, 5, time.Hour, time.Hour, func(int) error {
+		n++
+		return fail
+	}); err != fail || n != 1 {
+		t.Errorf("Retry = %v after %d attempts, want %v after 1", err, n, fail)
+	}
+}
@@ -1,75 +1,158 @@
 package common
 
 import (
-	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
+// Connection string key errors wrapped by ConnectionStringError.
+var (
+	ErrMissingKey   = errors.New("is required")
+	ErrDuplicateKey = errors.New("is duplicated")
+	ErrUnknownKey   = errors.New("is not supported")
+)
+
+// ConnectionStringError is returned when a connection string key is
+// missing, duplicated or unknown, Err is one of ErrMissingKey,
+// ErrDuplicateKey and ErrUnknownKey.
+type ConnectionStringError struct {
+	Key string
+	Err error
+}
+
+func (e *ConnectionStringError) Error() string {
+	return fmt.Sprintf("connection string: %s %s", e.Key, e.Err)
+}
+
+func (e *ConnectionStringError) Unwrap() error {
+	return e.Err
+}
+
 // ParseConnectionString parses the given connection string into a key-value map,
 // returns an error if at least one of required keys is missing.
+// Unknown keys are kept and the last value of duplicated keys wins.
 func ParseConnectionString(cs string, require ...string) (map[string]string, error) {
+	return parseConnectionString(cs, false, require)
+}
+
+// ParseConnectionStringStrict is ParseConnectionString that also
+// rejects duplicated keys and keys that are neither required nor optional.
+func ParseConnectionStringStrict(
+	cs string, require []string, optional ...string,
+) (map[string]string, error) {
+	m, err := parseConnectionString(cs, true, require)
+	if err != nil {
+		return nil, err
+	}
+Loop:
+	for k := range m {
+		for _, known := range [][]string{require, optional} {
+			for _, s := range known {
+				if k == s {
+					continue Loop
+				}
+			}
+		}
+		return nil, &ConnectionStringError{Key: k, Err: ErrUnknownKey}
+	}
+	return m, nil
+}
+
+func parseConnectionString(cs string, strict bool, require []string) (map[string]string, error) {
 	m := map[string]string{}
 	for _, s := range strings.Split(cs, ";") {
 		if s == "" {
 			continue
 		}
 		kv := strings.SplitN(s, "=", 2)
-		if len(kv) != 2 {
+		if len(kv) != 2 || kv[0] == "" {
 			return nil, errors.New("malformed connection string")
 		}
+		if _, ok := m[kv[0]]; ok && strict {
+			return nil, &ConnectionStringError{Key: kv[0], Err: ErrDuplicateKey}
+		}
 		m[kv[0]] = kv[1]
 	}
 	for _, k := range require {
 		if s := m[k]; s == "" {
-			return nil, fmt.Errorf("%s is required", k)
+			return nil, &ConnectionStringError{Key: k, Err: ErrMissingKey}
 		}
 	}
 	return m, nil
 }
 
-func GetEdgeModuleEnvironmentVariables() (map[string]string, error) {
-	m := map[string]string{}
-
-	require := []string{
-		"ContainerHostName",
-		"IOTHubHostName",
-		"GatewayHostName",
-		"DeviceID",
-		"ModuleID",
-		"GenerationID",
-		"WorkloadAPI",
-		"APIVersion",
+// BuildConnectionString joins the given key-value pairs
+// into a connection string, pairs with empty values are skipped.
+func BuildConnectionString(kv ...string) (string, error) {
+	if len(kv)%2 != 0 {
+		return "", errors.New("odd number of connection string arguments")
 	}
+	var b strings.Builder
+	for i := 0; i < len(kv); i += 2 {
+		if kv[i+1] == "" {
+			continue
+		}
+		if strings.ContainsAny(kv[i], ";=") || strings.Contains(kv[i+1], ";") {
+			return "", fmt.Errorf("connection string: %s contains a reserved character", kv[i])
+		}
+		if b.Len() != 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(kv[i])
+		b.WriteByte('=')
+		b.WriteString(kv[i+1])
+	}
+	return b.String(), nil
+}
 
-	m["ContainerHostName"] = os.Getenv("HOSTNAME")
-	m["IOTHubHostName"] = os.Getenv("IOTEDGE_IOTHUBHOSTNAME")
-	m["GatewayHostName"] = os.Getenv("IOTEDGE_GATEWAYHOSTNAME")
-	m["DeviceID"] = os.Getenv("IOTEDGE_DEVICEID")
-	m["ModuleID"] = os.Getenv("IOTEDGE_MODULEID")
-	m["GenerationID"] = os.Getenv("IOTEDGE_MODULEGENERATIONID")
-	m["WorkloadAPI"] = os.Getenv("IOTEDGE_WORKLOADURI")
-	m["APIVersion"] = os.Getenv("IOTEDGE_APIVERSION")
+// edgeModuleEnv maps IoT Edge module environment variables
+// to keys of the map returned by GetEdgeModuleEnvironmentVariables.
+var edgeModuleEnv = []struct {
+	key      string
+	env      string
+	required bool
+}{
+	{"ContainerHostName", "HOSTNAME", false},
+	{"IOTHubHostName", "IOTEDGE_IOTHUBHOSTNAME", true},
+	{"GatewayHostName", "IOTEDGE_GATEWAYHOSTNAME", false},
+	{"DeviceID", "IOTEDGE_DEVICEID", true},
+	{"ModuleID", "IOTEDGE_MODULEID", true},
+	{"GenerationID", "IOTEDGE_MODULEGENERATIONID", true},
+	{"WorkloadAPI", "IOTEDGE_WORKLOADURI", true},
+	{"APIVersion", "IOTEDGE_APIVERSION", true},
+	{"AuthScheme", "IOTEDGE_AUTHSCHEME", false},
+	{"ManagementAPI", "IOTEDGE_MANAGEMENTURI", false},
+}
 
-	for _, k := range require {
-		if s := m[k]; s == "" {
-			return nil, fmt.Errorf("%s is required", k)
+// GetEdgeModuleEnvironmentVariables reads environment variables the IoT Edge
+// runtime passes to modules. IOTHubHostName is the hub the module identity
+// belongs to, it's used for token audiences, while GatewayHostName is the
+// edgeHub host modules connect to, it's missing when running outside of a gateway.
+func GetEdgeModuleEnvironmentVariables() (map[string]string, error) {
+	m := make(map[string]string, len(edgeModuleEnv))
+	for _, v := range edgeModuleEnv {
+		m[v.key] = os.Getenv(v.env)
+		if v.required && m[v.key] == "" {
+			return nil, fmt.Errorf(
+				"%s environment variable is required, make sure the module is run by the IoT Edge runtime",
+				v.env,
+			)
 		}
 	}
+	if m["AuthScheme"] != "" && m["AuthScheme"] != "sasToken" {
+		return nil, fmt.Errorf(
+			"unsupported IOTEDGE_AUTHSCHEME %q, only sasToken is supported", m["AuthScheme"],
+		)
+	}
 	return m, nil
 }
 
@@ -147,6 +230,52 @@ func (sas *SharedAccessSignature) String() string {
 	return s
 }
 
+// ParseSharedAccessSignature parses a token produced by String, e.g.
+// SharedAccessSignature sr=hub.azure-devices.net&sig=...&se=1546308061&skn=owner.
+func ParseSharedAccessSignature(s string) (*SharedAccessSignature, error) {
+	const prefix = "SharedAccessSignature "
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("shared access signature: missing prefix")
+	}
+	q, err := url.ParseQuery(s[len(prefix):])
+	if err != nil {
+		return nil, fmt.Errorf("shared access signature: %w", err)
+	}
+	for _, k := range []string{"sr", "sig", "se"} {
+		if q.Get(k) == "" {
+			return nil, fmt.Errorf("shared access signature: %s is required", k)
+		}
+	}
+	se, err := strconv.ParseInt(q.Get("se"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("shared access signature: malformed se: %w", err)
+	}
+	return &SharedAccessSignature{
+		Sr:  q.Get("sr"),
+		Sig: q.Get("sig"),
+		Se:  time.Unix(se, 0),
+		Skn: q.Get("skn"),
+	}, nil
+}
+
+// NewSharedAccessSignatureWithSigner is NewSharedAccessSignature that delegates
+// HMAC-SHA256 signing to sign, e.g. a hardware security module or a TPM,
+// so the key never has to be loaded into process memory.
+func NewSharedAccessSignatureWithSigner(
+	resource, policy string, expiry time.Time, sign func(data []byte) ([]byte, error),
+) (*SharedAccessSignature, error) {
+	digest, err := sign([]byte(url.QueryEscape(resource) + "\n" + strconv.FormatInt(expiry.Unix(), 10)))
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return &SharedAccessSignature{
+		Sr:  resource,
+		Sig: base64.StdEncoding.EncodeToString(digest),
+		Se:  expiry,
+		Skn: policy,
+	}, nil
+}
+
 // EDGE MODULE AUTOMATIC AUTHENTICATION
 
 // TokenFromEdge generates a shared access signature for the named resource and lifetime using the Workload API sign endpoint
@@ -175,11 +304,16 @@ func NewSharedAccessSignatureFromEdge(
 }
 
 func mksigViaEdge(workloadURI, resource, module, genid string, se time.Time) (string, error) {
+	c, err := sharedWorkloadClient(workloadURI)
+	if err != nil {
+		return "", fmt.Errorf("sign: unable to sign request: %w", err)
+	}
 	data := url.QueryEscape(resource) + "\n" + strconv.FormatInt(se.Unix(), 10)
-	request := &EdgeSignRequestPayload{
-		Data: base64.StdEncoding.EncodeToString([]byte(data)),
+	digest, err := c.Sign(context.Background(), module, genid, "primary", []byte(data))
+	if err != nil {
+		return "", fmt.Errorf("sign: unable to sign request: %w", err)
 	}
-	return edgeSignRequest(workloadURI, module, genid, request)
+	return base64.StdEncoding.EncodeToString(digest), nil
 }
 
 // EdgeSignRequestPayload is a placeholder object for sign requests.
@@ -211,86 +345,3 @@ type EdgeSignRequestResponse struct {
 	Digest  string `json:"digest"`
 	Message string `json:"message"`
 }
-
-var (
-	sharedUnixHTTPClient http.Client
-	doOnce               sync.Once
-)
-
-func setSharedUnixHTTPClient(addrName string) {
-	doOnce.Do(func() {
-		sharedUnixHTTPClient = http.Client{
-			Transport: &http.Transport{
-				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-					return net.Dial("unix", addrName)
-				},
-			},
-		}
-	})
-}
-
-func edgeSignRequest(workloadURI, name, genid string, payload *EdgeSignRequestPayload) (string, error) {
-	esrr := EdgeSignRequestResponse{}
-
-	// validate payload properties
-	err := payload.Validate()
-	if err != nil {
-		return "", fmt.Errorf("sign: unable to sign request: %w", err)
-	}
-
-	payloadJSON, _ := json.Marshal(payload)
-
-	// catch unix domain sockets URIs
-	if strings.Contains(workloadURI, "unix://") {
-		addr, err := net.ResolveUnixAddr("unix", strings.TrimPrefix(workloadURI, "unix://"))
-		if err != nil {
-			fmt.Printf("Failed to resolve: %v\n", err)
-			return "", err
-		}
-
-		setSharedUnixHTTPClient(addr.Name)
-		response, err := sharedUnixHTTPClient.Post("http://iotedge"+fmt.Sprintf("/modules/%s/genid/%s/sign?api-version=2018-06-28", name, genid), "application/json", bytes.NewBuffer(payloadJSON))
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (resp): %w", err)
-		}
-		defer response.Body.Close()
-
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (read): %w", err)
-		}
-
-		err = json.Unmarshal(body, &esrr)
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (unm): %w", err)
-		}
-	} else {
-		// format uri string for base uri
-		uri := fmt.Sprintf("%smodules/%s/genid/%s/sign?api-version=2018-06-28", workloadURI, name, genid)
-
-		// get http response and handle error
-		resp, err := http.Post(uri, "application/json", bytes.NewBuffer(payloadJSON))
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (resp): %w", err)
-		}
-		defer resp.Body.Close()
-
-		// read response
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (read): %w", err)
-		}
-
-		err = json.Unmarshal(body, &esrr)
-		if err != nil {
-			return "", fmt.Errorf("sign: unable to sign request (unm): %w", err)
-		}
-	}
-
-	// if error returned from WorkloadAPI
-	if len(esrr.Message) > 0 {
-		return "", fmt.Errorf("sign: unable to sign request: %s", esrr.Message)
-	}
-
-	return esrr.Digest, nil
-}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -25,6 +26,48 @@ func TestParseConnectionString(t *testing.T) {
 	}
 }
 
+func TestParseConnectionStringErrors(t *testing.T) {
+	for cs, want := range map[string]error{
+		"DeviceId=foo;DeviceId=bar;SharedAccessKey=baz": ErrDuplicateKey,
+		"DeviceId=foo": ErrMissingKey,
+		"DeviceId=foo;SharedAccessKey=baz;Foo=bar": ErrUnknownKey,
+	} {
+		_, err := ParseConnectionStringStrict(cs, []string{"DeviceId", "SharedAccessKey"})
+		if !errors.Is(err, want) {
+			t.Errorf("ParseConnectionStringStrict(%q) = %v, want %v", cs, err, want)
+		}
+	}
+}
+
+func TestParseConnectionStringLenient(t *testing.T) {
+	m, err := ParseConnectionString("DeviceId=foo;DeviceId=bar;Foo=baz", "DeviceId")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["DeviceId"] != "bar" || m["Foo"] != "baz" {
+		t.Fatalf("ParseConnectionString = %v", m)
+	}
+}
+
+func TestBuildConnectionString(t *testing.T) {
+	cs, err := BuildConnectionString(
+		"HostName", "test.azure-devices.net",
+		"DeviceId", "foo",
+		"ModuleId", "",
+		"SharedAccessKey", "c2VjcmV0==",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "HostName=test.azure-devices.net;DeviceId=foo;SharedAccessKey=c2VjcmV0=="
+	if cs != want {
+		t.Fatalf("BuildConnectionString = %q, want %q", cs, want)
+	}
+	if _, err = BuildConnectionString("DeviceId", "foo;bar"); err == nil {
+		t.Fatal("expected an error for values with semicolons")
+	}
+}
+
 func TestNewSharedAccessKey(t *testing.T) {
 	sak := NewSharedAccessKey("test.azure-devices.net", "owner", "c2VjcmV0")
 	if _, err := sak.Token(sak.HostName, time.Hour); err != nil {
@@ -51,3 +94,58 @@ func TestNewSharedAccessSignature(t *testing.T) {
 		t.Fatalf("%#v.String() = %q, want %q", sas, have, want)
 	}
 }
+
+func TestParseSharedAccessSignature(t *testing.T) {
+	sas, err := NewSharedAccessSignature(
+		"test.azure-devices.net",
+		"owner",
+		"c2VjcmV0",
+		time.Date(2019, 1, 1, 1, 1, 1, 0, time.UTC),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ParseSharedAccessSignature(sas.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.String() != sas.String() {
+		t.Fatalf("ParseSharedAccessSignature(%q) = %q", sas, have)
+	}
+	if _, err = ParseSharedAccessSignature("sr=test&sig=abc&se=1"); err == nil {
+		t.Fatal("expected an error for tokens without the prefix")
+	}
+}
+
+func TestGetEdgeModuleEnvironmentVariables(t *testing.T) {
+	for k, v := range map[string]string{
+		"IOTEDGE_IOTHUBHOSTNAME":     "hub.azure-devices.net",
+		"IOTEDGE_GATEWAYHOSTNAME":    "gateway",
+		"IOTEDGE_DEVICEID":           "dev",
+		"IOTEDGE_MODULEID":           "mod",
+		"IOTEDGE_MODULEGENERATIONID": "1",
+		"IOTEDGE_WORKLOADURI":        "unix:///var/run/iotedge/workload.sock",
+		"IOTEDGE_APIVERSION":         "2019-01-30",
+		"IOTEDGE_AUTHSCHEME":         "sasToken",
+	} {
+		t.Setenv(k, v)
+	}
+	m, err := GetEdgeModuleEnvironmentVariables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["IOTHubHostName"] != "hub.azure-devices.net" || m["GatewayHostName"] != "gateway" {
+		t.Errorf("unexpected hostnames: %v", m)
+	}
+
+	t.Setenv("IOTEDGE_AUTHSCHEME", "x509")
+	if _, err = GetEdgeModuleEnvironmentVariables(); err == nil {
+		t.Error("expected an error for unsupported auth scheme")
+	}
+
+	t.Setenv("IOTEDGE_AUTHSCHEME", "")
+	t.Setenv("IOTEDGE_DEVICEID", "")
+	if _, err = GetEdgeModuleEnvironmentVariables(); err == nil {
+		t.Error("expected an error for missing device id")
+	}
+}
@@ -1,13 +1,14 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
-	"net/http"
-	"strings"
+	"os"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 // DigiCert Baltimore Root (sha1 fingerprint=d4de20d05e66fc53fe1a50882c78db2852cae474) - remove post migration circa early 2023
@@ -295,7 +296,12 @@ RA+GsCyRxj3qrg+E
 -----END CERTIFICATE-----
 `)
 
-// RootCAs root CA certificates pool for connecting to the cloud.
+// RootCAsFileEnv is the environment variable with a path to a PEM file
+// which certificates are added to RootCAs, e.g. ones of a TLS-inspecting proxy.
+const RootCAsFileEnv = "IOTHUB_ROOT_CA_FILE"
+
+// RootCAs root CA certificates pool for connecting to the cloud,
+// it consists of the bundled certificates only, see LoadRootCAs.
 func RootCAs() *x509.CertPool {
 	p := x509.NewCertPool()
 	if ok := p.AppendCertsFromPEM(caCerts); !ok {
@@ -304,67 +310,133 @@ func RootCAs() *x509.CertPool {
 	return p
 }
 
-// TrustBundleResponse aids parsing the response from the edge.
-type TrustBundleResponse struct {
-	Certificate string `json:"certificate"`
+// LoadRootCAs returns the bundled root CA certificates pool extended with
+// the ones from IOTHUB_ROOT_CA_FILE when it's set, clients use it by default.
+func LoadRootCAs() (*x509.CertPool, error) {
+	return NewRootCAs(WithCAFile(os.Getenv(RootCAsFileEnv)))
 }
 
-// TrustBundle root CA certificates pool for connecting to EdgeHub Gateway.
-func TrustBundle(workloadURI string) (*x509.CertPool, error) {
-	tbr := TrustBundleResponse{}
-	var err error
+// RootCAsOption is a NewRootCAs option.
+type RootCAsOption func(c *rootCAsConfig)
 
-	// catch unix domain sockets URIs
-	if strings.Contains(workloadURI, "unix://") {
-		addr, err := net.ResolveUnixAddr("unix", strings.TrimPrefix(workloadURI, "unix://"))
-		if err != nil {
-			fmt.Printf("Failed to resolve: %v\n", err)
-			return nil, err
-		}
+type rootCAsConfig struct {
+	system   bool
+	nobundle bool
+	files    []string
+	pems     [][]byte
+}
 
-		setSharedUnixHTTPClient(addr.Name)
-		response, err := sharedUnixHTTPClient.Get("http://iotedge" + "/trust-bundle?api-version=2019-11-05")
-		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
-		}
-		defer response.Body.Close()
+// WithSystemRoots merges the operating system trust store into the pool.
+func WithSystemRoots() RootCAsOption {
+	return func(c *rootCAsConfig) {
+		c.system = true
+	}
+}
 
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
-		}
+// WithoutBundledRoots excludes the bundled certificates from the pool.
+func WithoutBundledRoots() RootCAsOption {
+	return func(c *rootCAsConfig) {
+		c.nobundle = true
+	}
+}
 
-		err = json.Unmarshal(body, &tbr)
-		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
+// WithCAFile adds certificates from the named PEM file, empty path is ignored.
+func WithCAFile(path string) RootCAsOption {
+	return func(c *rootCAsConfig) {
+		if path != "" {
+			c.files = append(c.files, path)
 		}
-	} else {
-		// format uri string
-		uri := fmt.Sprintf("%strust-bundle?api-version=2019-11-05", workloadURI)
+	}
+}
 
-		// get http response and handle error
-		resp, err := http.Get(uri)
-		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
-		}
-		defer resp.Body.Close()
+// WithCAPEM adds PEM encoded certificates.
+func WithCAPEM(pem []byte) RootCAsOption {
+	return func(c *rootCAsConfig) {
+		c.pems = append(c.pems, pem)
+	}
+}
+
+// NewRootCAs creates a certificates pool of the bundled root CAs
+// extended or replaced with the ones the options specify.
+func NewRootCAs(opts ...RootCAsOption) (*x509.CertPool, error) {
+	var c rootCAsConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
 
-		// read response
-		body, err := io.ReadAll(resp.Body)
+	p := x509.NewCertPool()
+	if c.system {
+		sp, err := x509.SystemCertPool()
 		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
+			return nil, fmt.Errorf("tls: unable to load system certificates: %w", err)
 		}
-
-		err = json.Unmarshal(body, &tbr)
+		p = sp
+	}
+	if !c.nobundle {
+		if ok := p.AppendCertsFromPEM(caCerts); !ok {
+			return nil, errors.New("tls: unable to append certificates")
+		}
+	}
+	for _, path := range c.files {
+		b, err := os.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		if ok := p.AppendCertsFromPEM(b); !ok {
+			return nil, fmt.Errorf("tls: no certificates found in %s", path)
 		}
 	}
+	for _, b := range c.pems {
+		if ok := p.AppendCertsFromPEM(b); !ok {
+			return nil, errors.New("tls: no certificates found in pem")
+		}
+	}
+	return p, nil
+}
 
-	p := x509.NewCertPool()
-	if ok := p.AppendCertsFromPEM([]byte(tbr.Certificate)); !ok {
-		err = fmt.Errorf("tls: unable to append certificates: count not append certs to pool")
+// TrustBundleResponse aids parsing the response from the edge.
+type TrustBundleResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+// TrustBundle root CA certificates pool for connecting to EdgeHub Gateway.
+func TrustBundle(workloadURI string) (*x509.CertPool, error) {
+	c, err := sharedWorkloadClient(workloadURI)
+	if err != nil {
+		return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
+	}
+	p, err := c.TrustBundle(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("tls: unable to append certificates: %w", err)
 	}
+	return p, nil
+}
 
-	return p, err
+// LoadPKCS12 reads a client certificate from the PKCS#12 (PFX) file,
+// see ParsePKCS12.
+func LoadPKCS12(path, password string) (*tls.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePKCS12(b, password)
+}
+
+// ParsePKCS12 decodes a PKCS#12 bundle with a private key and a certificate
+// chain that's commonly used for provisioning device identities, CA
+// certificates of the bundle are sent along with the leaf certificate.
+func ParsePKCS12(data []byte, password string) (*tls.Certificate, error) {
+	key, crt, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{
+		Certificate: [][]byte{crt.Raw},
+		PrivateKey:  key,
+		Leaf:        crt,
+	}
+	for _, ca := range chain {
+		c.Certificate = append(c.Certificate, ca.Raw)
+	}
+	return c, nil
 }
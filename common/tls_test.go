@@ -1,9 +1,20 @@
 package common
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func TestRootCAs(t *testing.T) {
@@ -25,6 +36,13 @@ func TestRootCAs(t *testing.T) {
 	defer res.Body.Close()
 }
 
+func TestLoadRootCAsMalformedFile(t *testing.T) {
+	t.Setenv(RootCAsFileEnv, filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := LoadRootCAs(); err == nil {
+		t.Fatal("LoadRootCAs error is nil")
+	}
+}
+
 func TestNewRootCAs(t *testing.T) {
 	// See validation steps here:
 	// https://techcommunity.microsoft.com/t5/internet-of-things-blog/azure-iot-tls-critical-changes-are-almost-here-and-why-you/ba-p/2393169
@@ -46,3 +64,58 @@ func TestNewRootCAs(t *testing.T) {
 	}
 	defer res.Body.Close()
 }
+
+func TestNewRootCAsOptions(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(name, caCerts, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRootCAs(WithoutBundledRoots(), WithCAFile(name)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRootCAs(WithCAFile(name + ".missing")); err == nil {
+		t.Fatal("expected an error for missing files")
+	}
+	if _, err := NewRootCAs(WithCAPEM([]byte("garbage"))); err == nil {
+		t.Fatal("expected an error for malformed pem")
+	}
+}
+
+func TestParsePKCS12(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "golang-device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := pkcs12.Modern.Encode(key, crt, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "device.p12")
+	if err = os.WriteFile(path, pfx, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadPKCS12(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Leaf.Subject.CommonName != "golang-device" || len(c.Certificate) != 1 || !key.Equal(c.PrivateKey) {
+		t.Errorf("unexpected certificate %+v", c)
+	}
+	if _, err = LoadPKCS12(path, "wrong"); err == nil {
+		t.Error("LoadPKCS12 with a wrong password = nil error")
+	}
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenFunc generates a shared access signature for the named resource and lifetime,
+// SharedAccessKey.Token and transport credentials' Token methods satisfy it.
+type TokenFunc func(resource string, lifetime time.Duration) (*SharedAccessSignature, error)
+
+// NewTokenCache creates a cache that generates tokens of the given lifetime
+// with gen and keeps them by audience, tokens are renewed in the background
+// when a quarter of their lifetime is left, so callers rarely wait for them.
+//
+// Tokens that haven't been requested since the previous renewal are evicted.
+func NewTokenCache(gen TokenFunc, lifetime time.Duration) *TokenCache {
+	return &TokenCache{
+		gen:      gen,
+		lifetime: lifetime,
+		tokens:   map[string]*cachedToken{},
+		calls:    map[string]*tokenCall{},
+	}
+}
+
+// TokenCache is a shared access signatures cache safe for concurrent use.
+type TokenCache struct {
+	gen      TokenFunc
+	lifetime time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+	calls  map[string]*tokenCall // in-progress generations by resource
+	closed bool
+}
+
+// tokenCall is a token generation that concurrent
+// Token calls for the same resource wait for.
+type tokenCall struct {
+	done chan struct{}
+	sas  *SharedAccessSignature
+	err  error
+}
+
+type cachedToken struct {
+	sas   *SharedAccessSignature
+	used  bool // requested since it was generated
+	timer *time.Timer
+}
+
+// Token returns a cached token for the resource when it's valid for
+// at least an eighth of the lifetime, otherwise it generates a new one.
+//
+// Tokens are generated without holding the lock, since it may involve
+// network calls, e.g. to the edge workload API, so callers requesting
+// other resources aren't blocked, concurrent callers requesting the
+// same resource wait for a single generation.
+func (c *TokenCache) Token(resource string) (*SharedAccessSignature, error) {
+	c.mu.Lock()
+	if t, ok := c.tokens[resource]; ok && time.Until(t.sas.Se) > c.lifetime/8 {
+		t.used = true
+		c.mu.Unlock()
+		return t.sas, nil
+	}
+	if call, ok := c.calls[resource]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.sas, call.err
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	c.calls[resource] = call
+	c.mu.Unlock()
+
+	call.sas, call.err = c.gen(resource, c.lifetime)
+
+	c.mu.Lock()
+	delete(c.calls, resource)
+	if call.err == nil && !c.closed {
+		c.store(resource, call.sas).used = true
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.sas, call.err
+}
+
+// store must be called with the mutex held.
+func (c *TokenCache) store(resource string, sas *SharedAccessSignature) *cachedToken {
+	if t, ok := c.tokens[resource]; ok {
+		t.timer.Stop()
+	}
+	t := &cachedToken{sas: sas}
+	t.timer = time.AfterFunc(time.Until(sas.Se)-c.lifetime/4, func() {
+		c.renew(resource, t)
+	})
+	c.tokens[resource] = t
+	return t
+}
+
+func (c *TokenCache) renew(resource string, t *cachedToken) {
+	c.mu.Lock()
+	if c.closed || c.tokens[resource] != t {
+		c.mu.Unlock()
+		return
+	}
+	if !t.used {
+		delete(c.tokens, resource)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	// failures are ignored, Token regenerates it when it's about to expire
+	sas, err := c.gen(resource, c.lifetime)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed && c.tokens[resource] == t {
+		c.store(resource, sas)
+	}
+}
+
+// Close stops background renewals and drops cached tokens,
+// subsequent Token calls generate tokens every time.
+func (c *TokenCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for resource, t := range c.tokens {
+		t.timer.Stop()
+		delete(c.tokens, resource)
+	}
+	c.closed = true
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenCache(t *testing.T) {
+	var n int32
+	c := NewTokenCache(func(resource string, lifetime time.Duration) (*SharedAccessSignature, error) {
+		atomic.AddInt32(&n, 1)
+		return &SharedAccessSignature{Sr: resource, Se: time.Now().Add(lifetime)}, nil
+	}, 200*time.Millisecond)
+	defer c.Close()
+
+	a, err := c.Token("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Token("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b || atomic.LoadInt32(&n) != 1 {
+		t.Fatalf("token has been generated %d times, want once", n)
+	}
+
+	// used tokens are renewed in the background
+	time.Sleep(180 * time.Millisecond)
+	if have := atomic.LoadInt32(&n); have != 2 {
+		t.Fatalf("token has been generated %d times, want 2", have)
+	}
+	if b, _ = c.Token("a"); a == b {
+		t.Fatal("token hasn't been renewed")
+	}
+}
+
+func TestTokenCacheConcurrentGeneration(t *testing.T) {
+	var n int32
+	unblock := make(chan struct{})
+	c := NewTokenCache(func(resource string, lifetime time.Duration) (*SharedAccessSignature, error) {
+		atomic.AddInt32(&n, 1)
+		if resource == "slow" {
+			<-unblock
+		}
+		return &SharedAccessSignature{Sr: resource, Se: time.Now().Add(lifetime)}, nil
+	}, time.Hour)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	tokens := make([]*SharedAccessSignature, 3)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sas, err := c.Token("slow")
+			if err != nil {
+				t.Error(err)
+			}
+			tokens[i] = sas
+		}(i)
+	}
+
+	// other resources aren't blocked by the slow generation
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Token("fast")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("generating a token blocks other resources")
+	}
+
+	close(unblock)
+	wg.Wait()
+	for _, sas := range tokens[1:] {
+		if sas != tokens[0] {
+			t.Fatal("concurrent callers got different tokens")
+		}
+	}
+	if have := atomic.LoadInt32(&n); have != 2 {
+		t.Errorf("tokens have been generated %d times, want 2", have)
+	}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AMQPWebSocketSubprotocol is the websocket subprotocol of AMQP 1.0.
+const AMQPWebSocketSubprotocol = "AMQPWSB10"
+
+// DialAMQPWebSocket connects to the given wss:// url and returns
+// a net.Conn that transfers AMQP frames in binary websocket messages,
+// it's meant to be used with amqp.NewConn where port 5671 is blocked.
+func DialAMQPWebSocket(ctx context.Context, url string, tlsCfg *tls.Config) (net.Conn, error) {
+	d := websocket.Dialer{
+		TLSClientConfig:  tlsCfg,
+		Subprotocols:     []string{AMQPWebSocketSubprotocol},
+		HandshakeTimeout: 45 * time.Second,
+	}
+	ws, res, err := d.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = res.Body.Close()
+	return &wsConn{ws: ws}, nil
+}
+
+// wsConn adapts a websocket connection to net.Conn.
+type wsConn struct {
+	ws *websocket.Conn
+	r  io.Reader // current message reader
+
+	wmu sync.Mutex
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			typ, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workload API versions differ per endpoint, older edge daemons
+// don't support newer versions of the endpoints they implement.
+const (
+	signAPIVersion        = "2018-06-28"
+	trustBundleAPIVersion = "2019-11-05"
+	cryptoAPIVersion      = "2019-01-30" // encrypt, decrypt and certificates
+	identityAPIVersion    = "2018-06-28"
+)
+
+// WorkloadClient is an IoT Edge workload API client, it talks to
+// the security daemon over unix domain sockets or HTTP depending
+// on the URI scheme, e.g. unix:///var/run/iotedge/workload.sock.
+//
+// It can also be used with the management API URI
+// (IOTEDGE_MANAGEMENTURI) for listing identities.
+type WorkloadClient struct {
+	base   string
+	client *http.Client
+}
+
+// NewWorkloadClient creates a workload API client for the given URI,
+// that's usually the IOTEDGE_WORKLOADURI environment variable.
+func NewWorkloadClient(workloadURI string) (*WorkloadClient, error) {
+	u, err := url.Parse(workloadURI)
+	if err != nil {
+		return nil, fmt.Errorf("workload: malformed uri: %w", err)
+	}
+	switch u.Scheme {
+	case "unix":
+		addr, err := net.ResolveUnixAddr("unix", u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("workload: %w", err)
+		}
+		return &WorkloadClient{
+			base: "http://iotedge",
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", addr.Name)
+					},
+				},
+			},
+		}, nil
+	case "http", "https":
+		return &WorkloadClient{
+			base:   strings.TrimRight(workloadURI, "/"),
+			client: &http.Client{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("workload: unsupported uri scheme %q", u.Scheme)
+	}
+}
+
+var (
+	workloadClientsMu sync.Mutex
+	workloadClients   = map[string]*WorkloadClient{}
+)
+
+// sharedWorkloadClient returns the workload client for the given URI
+// creating it on the first call, so frequent signing and trust bundle
+// requests reuse connections instead of opening new ones every time.
+func sharedWorkloadClient(workloadURI string) (*WorkloadClient, error) {
+	workloadClientsMu.Lock()
+	defer workloadClientsMu.Unlock()
+	if c, ok := workloadClients[workloadURI]; ok {
+		return c, nil
+	}
+	c, err := NewWorkloadClient(workloadURI)
+	if err != nil {
+		return nil, err
+	}
+	workloadClients[workloadURI] = c
+	return c, nil
+}
+
+// Sign signs data with the named module key using HMAC-SHA256,
+// keyID is usually "primary".
+func (c *WorkloadClient) Sign(
+	ctx context.Context, module, genid, keyID string, data []byte,
+) ([]byte, error) {
+	var res struct {
+		Digest string `json:"digest"`
+	}
+	if err := c.do(ctx, http.MethodPost, signAPIVersion,
+		fmt.Sprintf("/modules/%s/genid/%s/sign", url.PathEscape(module), url.PathEscape(genid)),
+		&EdgeSignRequestPayload{
+			KeyID: keyID,
+			Algo:  "HMACSHA256",
+			Data:  base64.StdEncoding.EncodeToString(data),
+		}, &res,
+	); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Digest)
+}
+
+// Encrypt encrypts plaintext with the module's key.
+func (c *WorkloadClient) Encrypt(
+	ctx context.Context, module, genid string, initVector, plaintext []byte,
+) ([]byte, error) {
+	var res struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := c.do(ctx, http.MethodPost, cryptoAPIVersion,
+		fmt.Sprintf("/modules/%s/genid/%s/encrypt", url.PathEscape(module), url.PathEscape(genid)),
+		map[string]string{
+			"plaintext":            base64.StdEncoding.EncodeToString(plaintext),
+			"initializationVector": base64.StdEncoding.EncodeToString(initVector),
+		}, &res,
+	); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Ciphertext)
+}
+
+// Decrypt decrypts ciphertext produced by Encrypt with the same initialization vector.
+func (c *WorkloadClient) Decrypt(
+	ctx context.Context, module, genid string, initVector, ciphertext []byte,
+) ([]byte, error) {
+	var res struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := c.do(ctx, http.MethodPost, cryptoAPIVersion,
+		fmt.Sprintf("/modules/%s/genid/%s/decrypt", url.PathEscape(module), url.PathEscape(genid)),
+		map[string]string{
+			"ciphertext":           base64.StdEncoding.EncodeToString(ciphertext),
+			"initializationVector": base64.StdEncoding.EncodeToString(initVector),
+		}, &res,
+	); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Plaintext)
+}
+
+// ServerCertificate is a certificate issued by the edge CA.
+type ServerCertificate struct {
+	Certificate string `json:"certificate"` // PEM encoded chain
+	PrivateKey  struct {
+		Type  string `json:"type"`
+		Bytes string `json:"bytes"` // PEM encoded key
+	} `json:"privateKey"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// CreateServerCertificate issues a server certificate for the given
+// common name signed by the edge CA, so modules can run TLS servers.
+func (c *WorkloadClient) CreateServerCertificate(
+	ctx context.Context, module, genid, commonName string, expiration time.Time,
+) (*ServerCertificate, error) {
+	var res ServerCertificate
+	if err := c.do(ctx, http.MethodPost, cryptoAPIVersion,
+		fmt.Sprintf("/modules/%s/genid/%s/certificate/server", url.PathEscape(module), url.PathEscape(genid)),
+		map[string]string{
+			"commonName": commonName,
+			"expiration": expiration.UTC().Format(time.RFC3339),
+		}, &res,
+	); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// TrustBundle returns the edge CA certificates pool.
+func (c *WorkloadClient) TrustBundle(ctx context.Context) (*x509.CertPool, error) {
+	var res TrustBundleResponse
+	if err := c.do(ctx, http.MethodGet, trustBundleAPIVersion, "/trust-bundle", nil, &res); err != nil {
+		return nil, err
+	}
+	p := x509.NewCertPool()
+	if ok := p.AppendCertsFromPEM([]byte(res.Certificate)); !ok {
+		return nil, errors.New("workload: unable to append trust bundle certificates")
+	}
+	return p, nil
+}
+
+// EdgeIdentity is a module identity known to the edge daemon.
+type EdgeIdentity struct {
+	ModuleID     string `json:"moduleId"`
+	ManagedBy    string `json:"managedBy"`
+	GenerationID string `json:"generationId"`
+	AuthType     string `json:"authType"`
+}
+
+// ListIdentities lists module identities, it's available only
+// through the management API and requires edgeAgent privileges.
+func (c *WorkloadClient) ListIdentities(ctx context.Context) ([]*EdgeIdentity, error) {
+	var res struct {
+		Identities []*EdgeIdentity `json:"identities"`
+	}
+	if err := c.do(ctx, http.MethodGet, identityAPIVersion, "/identities/", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Identities, nil
+}
+
+func (c *WorkloadClient) do(
+	ctx context.Context, method, apiVersion, path string, req, res interface{},
+) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	r, err := http.NewRequestWithContext(ctx, method,
+		c.base+path+"?api-version="+apiVersion, body,
+	)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("workload: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("workload: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			return fmt.Errorf("workload: %s (%d)", e.Message, resp.StatusCode)
+		}
+		return fmt.Errorf("workload: request failed with %d response code", resp.StatusCode)
+	}
+	if err = json.Unmarshal(b, res); err != nil {
+		return fmt.Errorf("workload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWorkloadClientSign(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/modules/mod/genid/1/sign" {
+			t.Errorf("path = %q, want %q", r.URL.Path, "/modules/mod/genid/1/sign")
+		}
+		var req EdgeSignRequestPayload
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.KeyID != "primary" || req.Algo != "HMACSHA256" {
+			t.Errorf("request = %+v, want primary HMACSHA256", req)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"digest": req.Data, // echo
+		})
+	}))
+	defer s.Close()
+
+	c, err := NewWorkloadClient(s.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Sign(context.Background(), "mod", "1", "primary", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Errorf("digest = %q, want %q", b, "data")
+	}
+}
+
+func TestWorkloadClientError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"message": "module not found",
+		})
+	}))
+	defer s.Close()
+
+	c, err := NewWorkloadClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Decrypt(context.Background(), "mod", "1", nil,
+		[]byte(base64.StdEncoding.EncodeToString([]byte("x"))),
+	)
+	if err == nil || err.Error() != "workload: module not found (404)" {
+		t.Errorf("err = %v, want module not found", err)
+	}
+}
+
+func TestWorkloadAPIVersions(t *testing.T) {
+	versions := map[string]string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions[r.URL.Path] = r.URL.Query().Get("api-version")
+		_, _ = w.Write([]byte(`{"digest":"","certificate":"` +
+			`-----BEGIN CERTIFICATE-----\nMA==\n-----END CERTIFICATE-----\n"}`))
+	}))
+	defer s.Close()
+
+	c, err := sharedWorkloadClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Sign(context.Background(), "mod", "1", "primary", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.TrustBundle(context.Background())
+	for path, want := range map[string]string{
+		"/modules/mod/genid/1/sign": signAPIVersion,
+		"/trust-bundle":             trustBundleAPIVersion,
+	} {
+		if versions[path] != want {
+			t.Errorf("%s api-version = %q, want %q", path, versions[path], want)
+		}
+	}
+
+	shared, err := sharedWorkloadClient(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != c {
+		t.Error("workload client is not reused")
+	}
+}
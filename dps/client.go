@@ -0,0 +1,350 @@
+// Package dps implements the device side of the Azure IoT Hub
+// Device Provisioning Service registration over HTTPS.
+package dps
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+// DefaultEndpoint is the global device provisioning endpoint.
+const DefaultEndpoint = "global.azure-devices-provisioning.net"
+
+const (
+	apiVersion          = "2021-06-01"
+	defaultPollInterval = 3 * time.Second
+	tokenLifetime       = time.Hour
+)
+
+// ClientOption is a client configuration option.
+type ClientOption func(c *Client)
+
+// WithEndpoint overrides the provisioning endpoint host, default is DefaultEndpoint.
+func WithEndpoint(host string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = host
+	}
+}
+
+// WithHTTPClient changes default http client, the client certificate
+// of x509 registrations has to be configured in it manually.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithRootCAs overrides root CA certificates, default is common.RootCAs.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// WithLogger sets client logger.
+func WithLogger(l logger.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// WithPollInterval sets how often the registration status is polled
+// when the service doesn't suggest it with Retry-After, default is 3s.
+func WithPollInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.poll = d
+	}
+}
+
+// WithPayload attaches custom data to registration requests
+// that's passed to custom allocation policies, v is JSON-encoded.
+func WithPayload(v interface{}) ClientOption {
+	return func(c *Client) {
+		c.payload = v
+	}
+}
+
+// NewFromSymmetricKey creates a client that registers the device
+// with a symmetric key of an individual enrollment or a key
+// derived from a group enrollment key with DeriveSymmetricKey.
+func NewFromSymmetricKey(idScope, registrationID, key string, opts ...ClientOption) (*Client, error) {
+	if key == "" {
+		return nil, errorf("symmetric key is required")
+	}
+	if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+		return nil, errorf("malformed symmetric key: %s", err)
+	}
+	return newClient(idScope, registrationID, key, nil, opts)
+}
+
+// NewFromX509 creates a client that registers the device with the given
+// certificate, registrationID defaults to the certificate's common name.
+func NewFromX509(idScope, registrationID string, crt *tls.Certificate, opts ...ClientOption) (*Client, error) {
+	if crt == nil {
+		return nil, errorf("certificate is required")
+	}
+	if registrationID == "" {
+		leaf := crt.Leaf
+		if leaf == nil && len(crt.Certificate) != 0 {
+			var err error
+			if leaf, err = x509.ParseCertificate(crt.Certificate[0]); err != nil {
+				return nil, errorf("malformed certificate: %s", err)
+			}
+		}
+		if leaf != nil {
+			registrationID = leaf.Subject.CommonName
+		}
+	}
+	return newClient(idScope, registrationID, "", crt, opts)
+}
+
+func newClient(
+	idScope, registrationID, key string, crt *tls.Certificate, opts []ClientOption,
+) (*Client, error) {
+	if idScope == "" {
+		return nil, errorf("id scope is required")
+	}
+	if registrationID == "" {
+		return nil, errorf("registration id is required")
+	}
+	c := &Client{
+		endpoint: DefaultEndpoint,
+		idScope:  idScope,
+		regID:    registrationID,
+		key:      key,
+		crt:      crt,
+		poll:     defaultPollInterval,
+		logger:   logger.NewFromString(os.Getenv("IOTHUB_DPS_LOG_LEVEL")),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.rootCAs == nil {
+		var err error
+		if c.rootCAs, err = common.LoadRootCAs(); err != nil {
+			return nil, errorf("root CAs: %s", err)
+		}
+	}
+	if c.http == nil {
+		tlsCfg := &tls.Config{RootCAs: c.rootCAs}
+		if crt != nil {
+			tlsCfg.Certificates = []tls.Certificate{*crt}
+		}
+		c.http = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		}
+	}
+	return c, nil
+}
+
+// Client is a device provisioning client.
+type Client struct {
+	endpoint string
+	idScope  string
+	regID    string
+	key      string
+	crt      *tls.Certificate
+	poll     time.Duration
+	payload  interface{}
+	rootCAs  *x509.CertPool
+	http     *http.Client
+	logger   logger.Logger
+}
+
+// RegistrationID returns the registration id of the device.
+func (c *Client) RegistrationID() string {
+	return c.regID
+}
+
+// RegistrationState is the device registration result.
+type RegistrationState struct {
+	RegistrationID         string          `json:"registrationId"`
+	CreatedDateTimeUTC     *time.Time      `json:"createdDateTimeUtc,omitempty"`
+	AssignedHub            string          `json:"assignedHub,omitempty"`
+	DeviceID               string          `json:"deviceId,omitempty"`
+	Status                 string          `json:"status"`
+	Substatus              string          `json:"substatus,omitempty"`
+	ErrorCode              int             `json:"errorCode,omitempty"`
+	ErrorMessage           string          `json:"errorMessage,omitempty"`
+	LastUpdatedDateTimeUTC *time.Time      `json:"lastUpdatedDateTimeUtc,omitempty"`
+	ETag                   string          `json:"etag,omitempty"`
+	Payload                json.RawMessage `json:"payload,omitempty"`
+}
+
+// ConnectionString returns a device connection string for the assigned hub,
+// that's a symmetric key one for symmetric key registrations and
+// an x509 one meant for iotdevice.NewFromX509ConnectionString otherwise.
+func (c *Client) ConnectionString(s *RegistrationState) (string, error) {
+	if s.AssignedHub == "" || s.DeviceID == "" {
+		return "", errorf("registration has no assigned hub")
+	}
+	if c.key != "" {
+		return common.BuildConnectionString(
+			"HostName", s.AssignedHub,
+			"DeviceId", s.DeviceID,
+			"SharedAccessKey", c.key,
+		)
+	}
+	return common.BuildConnectionString(
+		"HostName", s.AssignedHub,
+		"DeviceId", s.DeviceID,
+		"x509", "true",
+	)
+}
+
+type operationStatus struct {
+	OperationID       string             `json:"operationId"`
+	Status            string             `json:"status"`
+	RegistrationState *RegistrationState `json:"registrationState"`
+}
+
+// Register registers the device and blocks until the service
+// assigns it to a hub or the registration fails.
+func (c *Client) Register(ctx context.Context) (*RegistrationState, error) {
+	body := map[string]interface{}{"registrationId": c.regID}
+	if c.payload != nil {
+		body["payload"] = c.payload
+	}
+	var op operationStatus
+	wait, err := c.call(ctx, http.MethodPut, "register", body, &op)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c.logger.Debugf("registration %s is %s", op.OperationID, op.Status)
+		switch op.Status {
+		case "assigned":
+			return op.RegistrationState, nil
+		case "assigning", "unassigned":
+		default:
+			if s := op.RegistrationState; s != nil && s.ErrorMessage != "" {
+				return nil, errorf("registration %s: %s (%d)", op.Status, s.ErrorMessage, s.ErrorCode)
+			}
+			return nil, errorf("registration %s", op.Status)
+		}
+		if op.OperationID == "" {
+			return nil, errorf("registration is %s without an operation id", op.Status)
+		}
+		if wait == 0 {
+			wait = c.poll
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if wait, err = c.call(ctx, http.MethodGet,
+			"operations/"+url.PathEscape(op.OperationID), nil, &op,
+		); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// BadRequestError is an error response returned by the service.
+type BadRequestError struct {
+	StatusCode int    `json:"-"`
+	ErrorCode  int    `json:"errorCode"`
+	TrackingID string `json:"trackingId"`
+	Message    string `json:"message"`
+}
+
+func (e *BadRequestError) Error() string {
+	return fmt.Sprintf("dps: %s (code = %d, status = %d)", e.Message, e.ErrorCode, e.StatusCode)
+}
+
+// call performs a registration request and returns
+// the poll interval suggested by the Retry-After header.
+func (c *Client) call(
+	ctx context.Context, method, path string, body, v interface{},
+) (time.Duration, error) {
+	var br io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		br = bytes.NewReader(b)
+	}
+	resource := c.idScope + "/registrations/" + c.regID
+	req, err := http.NewRequestWithContext(ctx, method,
+		"https://"+c.endpoint+"/"+url.PathEscape(c.idScope)+"/registrations/"+
+			url.PathEscape(c.regID)+"/"+path+"?api-version="+apiVersion,
+		br,
+	)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if c.key != "" {
+		sas, err := common.NewSharedAccessSignature(
+			resource, "registration", c.key, time.Now().Add(tokenLifetime),
+		)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", sas.String())
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	c.logger.Debugf("%s %s: %s %s", method, path, res.Status, b)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		e := &BadRequestError{StatusCode: res.StatusCode}
+		if err = json.Unmarshal(b, e); err != nil || e.Message == "" {
+			e.Message = res.Status
+		}
+		return 0, e
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	if n, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && n > 0 {
+		wait = time.Duration(n) * time.Second
+	}
+	return wait, nil
+}
+
+// DeriveSymmetricKey derives a device key from a group enrollment key,
+// that's base64-encoded HMAC-SHA256 of the registration id.
+func DeriveSymmetricKey(groupKey, registrationID string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(groupKey)
+	if err != nil {
+		return "", errorf("malformed group key: %s", err)
+	}
+	h := hmac.New(sha256.New, b)
+	h.Write([]byte(registrationID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+const userAgent = "iothub-golang-sdk/dev"
+
+func errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("dps: "+format, v...)
+}
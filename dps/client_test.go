@@ -0,0 +1,115 @@
+package dps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+const testKey = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func TestRegister(t *testing.T) {
+	polls := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sas, err := common.ParseSharedAccessSignature(r.Header.Get("Authorization"))
+		if err != nil {
+			t.Errorf("authorization: %s", err)
+		} else if sas.Sr != "scope/registrations/dev" || sas.Skn != "registration" {
+			t.Errorf("unexpected signature %+v", sas)
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/scope/registrations/dev/register":
+			var v struct {
+				RegistrationID string            `json:"registrationId"`
+				Payload        map[string]string `json:"payload"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			if v.RegistrationID != "dev" || v.Payload["model"] != "m" {
+				t.Errorf("unexpected request %+v", v)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"operationId":"op","status":"assigning"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/scope/registrations/dev/operations/op":
+			if polls++; polls == 1 {
+				_, _ = w.Write([]byte(`{"operationId":"op","status":"assigning"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"operationId":"op","status":"assigned","registrationState":{` +
+				`"registrationId":"dev","assignedHub":"hub.azure-devices.net","deviceId":"dev","status":"assigned"}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewFromSymmetricKey("scope", "dev", testKey,
+		WithEndpoint(strings.TrimPrefix(srv.URL, "https://")),
+		WithHTTPClient(srv.Client()),
+		WithPollInterval(time.Millisecond),
+		WithPayload(map[string]string{"model": "m"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.Register(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AssignedHub != "hub.azure-devices.net" || s.DeviceID != "dev" || polls != 2 {
+		t.Errorf("unexpected state %+v after %d polls", s, polls)
+	}
+	cs, err := c.ConnectionString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "HostName=hub.azure-devices.net;DeviceId=dev;SharedAccessKey=" + testKey; cs != want {
+		t.Errorf("ConnectionString() = %q, want %q", cs, want)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errorCode":401002,"trackingId":"t","message":"Unauthorized"}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewFromSymmetricKey("scope", "dev", testKey,
+		WithEndpoint(strings.TrimPrefix(srv.URL, "https://")),
+		WithHTTPClient(srv.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e *BadRequestError
+	if _, err = c.Register(context.Background()); !errors.As(err, &e) || e.ErrorCode != 401002 {
+		t.Errorf("Register() error = %v, want a BadRequestError", err)
+	}
+}
+
+func TestDeriveSymmetricKey(t *testing.T) {
+	a, err := DeriveSymmetricKey(testKey, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DeriveSymmetricKey(testKey, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("keys of different registrations are equal")
+	}
+	if _, err = NewFromSymmetricKey("scope", "a", a); err != nil {
+		t.Errorf("derived key is invalid: %s", err)
+	}
+}
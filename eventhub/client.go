@@ -12,9 +12,11 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
 )
 
 // Credentials is an evenhub connection string representation.
@@ -25,30 +27,54 @@ type Credentials struct {
 	EntityPath          string
 }
 
-// ParseConnectionString parses the given connection string into Credentials structure.
+// ParseConnectionString parses the given connection string into Credentials structure,
+// it fails when required keys are missing, unknown keys are ignored.
 func ParseConnectionString(cs string) (*Credentials, error) {
-	var c Credentials
-	for _, s := range strings.Split(cs, ";") {
-		kv := strings.SplitN(s, "=", 2)
-		if len(kv) != 2 {
-			return nil, errors.New("malformed connection string")
-		}
+	m, err := common.ParseConnectionString(cs,
+		"Endpoint", "SharedAccessKeyName", "SharedAccessKey",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return newCredentials(m)
+}
 
-		switch kv[0] {
-		case "Endpoint":
-			if !strings.HasPrefix(kv[1], "sb://") {
-				return nil, errors.New("only sb:// schema supported")
-			}
-			c.Endpoint = strings.TrimRight(kv[1][5:], "/")
-		case "SharedAccessKeyName":
-			c.SharedAccessKeyName = kv[1]
-		case "SharedAccessKey":
-			c.SharedAccessKey = kv[1]
-		case "EntityPath":
-			c.EntityPath = kv[1]
-		}
+// ParseConnectionStringStrict is ParseConnectionString that
+// also fails when unknown or duplicated keys are present.
+func ParseConnectionStringStrict(cs string) (*Credentials, error) {
+	m, err := common.ParseConnectionStringStrict(cs,
+		[]string{"Endpoint", "SharedAccessKeyName", "SharedAccessKey"},
+		"EntityPath",
+	)
+	if err != nil {
+		return nil, err
 	}
-	return &c, nil
+	return newCredentials(m)
+}
+
+func newCredentials(m map[string]string) (*Credentials, error) {
+	if !strings.HasPrefix(m["Endpoint"], "sb://") {
+		return nil, errors.New("only sb:// schema supported")
+	}
+	return &Credentials{
+		Endpoint:            strings.TrimRight(m["Endpoint"][5:], "/"),
+		SharedAccessKeyName: m["SharedAccessKeyName"],
+		SharedAccessKey:     m["SharedAccessKey"],
+		EntityPath:          m["EntityPath"],
+	}, nil
+}
+
+// BuildConnectionString is the inverse of ParseConnectionString.
+func BuildConnectionString(creds *Credentials) (string, error) {
+	if creds.Endpoint == "" || creds.SharedAccessKeyName == "" || creds.SharedAccessKey == "" {
+		return "", errors.New("endpoint, key name and key are required")
+	}
+	return common.BuildConnectionString(
+		"Endpoint", "sb://"+creds.Endpoint+"/",
+		"SharedAccessKeyName", creds.SharedAccessKeyName,
+		"SharedAccessKey", creds.SharedAccessKey,
+		"EntityPath", creds.EntityPath,
+	)
 }
 
 // Option is a client configuration option.
@@ -78,6 +104,14 @@ func WithConnOption(key string, value any) Option {
 	}
 }
 
+// WithWebSocket makes the client use AMQP over WebSockets on port 443,
+// that is useful when port 5671 is blocked by a firewall.
+func WithWebSocket(enable bool) Option {
+	return func(c *Client) {
+		c.ws = enable
+	}
+}
+
 // DialContext connects to the named EventHub and returns a client instance
 // using the provided context.
 func DialContext(ctx context.Context, host, name string, opts ...Option) (*Client, error) {
@@ -87,13 +121,39 @@ func DialContext(ctx context.Context, host, name string, opts ...Option) (*Clien
 	}
 
 	var err error
-	c.conn, err = amqp.Dial(ctx, "amqps://"+host, &c.opts)
+	if c.ws {
+		c.conn, err = dialWebSocket(ctx, host, &c.opts)
+	} else {
+		c.conn, err = amqp.Dial(ctx, "amqps://"+host, &c.opts)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
+func dialWebSocket(ctx context.Context, host string, opts *amqp.ConnOptions) (*amqp.Conn, error) {
+	tlsCfg := opts.TLSConfig
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{ServerName: host}
+	}
+	nc, err := common.DialAMQPWebSocket(ctx, "wss://"+host+":443/$servicebus/websocket", tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// TLS is already terminated by the websocket connection
+	o := *opts
+	o.TLSConfig = nil
+	o.HostName = host
+	conn, err := amqp.NewConn(ctx, nc, &o)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // Dial connects to the named EventHub and returns a client instance.
 // DEPRECATED: Use DialContext.
 func Dial(host, name string, opts ...Option) (*Client, error) {
@@ -123,6 +183,11 @@ type Client struct {
 	name string
 	conn *amqp.Conn
 	opts amqp.ConnOptions
+	ws   bool
+
+	mu      sync.Mutex
+	sess    *amqp.Session           // producer session
+	senders map[string]*amqp.Sender // producer links by address
 }
 
 // SubscribeOption is a Subscribe option.
@@ -135,29 +200,104 @@ func WithSubscribeConsumerGroup(name string) SubscribeOption {
 	}
 }
 
+// WithSubscribePartitions limits the subscription to the named partitions,
+// by default events are received from all partitions of the hub.
+func WithSubscribePartitions(ids ...string) SubscribeOption {
+	return func(s *sub) {
+		s.partitions = ids
+	}
+}
+
 // WithSubscribeSince requests events that occurred after the given time.
 func WithSubscribeSince(t time.Time) SubscribeOption {
+	return withSubscribeSelector(fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
+		t.UnixNano()/int64(time.Millisecond)))
+}
+
+// WithSubscribeOffset requests events starting from the given offset,
+// inclusive includes the event at the offset itself.
+// Use "-1" for the beginning of partitions and "@latest" for new events only.
+func WithSubscribeOffset(offset string, inclusive bool) SubscribeOption {
+	return withSubscribeSelector(fmt.Sprintf("amqp.annotation.x-opt-offset %s '%s'",
+		cmpOp(inclusive), offset))
+}
+
+// WithSubscribeSequenceNumber requests events starting from the given
+// sequence number, inclusive includes the event with the number itself.
+func WithSubscribeSequenceNumber(seq int64, inclusive bool) SubscribeOption {
+	return withSubscribeSelector(fmt.Sprintf("amqp.annotation.x-opt-sequence-number %s '%d'",
+		cmpOp(inclusive), seq))
+}
+
+// WithSubscribeEarliest requests all events retained by the hub,
+// starting from the beginning of partitions.
+func WithSubscribeEarliest() SubscribeOption {
+	return WithSubscribeOffset("-1", false)
+}
+
+// WithSubscribeLatest requests only events enqueued
+// after partition receivers are attached.
+func WithSubscribeLatest() SubscribeOption {
+	return WithSubscribeOffset("@latest", false)
+}
+
+func cmpOp(inclusive bool) string {
+	if inclusive {
+		return ">="
+	}
+	return ">"
+}
+
+// withSubscribeSelector sets the start position filter, only one
+// can be used so it overrides the ones set by other start position options.
+func withSubscribeSelector(expr string) SubscribeOption {
 	return func(s *sub) {
-		if s.receiverOpts.Filters == nil {
-			s.receiverOpts.Filters = make([]amqp.LinkFilter, 0)
+		s.receiverOpts.Filters = append(s.receiverOpts.Filters, amqp.NewSelectorFilter(expr))
+	}
+}
+
+// WithSubscribeEpoch makes receivers epoch (owner-level) ones, a receiver
+// with a higher epoch disconnects receivers of the same partition and
+// consumer group with lower epochs, so competing consumers are fenced.
+func WithSubscribeEpoch(epoch int64) SubscribeOption {
+	return func(s *sub) {
+		if s.receiverOpts.Properties == nil {
+			s.receiverOpts.Properties = make(map[string]any)
 		}
-		s.receiverOpts.Filters = append(s.receiverOpts.Filters, amqp.NewSelectorFilter(fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
-			t.UnixNano()/int64(time.Millisecond))))
+		s.receiverOpts.Properties["com.microsoft:epoch"] = epoch
 	}
 }
 
 type sub struct {
 	group        string
+	partitions   []string
 	sessionOpts  amqp.SessionOptions
 	receiverOpts amqp.ReceiverOptions
 }
 
-// Event is an Event Hub event, simply wraps an AMQP message.
+// Event is an Event Hub event, it wraps an AMQP message
+// and exposes system properties set by the hub.
 type Event struct {
 	*amqp.Message
+
+	Offset         string    // x-opt-offset
+	SequenceNumber int64     // x-opt-sequence-number
+	EnqueuedTime   time.Time // x-opt-enqueued-time
+	PartitionKey   string    // x-opt-partition-key
+
 	recv *amqp.Receiver
 }
 
+// newEvent decodes system properties from the message annotations.
+func newEvent(msg *amqp.Message, recv *amqp.Receiver) *Event {
+	ev := &Event{Message: msg, recv: recv}
+	ev.Offset, _ = msg.Annotations["x-opt-offset"].(string)
+	ev.SequenceNumber, _ = msg.Annotations["x-opt-sequence-number"].(int64)
+	ev.EnqueuedTime, _ = msg.Annotations["x-opt-enqueued-time"].(time.Time)
+	ev.PartitionKey, _ = msg.Annotations["x-opt-partition-key"].(string)
+	return ev
+}
+
 // Subscribe subscribes to all hub's partitions and registers the given
 // handler and blocks until it encounters an error or the context is cancelled.
 //
@@ -182,9 +322,11 @@ func (c *Client) Subscribe(
 	}
 	defer sess.Close(context.Background())
 
-	ids, err := c.getPartitionIDs(ctx, sess)
-	if err != nil {
-		return err
+	ids := s.partitions
+	if len(ids) == 0 {
+		if ids, err = c.getPartitionIDs(ctx, sess); err != nil {
+			return err
+		}
 	}
 
 	// stop all goroutines at return
@@ -201,23 +343,42 @@ func (c *Client) Subscribe(
 			return err
 		}
 
-		go func(recv *amqp.Receiver) {
-			defer recv.Close(context.Background())
+		go func(addr string, recv *amqp.Receiver) {
+			defer func() {
+				recv.Close(context.Background())
+			}()
+			var offset string // last delivered event's offset
+			backoff := minRecoveryBackoff
 			for {
 				msg, err := recv.Receive(ctx, &amqp.ReceiveOptions{})
 				if err != nil {
+					if ctx.Err() == nil && isRecoverable(err) {
+						// recreate the detached receiver, the event hub keeps
+						// no state so other partitions are unaffected
+						recv.Close(context.Background())
+						var r *amqp.Receiver
+						if r, err = c.recoverReceiver(ctx, sess, addr, &s, offset, &backoff); err == nil {
+							recv = r
+							continue
+						}
+					}
 					select {
 					case errc <- err:
 					case <-ctx.Done():
 					}
 					return
 				}
+				backoff = minRecoveryBackoff
+				ev := newEvent(msg, recv)
+				if ev.Offset != "" {
+					offset = ev.Offset
+				}
 				select {
-				case evc <- &Event{Message: msg, recv: recv}:
+				case evc <- ev:
 				case <-ctx.Done():
 				}
 			}
-		}(recv)
+		}(addr, recv)
 	}
 
 	for {
@@ -243,8 +404,119 @@ func (c *Client) Subscribe(
 	}
 }
 
+const (
+	minRecoveryBackoff = 100 * time.Millisecond
+	maxRecoveryBackoff = 30 * time.Second
+)
+
+// isRecoverable reports whether the error is caused by a detached link,
+// e.g. an idle timeout or server busy, except when the link has been
+// stolen by an epoch receiver, that must not be competed with.
+func isRecoverable(err error) bool {
+	var le *amqp.LinkError
+	if !errors.As(err, &le) {
+		return false
+	}
+	return le.RemoteErr == nil || le.RemoteErr.Condition != amqp.ErrCondStolen
+}
+
+// recoverReceiver recreates the partition receiver starting after
+// the given offset, retrying with exponential backoff until
+// it succeeds, the context is done or an unrecoverable error occurs.
+func (c *Client) recoverReceiver(
+	ctx context.Context,
+	sess *amqp.Session,
+	addr string,
+	s *sub,
+	offset string,
+	backoff *time.Duration,
+) (*amqp.Receiver, error) {
+	opts := s.receiverOpts
+	if offset != "" {
+		opts.Filters = []amqp.LinkFilter{amqp.NewSelectorFilter(
+			fmt.Sprintf("amqp.annotation.x-opt-offset > '%s'", offset),
+		)}
+	}
+	for {
+		t := time.NewTimer(*backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		if *backoff *= 2; *backoff > maxRecoveryBackoff {
+			*backoff = maxRecoveryBackoff
+		}
+
+		recv, err := sess.NewReceiver(ctx, addr, &opts)
+		if err == nil {
+			return recv, nil
+		}
+		if !isRecoverable(err) {
+			return nil, err
+		}
+	}
+}
+
 // getPartitionIDs returns partition ids of the hub.
 func (c *Client) getPartitionIDs(ctx context.Context, sess *amqp.Session) ([]string, error) {
+	val, err := c.management(ctx, sess, map[string]interface{}{
+		"operation": "READ",
+		"name":      c.name,
+		"type":      "com.microsoft:eventhub",
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := val["partition_ids"].([]string)
+	if !ok {
+		return nil, errors.New("unable to typecast partition_ids")
+	}
+	return ids, nil
+}
+
+// PartitionInfo is partition runtime information.
+type PartitionInfo struct {
+	PartitionID                string
+	BeginSequenceNumber        int64
+	LastEnqueuedSequenceNumber int64
+	LastEnqueuedOffset         string
+	LastEnqueuedTime           time.Time
+	IsEmpty                    bool
+}
+
+// GetPartitionInfo returns runtime information of the named partition,
+// it's useful for measuring consumers lag and deciding where to start.
+func (c *Client) GetPartitionInfo(ctx context.Context, partitionID string) (*PartitionInfo, error) {
+	sess, err := c.conn.NewSession(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close(context.Background())
+
+	val, err := c.management(ctx, sess, map[string]interface{}{
+		"operation": "READ",
+		"name":      c.name,
+		"type":      "com.microsoft:partition",
+		"partition": partitionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &PartitionInfo{PartitionID: partitionID}
+	info.BeginSequenceNumber, _ = val["begin_sequence_number"].(int64)
+	info.LastEnqueuedSequenceNumber, _ = val["last_enqueued_sequence_number"].(int64)
+	info.LastEnqueuedOffset, _ = val["last_enqueued_offset"].(string)
+	info.LastEnqueuedTime, _ = val["last_enqueued_time_utc"].(time.Time)
+	info.IsEmpty, _ = val["is_partition_empty"].(bool)
+	return info, nil
+}
+
+// management makes a request to the $management node and returns the response value.
+func (c *Client) management(
+	ctx context.Context, sess *amqp.Session, props map[string]interface{},
+) (map[string]interface{}, error) {
 	replyTo := genID()
 	recv, err := sess.NewReceiver(ctx, "$management", &amqp.ReceiverOptions{TargetAddress: replyTo})
 	if err != nil {
@@ -264,11 +536,7 @@ func (c *Client) getPartitionIDs(ctx context.Context, sess *amqp.Session) ([]str
 			MessageID: mid,
 			ReplyTo:   &replyTo,
 		},
-		ApplicationProperties: map[string]interface{}{
-			"operation": "READ",
-			"name":      c.name,
-			"type":      "com.microsoft:eventhub",
-		},
+		ApplicationProperties: props,
 	}, &amqp.SendOptions{}); err != nil {
 		return nil, err
 	}
@@ -291,11 +559,7 @@ func (c *Client) getPartitionIDs(ctx context.Context, sess *amqp.Session) ([]str
 	if !ok {
 		return nil, errors.New("unable to typecast value")
 	}
-	ids, ok := val["partition_ids"].([]string)
-	if !ok {
-		return nil, errors.New("unable to typecast partition_ids")
-	}
-	return ids, nil
+	return val, nil
 }
 
 // Close closes underlying AMQP connection.
@@ -5,6 +5,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/Azure/go-amqp"
 )
 
 func TestParseConnectionString(t *testing.T) {
@@ -52,3 +54,39 @@ func TestClient_Subscribe(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNewEvent(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ev := newEvent(&amqp.Message{
+		Annotations: amqp.Annotations{
+			"x-opt-offset":          "4096",
+			"x-opt-sequence-number": int64(42),
+			"x-opt-enqueued-time":   now,
+			"x-opt-partition-key":   "key",
+		},
+	}, nil)
+	if ev.Offset != "4096" || ev.SequenceNumber != 42 ||
+		!ev.EnqueuedTime.Equal(now) || ev.PartitionKey != "key" {
+		t.Fatalf("newEvent = %+v, want decoded system properties", ev)
+	}
+}
+
+func TestBuildConnectionString(t *testing.T) {
+	creds := &Credentials{
+		Endpoint:            "namespace.windows.net",
+		SharedAccessKeyName: "policy-name",
+		SharedAccessKey:     "abcNg==",
+		EntityPath:          "hub-name",
+	}
+	cs, err := BuildConnectionString(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ParseConnectionString(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *have != *creds {
+		t.Fatalf("ParseConnectionString(%q) = %#v, want %#v", cs, have, creds)
+	}
+}
@@ -0,0 +1,401 @@
+package eventhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Ownership is a partition ownership record shared by processor instances.
+type Ownership struct {
+	ConsumerGroup string
+	PartitionID   string
+	OwnerID       string
+	ETag          string
+	LastModified  time.Time
+}
+
+// Checkpoint is the last processed position of a partition.
+type Checkpoint struct {
+	ConsumerGroup  string
+	PartitionID    string
+	Offset         string
+	SequenceNumber int64
+}
+
+// CheckpointStore persists partition ownership and checkpoints,
+// it has to be shared by all instances of an event processor.
+type CheckpointStore interface {
+	// ListOwnership returns all ownership records of the consumer group.
+	ListOwnership(ctx context.Context, group string) ([]Ownership, error)
+
+	// ClaimOwnership tries to claim the given partitions and returns
+	// successfully claimed ones with updated ETag and LastModified,
+	// a claim fails when its ETag doesn't match the stored one.
+	ClaimOwnership(ctx context.Context, claims []Ownership) ([]Ownership, error)
+
+	// ListCheckpoints returns all checkpoints of the consumer group.
+	ListCheckpoints(ctx context.Context, group string) ([]Checkpoint, error)
+
+	// UpdateCheckpoint stores the given checkpoint.
+	UpdateCheckpoint(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// NewMemoryCheckpointStore creates an in-memory checkpoint store,
+// it's useful for tests and for instances running in a single process.
+func NewMemoryCheckpointStore() CheckpointStore {
+	return &memoryStore{
+		owns: map[string]Ownership{},
+		cps:  map[string]Checkpoint{},
+	}
+}
+
+type memoryStore struct {
+	mu   sync.Mutex
+	etag uint64
+	owns map[string]Ownership
+	cps  map[string]Checkpoint
+}
+
+func (s *memoryStore) ListOwnership(ctx context.Context, group string) ([]Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []Ownership
+	for _, o := range s.owns {
+		if o.ConsumerGroup == group {
+			r = append(r, o)
+		}
+	}
+	return r, nil
+}
+
+func (s *memoryStore) ClaimOwnership(ctx context.Context, claims []Ownership) ([]Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []Ownership
+	for _, c := range claims {
+		k := c.ConsumerGroup + "/" + c.PartitionID
+		if o, ok := s.owns[k]; ok && o.ETag != c.ETag {
+			continue
+		}
+		s.etag++
+		c.ETag = strconv.FormatUint(s.etag, 10)
+		c.LastModified = time.Now()
+		s.owns[k] = c
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+func (s *memoryStore) ListCheckpoints(ctx context.Context, group string) ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []Checkpoint
+	for _, cp := range s.cps {
+		if cp.ConsumerGroup == group {
+			r = append(r, cp)
+		}
+	}
+	return r, nil
+}
+
+func (s *memoryStore) UpdateCheckpoint(ctx context.Context, cp Checkpoint) error {
+	s.mu.Lock()
+	s.cps[cp.ConsumerGroup+"/"+cp.PartitionID] = cp
+	s.mu.Unlock()
+	return nil
+}
+
+// ProcessorOption is an event processor configuration option.
+type ProcessorOption func(p *EventProcessor)
+
+// WithProcessorConsumerGroup overrides default consumer group, default is `$Default`.
+func WithProcessorConsumerGroup(name string) ProcessorOption {
+	return func(p *EventProcessor) {
+		p.group = name
+	}
+}
+
+// WithProcessorOwnerID sets the instance's owner id, a random one is used by default.
+func WithProcessorOwnerID(id string) ProcessorOption {
+	return func(p *EventProcessor) {
+		p.owner = id
+	}
+}
+
+// WithProcessorLoadBalancingInterval sets how often ownership is renewed
+// and partitions are rebalanced, default is 10s.
+func WithProcessorLoadBalancingInterval(d time.Duration) ProcessorOption {
+	return func(p *EventProcessor) {
+		p.interval = d
+	}
+}
+
+// WithProcessorOwnershipExpiry sets after how long without renewal an ownership
+// is considered abandoned and can be claimed by others, default is 60s.
+func WithProcessorOwnershipExpiry(d time.Duration) ProcessorOption {
+	return func(p *EventProcessor) {
+		p.expiry = d
+	}
+}
+
+// NewEventProcessor creates an event processor that balances the hub's
+// partitions between all instances sharing the checkpoint store,
+// mirroring the Azure Event Processor Host model.
+func (c *Client) NewEventProcessor(store CheckpointStore, opts ...ProcessorOption) *EventProcessor {
+	p := &EventProcessor{
+		client:   c,
+		store:    store,
+		group:    "$Default",
+		owner:    genID(),
+		interval: 10 * time.Second,
+		expiry:   60 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// EventProcessor consumes events from partitions owned by the instance.
+type EventProcessor struct {
+	client   *Client
+	store    CheckpointStore
+	group    string
+	owner    string
+	interval time.Duration
+	expiry   time.Duration
+}
+
+// PartitionContext is the context of the partition an event is received from.
+type PartitionContext struct {
+	PartitionID   string
+	ConsumerGroup string
+
+	store CheckpointStore
+}
+
+// UpdateCheckpoint stores the position of the given event,
+// so processing continues after it when the partition changes hands.
+func (pc *PartitionContext) UpdateCheckpoint(ctx context.Context, ev *Event) error {
+	if ev.Offset == "" {
+		return errors.New("event has no offset")
+	}
+	return pc.store.UpdateCheckpoint(ctx, Checkpoint{
+		ConsumerGroup:  pc.ConsumerGroup,
+		PartitionID:    pc.PartitionID,
+		Offset:         ev.Offset,
+		SequenceNumber: ev.SequenceNumber,
+	})
+}
+
+// Run processes events of owned partitions with fn and blocks
+// until it encounters an error or the context is cancelled.
+//
+// Events of a partition are handled sequentially, non-nil errors
+// returned from fn reject AMQP messages and stop processing.
+func (p *EventProcessor) Run(
+	ctx context.Context, fn func(pc *PartitionContext, event *Event) error,
+) error {
+	sess, err := p.client.conn.NewSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close(context.Background())
+
+	ids, err := p.client.getPartitionIDs(ctx, sess)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	errc := make(chan error, 1)
+	running := map[string]context.CancelFunc{}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		owned, err := p.balance(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		// stop partitions that have been taken over by others
+		for id, stop := range running {
+			if !owned[id] {
+				stop()
+				delete(running, id)
+			}
+		}
+		for id := range owned {
+			if _, ok := running[id]; ok {
+				continue
+			}
+			pctx, stop := context.WithCancel(ctx)
+			running[id] = stop
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := p.process(pctx, sess, id, fn); err != nil && pctx.Err() == nil {
+					select {
+					case errc <- err:
+					default:
+					}
+				}
+			}(id)
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// balance renews owned partitions and claims at most one more
+// partition when the instance owns less than its fair share.
+func (p *EventProcessor) balance(ctx context.Context, ids []string) (map[string]bool, error) {
+	all, err := p.store.ListOwnership(ctx, p.group)
+	if err != nil {
+		return nil, err
+	}
+	claims := selectClaims(p.group, p.owner, ids, all, time.Now().Add(-p.expiry))
+	claimed, err := p.store.ClaimOwnership(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool, len(claimed))
+	for _, o := range claimed {
+		owned[o.PartitionID] = true
+	}
+	return owned, nil
+}
+
+// selectClaims returns ownership claims the owner should make, that is all
+// currently owned partitions to renew them plus one more partition when
+// the owner has less than its share, preferring unowned or expired
+// partitions and stealing from the busiest owner otherwise.
+func selectClaims(group, owner string, ids []string, all []Ownership, expired time.Time) []Ownership {
+	byID := make(map[string]Ownership, len(all))
+	counts := map[string]int{owner: 0}
+	for _, o := range all {
+		byID[o.PartitionID] = o
+		if o.OwnerID != "" && o.LastModified.After(expired) {
+			counts[o.OwnerID]++
+		}
+	}
+
+	var claims, free []Ownership
+	for _, id := range ids {
+		o, ok := byID[id]
+		if !ok {
+			o = Ownership{ConsumerGroup: group, PartitionID: id}
+		}
+		switch {
+		case o.OwnerID == owner && o.LastModified.After(expired):
+			claims = append(claims, o)
+		case o.OwnerID == "" || !o.LastModified.After(expired):
+			free = append(free, o)
+		}
+	}
+
+	// every owner gets minN partitions and rem of them get one more
+	minN, rem := len(ids)/len(counts), len(ids)%len(counts)
+	above := 0
+	for id, n := range counts {
+		if id != owner && n > minN {
+			above++
+		}
+	}
+	want := minN
+	if above < rem {
+		want++
+	}
+	if len(claims) >= want {
+		return claims
+	}
+
+	if len(free) != 0 {
+		free[0].OwnerID = owner
+		return append(claims, free[0])
+	}
+
+	// steal from the owner that has the most partitions
+	var busiest string
+	for id, n := range counts {
+		if id != owner && n > counts[busiest] {
+			busiest = id
+		}
+	}
+	if busiest == "" || counts[busiest] <= minN {
+		return claims
+	}
+	for _, id := range ids {
+		if o := byID[id]; o.OwnerID == busiest {
+			o.OwnerID = owner
+			return append(claims, o)
+		}
+	}
+	return claims
+}
+
+func (p *EventProcessor) process(
+	ctx context.Context,
+	sess *amqp.Session,
+	id string,
+	fn func(pc *PartitionContext, event *Event) error,
+) error {
+	opts := &amqp.ReceiverOptions{}
+	cps, err := p.store.ListCheckpoints(ctx, p.group)
+	if err != nil {
+		return err
+	}
+	for _, cp := range cps {
+		if cp.PartitionID == id {
+			opts.Filters = append(opts.Filters, amqp.NewSelectorFilter(
+				fmt.Sprintf("amqp.annotation.x-opt-offset > '%s'", cp.Offset),
+			))
+			break
+		}
+	}
+
+	recv, err := sess.NewReceiver(ctx,
+		fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", p.client.name, p.group, id), opts,
+	)
+	if err != nil {
+		return err
+	}
+	defer recv.Close(context.Background())
+
+	pc := &PartitionContext{PartitionID: id, ConsumerGroup: p.group, store: p.store}
+	for {
+		msg, err := recv.Receive(ctx, &amqp.ReceiveOptions{})
+		if err != nil {
+			return err
+		}
+		if err := fn(pc, newEvent(msg, recv)); err != nil {
+			if rerr := recv.RejectMessage(ctx, msg, &amqp.Error{
+				Condition:   amqp.ErrCondInternalError,
+				Description: err.Error(),
+			}); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		if err := recv.AcceptMessage(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package eventhub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSelectClaims(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	ids := []string{"0", "1", "2", "3"}
+
+	// a new instance claims a free partition first
+	claims := selectClaims("g", "b", ids, []Ownership{
+		{PartitionID: "0", OwnerID: "a", LastModified: now},
+		{PartitionID: "1", OwnerID: "a", LastModified: now},
+		{PartitionID: "2", OwnerID: "a", LastModified: now.Add(-2 * time.Minute)},
+	}, expired)
+	if len(claims) != 1 || claims[0].PartitionID != "2" || claims[0].OwnerID != "b" {
+		t.Fatalf("claims = %+v, want expired partition 2", claims)
+	}
+
+	// and steals from the busiest owner when there's nothing free
+	all := []Ownership{
+		{PartitionID: "0", OwnerID: "a", LastModified: now},
+		{PartitionID: "1", OwnerID: "a", LastModified: now},
+		{PartitionID: "2", OwnerID: "a", LastModified: now},
+		{PartitionID: "3", OwnerID: "b", LastModified: now},
+	}
+	claims = selectClaims("g", "b", ids, all, expired)
+	if len(claims) != 2 || claims[1].OwnerID != "b" || claims[1].PartitionID != "0" {
+		t.Fatalf("claims = %+v, want renewal of 3 and stolen 0", claims)
+	}
+
+	// balanced owners only renew their partitions
+	all[0].OwnerID = "b"
+	claims = selectClaims("g", "b", ids, all, expired)
+	if len(claims) != 2 {
+		t.Fatalf("claims = %+v, want only renewals", claims)
+	}
+}
+
+func TestMemoryCheckpointStoreClaim(t *testing.T) {
+	s := NewMemoryCheckpointStore()
+	ctx := context.Background()
+
+	claimed, err := s.ClaimOwnership(ctx, []Ownership{{ConsumerGroup: "g", PartitionID: "0", OwnerID: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("claimed = %+v, want one", claimed)
+	}
+
+	// stale etag
+	claimed, err = s.ClaimOwnership(ctx, []Ownership{{ConsumerGroup: "g", PartitionID: "0", OwnerID: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 0 {
+		t.Fatalf("claimed = %+v, want none", claimed)
+	}
+}
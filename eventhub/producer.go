@@ -0,0 +1,171 @@
+package eventhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+)
+
+// DefaultMaxBatchSize is the default maximum batch size in bytes,
+// that's the maximum message size of standard tier hubs.
+const DefaultMaxBatchSize = 1024 * 1024
+
+// batchMessageFormat is the AMQP message format of batched messages.
+const batchMessageFormat uint32 = 0x80013700
+
+// ErrBatchFull the message doesn't fit into the batch.
+var ErrBatchFull = errors.New("batch is full")
+
+// SendOption is a Send and SendBatch option.
+type SendOption func(s *sendOpts)
+
+type sendOpts struct {
+	partitionID  string
+	partitionKey string
+}
+
+// WithSendPartitionID sends events directly to the named partition.
+func WithSendPartitionID(id string) SendOption {
+	return func(s *sendOpts) {
+		s.partitionID = id
+	}
+}
+
+// WithSendPartitionKey makes the hub assign events with
+// the same key to the same partition.
+func WithSendPartitionKey(key string) SendOption {
+	return func(s *sendOpts) {
+		s.partitionKey = key
+	}
+}
+
+// Send sends the message to the event hub, by default
+// the hub distributes events between partitions evenly.
+func (c *Client) Send(ctx context.Context, msg *amqp.Message, opts ...SendOption) error {
+	var s sendOpts
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if err := s.annotate(msg); err != nil {
+		return err
+	}
+	send, err := c.sender(ctx, s.partitionID)
+	if err != nil {
+		return err
+	}
+	if err = send.Send(ctx, msg, &amqp.SendOptions{}); err != nil {
+		var le *amqp.LinkError
+		if errors.As(err, &le) {
+			// detached links are recreated on the next send
+			c.mu.Lock()
+			for addr, s := range c.senders {
+				if s == send {
+					delete(c.senders, addr)
+				}
+			}
+			c.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// NewBatch creates an empty batch limited to the given size in bytes.
+func NewBatch(maxSize int) *Batch {
+	return &Batch{max: maxSize}
+}
+
+// Batch is a set of events sent in a single AMQP message.
+type Batch struct {
+	max  int
+	size int
+	data [][]byte
+}
+
+// Add adds the message to the batch, ErrBatchFull is returned
+// when adding it would exceed the batch size limit.
+func (b *Batch) Add(msg *amqp.Message) error {
+	p, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	// every message is wrapped in a data section with up to 8 bytes overhead
+	n := len(p) + 8
+	if b.size+n > b.max {
+		if len(b.data) == 0 {
+			return fmt.Errorf("message size %d exceeds batch size limit %d", n, b.max)
+		}
+		return ErrBatchFull
+	}
+	b.size += n
+	b.data = append(b.data, p)
+	return nil
+}
+
+// Len returns number of messages in the batch.
+func (b *Batch) Len() int {
+	return len(b.data)
+}
+
+// Size returns approximate size of the batch in bytes.
+func (b *Batch) Size() int {
+	return b.size
+}
+
+// SendBatch sends all messages of the batch at once.
+func (c *Client) SendBatch(ctx context.Context, b *Batch, opts ...SendOption) error {
+	if len(b.data) == 0 {
+		return errors.New("batch is empty")
+	}
+	return c.Send(ctx, &amqp.Message{
+		Format: batchMessageFormat,
+		Data:   b.data,
+	}, opts...)
+}
+
+func (s *sendOpts) annotate(msg *amqp.Message) error {
+	if s.partitionKey == "" {
+		return nil
+	}
+	if s.partitionID != "" {
+		return errors.New("partition id and partition key are mutually exclusive")
+	}
+	if msg.Annotations == nil {
+		msg.Annotations = amqp.Annotations{}
+	}
+	msg.Annotations["x-opt-partition-key"] = s.partitionKey
+	return nil
+}
+
+// sender returns a sender link for the hub or its partition,
+// links are created once and reused by subsequent sends.
+func (c *Client) sender(ctx context.Context, partitionID string) (*amqp.Sender, error) {
+	addr := "/" + c.name
+	if partitionID != "" {
+		addr += "/Partitions/" + partitionID
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if send, ok := c.senders[addr]; ok {
+		return send, nil
+	}
+	if c.sess == nil {
+		sess, err := c.conn.NewSession(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.sess = sess
+	}
+	send, err := c.sess.NewSender(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.senders == nil {
+		c.senders = map[string]*amqp.Sender{}
+	}
+	c.senders[addr] = send
+	return send, nil
+}
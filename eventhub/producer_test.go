@@ -0,0 +1,28 @@
+package eventhub
+
+import (
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestBatchAdd(t *testing.T) {
+	b := NewBatch(100)
+	msg := &amqp.Message{Data: [][]byte{make([]byte, 30)}}
+	if err := b.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(msg); err != ErrBatchFull {
+		t.Fatalf("Add() = %v, want %v", err, ErrBatchFull)
+	}
+	if b.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", b.Len())
+	}
+
+	if err := NewBatch(10).Add(msg); err == nil || err == ErrBatchFull {
+		t.Fatalf("Add() = %v, want message too large error", err)
+	}
+}
@@ -5,10 +5,13 @@ go 1.18
 require (
 	github.com/Azure/go-amqp v1.0.1
 	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/gorilla/websocket v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 )
@@ -0,0 +1,136 @@
+// Package iotcentral provisions devices of Azure IoT Central applications.
+//
+// IoT Central devices are registered with the Device Provisioning Service
+// using the application's id scope, the device model id is announced in
+// the registration payload so the device is assigned its device template.
+package iotcentral
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/amenzhinsky/iothub/dps"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// Option is a provisioning option.
+type Option func(p *provisioner)
+
+// WithModelID sets the DTDL model id of the device, e.g.
+// dtmi:com:example:Thermostat;1, IoT Central assigns devices
+// to device templates by it.
+//
+// With the MQTT transport it's also worth passing mqtt.WithModelID
+// so the device follows IoT Plug and Play conventions.
+func WithModelID(id string) Option {
+	return func(p *provisioner) {
+		p.modelID = id
+	}
+}
+
+// WithDPSOptions sets options of the underlying provisioning client.
+func WithDPSOptions(opts ...dps.ClientOption) Option {
+	return func(p *provisioner) {
+		p.dpsOpts = append(p.dpsOpts, opts...)
+	}
+}
+
+// WithClientOptions sets options of the returned device client.
+func WithClientOptions(opts ...iotdevice.ClientOption) Option {
+	return func(p *provisioner) {
+		p.clientOpts = append(p.clientOpts, opts...)
+	}
+}
+
+type provisioner struct {
+	modelID    string
+	dpsOpts    []dps.ClientOption
+	clientOpts []iotdevice.ClientOption
+}
+
+// registrationPayload is the payload IoT Central expects from devices.
+type registrationPayload struct {
+	ModelID string `json:"modelId"`
+}
+
+func newProvisioner(opts []Option) *provisioner {
+	p := &provisioner{}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.modelID != "" {
+		p.dpsOpts = append(p.dpsOpts, dps.WithPayload(&registrationPayload{
+			ModelID: p.modelID,
+		}))
+	}
+	return p
+}
+
+// NewFromSymmetricKey provisions the device with its symmetric key
+// and returns a client connected with the given transport.
+func NewFromSymmetricKey(
+	ctx context.Context, tr transport.Transport, idScope, deviceID, key string, opts ...Option,
+) (*iotdevice.Client, error) {
+	p := newProvisioner(opts)
+	c, err := dps.NewFromSymmetricKey(idScope, deviceID, key, p.dpsOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.Register(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := c.ConnectionString(s)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := iotdevice.NewFromConnectionString(tr, cs, p.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return connect(ctx, dc)
+}
+
+// NewFromGroupKey is like NewFromSymmetricKey but the device key is derived
+// from the SAS group enrollment key of the application, that's the key
+// found on the application's device connection groups page.
+func NewFromGroupKey(
+	ctx context.Context, tr transport.Transport, idScope, deviceID, groupKey string, opts ...Option,
+) (*iotdevice.Client, error) {
+	key, err := dps.DeriveSymmetricKey(groupKey, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromSymmetricKey(ctx, tr, idScope, deviceID, key, opts...)
+}
+
+// NewFromX509 provisions the device with the given certificate, deviceID
+// defaults to its common name, and returns a connected client.
+func NewFromX509(
+	ctx context.Context, tr transport.Transport, idScope, deviceID string, crt *tls.Certificate,
+	opts ...Option,
+) (*iotdevice.Client, error) {
+	p := newProvisioner(opts)
+	c, err := dps.NewFromX509(idScope, deviceID, crt, p.dpsOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.Register(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := iotdevice.NewFromX509Cert(tr, s.DeviceID, s.AssignedHub, crt, p.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return connect(ctx, dc)
+}
+
+func connect(ctx context.Context, c *iotdevice.Client) (*iotdevice.Client, error) {
+	if err := c.Connect(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,85 @@
+package iotcentral
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/dps"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	"github.com/amenzhinsky/iothub/iothubtest"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+const testGroupKey = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func TestNewFromGroupKey(t *testing.T) {
+	hub, err := iothubtest.New(iothubtest.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	key, err := dps.DeriveSymmetricKey(testGroupKey, "golang-central")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := hub.NewServiceClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err = sc.CreateDevice(ctx, &iotservice.Device{
+		DeviceID: "golang-central",
+		Authentication: &iotservice.Authentication{
+			Type:         iotservice.AuthSAS,
+			SymmetricKey: &iotservice.SymmetricKey{PrimaryKey: key, SecondaryKey: key},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var modelID string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct {
+			Payload registrationPayload `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Error(err)
+		}
+		modelID = v.Payload.ModelID
+		_, _ = w.Write([]byte(`{"operationId":"op","status":"assigned","registrationState":{` +
+			`"registrationId":"golang-central","assignedHub":"` + hub.HostName() +
+			`","deviceId":"golang-central","status":"assigned"}}`))
+	}))
+	defer srv.Close()
+
+	dc, err := NewFromGroupKey(ctx, mqtt.New(hub.TransportOptions()...),
+		"scope", "golang-central", testGroupKey,
+		WithModelID("dtmi:com:example:Thermostat;1"),
+		WithDPSOptions(
+			dps.WithEndpoint(strings.TrimPrefix(srv.URL, "https://")),
+			dps.WithHTTPClient(srv.Client()),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if modelID != "dtmi:com:example:Thermostat;1" {
+		t.Errorf("registration model id = %q", modelID)
+	}
+	if err = dc.SendEvent(ctx, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hub.ReceiveEvent(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
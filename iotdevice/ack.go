@@ -0,0 +1,67 @@
+package iotdevice
+
+import "strings"
+
+// WritablePropertyAck is the acknowledgement of a writable property
+// reported in response to a desired property change, it follows the IoT
+// Plug and Play convention: Code is an HTTP status code, e.g. 200 when
+// the value is applied, 202 when applying is in progress or 400 when
+// it's rejected, Version is the $version of the desired state.
+type WritablePropertyAck struct {
+	Value       interface{} `json:"value"`
+	Code        int         `json:"ac"`
+	Version     int         `json:"av"`
+	Description string      `json:"ad,omitempty"`
+}
+
+// Ack returns a reported state patch that acknowledges the named desired
+// properties with the given code and description echoing their values,
+// all properties except components are acknowledged when no names are given.
+//
+// It's meant to be called from twin update handlers, since patches
+// carry the desired $version the acknowledgement refers to:
+//
+//	desired := <-sub.C()
+//	// apply the changes
+//	c.UpdateTwinState(ctx, desired.Ack(200, "applied"))
+func (s TwinState) Ack(code int, description string, names ...string) TwinState {
+	return TwinState(ackProperties(s, s.Version(), code, description, names))
+}
+
+// AckComponent is like Ack but for properties of the named
+// component, the patch is marked as a component one.
+func (s TwinState) AckComponent(component string, code int, description string, names ...string) TwinState {
+	props, _ := s[component].(map[string]interface{})
+	v := ackProperties(props, s.Version(), code, description, names)
+	v["__t"] = "c"
+	return TwinState{component: v}
+}
+
+func ackProperties(
+	props map[string]interface{}, version, code int, description string, names []string,
+) map[string]interface{} {
+	if len(names) == 0 {
+		for k := range props {
+			if !strings.HasPrefix(k, "$") && k != "__t" && !isComponent(props[k]) {
+				names = append(names, k)
+			}
+		}
+	}
+	v := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		v[name] = &WritablePropertyAck{
+			Value:       props[name],
+			Code:        code,
+			Version:     version,
+			Description: description,
+		}
+	}
+	return v
+}
+
+// isComponent reports whether the property is a component,
+// that's an object marked with the "__t": "c" property.
+func isComponent(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	return ok && m["__t"] == "c"
+}
@@ -0,0 +1,49 @@
+package iotdevice
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTwinStateAck(t *testing.T) {
+	var desired TwinState
+	if err := json.Unmarshal([]byte(`{
+  "targetTemperature": 21.5,
+  "fanSpeed": 2,
+  "thermostat1": {"__t": "c", "targetTemperature": 19},
+  "$version": 7
+}`), &desired); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		state TwinState
+		want  string
+	}{
+		{
+			"named",
+			desired.Ack(200, "applied", "targetTemperature"),
+			`{"targetTemperature":{"value":21.5,"ac":200,"av":7,"ad":"applied"}}`,
+		},
+		{
+			"all",
+			desired.Ack(202, ""),
+			`{"fanSpeed":{"value":2,"ac":202,"av":7},` +
+				`"targetTemperature":{"value":21.5,"ac":202,"av":7}}`,
+		},
+		{
+			"component",
+			desired.AckComponent("thermostat1", 400, "out of range"),
+			`{"thermostat1":{"__t":"c","targetTemperature":{"value":19,"ac":400,"av":7,"ad":"out of range"}}}`,
+		},
+	} {
+		b, err := json.Marshal(tc.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("%s: ack = %s, want %s", tc.name, b, tc.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Package bridge mirrors messages between a local MQTT broker, such as
+// mosquitto running on the device, and inputs and outputs of an IoT Edge
+// module, so brownfield MQTT traffic can take part in IoT Hub routing.
+//
+// MQTT 3.1.1 messages don't have properties, so message properties are
+// translated to and from topic segments with topic templates, e.g.
+// messages published to sensors/boiler/temperature and bridged with
+// the sensors/{sensor}/{metric} template get the sensor=boiler and
+// metric=temperature properties, while module messages with the same
+// properties are published to the same topic in the opposite direction.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/logger"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TopicProperty is the property inbound messages carry their local topic in.
+const TopicProperty = "mqtt-topic"
+
+// Broker is a local MQTT broker connection, iotdevice.ModuleClient
+// implements it for the IoT Edge broker and NewPahoBroker adapts
+// paho clients connected to other brokers.
+type Broker interface {
+	Publish(ctx context.Context, topic string, qos int, payload []byte) error
+	Subscribe(ctx context.Context, filter string, qos int, fn func(topic string, payload []byte)) error
+	Unsubscribe(ctx context.Context, filter string) error
+}
+
+// Option is a bridge configuration option.
+type Option func(b *Bridge)
+
+// WithInbound mirrors messages published to local topics matching the
+// template to the named module output, template segments in braces match
+// a single topic level and are translated to message properties, a
+// trailing # segment matches the rest of the topic.
+func WithInbound(template, output string) Option {
+	return func(b *Bridge) {
+		b.inbound = append(b.inbound, &route{template: template, target: output})
+	}
+}
+
+// WithOutbound mirrors messages routed to the named module input to the
+// local topic rendered from the template, segments in braces are replaced
+// with the corresponding message properties, messages missing any of
+// them are dropped.
+func WithOutbound(input, template string) Option {
+	return func(b *Bridge) {
+		b.outbound = append(b.outbound, &route{template: template, target: input})
+	}
+}
+
+// WithQoS sets the QoS of local subscriptions and publishes, default is 1.
+func WithQoS(qos int) Option {
+	return func(b *Bridge) {
+		b.qos = qos
+	}
+}
+
+// WithLogger sets the bridge logger.
+func WithLogger(l logger.Logger) Option {
+	return func(b *Bridge) {
+		b.logger = l
+	}
+}
+
+// New creates a bridge between the module and the local broker,
+// both have to be connected before the bridge is run.
+func New(module *iotdevice.ModuleClient, broker Broker, opts ...Option) (*Bridge, error) {
+	b := &Bridge{
+		module: module,
+		broker: broker,
+		qos:    1,
+		logger: logger.New(logger.LevelWarn, nil),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if len(b.inbound) == 0 && len(b.outbound) == 0 {
+		return nil, errors.New("bridge: no routes")
+	}
+	for _, r := range append(b.inbound, b.outbound...) {
+		if r.target == "" {
+			return nil, fmt.Errorf("bridge: %s: module input or output is empty", r.template)
+		}
+		if err := r.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Bridge mirrors messages between a module and a local broker.
+//
+// Inbound and outbound topics shouldn't overlap,
+// otherwise messages are bridged back and forth.
+type Bridge struct {
+	module   *iotdevice.ModuleClient
+	broker   Broker
+	inbound  []*route
+	outbound []*route
+	qos      int
+	logger   logger.Logger
+}
+
+// Run subscribes to all routes and mirrors messages until ctx is done
+// or a subscription fails, local subscriptions are removed on return.
+func (b *Bridge) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, len(b.outbound)+1)
+	var wg sync.WaitGroup
+	defer func() {
+		// forwarders stop only when ctx is cancelled
+		cancel()
+		wg.Wait()
+	}()
+	for _, r := range b.outbound {
+		sub, err := b.module.SubscribeInput(ctx, r.target)
+		if err != nil {
+			return err
+		}
+		defer b.module.UnsubscribeInputs(sub)
+		wg.Add(1)
+		go func(r *route, sub *iotdevice.EventSub) {
+			defer wg.Done()
+			errc <- b.forwardOutbound(ctx, r, sub)
+		}(r, sub)
+	}
+
+	// local messages are queued, so slow sends don't block
+	// the broker's delivery routine for longer than necessary
+	in := make(chan *inboundMessage, 64)
+	for _, r := range b.inbound {
+		r := r
+		if err := b.broker.Subscribe(ctx, r.filter, b.qos, func(topic string, payload []byte) {
+			select {
+			case in <- &inboundMessage{route: r, topic: topic, payload: payload}:
+			case <-ctx.Done():
+			}
+		}); err != nil {
+			return err
+		}
+		defer func() {
+			uctx, ucancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer ucancel()
+			if err := b.broker.Unsubscribe(uctx, r.filter); err != nil {
+				b.logger.Warnf("unsubscribe %s error: %s", r.filter, err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.forwardInbound(ctx, in)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type inboundMessage struct {
+	route   *route
+	topic   string
+	payload []byte
+}
+
+func (b *Bridge) forwardInbound(ctx context.Context, in <-chan *inboundMessage) {
+	for {
+		select {
+		case msg := <-in:
+			props, ok := msg.route.match(msg.topic)
+			if !ok {
+				continue // overlapping subscriptions
+			}
+			props[TopicProperty] = msg.topic
+			if err := b.module.SendOutputEvent(ctx, msg.route.target, msg.payload,
+				iotdevice.WithSendProperties(props),
+			); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				b.logger.Errorf("%s -> %s error: %s", msg.topic, msg.route.target, err)
+				continue
+			}
+			b.logger.Debugf("%s -> %s", msg.topic, msg.route.target)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Bridge) forwardOutbound(ctx context.Context, r *route, sub *iotdevice.EventSub) error {
+	for {
+		select {
+		case msg, ok := <-sub.C():
+			if !ok {
+				return sub.Err()
+			}
+			topic, err := r.render(msg)
+			if err != nil {
+				b.logger.Warnf("%s -> %s dropped: %s", r.target, r.template, err)
+				continue
+			}
+			if err = b.broker.Publish(ctx, topic, b.qos, msg.Payload); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				b.logger.Errorf("%s -> %s error: %s", r.target, topic, err)
+				continue
+			}
+			b.logger.Debugf("%s -> %s", r.target, topic)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// route is a parsed topic template.
+type route struct {
+	template string
+	target   string // module input or output
+	segments []string
+	filter   string // MQTT topic filter of the template
+}
+
+func (r *route) parse() error {
+	if r.template == "" {
+		return errors.New("bridge: topic template is empty")
+	}
+	r.segments = strings.Split(r.template, "/")
+	filter := make([]string, len(r.segments))
+	for i, s := range r.segments {
+		switch {
+		case s == "#" && i != len(r.segments)-1:
+			return fmt.Errorf("bridge: %s: # has to be the last segment", r.template)
+		case isParam(s):
+			filter[i] = "+"
+		case strings.ContainsAny(s, "{}"):
+			return fmt.Errorf("bridge: %s: malformed segment %q", r.template, s)
+		default:
+			filter[i] = s
+		}
+	}
+	r.filter = strings.Join(filter, "/")
+	return nil
+}
+
+// match matches the topic against the template
+// returning properties of the parametrized segments.
+func (r *route) match(topic string) (map[string]string, bool) {
+	parts := strings.Split(topic, "/")
+	props := map[string]string{}
+	for i, s := range r.segments {
+		if s == "#" {
+			return props, true
+		}
+		if i == len(parts) {
+			return nil, false
+		}
+		switch {
+		case isParam(s):
+			props[s[1:len(s)-1]] = parts[i]
+		case s == "+":
+		case s != parts[i]:
+			return nil, false
+		}
+	}
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return props, true
+}
+
+// render returns the template topic with parameters
+// substituted with the message properties.
+func (r *route) render(msg *common.Message) (string, error) {
+	parts := make([]string, len(r.segments))
+	for i, s := range r.segments {
+		if !isParam(s) {
+			if s == "+" || s == "#" {
+				return "", fmt.Errorf("wildcard %q cannot be published to", s)
+			}
+			parts[i] = s
+			continue
+		}
+		v := msg.Properties[s[1:len(s)-1]]
+		if v == "" || strings.ContainsAny(v, "/+#") {
+			return "", fmt.Errorf("property %s is empty or not a topic level", s)
+		}
+		parts[i] = v
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+func isParam(s string) bool {
+	return len(s) > 2 && s[0] == '{' && s[len(s)-1] == '}'
+}
+
+// NewPahoBroker adapts the connected paho client to the Broker interface.
+func NewPahoBroker(c mqtt.Client) Broker {
+	return &pahoBroker{c: c}
+}
+
+type pahoBroker struct {
+	c mqtt.Client
+}
+
+func (b *pahoBroker) Publish(ctx context.Context, topic string, qos int, payload []byte) error {
+	return wait(ctx, b.c.Publish(topic, byte(qos), false, payload))
+}
+
+func (b *pahoBroker) Subscribe(
+	ctx context.Context, filter string, qos int, fn func(topic string, payload []byte),
+) error {
+	return wait(ctx, b.c.Subscribe(filter, byte(qos), func(_ mqtt.Client, m mqtt.Message) {
+		fn(m.Topic(), m.Payload())
+	}))
+}
+
+func (b *pahoBroker) Unsubscribe(ctx context.Context, filter string) error {
+	return wait(ctx, b.c.Unsubscribe(filter))
+}
+
+func wait(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
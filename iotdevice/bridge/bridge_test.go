@@ -0,0 +1,266 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
+)
+
+func TestRouteMatch(t *testing.T) {
+	for _, s := range []struct {
+		template string
+		topic    string
+		props    map[string]string
+	}{
+		{"sensors/{sensor}/{metric}", "sensors/boiler/temp", map[string]string{
+			"sensor": "boiler", "metric": "temp",
+		}},
+		{"sensors/{sensor}/{metric}", "sensors/boiler", nil},
+		{"sensors/{sensor}/{metric}", "sensors/boiler/temp/raw", nil},
+		{"sensors/{sensor}/#", "sensors/boiler/temp/raw", map[string]string{
+			"sensor": "boiler",
+		}},
+		{"sensors/+/temp", "sensors/boiler/temp", map[string]string{}},
+		{"sensors/+/temp", "alarms/boiler/temp", nil},
+	} {
+		r := &route{template: s.template, target: "out"}
+		if err := r.parse(); err != nil {
+			t.Fatal(err)
+		}
+		props, ok := r.match(s.topic)
+		if ok != (s.props != nil) {
+			t.Errorf("%s match %s = %t", s.template, s.topic, ok)
+			continue
+		}
+		if !equal(props, s.props) {
+			t.Errorf("%s match %s = %v, want %v", s.template, s.topic, props, s.props)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithInbound("a/{b/c", "out")},
+		{WithInbound("a/#/c", "out")},
+		{WithOutbound("", "a/b")},
+	} {
+		if _, err := New(nil, &fakeBroker{}, opts...); err == nil {
+			t.Errorf("New(%d options) error is nil", len(opts))
+		}
+	}
+}
+
+func newModuleClient(t *testing.T) (*iotdevice.ModuleClient, *transporttest.Transport) {
+	t.Helper()
+	tr := transporttest.New()
+	creds, err := iotdevice.ParseModuleConnectionString(
+		transporttest.ConnectionString + ";ModuleId=bridge",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := iotdevice.NewModule(tr, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mc.Close()
+	})
+	if err = mc.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return mc, tr
+}
+
+// runBridge runs the bridge and returns the Run error
+// failing the test if it doesn't return in time.
+func runBridge(t *testing.T, ctx context.Context, b *Bridge, fn func()) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+	if fn != nil {
+		fn()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Run doesn't return")
+		return nil
+	}
+}
+
+func TestBridgeSubscribeError(t *testing.T) {
+	mc, _ := newModuleClient(t)
+	subErr := errors.New("not authorized")
+	b, err := New(mc, &fakeBroker{subs: map[string]func(string, []byte){}, subErr: subErr},
+		WithInbound("sensors/{sensor}", "telemetry"),
+		WithOutbound("commands", "actuators/{actuator}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runBridge(t, context.Background(), b, nil); err != subErr {
+		t.Fatalf("Run error = %v, want %v", err, subErr)
+	}
+}
+
+func TestBridgeSubscriptionClosed(t *testing.T) {
+	mc, _ := newModuleClient(t)
+	broker := &fakeBroker{subs: map[string]func(string, []byte){}}
+	b, err := New(mc, broker,
+		WithInbound("sensors/{sensor}", "telemetry"),
+		WithOutbound("commands", "actuators/{actuator}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runBridge(t, context.Background(), b, func() {
+		broker.waitSub(t, "sensors/+")
+		mc.Close()
+	}); err != iotdevice.ErrClosed {
+		t.Fatalf("Run error = %v, want %v", err, iotdevice.ErrClosed)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	mc, tr := newModuleClient(t)
+
+	broker := &fakeBroker{
+		subs:      map[string]func(string, []byte){},
+		published: make(chan *published, 1),
+	}
+	b, err := New(mc, broker,
+		WithInbound("sensors/{sensor}/{metric}", "telemetry"),
+		WithOutbound("commands", "actuators/{actuator}/set"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+	fn := broker.waitSub(t, "sensors/+/+")
+	fn("sensors/boiler/temp", []byte("42"))
+
+	sent, err := tr.WaitSent(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := sent[0]
+	if msg.OutputName != "telemetry" || string(msg.Payload) != "42" {
+		t.Errorf("sent = %q to %q, want %q to %q", msg.Payload, msg.OutputName, "42", "telemetry")
+	}
+	if want := map[string]string{
+		"sensor":      "boiler",
+		"metric":      "temp",
+		TopicProperty: "sensors/boiler/temp",
+	}; !equal(msg.Properties, want) {
+		t.Errorf("properties = %v, want %v", msg.Properties, want)
+	}
+
+	// the input subscription is made before local ones
+	if err = tr.SendInput("commands", &common.Message{
+		Payload:    []byte("open"),
+		Properties: map[string]string{"actuator": "valve"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-broker.published:
+		if p.topic != "actuators/valve/set" || string(p.payload) != "open" {
+			t.Errorf("published %q to %q", p.payload, p.topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message is not published")
+	}
+
+	cancel()
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run error = %v, want %v", err, context.Canceled)
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.subs) != 0 {
+		t.Errorf("subscriptions left after Run: %v", broker.subs)
+	}
+}
+
+type published struct {
+	topic   string
+	payload []byte
+}
+
+type fakeBroker struct {
+	mu        sync.Mutex
+	subs      map[string]func(string, []byte)
+	subErr    error
+	published chan *published
+}
+
+func (b *fakeBroker) waitSub(t *testing.T, filter string) func(string, []byte) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		b.mu.Lock()
+		fn := b.subs[filter]
+		b.mu.Unlock()
+		if fn != nil {
+			return fn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not subscribed", filter)
+	return nil
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, topic string, qos int, payload []byte) error {
+	select {
+	case b.published <- &published{topic: topic, payload: payload}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *fakeBroker) Subscribe(
+	ctx context.Context, filter string, qos int, fn func(topic string, payload []byte),
+) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subErr != nil {
+		return b.subErr
+	}
+	b.subs[filter] = fn
+	return nil
+}
+
+func (b *fakeBroker) Unsubscribe(ctx context.Context, filter string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, filter)
+	return nil
+}
+
+func equal(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -9,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +30,18 @@ func WithLogger(l logger.Logger) ClientOption {
 	}
 }
 
+// WithSendRateLimit limits the rate of device-to-cloud messages to
+// msgsPerSecond with bursts of up to burst messages, so fleets stay under
+// the hub's throttling limits instead of causing throttling errors
+// when devices reconnect at once. Every send attempt including
+// retries waits for the limiter. Panics on non-positive values.
+func WithSendRateLimit(msgsPerSecond float64, burst int) ClientOption {
+	l := common.NewRateLimiter(msgsPerSecond, burst)
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
 // NewFromConnectionString creates a device client based on the given connection string.
 func NewFromConnectionString(
 	transport transport.Transport, cs string, opts ...ClientOption,
@@ -39,13 +53,43 @@ func NewFromConnectionString(
 	return New(transport, creds, opts...)
 }
 
+// ParseConnectionString parses a device connection string,
+// it fails when required keys are missing, unknown keys are ignored.
+//
+// GatewayHostName makes the device connect through the named edge gateway,
+// x509 and module connection strings are rejected with a hint
+// to use ParseX509ConnectionString or ParseModuleConnectionString.
 func ParseConnectionString(cs string) (*SharedAccessKeyCredentials, error) {
-	m, err := common.ParseConnectionString(cs, "DeviceId", "SharedAccessKey")
+	return parseConnectionString(cs, false)
+}
+
+// ParseConnectionStringStrict is ParseConnectionString that
+// also fails when unknown or duplicated keys are present.
+func ParseConnectionStringStrict(cs string) (*SharedAccessKeyCredentials, error) {
+	return parseConnectionString(cs, true)
+}
+
+func parseConnectionString(cs string, strict bool) (*SharedAccessKeyCredentials, error) {
+	m, err := common.ParseConnectionString(cs)
+	if err != nil {
+		return nil, err
+	}
+	if m["ModuleId"] != "" {
+		return nil, errors.New("module connection string, use ParseModuleConnectionString")
+	}
+	if isX509(m) {
+		return nil, errors.New("x509 connection string, use ParseX509ConnectionString")
+	}
+	m, err = parseKeys(cs, strict,
+		[]string{"HostName", "DeviceId", "SharedAccessKey"},
+		"SharedAccessKeyName", "GatewayHostName",
+	)
 	if err != nil {
 		return nil, err
 	}
 	return &SharedAccessKeyCredentials{
-		DeviceID: m["DeviceId"],
+		DeviceID:        m["DeviceId"],
+		GatewayHostName: m["GatewayHostName"],
 		SharedAccessKey: common.SharedAccessKey{
 			HostName:            m["HostName"],
 			SharedAccessKeyName: m["SharedAccessKeyName"],
@@ -54,6 +98,66 @@ func ParseConnectionString(cs string) (*SharedAccessKeyCredentials, error) {
 	}, nil
 }
 
+// ParseX509ConnectionString parses a connection string with the x509 flag
+// set, e.g. HostName=h;DeviceId=d;x509=true, that has no key so the
+// certificate used for authentication has to be provided separately.
+func ParseX509ConnectionString(cs string, crt *tls.Certificate) (*X509Credentials, error) {
+	return parseX509ConnectionString(cs, crt, false)
+}
+
+// ParseX509ConnectionStringStrict is ParseX509ConnectionString that
+// also fails when unknown or duplicated keys are present.
+func ParseX509ConnectionStringStrict(cs string, crt *tls.Certificate) (*X509Credentials, error) {
+	return parseX509ConnectionString(cs, crt, true)
+}
+
+func parseX509ConnectionString(cs string, crt *tls.Certificate, strict bool) (*X509Credentials, error) {
+	if crt == nil {
+		return nil, errors.New("certificate is required")
+	}
+	m, err := parseKeys(cs, strict,
+		[]string{"HostName", "DeviceId", "x509"},
+		"GatewayHostName",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !isX509(m) {
+		return nil, errors.New("x509 flag is not set")
+	}
+	return &X509Credentials{
+		HostName:        m["HostName"],
+		DeviceID:        m["DeviceId"],
+		Certificate:     crt,
+		GatewayHostName: m["GatewayHostName"],
+	}, nil
+}
+
+func isX509(m map[string]string) bool {
+	return strings.EqualFold(m["x509"], "true")
+}
+
+// parseKeys parses the connection string checking the required keys,
+// in the strict mode unknown and duplicated keys are rejected too.
+func parseKeys(cs string, strict bool, require []string, optional ...string) (map[string]string, error) {
+	if strict {
+		return common.ParseConnectionStringStrict(cs, require, optional...)
+	}
+	return common.ParseConnectionString(cs, require...)
+}
+
+// NewFromX509ConnectionString creates a device client based on the given
+// x509 connection string and the certificate, see ParseX509ConnectionString.
+func NewFromX509ConnectionString(
+	transport transport.Transport, cs string, crt *tls.Certificate, opts ...ClientOption,
+) (*Client, error) {
+	creds, err := ParseX509ConnectionString(cs, crt)
+	if err != nil {
+		return nil, err
+	}
+	return New(transport, creds, opts...)
+}
+
 func NewFromX509Cert(
 	transport transport.Transport,
 	deviceID, hostName string, crt *tls.Certificate,
@@ -78,6 +182,24 @@ func NewFromX509FromFile(
 	return NewFromX509Cert(transport, deviceID, hostname, &crt, opts...)
 }
 
+// NewFromX509PKCS12File is NewFromX509FromFile that reads the certificate
+// and its private key from a password protected PKCS#12 (PFX) bundle,
+// deviceID defaults to the certificate's common name.
+func NewFromX509PKCS12File(
+	transport transport.Transport,
+	deviceID, hostname, pfxFile, password string,
+	opts ...ClientOption,
+) (*Client, error) {
+	crt, err := common.LoadPKCS12(pfxFile, password)
+	if err != nil {
+		return nil, err
+	}
+	if deviceID == "" {
+		deviceID = crt.Leaf.Subject.CommonName
+	}
+	return NewFromX509Cert(transport, deviceID, hostname, crt, opts...)
+}
+
 // New returns new iothub client.
 func New(
 	transport transport.Transport, creds transport.Credentials, opts ...ClientOption,
@@ -93,17 +215,32 @@ func New(
 		evMux: newEventsMux(),
 		tsMux: newTwinStateMux(),
 		dmMux: newMethodMux(),
+		inMux: newEventsMux(),
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
+	c.startDispatch()
+	c.trackReconnects()
 
 	// transport uses the same logger as the client
 	c.tr.SetLogger(c.logger)
 	return c, nil
 }
 
+// trackReconnects updates the connection time when
+// the transport restores the connection on its own.
+func (c *Client) trackReconnects() {
+	if n, ok := c.tr.(transport.ReconnectNotifier); ok {
+		n.NotifyReconnect(func() {
+			c.mu.Lock()
+			c.connectedAt = time.Now()
+			c.mu.Unlock()
+		})
+	}
+}
+
 // Client is iothub device client.
 type Client struct {
 	creds transport.Credentials
@@ -118,6 +255,17 @@ type Client struct {
 	evMux *eventsMux
 	tsMux *twinStateMux
 	dmMux *methodMux
+	inMux *eventsMux // module inputs
+
+	dispatchWorkers int           // WithDispatchWorkers
+	dispatchOrdered bool          // WithOrderedDispatch
+	pool            *dispatchPool // nil when workers are disabled
+
+	limiter *common.RateLimiter // WithSendRateLimit
+
+	connectedAt time.Time // last successful Connect or automatic reconnect
+
+	inflight inflight // in-progress publishes and twin requests
 }
 
 // DirectMethodHandler handles direct method invocations.
@@ -125,8 +273,39 @@ type DirectMethodHandler func(payload map[string]interface{}) (
 	code int, response map[string]interface{}, err error,
 )
 
+// RawDirectMethodHandler handles direct method invocations with payloads
+// in their JSON form, so they can be decoded into arbitrary types
+// without losing number precision. Empty response is sent as {}.
+type RawDirectMethodHandler func(payload json.RawMessage) (
+	code int, response json.RawMessage, err error,
+)
+
+// raw converts the map based handler into a raw one.
+func (fn DirectMethodHandler) raw() RawDirectMethodHandler {
+	return func(payload json.RawMessage) (int, json.RawMessage, error) {
+		var v map[string]interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return 0, nil, err
+		}
+		code, v, err := fn(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		if v == nil {
+			return code, nil, nil
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		return code, b, nil
+	}
+}
+
 // DeviceID returns iothub device id.
 func (c *Client) DeviceID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.creds.GetDeviceID()
 }
 
@@ -144,6 +323,7 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 	err := c.tr.Connect(ctx, c.creds)
 	if err == nil {
+		c.connectedAt = time.Now()
 		close(c.ready)
 	}
 	c.mu.Unlock()
@@ -151,13 +331,78 @@ func (c *Client) Connect(ctx context.Context) error {
 	return err
 }
 
+// UpdateCredentials replaces the client's credentials,
+// they're used starting from the next Connect or Reconnect call.
+func (c *Client) UpdateCredentials(creds transport.Credentials) {
+	c.mu.Lock()
+	c.creds = creds
+	c.mu.Unlock()
+}
+
+// Disconnect disconnects the client from the iothub keeping all
+// subscriptions and registered methods, so it can be connected again.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case <-c.ready:
+	default:
+		return errors.New("not connected")
+	}
+	if err := c.tr.Disconnect(); err != nil {
+		return err
+	}
+	c.ready = make(chan struct{})
+	return nil
+}
+
+// Reconnect gracefully disconnects from the iothub and connects
+// back using the current credentials restoring all subscriptions,
+// it's useful for applying rotated keys or certificates.
+func (c *Client) Reconnect(ctx context.Context) error {
+	if err := c.Disconnect(); err != nil {
+		return err
+	}
+	return c.Connect(ctx)
+}
+
+// ConnectionState returns the current connection state of the underlying transport.
+func (c *Client) ConnectionState() transport.ConnectionState {
+	select {
+	case <-c.done:
+		return transport.Disconnected
+	default:
+	}
+	return c.tr.ConnectionState()
+}
+
+// IsConnected reports whether the client is connected to the iothub,
+// it's useful for health checks and readiness probes.
+func (c *Client) IsConnected() bool {
+	return c.ConnectionState() == transport.Connected
+}
+
 // ErrClosed the client is already closed.
 var ErrClosed = errors.New("closed")
 
 func (c *Client) checkConnection(ctx context.Context) error {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
 	select {
-	case <-c.ready:
-		return nil
+	case <-ready:
+		// ready stays closed after the client is closed
+		select {
+		case <-c.done:
+			return ErrClosed
+		default:
+			return nil
+		}
 	case <-c.done:
 		return ErrClosed
 	case <-ctx.Done():
@@ -166,7 +411,7 @@ func (c *Client) checkConnection(ctx context.Context) error {
 }
 
 // SubscribeEvents subscribes to cloud-to-device events and returns a subscription struct.
-func (c *Client) SubscribeEvents(ctx context.Context) (*EventSub, error) {
+func (c *Client) SubscribeEvents(ctx context.Context, opts ...SubscriptionOption) (*EventSub, error) {
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
@@ -175,7 +420,7 @@ func (c *Client) SubscribeEvents(ctx context.Context) (*EventSub, error) {
 	}); err != nil {
 		return nil, err
 	}
-	return c.evMux.sub(), nil
+	return c.evMux.sub(opts...), nil
 }
 
 // UnsubscribeEvents makes the given subscription to stop receiving messages.
@@ -188,6 +433,15 @@ func (c *Client) UnsubscribeEvents(sub *EventSub) {
 // If fn returns an error and empty body its error string
 // used as value of the error attribute in the result json.
 func (c *Client) RegisterMethod(ctx context.Context, name string, fn DirectMethodHandler) error {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return c.RegisterRawMethod(ctx, name, fn.raw())
+}
+
+// RegisterRawMethod is RegisterMethod that doesn't decode
+// payloads and encode responses, see RawDirectMethodHandler.
+func (c *Client) RegisterRawMethod(ctx context.Context, name string, fn RawDirectMethodHandler) error {
 	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
@@ -221,7 +475,9 @@ func (c *Client) RetrieveTwinState(ctx context.Context) (desired, reported TwinS
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, nil, err
 	}
+	c.inflight.add()
 	b, err := c.tr.RetrieveTwinProperties(ctx)
+	c.inflight.done()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -245,11 +501,13 @@ func (c *Client) UpdateTwinState(ctx context.Context, s TwinState) (int, error)
 	if err != nil {
 		return 0, err
 	}
+	c.inflight.add()
+	defer c.inflight.done()
 	return c.tr.UpdateTwinProperties(ctx, b)
 }
 
 // SubscribeTwinUpdates registers fn as a desired state changes handler.
-func (c *Client) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error) {
+func (c *Client) SubscribeTwinUpdates(ctx context.Context, opts ...SubscriptionOption) (*TwinStateSub, error) {
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
@@ -258,7 +516,23 @@ func (c *Client) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error
 	}); err != nil {
 		return nil, err
 	}
-	return c.tsMux.sub(), nil
+	return c.tsMux.sub(opts...), nil
+}
+
+// SubscribeTwinUpdatesFiltered is SubscribeTwinUpdates that delivers only
+// patches touching the given dot-separated property path, e.g. desired.config.*,
+// where * matches any property. Delivered states contain only the matching
+// sub-document and the version.
+func (c *Client) SubscribeTwinUpdatesFiltered(
+	ctx context.Context, path string, opts ...SubscriptionOption,
+) (*TwinStateSub, error) {
+	p, err := parseTwinPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.SubscribeTwinUpdates(ctx, append(opts, func(cfg *subConfig) {
+		cfg.path = p
+	})...)
 }
 
 // UnsubscribeTwinUpdates unsubscribes the given handler from twin state updates.
@@ -267,93 +541,309 @@ func (c *Client) UnsubscribeTwinUpdates(sub *TwinStateSub) {
 }
 
 // SendOption is a send event options.
-type SendOption func(msg *common.Message) error
+type SendOption func(o *sendOptions) error
+
+// sendOptions are options of a single send, message attributes are set
+// on msg directly, the rest aren't passed to the transport.
+type sendOptions struct {
+	msg   *common.Message
+	retry *RetryPolicy
+}
 
 // WithSendQoS sets the quality of service (MQTT only).
 // Only 0 and 1 values are supported, defaults to 1.
 func WithSendQoS(qos int) SendOption {
-	return func(msg *common.Message) error {
-		if msg.TransportOptions == nil {
-			msg.TransportOptions = map[string]interface{}{}
+	return func(o *sendOptions) error {
+		if o.msg.TransportOptions == nil {
+			o.msg.TransportOptions = map[string]interface{}{}
 		}
-		msg.TransportOptions["qos"] = qos
+		o.msg.TransportOptions["qos"] = qos
 		return nil
 	}
 }
 
 // WithSendMessageID sets message id.
 func WithSendMessageID(mid string) SendOption {
-	return func(msg *common.Message) error {
-		msg.MessageID = mid
+	return func(o *sendOptions) error {
+		o.msg.MessageID = mid
 		return nil
 	}
 }
 
 // WithSendCorrelationID sets message correlation id.
 func WithSendCorrelationID(cid string) SendOption {
-	return func(msg *common.Message) error {
-		msg.CorrelationID = cid
+	return func(o *sendOptions) error {
+		o.msg.CorrelationID = cid
 		return nil
 	}
 }
 
 // WithSendProperty sets a message option.
 func WithSendProperty(k, v string) SendOption {
-	return func(msg *common.Message) error {
-		if msg.Properties == nil {
-			msg.Properties = map[string]string{}
+	return func(o *sendOptions) error {
+		if o.msg.Properties == nil {
+			o.msg.Properties = map[string]string{}
 		}
-		msg.Properties[k] = v
+		o.msg.Properties[k] = v
 		return nil
 	}
 }
 
 // WithSendProperties same as `WithSendProperty` but accepts map of keys and values.
 func WithSendProperties(m map[string]string) SendOption {
-	return func(msg *common.Message) error {
-		if msg.Properties == nil {
-			msg.Properties = map[string]string{}
+	return func(o *sendOptions) error {
+		if o.msg.Properties == nil {
+			o.msg.Properties = map[string]string{}
 		}
 		for k, v := range m {
-			msg.Properties[k] = v
+			o.msg.Properties[k] = v
 		}
 		return nil
 	}
 }
 
+// WithSendContentType sets the payload's content type.
+func WithSendContentType(contentType string) SendOption {
+	return func(o *sendOptions) error {
+		o.msg.ContentType = contentType
+		return nil
+	}
+}
+
+// WithSendContentEncoding sets the payload's content encoding.
+func WithSendContentEncoding(contentEncoding string) SendOption {
+	return func(o *sendOptions) error {
+		o.msg.ContentEncoding = contentEncoding
+		return nil
+	}
+}
+
+// WithSendInterfaceID sets the interface id system property.
+func WithSendInterfaceID(id string) SendOption {
+	return func(o *sendOptions) error {
+		o.msg.InterfaceID = id
+		return nil
+	}
+}
+
+// WithSendComponentName sets the IoT Plug and Play component name
+// of the telemetry, routing queries can refer to it as $dt-subject.
+func WithSendComponentName(name string) SendOption {
+	return func(o *sendOptions) error {
+		o.msg.ComponentName = name
+		return nil
+	}
+}
+
 func WithSendExpiryTime(t time.Time) SendOption {
-	return func(msg *common.Message) error {
-		msg.ExpiryTime = &t
+	return func(o *sendOptions) error {
+		o.msg.ExpiryTime = &t
+		return nil
+	}
+}
+
+// WithSendTTL sets the message expiry time relative to now,
+// edgeHub drops expired messages from its store-and-forward queue.
+func WithSendTTL(ttl time.Duration) SendOption {
+	return func(o *sendOptions) error {
+		if ttl <= 0 {
+			return errors.New("ttl must be positive")
+		}
+		t := time.Now().Add(ttl)
+		o.msg.ExpiryTime = &t
 		return nil
 	}
 }
 
+// PriorityProperty is the application property set by WithSendPriority.
+const PriorityProperty = "priority"
+
+// WithSendPriority sets the priority application property to 0-9.
+//
+// It's an ordinary application property that neither IoT Hub nor edgeHub
+// interpret, messages aren't prioritized unless routes select them by it,
+// e.g. FROM /messages/* WHERE priority = 0 INTO $upstream, in routes that
+// have a priority set in the edgeHub deployment.
+func WithSendPriority(priority int) SendOption {
+	return func(o *sendOptions) error {
+		if priority < 0 || priority > 9 {
+			return fmt.Errorf("priority must be in range 0-9, got %d", priority)
+		}
+		return WithSendProperty(PriorityProperty, strconv.Itoa(priority))(o)
+	}
+}
+
 func WithSendCreationTime(t time.Time) SendOption {
-	return func(msg *common.Message) error {
-		msg.EnqueuedTime = &t
+	return func(o *sendOptions) error {
+		o.msg.EnqueuedTime = &t
+		return nil
+	}
+}
+
+// RetryPolicy controls retrying of transient send failures.
+type RetryPolicy struct {
+	// Deadline limits total time spent on sending including all retries,
+	// zero means retrying until the context is done.
+	Deadline time.Duration
+
+	// Backoff is the delay before the first retry, it's doubled
+	// after each failed attempt up to MaxBackoff.
+	// Default to 100ms and 5s respectively.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether the given error is transient,
+	// when it's nil all errors are retried except context cancellations.
+	Retryable func(err error) bool
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// WithSendRetry makes SendEvent retry transient publish failures,
+// such as token timeouts or reconnect windows, according to the given policy
+// instead of failing immediately when the broker briefly drops.
+func WithSendRetry(policy RetryPolicy) SendOption {
+	return func(o *sendOptions) error {
+		if policy.Deadline < 0 || policy.Backoff < 0 || policy.MaxBackoff < 0 {
+			return errors.New("retry policy durations cannot be negative")
+		}
+		o.retry = &policy
 		return nil
 	}
 }
 
 // SendEvent sends a device-to-cloud message.
-// Panics when event is nil.
+// Messages exceeding IoT Hub limits are rejected with Message.Validate errors
+// before they reach the transport.
 func (c *Client) SendEvent(ctx context.Context, payload []byte, opts ...SendOption) error {
 	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
 	msg := &common.Message{Payload: payload}
+	o := &sendOptions{msg: msg}
 	for _, opt := range opts {
-		if err := opt(msg); err != nil {
+		if err := opt(o); err != nil {
 			return err
 		}
 	}
-	if err := c.tr.Send(ctx, msg); err != nil {
+	if err := msg.Validate(common.MaxD2CMessageSize); err != nil {
+		return err
+	}
+	c.inflight.add()
+	defer c.inflight.done()
+
+	var err error
+	if o.retry != nil {
+		err = c.sendWithRetry(ctx, msg, o.retry)
+	} else {
+		err = c.send(ctx, msg)
+	}
+	if err != nil {
 		return err
 	}
 	c.logger.Debugf("device-to-cloud: %#v", msg)
 	return nil
 }
 
+// SendEventReader sends a device-to-cloud message with the payload of
+// size bytes read from r, see SendEvent. It's a convenience for sending
+// payloads from files or pipes, the payload is still buffered in memory
+// as a whole because transports frame whole messages, sizes over
+// the hub limit are rejected before anything is read.
+func (c *Client) SendEventReader(
+	ctx context.Context, r io.Reader, size int64, opts ...SendOption,
+) error {
+	b, err := common.ReadPayload(r, size, common.MaxD2CMessageSize)
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, b, opts...)
+}
+
+// send sends the message once the rate limiter allows it.
+func (c *Client) send(ctx context.Context, msg *common.Message) error {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return c.tr.Send(ctx, msg)
+}
+
+func (c *Client) sendWithRetry(ctx context.Context, msg *common.Message, policy *RetryPolicy) error {
+	if policy.Deadline != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Deadline)
+		defer cancel()
+	}
+	backoff, maxBackoff := policy.Backoff, policy.MaxBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if maxBackoff == 0 {
+		maxBackoff = 5 * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := c.send(ctx, msg)
+		if err == nil || !policy.retryable(err) {
+			return err
+		}
+		c.logger.Warnf("send attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Drain blocks until all in-flight publishes and twin requests
+// complete or the context is done, operations started while
+// draining are waited for as well.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.inflight.wait(ctx)
+}
+
+// CloseWithTimeout waits up to the given timeout for in-flight publishes
+// and twin requests to finish and closes the client afterwards,
+// so the last telemetry batch isn't silently dropped on shutdown.
+//
+// Returns context.DeadlineExceeded when the client has been closed
+// with operations still in progress.
+func (c *Client) CloseWithTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	derr := c.Drain(ctx)
+	if err := c.Close(); err != nil {
+		return err
+	}
+	return derr
+}
+
+// SecurityInterfaceID is the interface id of Defender for IoT security messages.
+const SecurityInterfaceID = "urn:azureiot:Security:SecurityAgent:1"
+
+// SendSecurityMessage sends a Defender for IoT security message,
+// that's a regular event with the security interface id set.
+func (c *Client) SendSecurityMessage(ctx context.Context, payload []byte, opts ...SendOption) error {
+	return c.SendEvent(ctx, payload, append(opts, WithSendInterfaceID(SecurityInterfaceID))...)
+}
+
 // Close closes transport connection.
 func (c *Client) Close() error {
 	c.mu.Lock()
@@ -365,6 +855,10 @@ func (c *Client) Close() error {
 		close(c.done)
 		c.evMux.close(ErrClosed)
 		c.tsMux.close(ErrClosed)
+		c.inMux.close(ErrClosed)
+		if c.pool != nil {
+			c.pool.close()
+		}
 		return c.tr.Close()
 	}
 }
@@ -436,3 +930,46 @@ func (c *Client) DeleteModule(ctx context.Context, m *iotservice.Module) error {
 
 	return c.tr.DeleteModule(ctx, m)
 }
+
+// inflight counts in-progress operations.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero, nil when nobody waits
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	f.n++
+	f.mu.Unlock()
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	f.n--
+	if f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+	f.mu.Unlock()
+}
+
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
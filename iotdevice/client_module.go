@@ -1,10 +1,21 @@
 package iotdevice
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/iotservice"
 	"github.com/amenzhinsky/iothub/logger"
 )
 
@@ -13,8 +24,16 @@ import (
 // ModuleClient is iothub device client adapted for use with a module connection
 type ModuleClient struct {
 	Client
+
+	edgeMu   sync.Mutex
+	edgeHTTP *http.Client // edgeHub REST client
+	edgeAt   time.Time    // when edgeHTTP was created
 }
 
+// edgeRefreshInterval is how often the edgeHub REST client is recreated
+// to pick up a rotated trust bundle, it matches the MQTT transport default.
+const edgeRefreshInterval = 15 * time.Minute
+
 // functions
 
 // NewModuleFromConnectionString returns a ModuleClient struct with credentials based off of a supplied connection string
@@ -37,6 +56,9 @@ func NewModuleFromConnectionString(
 	return NewModule(transport, creds, opts...)
 }
 
+// NewModuleFromEnvironment creates a module client from IOTEDGE_* environment
+// variables set by the IoT Edge runtime, when edge is true the module
+// connects through the edgeHub gateway instead of the hub directly.
 func NewModuleFromEnvironment(
 	transport transport.Transport,
 	edge bool,
@@ -46,10 +68,16 @@ func NewModuleFromEnvironment(
 	if err != nil {
 		return nil, err
 	}
+	if edge && creds.Gateway == "" {
+		return nil, errors.New(
+			"IOTEDGE_GATEWAYHOSTNAME environment variable is required to connect through the edge gateway",
+		)
+	}
 	creds.EdgeGateway = edge
 	return NewModule(transport, creds, opts...)
 }
 
+// ParseModuleEnvironmentVariables creates module credentials from IOTEDGE_* environment variables.
 func ParseModuleEnvironmentVariables() (*ModuleSharedAccessKeyCredentials, error) {
 	m, err := common.GetEdgeModuleEnvironmentVariables()
 	if err != nil {
@@ -71,7 +99,20 @@ func ParseModuleEnvironmentVariables() (*ModuleSharedAccessKeyCredentials, error
 
 // ParseModuleConnectionString returns a ModuleSharedAccessKeyCredentials struct with some properties derived from a supplied connection string
 func ParseModuleConnectionString(cs string) (*ModuleSharedAccessKeyCredentials, error) {
-	m, err := common.ParseConnectionString(cs, "DeviceId", "ModuleId")
+	return parseModuleConnectionString(cs, false)
+}
+
+// ParseModuleConnectionStringStrict is ParseModuleConnectionString that
+// also fails when unknown or duplicated keys are present.
+func ParseModuleConnectionStringStrict(cs string) (*ModuleSharedAccessKeyCredentials, error) {
+	return parseModuleConnectionString(cs, true)
+}
+
+func parseModuleConnectionString(cs string, strict bool) (*ModuleSharedAccessKeyCredentials, error) {
+	m, err := parseKeys(cs, strict,
+		[]string{"HostName", "DeviceId", "ModuleId", "SharedAccessKey"},
+		"SharedAccessKeyName", "GatewayHostName",
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +126,7 @@ func ParseModuleConnectionString(cs string) (*ModuleSharedAccessKeyCredentials,
 			},
 		},
 		ModuleID: m["ModuleId"],
+		Gateway:  m["GatewayHostName"],
 	}, nil
 }
 
@@ -104,12 +146,15 @@ func NewModule(
 			evMux: newEventsMux(),
 			tsMux: newTwinStateMux(),
 			dmMux: newMethodMux(),
+			inMux: newEventsMux(),
 		},
 	}
 
 	for _, opt := range opts {
 		opt(&c.Client)
 	}
+	c.startDispatch()
+	c.trackReconnects()
 
 	// transport uses the same logger as the client
 	c.tr.SetLogger(c.logger)
@@ -140,7 +185,7 @@ func (c *ModuleClient) Broker() string {
 
 // SubscribeTwinUpdates subscribes to module desired state changes.
 // It returns a channel to read the twin updates from.
-func (c *ModuleClient) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error) {
+func (c *ModuleClient) SubscribeTwinUpdates(ctx context.Context, opts ...SubscriptionOption) (*TwinStateSub, error) {
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
@@ -149,10 +194,223 @@ func (c *ModuleClient) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub,
 	}); err != nil {
 		return nil, err
 	}
-	return c.tsMux.sub(), nil
+	return c.tsMux.sub(opts...), nil
 }
 
 // UnsubscribeTwinUpdates unsubscribes the given handler from twin state updates.
 func (c *ModuleClient) UnsubscribeTwinUpdates(sub *TwinStateSub) {
 	c.tsMux.unsub(sub)
 }
+
+// SendOutputEvent sends a message to the named module output,
+// so it can be routed by IoT Edge with FROM /messages/modules/{module}/outputs/{output}.
+func (c *ModuleClient) SendOutputEvent(
+	ctx context.Context, outputName string, payload []byte, opts ...SendOption,
+) error {
+	if outputName == "" {
+		return errors.New("output name cannot be blank")
+	}
+	return c.SendEvent(ctx, payload, append(opts, func(o *sendOptions) error {
+		o.msg.OutputName = outputName
+		return nil
+	})...)
+}
+
+// SubscribeInputs subscribes to messages routed to any of the module's inputs,
+// the input name of a message is available in its InputName field.
+func (c *ModuleClient) SubscribeInputs(ctx context.Context, opts ...SubscriptionOption) (*EventSub, error) {
+	if err := c.checkConnection(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.inMux.once(func() error {
+		return c.tr.SubscribeInputs(ctx, c.inMux)
+	}); err != nil {
+		return nil, err
+	}
+	return c.inMux.sub(opts...), nil
+}
+
+// SubscribeInput is SubscribeInputs that receives only messages
+// routed to the named input, e.g. with INTO BrokeredEndpoint("/modules/m/inputs/{input}").
+func (c *ModuleClient) SubscribeInput(
+	ctx context.Context, inputName string, opts ...SubscriptionOption,
+) (*EventSub, error) {
+	if inputName == "" {
+		return nil, errors.New("input name cannot be blank")
+	}
+	return c.SubscribeInputs(ctx, append(opts, func(cfg *subConfig) {
+		cfg.input = inputName
+	})...)
+}
+
+// UnsubscribeInputs makes the given subscription to stop receiving messages.
+func (c *ModuleClient) UnsubscribeInputs(sub *EventSub) {
+	c.inMux.unsub(sub)
+}
+
+// InvokeMethod calls a direct method of another module or a device
+// through the edgeHub gateway, so module-to-module orchestration works
+// offline at the edge. When moduleID is empty the device method is called.
+func (c *ModuleClient) InvokeMethod(
+	ctx context.Context, deviceID, moduleID string, call *iotservice.MethodCall,
+) (*iotservice.MethodResult, error) {
+	if deviceID == "" {
+		return nil, errors.New("device id cannot be blank")
+	}
+	c.mu.RLock()
+	creds := c.creds
+	c.mu.RUnlock()
+	if creds.GetGateway() == "" {
+		return nil, errors.New("gateway hostname is not set")
+	}
+
+	client, err := c.edgeClient(creds)
+	if err != nil {
+		return nil, err
+	}
+	token, err := moduleToken(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/twins/" + url.PathEscape(deviceID)
+	if moduleID != "" {
+		path += "/modules/" + url.PathEscape(moduleID)
+	}
+	b, err := json.Marshal(call)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://"+creds.GetGateway()+path+"/methods?api-version=2018-06-28",
+		bytes.NewReader(b),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-ms-edge-moduleId", creds.GetDeviceID()+"/"+creds.GetModuleID())
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("invoke method failed with %d response code: %s", res.StatusCode, b)
+	}
+	var v iotservice.MethodResult
+	if err = json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// edgeClient returns HTTP client for the edgeHub REST endpoint that trusts
+// the edge CA when the workload API is available. The client is cached only
+// when it's created successfully and recreated every edgeRefreshInterval,
+// the previous one is kept when the trust bundle cannot be refreshed.
+func (c *ModuleClient) edgeClient(creds transport.Credentials) (*http.Client, error) {
+	c.edgeMu.Lock()
+	defer c.edgeMu.Unlock()
+	if c.edgeHTTP != nil && time.Since(c.edgeAt) < edgeRefreshInterval {
+		return c.edgeHTTP, nil
+	}
+
+	var (
+		tlsCfg = &tls.Config{}
+		err    error
+	)
+	if creds.GetWorkloadURI() != "" {
+		tlsCfg.RootCAs, err = common.TrustBundle(creds.GetWorkloadURI())
+	} else {
+		tlsCfg.RootCAs, err = common.LoadRootCAs()
+	}
+	if err != nil {
+		if c.edgeHTTP != nil {
+			c.logger.Warnf("error refreshing trust bundle: %s", err)
+			return c.edgeHTTP, nil
+		}
+		return nil, err
+	}
+	if c.edgeHTTP != nil {
+		c.edgeHTTP.CloseIdleConnections()
+	}
+	c.edgeAt = time.Now()
+	c.edgeHTTP = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+	return c.edgeHTTP, nil
+}
+
+// moduleToken generates the module's SAS token, through the workload API when it's available.
+func moduleToken(creds transport.Credentials) (string, error) {
+	audience := creds.GetHostName() + "/devices/" + url.QueryEscape(creds.GetDeviceID()) +
+		"/modules/" + url.QueryEscape(creds.GetModuleID())
+	var (
+		sas *common.SharedAccessSignature
+		err error
+	)
+	if creds.UseEdgeGateway() {
+		sas, err = creds.TokenFromEdge(creds.GetWorkloadURI(), creds.GetModuleID(), creds.GetGenerationID(), audience, time.Hour)
+	} else {
+		sas, err = creds.Token(url.QueryEscape(audience), time.Hour)
+	}
+	if err != nil {
+		return "", err
+	}
+	return sas.String(), nil
+}
+
+// edgeBroker is implemented by transports supporting the IoT Edge MQTT broker.
+type edgeBroker interface {
+	Publish(ctx context.Context, topic string, qos int, payload []byte) error
+	Subscribe(ctx context.Context, filter string, qos int, fn func(topic string, payload []byte)) error
+	Unsubscribe(ctx context.Context, filter string) error
+}
+
+// ErrBrokerNotSupported the transport cannot be used with the IoT Edge MQTT broker.
+var ErrBrokerNotSupported = errors.New("transport doesn't support the edge MQTT broker")
+
+func (c *ModuleClient) broker(ctx context.Context) (edgeBroker, error) {
+	if err := c.checkConnection(ctx); err != nil {
+		return nil, err
+	}
+	b, ok := c.tr.(edgeBroker)
+	if !ok {
+		return nil, ErrBrokerNotSupported
+	}
+	return b, nil
+}
+
+// Publish publishes the payload to a user-defined topic of the IoT Edge MQTT broker.
+func (c *ModuleClient) Publish(ctx context.Context, topic string, qos int, payload []byte) error {
+	b, err := c.broker(ctx)
+	if err != nil {
+		return err
+	}
+	return b.Publish(ctx, topic, qos, payload)
+}
+
+// Subscribe subscribes to a user-defined topic filter of the IoT Edge MQTT broker.
+func (c *ModuleClient) Subscribe(ctx context.Context, filter string, qos int, fn func(topic string, payload []byte)) error {
+	b, err := c.broker(ctx)
+	if err != nil {
+		return err
+	}
+	return b.Subscribe(ctx, filter, qos, fn)
+}
+
+// Unsubscribe removes the IoT Edge MQTT broker subscription.
+func (c *ModuleClient) Unsubscribe(ctx context.Context, filter string) error {
+	b, err := c.broker(ctx)
+	if err != nil {
+		return err
+	}
+	return b.Unsubscribe(ctx, filter)
+}
@@ -2,11 +2,20 @@ package iotdevice
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotdevice/iotdevicetest"
 	"github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
 	"github.com/amenzhinsky/iothub/iotservice"
 )
 
@@ -79,3 +88,89 @@ func TestSubscribeTwinUpdates(t *testing.T) {
 		t.Error("twin update not received")
 	}
 }
+
+func TestInvokeMethod(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %q, want %q", r.Method, http.MethodPost)
+		}
+		if want := "/twins/other/modules/mod2/methods"; r.URL.Path != want {
+			t.Errorf("path = %q, want %q", r.URL.Path, want)
+		}
+		if got, want := r.Header.Get("x-ms-edge-moduleId"), "dev/mod"; got != want {
+			t.Errorf("x-ms-edge-moduleId = %q, want %q", got, want)
+		}
+		sas, err := common.ParseSharedAccessSignature(r.Header.Get("Authorization"))
+		if err != nil {
+			t.Errorf("Authorization: %s", err)
+		} else if !strings.Contains(sas.Sr, "hub.azure-devices.net") ||
+			!strings.Contains(sas.Sr, "modules") || sas.Sig == "" {
+			t.Errorf("Authorization is not a module token: %+v", sas)
+		}
+
+		var call iotservice.MethodCall
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+			t.Fatal(err)
+		}
+		switch call.MethodName {
+		case "sum":
+			w.Write([]byte(`{"status":200,"payload":{"sum":3}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"method not found"}`))
+		}
+	}))
+	defer s.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	t.Setenv(common.RootCAsFileEnv, ca)
+
+	c, err := NewModule(transporttest.New(), &ModuleSharedAccessKeyCredentials{
+		SharedAccessKeyCredentials: SharedAccessKeyCredentials{
+			DeviceID: "dev",
+			SharedAccessKey: common.SharedAccessKey{
+				HostName:        "hub.azure-devices.net",
+				SharedAccessKey: "a2V5",
+			},
+		},
+		ModuleID: "mod",
+		Gateway:  strings.TrimPrefix(s.URL, "https://"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the root CA file is missing, the error must not be cached
+	if _, err = c.InvokeMethod(context.Background(), "other", "mod2", &iotservice.MethodCall{
+		MethodName: "sum",
+	}); err == nil {
+		t.Fatal("InvokeMethod succeeded without root CAs")
+	}
+
+	// trust the test server certificate the same way as a custom root CA
+	if err = os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.Certificate().Raw,
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.InvokeMethod(context.Background(), "other", "mod2", &iotservice.MethodCall{
+		MethodName: "sum",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 200 || string(res.Payload) != `{"sum":3}` {
+		t.Errorf("InvokeMethod = %d %s, want 200 {\"sum\":3}", res.Status, res.Payload)
+	}
+
+	_, err = c.InvokeMethod(context.Background(), "other", "mod2", &iotservice.MethodCall{
+		MethodName: "missing",
+	})
+	if err == nil || !strings.Contains(err.Error(), "404") ||
+		!strings.Contains(err.Error(), "method not found") {
+		t.Errorf("InvokeMethod error = %v, want 404 with the response body", err)
+	}
+}
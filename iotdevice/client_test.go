@@ -3,9 +3,13 @@ package iotdevice
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/iotdevice/iotdevicetest"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
 	"github.com/amenzhinsky/iothub/iotdevice/transport/http"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
 	"github.com/amenzhinsky/iothub/iotservice"
 )
 
@@ -92,3 +96,113 @@ func TestUpdateModule(t *testing.T) {
 		t.Errorf("authentication type = `%s`, want `%s`", updatedModule.Authentication.Type, iotservice.AuthSAS)
 	}
 }
+
+func TestReconnectWithUpdatedCredentials(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := c.SubscribeEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RegisterMethod(ctx, "ping", func(map[string]interface{}) (int, map[string]interface{}, error) {
+		return 200, map[string]interface{}{"pong": true}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := ParseConnectionString("HostName=transporttest.azure-devices.net;" +
+		"DeviceId=transporttest;SharedAccessKey=cm90YXRlZA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UpdateCredentials(rotated)
+	if got := tr.Credentials(); got == rotated {
+		t.Fatal("credentials are applied before reconnecting")
+	}
+	if err = c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Credentials(); got != rotated {
+		t.Fatalf("transport credentials = %v, want the rotated ones", got)
+	}
+	if !c.IsConnected() {
+		t.Fatal("client isn't connected after Reconnect")
+	}
+
+	// subscriptions and methods made before reconnecting still work
+	if err = tr.SendC2D(&common.Message{Payload: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.C():
+		if string(msg.Payload) != "hello" {
+			t.Errorf("payload = %q, want %q", msg.Payload, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event isn't received after reconnecting")
+	}
+	code, b, err := tr.CallMethod("ping", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 200 || string(b) != `{"pong":true}` {
+		t.Errorf("ping = %d %s, want 200 {\"pong\":true}", code, b)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Reconnect(ctx); err != ErrClosed {
+		t.Errorf("Reconnect after close error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	check := func(want transport.ConnectionState) {
+		t.Helper()
+		if got := c.ConnectionState(); got != want {
+			t.Errorf("ConnectionState() = %s, want %s", got, want)
+		}
+		if got := c.IsConnected(); got != (want == transport.Connected) {
+			t.Errorf("IsConnected() = %t in the %s state", got, want)
+		}
+	}
+
+	check(transport.Disconnected)
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(transport.Connected)
+	tr.SetConnectionState(transport.Reconnecting)
+	check(transport.Reconnecting)
+	tr.Reconnect()
+	check(transport.Connected)
+	if err = c.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	check(transport.Disconnected)
+
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(transport.Disconnected)
+}
@@ -0,0 +1,107 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// ContentTypeJSON is the JSON content type, it's used when a message has no content type.
+const ContentTypeJSON = "application/json"
+
+// Codec encodes and decodes message payloads of a content type.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		ContentTypeJSON: jsonCodec{},
+	}
+)
+
+// RegisterCodec registers the codec for the given content type,
+// e.g. application/cbor or application/x-protobuf, replacing
+// the previously registered one. JSON is registered by default.
+func RegisterCodec(contentType string, codec Codec) {
+	if codec == nil {
+		panic("codec is nil")
+	}
+	mt, err := mediaType(contentType)
+	if err != nil {
+		panic(err)
+	}
+	codecsMu.Lock()
+	codecs[mt] = codec
+	codecsMu.Unlock()
+}
+
+func lookupCodec(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	mt, err := mediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[mt]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for %q", mt)
+	}
+	return codec, nil
+}
+
+// mediaType strips parameters such as charset from the content type.
+func mediaType(contentType string) (string, error) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("malformed content type %q: %w", contentType, err)
+	}
+	return mt, nil
+}
+
+// SendEventAs encodes v with the codec registered for the content type
+// and sends it as a device-to-cloud message with the content type set.
+func (c *Client) SendEventAs(
+	ctx context.Context, v interface{}, contentType string, opts ...SendOption,
+) error {
+	codec, err := lookupCodec(contentType)
+	if err != nil {
+		return err
+	}
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, b, append([]SendOption{
+		WithSendContentType(contentType),
+	}, opts...)...)
+}
+
+// DecodeMessage decodes the message's payload into v with the codec
+// registered for its content type, JSON is assumed when it's not set.
+func DecodeMessage(msg *common.Message, v interface{}) error {
+	codec, err := lookupCodec(msg.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(msg.Payload, v)
+}
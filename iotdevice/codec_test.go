@@ -0,0 +1,46 @@
+package iotdevice
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+type upperCodec struct{}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return bytes.ToUpper([]byte(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(b []byte, v interface{}) error {
+	*v.(*string) = string(bytes.ToLower(b))
+	return nil
+}
+
+func TestDecodeMessage(t *testing.T) {
+	RegisterCodec("text/x-upper", upperCodec{})
+
+	var s string
+	if err := DecodeMessage(&common.Message{
+		Payload:     []byte("HELLO"),
+		ContentType: "text/x-upper; charset=utf-8",
+	}, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != "hello" {
+		t.Errorf("decoded = %q, want %q", s, "hello")
+	}
+
+	var v map[string]int
+	if err := DecodeMessage(&common.Message{Payload: []byte(`{"a":1}`)}, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["a"] != 1 {
+		t.Errorf("decoded = %v, want a=1", v)
+	}
+
+	if err := DecodeMessage(&common.Message{ContentType: "application/unknown"}, &v); err == nil {
+		t.Error("expected an error for unregistered content type")
+	}
+}
@@ -3,15 +3,18 @@ package iotdevice
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
 )
 
 type X509Credentials struct {
-	HostName    string
-	DeviceID    string
-	Certificate *tls.Certificate
+	HostName        string
+	DeviceID        string
+	Certificate     *tls.Certificate
+	GatewayHostName string // edge gateway the device connects through
 }
 
 func (c *X509Credentials) GetDeviceID() string {
@@ -33,7 +36,8 @@ func (c *X509Credentials) Token(
 }
 
 type SharedAccessKeyCredentials struct {
-	DeviceID string
+	DeviceID        string
+	GatewayHostName string // edge gateway the device connects through
 	common.SharedAccessKey
 }
 
@@ -62,14 +66,17 @@ func (c *SharedAccessKeyCredentials) GetGenerationID() string {
 	return ""
 }
 
-// GetGateway not implemented for SharedAccessKeyCredentials
+// GetGateway returns the edge gateway host name.
 func (c *SharedAccessKeyCredentials) GetGateway() string {
-	return ""
+	return c.GatewayHostName
 }
 
-// GetBroker not implemented for SharedAccessKeyCredentials
+// GetBroker returns the gateway host name when it's set, and the hub's otherwise.
 func (c *SharedAccessKeyCredentials) GetBroker() string {
-	return ""
+	if c.GatewayHostName != "" {
+		return c.GatewayHostName
+	}
+	return c.GetHostName()
 }
 
 // GetWorkloadURI not implemented for SharedAccessKeyCredentials
@@ -77,9 +84,9 @@ func (c *SharedAccessKeyCredentials) GetWorkloadURI() string {
 	return ""
 }
 
-// UseEdgeGateway not implemented for SharedAccessKeyCredentials
+// UseEdgeGateway reports whether the device connects through an edge gateway.
 func (c *SharedAccessKeyCredentials) UseEdgeGateway() bool {
-	return false
+	return c.GatewayHostName != ""
 }
 
 // GetSAK not implemented for SharedAccessKeyCredentials
@@ -109,14 +116,17 @@ func (c *X509Credentials) GetGenerationID() string {
 	return ""
 }
 
-// GetGateway not implemented for X509Credentials
+// GetGateway returns the edge gateway host name.
 func (c *X509Credentials) GetGateway() string {
-	return ""
+	return c.GatewayHostName
 }
 
-// GetBroker not implemented for X509Credentials
+// GetBroker returns the gateway host name when it's set, and the hub's otherwise.
 func (c *X509Credentials) GetBroker() string {
-	return ""
+	if c.GatewayHostName != "" {
+		return c.GatewayHostName
+	}
+	return c.HostName
 }
 
 // GetWorkloadURI not implemented for X509Credentials
@@ -124,7 +134,42 @@ func (c *X509Credentials) GetWorkloadURI() string {
 	return ""
 }
 
-// UseEdgeGateway not implemented for X509Credentials
+// UseEdgeGateway reports whether the device connects through an edge gateway.
 func (c *X509Credentials) UseEdgeGateway() bool {
-	return false
+	return c.GatewayHostName != ""
+}
+
+// BuildConnectionString is the inverse of ParseConnectionString and
+// ParseModuleConnectionString, x509 credentials produce connection
+// strings with the x509 flag set and no key.
+func BuildConnectionString(creds transport.Credentials) (string, error) {
+	if creds.GetHostName() == "" || creds.GetDeviceID() == "" {
+		return "", errors.New("host name and device id are required")
+	}
+	switch c := creds.(type) {
+	case *ModuleSharedAccessKeyCredentials:
+		return common.BuildConnectionString(
+			"HostName", c.GetHostName(),
+			"DeviceId", c.DeviceID,
+			"ModuleId", c.ModuleID,
+			"SharedAccessKey", c.SharedAccessKey.SharedAccessKey,
+			"GatewayHostName", c.Gateway,
+		)
+	case *SharedAccessKeyCredentials:
+		return common.BuildConnectionString(
+			"HostName", c.GetHostName(),
+			"DeviceId", c.DeviceID,
+			"SharedAccessKey", c.SharedAccessKey.SharedAccessKey,
+			"GatewayHostName", c.GatewayHostName,
+		)
+	case *X509Credentials:
+		return common.BuildConnectionString(
+			"HostName", c.HostName,
+			"DeviceId", c.DeviceID,
+			"x509", "true",
+			"GatewayHostName", c.GatewayHostName,
+		)
+	default:
+		return "", fmt.Errorf("unsupported credentials type %T", creds)
+	}
 }
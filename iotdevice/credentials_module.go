@@ -36,13 +36,10 @@ func (c *ModuleSharedAccessKeyCredentials) UseEdgeGateway() bool {
 
 // GetBroker returns gateway host name if UseEdgeGateway is true, else returns IoT Hub host name
 func (c *ModuleSharedAccessKeyCredentials) GetBroker() string {
-	output := c.GetHostName()
-	gw := c.GetGateway()
-	usegw := c.UseEdgeGateway()
-	if usegw && len(gw) > 0 {
-		output = gw
+	if gw := c.GetGateway(); c.UseEdgeGateway() && gw != "" {
+		return gw
 	}
-	return output
+	return c.GetHostName()
 }
 
 // GetCertificate returns nil. Only here to satisfy Credentials interface
@@ -0,0 +1,119 @@
+package iotdevice
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+func TestParseConnectionStringGateway(t *testing.T) {
+	creds, err := ParseConnectionString(
+		"HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=c2VjcmV0;GatewayHostName=edge.local",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.GetBroker() != "edge.local" || creds.GetHostName() != "test.azure-devices.net" {
+		t.Fatalf("broker = %q, host = %q", creds.GetBroker(), creds.GetHostName())
+	}
+
+	cs, err := BuildConnectionString(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ParseConnectionString(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *have != *creds {
+		t.Fatalf("ParseConnectionString(%q) = %+v, want %+v", cs, have, creds)
+	}
+}
+
+func TestParseConnectionStringRejects(t *testing.T) {
+	for _, cs := range []string{
+		"HostName=test.azure-devices.net;DeviceId=dev;x509=true",
+		"HostName=test.azure-devices.net;DeviceId=dev;ModuleId=mod;SharedAccessKey=c2VjcmV0",
+		"DeviceId=dev;SharedAccessKey=c2VjcmV0",
+	} {
+		if _, err := ParseConnectionString(cs); err == nil {
+			t.Errorf("ParseConnectionString(%q) expected an error", cs)
+		}
+	}
+}
+
+func TestParseConnectionStringStrict(t *testing.T) {
+	cs := "HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=c2VjcmV0;Foo=bar"
+	if _, err := ParseConnectionString(cs); err != nil {
+		t.Fatalf("ParseConnectionString(%q) = %v, unknown keys have to be ignored", cs, err)
+	}
+	if _, err := ParseConnectionStringStrict(cs); !errors.Is(err, common.ErrUnknownKey) {
+		t.Fatalf("ParseConnectionStringStrict(%q) = %v, want %v", cs, err, common.ErrUnknownKey)
+	}
+}
+
+func TestParseX509ConnectionString(t *testing.T) {
+	crt := &tls.Certificate{}
+	creds, err := ParseX509ConnectionString(
+		"HostName=test.azure-devices.net;DeviceId=dev;x509=true", crt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.DeviceID != "dev" || creds.GetCertificate() != crt {
+		t.Fatalf("ParseX509ConnectionString = %+v", creds)
+	}
+}
+
+func TestParseModuleConnectionStringGateway(t *testing.T) {
+	creds, err := ParseModuleConnectionString(
+		"HostName=test.azure-devices.net;DeviceId=dev;ModuleId=mod;SharedAccessKey=c2VjcmV0;GatewayHostName=edge.local",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.GetGateway() != "edge.local" || creds.GetModuleID() != "mod" {
+		t.Fatalf("gateway = %q, module = %q", creds.GetGateway(), creds.GetModuleID())
+	}
+
+	// the gateway is used only when it's enabled explicitly
+	if creds.GetBroker() != "test.azure-devices.net" {
+		t.Fatalf("broker = %q, want the hub", creds.GetBroker())
+	}
+	creds.EdgeGateway = true
+	if creds.GetBroker() != "edge.local" {
+		t.Fatalf("broker = %q, want the gateway", creds.GetBroker())
+	}
+}
+
+type testTPM []byte
+
+func (k testTPM) HMAC(data []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, k)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func TestTPMCredentialsToken(t *testing.T) {
+	key := []byte("secret")
+	creds := &TPMCredentials{HostName: "test.azure-devices.net", DeviceID: "dev", TPM: testTPM(key)}
+	have, err := creds.Token("test.azure-devices.net/devices/dev", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := common.NewSharedAccessSignature(
+		"test.azure-devices.net/devices/dev", "", base64.StdEncoding.EncodeToString(key), have.Se,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.String() != want.String() {
+		t.Fatalf("Token = %q, want %q", have, want)
+	}
+}
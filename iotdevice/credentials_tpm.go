@@ -0,0 +1,116 @@
+package iotdevice
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// TPM is a trusted platform module that holds the device identity key,
+// it can be implemented with github.com/google/go-tpm, the package doesn't
+// depend on it to avoid pulling it into every application.
+//
+// The identity key has to be imported into the TPM beforehand,
+// DPS TPM attestation is not supported.
+type TPM interface {
+	// HMAC signs data with the identity key using HMAC-SHA256.
+	HMAC(data []byte) ([]byte, error)
+}
+
+// TPMCredentials signs SAS tokens with the key stored in a TPM.
+type TPMCredentials struct {
+	HostName        string
+	DeviceID        string
+	GatewayHostName string // edge gateway the device connects through
+	TPM             TPM
+}
+
+// NewFromTPM creates a device client that signs tokens with the TPM,
+// gatewayHostName is the edge gateway to connect through, it may be empty.
+func NewFromTPM(
+	transport transport.Transport,
+	deviceID, hostName, gatewayHostName string, tpm TPM,
+	opts ...ClientOption,
+) (*Client, error) {
+	if tpm == nil {
+		return nil, errors.New("tpm is nil")
+	}
+	return New(transport, &TPMCredentials{
+		HostName:        hostName,
+		DeviceID:        deviceID,
+		GatewayHostName: gatewayHostName,
+		TPM:             tpm,
+	}, opts...)
+}
+
+func (c *TPMCredentials) GetDeviceID() string {
+	return c.DeviceID
+}
+
+func (c *TPMCredentials) GetHostName() string {
+	return c.HostName
+}
+
+// Token generates a shared access signature signed by the TPM.
+func (c *TPMCredentials) Token(
+	resource string, lifetime time.Duration,
+) (*common.SharedAccessSignature, error) {
+	return common.NewSharedAccessSignatureWithSigner(
+		resource, "", time.Now().Add(lifetime), c.TPM.HMAC,
+	)
+}
+
+// GetGateway returns the edge gateway host name.
+func (c *TPMCredentials) GetGateway() string {
+	return c.GatewayHostName
+}
+
+// GetBroker returns the gateway host name when it's set, and the hub's otherwise.
+func (c *TPMCredentials) GetBroker() string {
+	if c.GatewayHostName != "" {
+		return c.GatewayHostName
+	}
+	return c.HostName
+}
+
+// UseEdgeGateway reports whether the device connects through an edge gateway.
+func (c *TPMCredentials) UseEdgeGateway() bool {
+	return c.GatewayHostName != ""
+}
+
+// NOT IMPLEMENTED
+
+// GetCertificate not implemented for TPMCredentials
+func (c *TPMCredentials) GetCertificate() *tls.Certificate {
+	return nil
+}
+
+// GetSAK not implemented for TPMCredentials, the key never leaves the TPM
+func (c *TPMCredentials) GetSAK() string {
+	return ""
+}
+
+// TokenFromEdge not implemented for TPMCredentials
+func (c *TPMCredentials) TokenFromEdge(
+	workloadURI, module, genid, resource string, lifetime time.Duration,
+) (*common.SharedAccessSignature, error) {
+	return nil, errors.New("cannot generate edge tokens with tpm credentials")
+}
+
+// GetModuleID not implemented for TPMCredentials
+func (c *TPMCredentials) GetModuleID() string {
+	return ""
+}
+
+// GetGenerationID not implemented for TPMCredentials
+func (c *TPMCredentials) GetGenerationID() string {
+	return ""
+}
+
+// GetWorkloadURI not implemented for TPMCredentials
+func (c *TPMCredentials) GetWorkloadURI() string {
+	return ""
+}
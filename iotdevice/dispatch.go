@@ -0,0 +1,108 @@
+package iotdevice
+
+import (
+	"hash/fnv"
+)
+
+// WithDispatchWorkers makes the client hand incoming cloud-to-device
+// messages, module inputs and twin updates over to n worker goroutines
+// instead of pushing them to subscriptions on the transport's receive
+// goroutine, so slow subscribers with OverflowBlock don't stall the
+// connection. Dispatching blocks only when all workers are busy and
+// their queues are full. Zero, the default, disables workers.
+//
+// Deliveries may be reordered unless WithOrderedDispatch is set.
+// Direct method handlers always run on the transport's goroutine.
+func WithDispatchWorkers(n int) ClientOption {
+	if n < 0 {
+		panic("number of workers is negative")
+	}
+	return func(c *Client) {
+		c.dispatchWorkers = n
+	}
+}
+
+// WithOrderedDispatch makes dispatch workers preserve the order of
+// deliveries within each stream, that is cloud-to-device messages,
+// twin updates and every module input, by processing a stream on
+// a single worker, so concurrency is only achieved across streams.
+func WithOrderedDispatch(ordered bool) ClientOption {
+	return func(c *Client) {
+		c.dispatchOrdered = ordered
+	}
+}
+
+// startDispatch starts dispatch workers when they're enabled.
+func (c *Client) startDispatch() {
+	if c.dispatchWorkers == 0 {
+		return
+	}
+	c.pool = newDispatchPool(c.dispatchWorkers, c.dispatchOrdered)
+	c.evMux.pool = c.pool
+	c.tsMux.pool = c.pool
+	c.inMux.pool = c.pool
+}
+
+// dispatchQueueSize is the number of deliveries
+// a worker queue holds until dispatching blocks.
+const dispatchQueueSize = 64
+
+func newDispatchPool(n int, ordered bool) *dispatchPool {
+	p := &dispatchPool{done: make(chan struct{})}
+	if ordered {
+		p.queues = make([]chan func(), n)
+		for i := range p.queues {
+			p.queues[i] = make(chan func(), dispatchQueueSize)
+			go p.work(p.queues[i])
+		}
+		return p
+	}
+	q := make(chan func(), dispatchQueueSize)
+	p.queues = []chan func(){q}
+	for i := 0; i < n; i++ {
+		go p.work(q)
+	}
+	return p
+}
+
+// dispatchPool runs deliveries on a fixed number of workers, in the ordered
+// mode every worker has its own queue, otherwise all of them share one.
+type dispatchPool struct {
+	queues []chan func()
+	done   chan struct{}
+}
+
+func (p *dispatchPool) work(q <-chan func()) {
+	for {
+		select {
+		case fn := <-q:
+			fn()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// run schedules fn, in the ordered mode functions with the same key are
+// run sequentially in the scheduling order. A nil pool runs fn in place.
+func (p *dispatchPool) run(key string, fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+	q := p.queues[0]
+	if len(p.queues) > 1 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		q = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	select {
+	case q <- fn:
+	case <-p.done:
+	}
+}
+
+// close stops workers, scheduled deliveries are discarded.
+func (p *dispatchPool) close() {
+	close(p.done)
+}
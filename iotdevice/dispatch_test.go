@@ -0,0 +1,88 @@
+package iotdevice
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+func TestDispatchPoolConcurrency(t *testing.T) {
+	p := newDispatchPool(2, false)
+	defer p.close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		p.run("events/", func() {
+			wg.Done()
+			<-release
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliveries are not run concurrently")
+	}
+	close(release)
+}
+
+func TestDispatchPoolOrdered(t *testing.T) {
+	p := newDispatchPool(4, true)
+	defer p.close()
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"events/", "twin", "events/input1"} {
+			wg.Add(1)
+			key, i := key, i
+			p.run(key, func() {
+				defer wg.Done()
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+	for key, v := range got {
+		for i := range v {
+			if v[i] != i {
+				t.Fatalf("%s: deliveries are out of order: %v", key, v)
+			}
+		}
+	}
+}
+
+func TestEventsMuxWithPool(t *testing.T) {
+	mux := newEventsMux()
+	mux.pool = newDispatchPool(1, true)
+	defer mux.pool.close()
+	sub := mux.sub(WithSubscriptionBufferSize(0))
+
+	// dispatching doesn't wait for the subscriber
+	for i := 0; i < 3; i++ {
+		mux.Dispatch(&common.Message{Payload: []byte(fmt.Sprint(i))})
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-sub.C():
+			if string(msg.Payload) != fmt.Sprint(i) {
+				t.Errorf("payload = %q, want %q", msg.Payload, fmt.Sprint(i))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message is not delivered")
+		}
+	}
+	mux.close(ErrClosed)
+}
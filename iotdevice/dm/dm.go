@@ -0,0 +1,271 @@
+// Package dm implements the conventional device management direct methods,
+// reboot and firmwareUpdate, that report their progress in the iothubDM
+// reported property, so back-end applications can track devices with
+// twin queries like:
+//
+//	SELECT * FROM devices WHERE properties.reported.iothubDM.firmwareUpdate.status = 'error'
+//
+// See https://learn.microsoft.com/azure/iot-hub/iot-hub-device-management-overview.
+package dm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+)
+
+// Method names.
+const (
+	RebootMethod         = "reboot"
+	FirmwareUpdateMethod = "firmwareUpdate"
+)
+
+// ReportedProperty is the reported property the progress is reported in.
+const ReportedProperty = "iothubDM"
+
+// FirmwareStatus is a state of the firmware update state machine:
+// waiting -> downloading -> applying -> applied, any state
+// but applied can transition to error.
+type FirmwareStatus string
+
+const (
+	FirmwareWaiting     FirmwareStatus = "waiting"
+	FirmwareDownloading FirmwareStatus = "downloading"
+	FirmwareApplying    FirmwareStatus = "applying"
+	FirmwareApplied     FirmwareStatus = "applied"
+	FirmwareError       FirmwareStatus = "error"
+)
+
+// Option is a manager configuration option.
+type Option func(m *Manager)
+
+// WithReboot registers the reboot method that calls fn in the background
+// after the method response is sent and the reboot time is reported.
+func WithReboot(fn func(ctx context.Context) error) Option {
+	return func(m *Manager) {
+		m.reboot = fn
+	}
+}
+
+// WithFirmwareUpdate registers the firmwareUpdate method, that expects
+// the {"fwPackageUri": "..."} payload, download fetches the package and
+// apply installs it, both are called in the background one after another.
+// Only one update can be in progress, concurrent calls are rejected.
+func WithFirmwareUpdate(
+	download func(ctx context.Context, uri string) error,
+	apply func(ctx context.Context) error,
+) Option {
+	return func(m *Manager) {
+		m.download = download
+		m.apply = apply
+	}
+}
+
+// WithErrorHandler sets a function that's called with errors of background
+// operations and reporting properties, by default they're ignored,
+// operation errors are reported in properties anyway.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(m *Manager) {
+		m.onError = fn
+	}
+}
+
+// New registers device management methods enabled by opts on the connected
+// client, background operations are stopped when the manager is closed.
+func New(ctx context.Context, c *iotdevice.Client, opts ...Option) (*Manager, error) {
+	m := &Manager{c: c}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.reboot == nil && m.download == nil {
+		return nil, errors.New("dm: no methods are enabled")
+	}
+	if (m.download == nil) != (m.apply == nil) {
+		return nil, errors.New("dm: both download and apply functions are required")
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if m.reboot != nil {
+		if err := c.RegisterRawMethod(ctx, RebootMethod, m.handleReboot); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if m.download != nil {
+		if err := c.RegisterRawMethod(ctx, FirmwareUpdateMethod, m.handleFirmwareUpdate); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Manager handles device management methods.
+type Manager struct {
+	c        *iotdevice.Client
+	reboot   func(ctx context.Context) error
+	download func(ctx context.Context, uri string) error
+	apply    func(ctx context.Context) error
+	onError  func(err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	updating bool
+	closed   bool
+}
+
+// Close unregisters the methods, cancels background
+// operations and waits for them to return.
+func (m *Manager) Close() {
+	if m.reboot != nil {
+		m.c.UnregisterMethod(RebootMethod)
+	}
+	if m.download != nil {
+		m.c.UnregisterMethod(FirmwareUpdateMethod)
+	}
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.cancel()
+	m.wg.Wait()
+}
+
+// start runs fn in the background unless the manager is closed.
+func (m *Manager) start(fn func()) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// response is a method response payload.
+type response struct {
+	Message string `json:"message"`
+}
+
+func respond(code int, msg string) (int, json.RawMessage, error) {
+	b, err := json.Marshal(&response{Message: msg})
+	return code, b, err
+}
+
+func (m *Manager) handleReboot(json.RawMessage) (int, json.RawMessage, error) {
+	if !m.start(func() {
+		if err := m.report("reboot", map[string]interface{}{
+			"lastReboot": now(),
+		}); err != nil {
+			m.notify(err)
+		}
+		if err := m.reboot(m.ctx); err != nil {
+			m.notify(err)
+		}
+	}) {
+		return respond(http.StatusServiceUnavailable, "device management is stopped")
+	}
+	return respond(http.StatusOK, "rebooting")
+}
+
+func (m *Manager) handleFirmwareUpdate(payload json.RawMessage) (int, json.RawMessage, error) {
+	var v struct {
+		URI string `json:"fwPackageUri"`
+	}
+	if err := json.Unmarshal(payload, &v); err != nil || v.URI == "" {
+		return respond(http.StatusBadRequest, "fwPackageUri is required")
+	}
+	m.mu.Lock()
+	if m.updating {
+		m.mu.Unlock()
+		return respond(http.StatusConflict, "firmware update is already in progress")
+	}
+	m.updating = true
+	m.mu.Unlock()
+
+	if !m.start(func() {
+		m.updateFirmware(v.URI)
+		m.mu.Lock()
+		m.updating = false
+		m.mu.Unlock()
+	}) {
+		return respond(http.StatusServiceUnavailable, "device management is stopped")
+	}
+	return respond(http.StatusOK, "firmware update started")
+}
+
+// updateFirmware runs the firmware update state machine,
+// every transition is reported, reporting errors don't
+// interrupt the update.
+func (m *Manager) updateFirmware(uri string) {
+	m.reportFirmware(FirmwareWaiting, map[string]interface{}{
+		"fwPackageUri":       uri,
+		"startedWaitingTime": now(),
+		"error":              nil,
+	})
+	m.reportFirmware(FirmwareDownloading, nil)
+	if err := m.download(m.ctx, uri); err != nil {
+		m.failFirmware(err)
+		return
+	}
+	m.reportFirmware(FirmwareApplying, map[string]interface{}{
+		"downloadCompleteTime": now(),
+		"startedApplyingImage": now(),
+	})
+	if err := m.apply(m.ctx); err != nil {
+		m.failFirmware(err)
+		return
+	}
+	m.reportFirmware(FirmwareApplied, map[string]interface{}{
+		"lastFirmwareUpdate": now(),
+	})
+}
+
+func (m *Manager) failFirmware(err error) {
+	m.notify(err)
+	m.reportFirmware(FirmwareError, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+func (m *Manager) reportFirmware(status FirmwareStatus, fields map[string]interface{}) {
+	v := map[string]interface{}{"status": status}
+	for k, f := range fields {
+		v[k] = f
+	}
+	if err := m.report("firmwareUpdate", v); err != nil {
+		m.notify(err)
+	}
+}
+
+// report patches the named section of the iothubDM reported property,
+// it's not bound to the manager's context so the final state is
+// reported even when the manager is being closed.
+func (m *Manager) report(section string, v map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := m.c.UpdateTwinState(ctx, iotdevice.TwinState{
+		ReportedProperty: map[string]interface{}{section: v},
+	})
+	return err
+}
+
+func (m *Manager) notify(err error) {
+	if m.onError != nil {
+		m.onError(err)
+	}
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
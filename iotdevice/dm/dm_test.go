@@ -0,0 +1,129 @@
+package dm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
+)
+
+func newTestManager(t *testing.T, opts ...Option) *transporttest.Transport {
+	t.Helper()
+	tr := transporttest.New()
+	c, err := iotdevice.NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(ctx, c, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return tr
+}
+
+// waitReported waits for the named iothubDM section to satisfy fn.
+func waitReported(t *testing.T, tr *transporttest.Transport, section string, fn func(map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		dm, _ := tr.Reported()[ReportedProperty].(map[string]interface{})
+		if v, ok := dm[section].(map[string]interface{}); ok && fn(v) {
+			return v
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s isn't reported: %v", section, tr.Reported())
+	return nil
+}
+
+func TestReboot(t *testing.T) {
+	rebooted := make(chan struct{})
+	tr := newTestManager(t, WithReboot(func(ctx context.Context) error {
+		close(rebooted)
+		return nil
+	}))
+	code, _, err := tr.CallMethod(RebootMethod, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("code = %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case <-rebooted:
+	case <-time.After(time.Second):
+		t.Fatal("device isn't rebooted")
+	}
+	waitReported(t, tr, "reboot", func(v map[string]interface{}) bool {
+		_, err := time.Parse(time.RFC3339, v["lastReboot"].(string))
+		return err == nil
+	})
+}
+
+func TestFirmwareUpdate(t *testing.T) {
+	download := make(chan string)
+	fail := errors.New("checksum mismatch")
+	applyErr := fail
+	tr := newTestManager(t, WithFirmwareUpdate(
+		func(ctx context.Context, uri string) error {
+			download <- uri
+			return nil
+		},
+		func(ctx context.Context) error {
+			return applyErr
+		},
+	))
+
+	if code, _, _ := tr.CallMethod(FirmwareUpdateMethod, map[string]string{}); code != http.StatusBadRequest {
+		t.Errorf("code = %d without package uri, want %d", code, http.StatusBadRequest)
+	}
+	call := func() int {
+		code, _, err := tr.CallMethod(FirmwareUpdateMethod, map[string]string{"fwPackageUri": "https://fw"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	if code := call(); code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", code, http.StatusOK)
+	}
+	waitReported(t, tr, "firmwareUpdate", func(v map[string]interface{}) bool {
+		return v["status"] == string(FirmwareDownloading)
+	})
+	if code := call(); code != http.StatusConflict {
+		t.Errorf("code = %d during an update, want %d", code, http.StatusConflict)
+	}
+	if uri := <-download; uri != "https://fw" {
+		t.Errorf("downloaded %q", uri)
+	}
+	v := waitReported(t, tr, "firmwareUpdate", func(v map[string]interface{}) bool {
+		return v["status"] == string(FirmwareError)
+	})
+	if v["error"] != fail.Error() {
+		t.Errorf("error = %v, want %q", v["error"], fail)
+	}
+
+	// the error is cleared by the next update
+	applyErr = nil
+	for code := call(); code == http.StatusConflict; code = call() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	<-download
+	v = waitReported(t, tr, "firmwareUpdate", func(v map[string]interface{}) bool {
+		return v["status"] == string(FirmwareApplied)
+	})
+	if v["error"] != nil || v["lastFirmwareUpdate"] == nil {
+		t.Errorf("unexpected firmware update state: %v", v)
+	}
+}
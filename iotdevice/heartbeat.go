@@ -0,0 +1,162 @@
+package iotdevice
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Heartbeat reported properties.
+const (
+	HeartbeatLastConnectionTime = "lastConnectionTime"
+	HeartbeatLastSeen           = "lastSeen"
+	HeartbeatUptime             = "uptime" // seconds since the heartbeat is started
+)
+
+// HeartbeatOption is a heartbeat reporter configuration option.
+type HeartbeatOption func(h *Heartbeat)
+
+// WithHeartbeatProperty sets the reported property heartbeats are nested
+// in, default is "heartbeat", empty name reports them at the top level.
+func WithHeartbeatProperty(name string) HeartbeatOption {
+	return func(h *Heartbeat) {
+		h.property = name
+	}
+}
+
+// WithHeartbeatFields adds fields returned by fn to every heartbeat,
+// fields starting with $ are reserved by the hub and dropped.
+func WithHeartbeatFields(fn func() map[string]interface{}) HeartbeatOption {
+	return func(h *Heartbeat) {
+		h.fields = fn
+	}
+}
+
+// WithHeartbeatErrorHandler sets a function that's called when
+// reporting a heartbeat fails, by default errors are logged.
+func WithHeartbeatErrorHandler(fn func(err error)) HeartbeatOption {
+	return func(h *Heartbeat) {
+		h.onError = fn
+	}
+}
+
+// Heartbeat periodically reports the device liveness in reported
+// properties, such as the last connection time and uptime.
+type Heartbeat struct {
+	c        *Client
+	interval time.Duration
+	property string
+	fields   func() map[string]interface{}
+	onError  func(err error)
+	started  time.Time
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartHeartbeat starts reporting heartbeats every interval in
+// the background until Stop is called or the client is closed,
+// the first heartbeat is reported once the client is connected.
+//
+// Every report is a patch that only contains heartbeat properties
+// with times formatted as RFC3339 in UTC, so other reported
+// properties are left intact. Panics when interval isn't positive.
+func (c *Client) StartHeartbeat(interval time.Duration, opts ...HeartbeatOption) *Heartbeat {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	h := &Heartbeat{
+		c:        c,
+		interval: interval,
+		property: "heartbeat",
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	go h.run()
+	return h
+}
+
+// Stop stops the reporter and waits for the in-progress report to finish.
+func (h *Heartbeat) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+}
+
+func (h *Heartbeat) run() {
+	defer close(h.done)
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+	for {
+		h.report()
+		select {
+		case <-t.C:
+		case <-h.stop:
+			return
+		case <-h.c.done:
+			return
+		}
+	}
+}
+
+func (h *Heartbeat) report() {
+	// heartbeats cannot lag behind more than the interval,
+	// so there's no point waiting longer for the connection
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := h.c.checkConnection(ctx); err != nil {
+		return // not connected yet or stopped
+	}
+	if _, err := h.c.UpdateTwinState(ctx, h.state(time.Now())); err != nil {
+		select {
+		case <-h.stop:
+			return
+		case <-h.c.done:
+			return
+		default:
+		}
+		if h.onError != nil {
+			h.onError(err)
+		} else {
+			h.c.logger.Warnf("heartbeat error: %s", err)
+		}
+	}
+}
+
+// state returns the heartbeat patch at the given time.
+func (h *Heartbeat) state(now time.Time) TwinState {
+	h.c.mu.RLock()
+	connectedAt := h.c.connectedAt
+	h.c.mu.RUnlock()
+
+	v := map[string]interface{}{}
+	if h.fields != nil {
+		for k, f := range h.fields() {
+			if !strings.HasPrefix(k, "$") {
+				v[k] = f
+			}
+		}
+	}
+	v[HeartbeatLastConnectionTime] = connectedAt.UTC().Format(time.RFC3339)
+	v[HeartbeatLastSeen] = now.UTC().Format(time.RFC3339)
+	v[HeartbeatUptime] = int64(now.Sub(h.started) / time.Second)
+	if h.property == "" {
+		return v
+	}
+	return TwinState{h.property: v}
+}
@@ -0,0 +1,86 @@
+package iotdevice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
+)
+
+func TestHeartbeat(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// started before connecting, the first heartbeat waits for the connection
+	h := c.StartHeartbeat(10*time.Millisecond, WithHeartbeatFields(func() map[string]interface{} {
+		return map[string]interface{}{"firmware": "1.0", "$version": 100}
+	}))
+	defer h.Stop()
+
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.UpdateTwinState(ctx, TwinState{"other": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var beat map[string]interface{}
+	for i := 0; i < 100 && beat == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		beat, _ = tr.Reported()["heartbeat"].(map[string]interface{})
+	}
+	if beat == nil {
+		t.Fatal("no heartbeat is reported")
+	}
+	h.Stop()
+
+	reported := tr.Reported()
+	if reported["other"] != true {
+		t.Errorf("heartbeat overwrote other reported properties: %v", reported)
+	}
+	for _, k := range []string{HeartbeatLastConnectionTime, HeartbeatLastSeen} {
+		s, _ := beat[k].(string)
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			t.Errorf("%s = %v is not RFC3339", k, beat[k])
+		}
+	}
+	if beat["firmware"] != "1.0" || beat["$version"] != nil || beat[HeartbeatUptime] == nil {
+		t.Errorf("unexpected heartbeat: %v", beat)
+	}
+
+	// reporting is stopped
+	ver := reported["$version"]
+	time.Sleep(30 * time.Millisecond)
+	if v := tr.Reported()["$version"]; v != ver {
+		t.Errorf("heartbeats are reported after Stop, version %v -> %v", ver, v)
+	}
+}
+
+func TestHeartbeatConnectionTimeOnReconnect(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Heartbeat{c: c}
+	c.mu.Lock()
+	c.connectedAt = time.Now().Add(-time.Hour)
+	c.mu.Unlock()
+	before := h.state(time.Now())[HeartbeatLastConnectionTime]
+
+	tr.Reconnect()
+	if after := h.state(time.Now())[HeartbeatLastConnectionTime]; after == before {
+		t.Fatalf("%s = %v isn't updated on reconnect", HeartbeatLastConnectionTime, after)
+	}
+}
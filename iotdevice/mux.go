@@ -2,9 +2,12 @@ package iotdevice
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/amenzhinsky/iothub/common"
 )
@@ -19,6 +22,62 @@ func once(on *sync.Once, fn func() error) error {
 	return err
 }
 
+// OverflowPolicy defines what happens to new messages
+// when a subscription's buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks dispatching until the subscriber reads from the buffer.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest discards the oldest buffered message to make room for the new one.
+	OverflowDropOldest
+
+	// OverflowDropNewest discards the incoming message.
+	OverflowDropNewest
+)
+
+// DefaultSubscriptionBufferSize is the default number of messages
+// a subscription can hold until its overflow policy is applied.
+const DefaultSubscriptionBufferSize = 10
+
+// SubscriptionOption is a subscription configuration option.
+type SubscriptionOption func(cfg *subConfig)
+
+// WithSubscriptionBufferSize sets the subscription buffer size,
+// defaults to DefaultSubscriptionBufferSize.
+func WithSubscriptionBufferSize(n int) SubscriptionOption {
+	if n < 0 {
+		panic("buffer size is negative")
+	}
+	return func(cfg *subConfig) {
+		cfg.size = n
+	}
+}
+
+// WithSubscriptionOverflowPolicy sets the subscription overflow policy,
+// defaults to OverflowBlock.
+func WithSubscriptionOverflowPolicy(policy OverflowPolicy) SubscriptionOption {
+	return func(cfg *subConfig) {
+		cfg.policy = policy
+	}
+}
+
+type subConfig struct {
+	size   int
+	policy OverflowPolicy
+	path   []string // twin property path filter
+	input  string   // module input name filter
+}
+
+func newSubConfig(opts ...SubscriptionOption) *subConfig {
+	cfg := &subConfig{size: DefaultSubscriptionBufferSize, policy: OverflowBlock}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
 func newEventsMux() *eventsMux {
 	return &eventsMux{done: make(chan struct{})}
 }
@@ -28,6 +87,7 @@ type eventsMux struct {
 	mu   sync.RWMutex
 	subs []*EventSub
 	done chan struct{}
+	pool *dispatchPool // WithDispatchWorkers
 }
 
 func (m *eventsMux) once(fn func() error) error {
@@ -35,19 +95,24 @@ func (m *eventsMux) once(fn func() error) error {
 }
 
 func (m *eventsMux) Dispatch(msg *common.Message) {
+	m.pool.run("events/"+msg.InputName, func() {
+		m.dispatch(msg)
+	})
+}
+
+func (m *eventsMux) dispatch(msg *common.Message) {
 	m.mu.RLock()
 	for _, s := range m.subs {
-		select {
-		case <-s.done:
-		case <-m.done:
-		case s.ch <- msg:
+		if s.input != "" && s.input != msg.InputName {
+			continue
 		}
+		s.push(msg, m.done)
 	}
 	m.mu.RUnlock()
 }
 
-func (m *eventsMux) sub() *EventSub {
-	s := newEventSub()
+func (m *eventsMux) sub(opts ...SubscriptionOption) *EventSub {
+	s := newEventSub(newSubConfig(opts...))
 	m.mu.Lock()
 	m.subs = append(m.subs, s)
 	m.mu.Unlock()
@@ -55,6 +120,8 @@ func (m *eventsMux) sub() *EventSub {
 }
 
 func (m *eventsMux) unsub(s *EventSub) {
+	// unblock the dispatcher if it's waiting for the subscriber
+	s.cancel()
 	m.mu.Lock()
 	for i, ss := range m.subs {
 		if ss == s {
@@ -81,17 +148,23 @@ func (m *eventsMux) close(err error) {
 	m.mu.Unlock()
 }
 
-func newEventSub() *EventSub {
+func newEventSub(cfg *subConfig) *EventSub {
 	return &EventSub{
-		ch:   make(chan *common.Message, 10), // TODO: configurable value
-		done: make(chan struct{}),
+		ch:     make(chan *common.Message, cfg.size),
+		done:   make(chan struct{}),
+		policy: cfg.policy,
+		input:  cfg.input,
 	}
 }
 
 type EventSub struct {
-	ch   chan *common.Message
-	err  error
-	done chan struct{}
+	ch      chan *common.Message
+	err     error
+	done    chan struct{}
+	once    sync.Once
+	policy  OverflowPolicy
+	dropped uint64
+	input   string
 }
 
 func (s *EventSub) C() <-chan *common.Message {
@@ -102,9 +175,52 @@ func (s *EventSub) Err() error {
 	return s.err
 }
 
+// Dropped returns number of messages discarded by the overflow policy.
+func (s *EventSub) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *EventSub) push(msg *common.Message, done <-chan struct{}) {
+	switch s.policy {
+	case OverflowDropNewest:
+		select {
+		case s.ch <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				return
+			default:
+			}
+			atomic.AddUint64(&s.dropped, 1)
+			select {
+			case <-s.ch:
+			default:
+				// nothing to drop, e.g. the buffer size is zero
+				return
+			}
+		}
+	default:
+		select {
+		case <-s.done:
+		case <-done:
+		case s.ch <- msg:
+		}
+	}
+}
+
+func (s *EventSub) cancel() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
 func (s *EventSub) close(err error) {
 	s.err = err
-	close(s.done)
+	s.cancel()
 	close(s.ch)
 }
 
@@ -117,6 +233,7 @@ type twinStateMux struct {
 	mu   sync.RWMutex
 	subs []*TwinStateSub
 	done chan struct{}
+	pool *dispatchPool // WithDispatchWorkers
 }
 
 func (m *twinStateMux) once(fn func() error) error {
@@ -124,6 +241,12 @@ func (m *twinStateMux) once(fn func() error) error {
 }
 
 func (m *twinStateMux) Dispatch(b []byte) {
+	m.pool.run("twin", func() {
+		m.dispatch(b)
+	})
+}
+
+func (m *twinStateMux) dispatch(b []byte) {
 	var v TwinState
 	if err := json.Unmarshal(b, &v); err != nil {
 		log.Printf("unmarshal error: %s", err) // TODO
@@ -131,24 +254,88 @@ func (m *twinStateMux) Dispatch(b []byte) {
 	}
 
 	m.mu.RLock()
-	select {
-	case <-m.done:
-		panic("already closed")
-	default:
-	}
-	for _, sub := range m.subs {
-		go func(sub *TwinStateSub) {
-			select {
-			case sub.ch <- v:
-			case <-m.done:
-			}
-		}(sub)
+	for _, s := range m.subs {
+		if s.path == nil {
+			s.push(v, m.done)
+		} else if fv := filterTwinState(v, s.path); fv != nil {
+			s.push(fv, m.done)
+		}
 	}
 	m.mu.RUnlock()
 }
 
-func (m *twinStateMux) sub() *TwinStateSub {
-	s := &TwinStateSub{ch: make(chan TwinState, 10)}
+// parseTwinPath splits a dot-separated property path,
+// the optional leading desired segment is omitted
+// because only desired properties are ever patched.
+func parseTwinPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("path is empty")
+	}
+	p := strings.Split(path, ".")
+	if p[0] == "desired" {
+		p = p[1:]
+	}
+	for _, s := range p {
+		if s == "" {
+			return nil, fmt.Errorf("malformed path %q", path)
+		}
+	}
+	return p, nil
+}
+
+// filterTwinState returns the part of the patch that matches the path
+// along with its version, or nil when the patch doesn't touch it.
+func filterTwinState(v TwinState, path []string) TwinState {
+	sub, ok := extractTwinPath(map[string]interface{}(v), path)
+	if !ok {
+		return nil
+	}
+	s, _ := sub.(map[string]interface{})
+	if s == nil {
+		s = map[string]interface{}{}
+	}
+	if ver, ok := v["$version"]; ok {
+		s["$version"] = ver
+	}
+	return s
+}
+
+// extractTwinPath extracts matching sub-document from the node,
+// where * segments match any property. A nil node means the property
+// has been removed along with everything beneath it.
+func extractTwinPath(node interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 || node == nil {
+		return node, true
+	}
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if path[0] != "*" {
+		child, ok := m[path[0]]
+		if !ok {
+			return nil, false
+		}
+		sub, ok := extractTwinPath(child, path[1:])
+		if !ok {
+			return nil, false
+		}
+		return map[string]interface{}{path[0]: sub}, true
+	}
+	res := map[string]interface{}{}
+	for k, child := range m {
+		if strings.HasPrefix(k, "$") {
+			continue // metadata such as $version
+		}
+		if sub, ok := extractTwinPath(child, path[1:]); ok {
+			res[k] = sub
+		}
+	}
+	return res, len(res) != 0
+}
+
+func (m *twinStateMux) sub(opts ...SubscriptionOption) *TwinStateSub {
+	s := newTwinStateSub(newSubConfig(opts...))
 	m.mu.Lock()
 	m.subs = append(m.subs, s)
 	m.mu.Unlock()
@@ -156,9 +343,11 @@ func (m *twinStateMux) sub() *TwinStateSub {
 }
 
 func (m *twinStateMux) unsub(s *TwinStateSub) {
+	s.cancel()
 	m.mu.Lock()
 	for i, ss := range m.subs {
 		if ss == s {
+			s.close(nil)
 			m.subs = append(m.subs[:i], m.subs[i+1:]...)
 			break
 		}
@@ -168,17 +357,36 @@ func (m *twinStateMux) unsub(s *TwinStateSub) {
 
 func (m *twinStateMux) close(err error) {
 	m.mu.Lock()
+	select {
+	case <-m.done:
+		panic("already closed")
+	default:
+	}
+	close(m.done)
 	for _, s := range m.subs {
-		s.err = ErrClosed
-		close(s.ch)
+		s.close(ErrClosed)
 	}
 	m.subs = m.subs[0:0]
 	m.mu.Unlock()
 }
 
+func newTwinStateSub(cfg *subConfig) *TwinStateSub {
+	return &TwinStateSub{
+		ch:     make(chan TwinState, cfg.size),
+		done:   make(chan struct{}),
+		policy: cfg.policy,
+		path:   cfg.path,
+	}
+}
+
 type TwinStateSub struct {
-	ch  chan TwinState
-	err error
+	ch      chan TwinState
+	err     error
+	done    chan struct{}
+	once    sync.Once
+	policy  OverflowPolicy
+	dropped uint64
+	path    []string
 }
 
 func (s *TwinStateSub) C() <-chan TwinState {
@@ -189,6 +397,55 @@ func (s *TwinStateSub) Err() error {
 	return s.err
 }
 
+// Dropped returns number of twin updates discarded by the overflow policy.
+func (s *TwinStateSub) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *TwinStateSub) push(v TwinState, done <-chan struct{}) {
+	switch s.policy {
+	case OverflowDropNewest:
+		select {
+		case s.ch <- v:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- v:
+				return
+			default:
+			}
+			atomic.AddUint64(&s.dropped, 1)
+			select {
+			case <-s.ch:
+			default:
+				// nothing to drop, e.g. the buffer size is zero
+				return
+			}
+		}
+	default:
+		select {
+		case <-s.done:
+		case <-done:
+		case s.ch <- v:
+		}
+	}
+}
+
+func (s *TwinStateSub) cancel() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *TwinStateSub) close(err error) {
+	s.err = err
+	s.cancel()
+	close(s.ch)
+}
+
 func newMethodMux() *methodMux {
 	return &methodMux{}
 }
@@ -197,7 +454,7 @@ func newMethodMux() *methodMux {
 type methodMux struct {
 	on sync.Once
 	mu sync.RWMutex
-	m  map[string]DirectMethodHandler
+	m  map[string]RawDirectMethodHandler
 }
 
 func (m *methodMux) once(fn func() error) error {
@@ -205,13 +462,13 @@ func (m *methodMux) once(fn func() error) error {
 }
 
 // handle registers the given direct-method handler.
-func (m *methodMux) handle(method string, fn DirectMethodHandler) error {
+func (m *methodMux) handle(method string, fn RawDirectMethodHandler) error {
 	if fn == nil {
 		panic("fn is nil")
 	}
 	m.mu.Lock()
 	if m.m == nil {
-		m.m = map[string]DirectMethodHandler{}
+		m.m = map[string]RawDirectMethodHandler{}
 	}
 	if _, ok := m.m[method]; ok {
 		m.mu.Unlock()
@@ -240,20 +497,14 @@ func (m *methodMux) Dispatch(method string, b []byte) (int, []byte, error) {
 		return 0, nil, fmt.Errorf("method %q is not registered", method)
 	}
 
-	var v map[string]interface{}
-	if err := json.Unmarshal(b, &v); err != nil {
-		return jsonErr(err)
-	}
-	code, v, err := f(v)
+	code, b, err := f(b)
 	if err != nil {
 		return jsonErr(err)
 	}
-	if v == nil {
-		v = map[string]interface{}{}
-	}
-	b, err = json.Marshal(v)
-	if err != nil {
-		return jsonErr(err)
+	if len(b) == 0 {
+		b = []byte("{}")
+	} else if !json.Valid(b) {
+		return jsonErr(errors.New("response is not valid json"))
 	}
 	return code, b, nil
 }
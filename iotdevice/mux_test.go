@@ -2,6 +2,7 @@ package iotdevice
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/amenzhinsky/iothub/common"
@@ -47,12 +48,35 @@ func TestEventsMuxClose(t *testing.T) {
 	}
 }
 
+func TestEventsMuxOverflow(t *testing.T) {
+	for policy, want := range map[OverflowPolicy]string{
+		OverflowDropOldest: "c",
+		OverflowDropNewest: "a",
+	} {
+		mux := newEventsMux()
+		sub := mux.sub(
+			WithSubscriptionBufferSize(1),
+			WithSubscriptionOverflowPolicy(policy),
+		)
+		for _, s := range []string{"a", "b", "c"} {
+			mux.Dispatch(&common.Message{Payload: []byte(s)})
+		}
+		if n := sub.Dropped(); n != 2 {
+			t.Errorf("policy %d: dropped = %d, want %d", policy, n, 2)
+		}
+		if msg := <-sub.C(); string(msg.Payload) != want {
+			t.Errorf("policy %d: payload = %q, want %q", policy, msg.Payload, want)
+		}
+		mux.close(ErrClosed)
+	}
+}
+
 func TestMethodMux(t *testing.T) {
 	m := methodMux{}
-	if err := m.handle("add", func(v map[string]interface{}) (int, map[string]interface{}, error) {
+	if err := m.handle("add", DirectMethodHandler(func(v map[string]interface{}) (int, map[string]interface{}, error) {
 		v["b"] = 2
 		return 321, v, nil
-	}); err != nil {
+	}).raw()); err != nil {
 		t.Fatal(err)
 	}
 	defer m.remove("add")
@@ -69,3 +93,75 @@ func TestMethodMux(t *testing.T) {
 		t.Errorf("data = %q, want %q", data, w)
 	}
 }
+
+func TestMethodMuxRaw(t *testing.T) {
+	m := methodMux{}
+	if err := m.handle("echo", func(b json.RawMessage) (int, json.RawMessage, error) {
+		return 200, b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handle("empty", func(b json.RawMessage) (int, json.RawMessage, error) {
+		return 204, nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handle("invalid", func(b json.RawMessage) (int, json.RawMessage, error) {
+		return 200, json.RawMessage("{"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method  string
+		payload string
+		code    int
+		want    string
+	}{
+		// precision is lost when large integers are decoded into float64
+		{"echo", `{"id":9007199254740993}`, 200, `{"id":9007199254740993}`},
+		{"echo", `[1,2]`, 200, `[1,2]`},
+		{"empty", `null`, 204, `{}`},
+		{"invalid", `{}`, 500, `{"error":"response is not valid json"}`},
+	} {
+		code, b, err := m.Dispatch(c.method, []byte(c.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code || string(b) != c.want {
+			t.Errorf("Dispatch(%q, %s) = %d, %s, want %d, %s",
+				c.method, c.payload, code, b, c.code, c.want)
+		}
+	}
+}
+
+func TestTwinStateMuxFiltered(t *testing.T) {
+	mux := newTwinStateMux()
+	p, err := parseTwinPath("desired.config.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := mux.sub(func(cfg *subConfig) {
+		cfg.path = p
+	})
+
+	mux.Dispatch([]byte(`{"other":1,"$version":2}`))
+	mux.Dispatch([]byte(`{"other":1,"config":{"a":1,"b":{"c":2}},"$version":3}`))
+
+	s := <-sub.C()
+	if s.Version() != 3 {
+		t.Errorf("version = %d, want 3", s.Version())
+	}
+	if _, ok := s["other"]; ok {
+		t.Errorf("state = %v, other is not filtered out", s)
+	}
+	cfg, _ := s["config"].(map[string]interface{})
+	if cfg["a"] != float64(1) || cfg["b"] == nil {
+		t.Errorf("state = %v, want config.a and config.b", s)
+	}
+	select {
+	case s = <-sub.C():
+		t.Errorf("unexpected state = %v", s)
+	default:
+	}
+}
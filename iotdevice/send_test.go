@@ -0,0 +1,244 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
+)
+
+func TestSendEventReader(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.SendEventReader(ctx, strings.NewReader("hello"), 5,
+		WithSendMessageID("1"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SendEventReader(ctx, strings.NewReader(""), common.MaxD2CMessageSize+1); !errors.Is(err, common.ErrMessageTooLarge) {
+		t.Errorf("SendEventReader error = %v, want %v", err, common.ErrMessageTooLarge)
+	}
+	sent := tr.Sent()
+	if len(sent) != 1 || string(sent[0].Payload) != "hello" || sent[0].MessageID != "1" {
+		t.Errorf("unexpected sent messages: %v", sent)
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString,
+		WithSendRateLimit(20, 1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err = c.SendEvent(ctx, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("3 messages at 20/s are sent in %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = c.SendEvent(ctx, []byte("hello")); err != context.Canceled {
+		t.Errorf("SendEvent error = %v, want %v", err, context.Canceled)
+	}
+	if n := len(tr.Sent()); n != 3 {
+		t.Errorf("%d messages are sent, want 3", n)
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	errSend := errors.New("publish timeout")
+	var attempts []time.Time
+	tr.SetSendHook(func(ctx context.Context, msg *common.Message) error {
+		if msg.TransportOptions != nil {
+			t.Errorf("transport options = %v, want none", msg.TransportOptions)
+		}
+		attempts = append(attempts, time.Now())
+		if len(attempts) <= 3 {
+			return errSend
+		}
+		return nil
+	})
+
+	if err = c.SendEvent(ctx, []byte("hello"), WithSendRetry(RetryPolicy{
+		Backoff:    20 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 4 {
+		t.Fatalf("%d send attempts, want 4", len(attempts))
+	}
+	// the backoff is doubled after each attempt up to the max
+	for i, want := range []time.Duration{
+		20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond,
+	} {
+		if d := attempts[i+1].Sub(attempts[i]); d < want {
+			t.Errorf("retry %d after %s, want at least %s", i+1, d, want)
+		}
+	}
+	if n := len(tr.Sent()); n != 1 {
+		t.Errorf("%d messages are sent, want 1", n)
+	}
+
+	// retries stop once the deadline is exceeded
+	attempts = nil
+	tr.SetSendHook(func(ctx context.Context, msg *common.Message) error {
+		attempts = append(attempts, time.Now())
+		return errSend
+	})
+	start := time.Now()
+	err = c.SendEvent(ctx, []byte("hello"), WithSendRetry(RetryPolicy{
+		Deadline: 100 * time.Millisecond,
+		Backoff:  10 * time.Millisecond,
+	}))
+	if err != errSend {
+		t.Errorf("SendEvent error = %v, want %v", err, errSend)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("SendEvent gave up after %s, want the 100ms deadline", d)
+	}
+	if len(attempts) < 2 {
+		t.Errorf("%d send attempts, want retries", len(attempts))
+	}
+
+	// non-retryable errors fail immediately
+	attempts = nil
+	if err = c.SendEvent(ctx, []byte("hello"), WithSendRetry(RetryPolicy{
+		Retryable: func(err error) bool { return false },
+	})); err != errSend {
+		t.Errorf("SendEvent error = %v, want %v", err, errSend)
+	}
+	if len(attempts) != 1 {
+		t.Errorf("%d send attempts, want 1", len(attempts))
+	}
+}
+
+// blockSends makes sends block until the returned function is called,
+// started receives a value once a send is blocked.
+func blockSends(tr *transporttest.Transport) (started <-chan struct{}, unblock func()) {
+	ch := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tr.SetSendHook(func(ctx context.Context, msg *common.Message) error {
+		ch <- struct{}{}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return ch, func() { close(release) }
+}
+
+func TestDrain(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	started, unblock := blockSends(tr)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendEvent(ctx, []byte("hello"))
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- c.Drain(ctx)
+	}()
+	select {
+	case err = <-drained:
+		t.Fatalf("Drain returned %v while a publish is in progress", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unblock()
+	if err = <-sent; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Drain doesn't return after the publish is done")
+	}
+	if n := len(tr.Sent()); n != 1 {
+		t.Errorf("%d messages are sent, want 1", n)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	tr := transporttest.New()
+	c, err := NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	started, unblock := blockSends(tr)
+	defer unblock()
+	go func() {
+		_ = c.SendEvent(ctx, []byte("hello"))
+	}()
+	<-started
+
+	start := time.Now()
+	if err = c.CloseWithTimeout(50 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("CloseWithTimeout error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("CloseWithTimeout returned after %s, want the 50ms timeout", d)
+	}
+	if err = c.SendEvent(ctx, []byte("hello")); err != ErrClosed {
+		t.Errorf("SendEvent after close error = %v, want %v", err, ErrClosed)
+	}
+}
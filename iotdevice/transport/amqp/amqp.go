@@ -0,0 +1,686 @@
+// Package amqp implements the AMQP device transport.
+//
+// Multiple transports can share a single physical connection by using
+// a Pool, which is useful for protocol gateways that connect hundreds
+// of device identities from a single process.
+package amqp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/eventhub"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+var ErrNotImplemented = errors.New("not implemented")
+
+const userAgent = "iothub-golang-sdk/dev"
+
+const (
+	// tokenLifetime is lifetime of CBS tokens.
+	tokenLifetime = time.Hour
+
+	// tokenUpdateSpan is how long before expiration tokens are renewed.
+	tokenUpdateSpan = 10 * time.Minute
+)
+
+// TransportOption is a transport configuration option.
+type TransportOption func(tr *Transport)
+
+// WithLogger sets logger for errors and warnings
+// plus debug messages when it's enabled.
+func WithLogger(l logger.Logger) TransportOption {
+	return func(tr *Transport) {
+		tr.logger = l
+	}
+}
+
+// WithTLSConfig sets TLS config that's used for dialing connections.
+func WithTLSConfig(config *tls.Config) TransportOption {
+	return func(tr *Transport) {
+		tr.tls = config
+	}
+}
+
+// WithPool makes the transport share a physical connection from the given
+// pool with other transports connecting to the same hub, every device
+// uses its own session, links and CBS token.
+//
+// x509 authentication cannot be used with pooled connections.
+func WithPool(p *Pool) TransportOption {
+	return func(tr *Transport) {
+		tr.pool = p
+	}
+}
+
+// WithTokenRenewalHandler sets a function that's called when renewing
+// the CBS token fails after all retries, then the transport disconnects
+// since the hub closes connections with expired tokens anyway,
+// so the client can be connected again.
+func WithTokenRenewalHandler(fn func(err error)) TransportOption {
+	return func(tr *Transport) {
+		tr.onRenewError = fn
+	}
+}
+
+// Disposition is the outcome cloud-to-device messages are settled with.
+type Disposition int
+
+const (
+	// Complete removes the message from the device queue, it's the default.
+	Complete Disposition = iota
+
+	// Abandon puts the message back to the device queue for redelivery.
+	Abandon
+
+	// Reject dead-letters the message without further delivery attempts.
+	Reject
+
+	// Unsettled leaves the message unsettled, so it's redelivered once
+	// its lock expires, the link stops receiving when it runs out of credit.
+	Unsettled
+)
+
+var dispositions = []string{"complete", "abandon", "reject", "none"}
+
+func (d Disposition) String() string {
+	if d < 0 || int(d) >= len(dispositions) {
+		return "unknown"
+	}
+	return dispositions[d]
+}
+
+// ParseDisposition parses complete, abandon, reject and none dispositions.
+func ParseDisposition(s string) (Disposition, error) {
+	for i, v := range dispositions {
+		if v == s {
+			return Disposition(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown disposition %q", s)
+}
+
+// WithC2DDisposition makes the transport settle cloud-to-device messages
+// with the given outcome instead of completing them, report is called
+// with the settlement result of every message when it's not nil.
+func WithC2DDisposition(d Disposition, report func(msg *common.Message, d Disposition, err error)) TransportOption {
+	return func(tr *Transport) {
+		tr.c2dDisposition = d
+		tr.c2dReport = report
+	}
+}
+
+// New returns new AMQP transport.
+// See more: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-amqp-support
+func New(opts ...TransportOption) *Transport {
+	tr := &Transport{
+		done:  make(chan struct{}),
+		renew: defaultRenewPolicy,
+	}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	return tr
+}
+
+// Transport is an AMQP device transport.
+type Transport struct {
+	mu    sync.RWMutex
+	conn  amqpConn
+	sess  *amqp.Session
+	send  *amqp.Sender
+	creds transport.Credentials
+	stop  chan struct{} // closed on disconnect to stop background routines
+	renew renewPolicy
+
+	pool *Pool
+	tls  *tls.Config
+
+	c2dDisposition Disposition
+	c2dReport      func(msg *common.Message, d Disposition, err error)
+
+	onRenewError func(err error) // WithTokenRenewalHandler
+
+	done   chan struct{}
+	logger logger.Logger
+}
+
+// amqpConn is an AMQP connection, it's always *amqp.Conn but tests.
+type amqpConn interface {
+	NewSession(ctx context.Context, opts *amqp.SessionOptions) (*amqp.Session, error)
+	Close() error
+}
+
+func (tr *Transport) SetLogger(logger logger.Logger) {
+	tr.logger = logger
+}
+
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.conn != nil {
+		return errors.New("already connected")
+	}
+	if tr.tls == nil {
+		// loaded on connect, so malformed IOTHUB_ROOT_CA_FILE is reported
+		rootCAs, err := common.LoadRootCAs()
+		if err != nil {
+			return err
+		}
+		tr.tls = &tls.Config{RootCAs: rootCAs}
+	}
+
+	var (
+		conn *amqp.Conn
+		err  error
+	)
+	if tr.pool != nil {
+		if creds.GetCertificate() != nil {
+			return errors.New("x509 authentication is not supported by pooled connections")
+		}
+		conn, err = tr.pool.acquire(ctx, transport.BrokerHost(creds), tr.tls)
+	} else {
+		conn, err = dial(ctx, creds, tr.tls)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tr.evictLost(conn, err)
+			tr.release(conn)
+		}
+	}()
+
+	stop := make(chan struct{})
+	if creds.GetCertificate() == nil {
+		if err = tr.putTokenContinuously(ctx, conn, creds, stop); err != nil {
+			close(stop)
+			return err
+		}
+	}
+
+	sess, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		close(stop)
+		return err
+	}
+	send, err := sess.NewSender(ctx, "/devices/"+url.PathEscape(creds.GetDeviceID())+"/messages/events", nil)
+	if err != nil {
+		_ = sess.Close(context.Background())
+		close(stop)
+		return err
+	}
+
+	tr.conn = conn
+	tr.sess = sess
+	tr.send = send
+	tr.creds = creds
+	tr.stop = stop
+	tr.logger.Debugf("connected to %s as %s", transport.BrokerHost(creds), creds.GetDeviceID())
+	return nil
+}
+
+func dial(ctx context.Context, creds transport.Credentials, tlsCfg *tls.Config) (*amqp.Conn, error) {
+	opts := &amqp.ConnOptions{
+		TLSConfig:  tlsCfg,
+		Properties: map[string]any{"com.microsoft:client-version": userAgent},
+	}
+	if crt := creds.GetCertificate(); crt != nil {
+		opts.TLSConfig = tlsCfg.Clone()
+		opts.TLSConfig.Certificates = append(opts.TLSConfig.Certificates, *crt)
+		opts.SASLType = amqp.SASLTypeExternal("")
+	} else {
+		opts.SASLType = amqp.SASLTypeAnonymous()
+	}
+	return amqp.Dial(ctx, "amqps://"+transport.BrokerHost(creds), opts)
+}
+
+// evictLost evicts the given pooled connection when err means it's
+// closed, so transports connecting later don't get a dead one.
+func (tr *Transport) evictLost(conn amqpConn, err error) {
+	var connErr *amqp.ConnError
+	if tr.pool != nil && errors.As(err, &connErr) {
+		tr.pool.evict(conn)
+	}
+}
+
+func (tr *Transport) release(conn amqpConn) {
+	if tr.pool != nil {
+		tr.pool.release(conn)
+		return
+	}
+	_ = conn.Close()
+}
+
+// putTokenContinuously writes token first time in blocking mode and returns
+// maintaining token updates in the background until stop is closed.
+func (tr *Transport) putTokenContinuously(
+	ctx context.Context, conn amqpConn, creds transport.Credentials, stop chan struct{},
+) error {
+	sess, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tokens := common.NewTokenCache(creds.Token, tokenLifetime)
+	if err := putToken(ctx, sess, creds, tokens); err != nil {
+		tokens.Close()
+		_ = sess.Close(context.Background())
+		return err
+	}
+
+	go func() {
+		defer func() {
+			if sess != nil {
+				_ = sess.Close(context.Background())
+			}
+		}()
+		defer tokens.Close()
+		tr.renewTokens(stop, func() error {
+			return renewToken(conn, &sess, creds, tokens)
+		})
+	}()
+	return nil
+}
+
+// renewPolicy is how often tokens are renewed and how failed renewals are retried.
+type renewPolicy struct {
+	interval   time.Duration
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// defaultRenewPolicy renews tokens tokenUpdateSpan before they expire,
+// so retries have to fit into that window.
+var defaultRenewPolicy = renewPolicy{
+	interval:   tokenLifetime - tokenUpdateSpan,
+	attempts:   5,
+	backoff:    5 * time.Second,
+	maxBackoff: time.Minute,
+}
+
+// renewTimeout limits a single token renewal attempt.
+const renewTimeout = time.Minute
+
+// renewTokens calls renew according to the transport's renewal policy
+// until stop is closed, the transport is disconnected when all attempts
+// of a renewal fail, see renewFailed.
+func (tr *Transport) renewTokens(stop chan struct{}, renew func() error) {
+	ticker := time.NewTimer(tr.renew.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := common.Retry(
+			stop, tr.renew.attempts, tr.renew.backoff, tr.renew.maxBackoff,
+			func(attempt int) error {
+				err := renew()
+				if err != nil {
+					tr.logger.Warnf("put token attempt %d failed: %s", attempt, err)
+				}
+				return err
+			},
+		); err != nil {
+			select {
+			case <-stop:
+			default:
+				tr.logger.Errorf("put token error: %s", err)
+				tr.renewFailed(stop, err)
+			}
+			return
+		}
+		ticker.Reset(tr.renew.interval)
+		tr.logger.Debugf("token updated")
+	}
+}
+
+// renewToken makes a single attempt to put a new token, the CBS
+// session is re-opened when it's lost along with its links.
+func renewToken(
+	conn amqpConn, sess **amqp.Session, creds transport.Credentials, tokens *common.TokenCache,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+	defer cancel()
+	if *sess == nil {
+		s, err := conn.NewSession(ctx, nil)
+		if err != nil {
+			return err
+		}
+		*sess = s
+	}
+	err := putToken(ctx, *sess, creds, tokens)
+	if err != nil && isLost(err) {
+		_ = (*sess).Close(context.Background())
+		*sess = nil
+	}
+	return err
+}
+
+// isLost reports whether err is caused by the session
+// or the link being closed, so they have to be re-opened.
+func isLost(err error) bool {
+	var (
+		sessErr *amqp.SessionError
+		linkErr *amqp.LinkError
+	)
+	return errors.As(err, &sessErr) || errors.As(err, &linkErr)
+}
+
+// renewFailed disconnects the transport unless the connection that failed
+// to renew its token has been already closed and reports err to the handler.
+func (tr *Transport) renewFailed(stop chan struct{}, err error) {
+	tr.mu.Lock()
+	if tr.conn == nil || tr.stop != stop {
+		tr.mu.Unlock()
+		return
+	}
+	tr.evictLost(tr.conn, err)
+	tr.disconnect()
+	tr.mu.Unlock()
+
+	if tr.onRenewError != nil {
+		tr.onRenewError(err)
+	}
+}
+
+func putToken(
+	ctx context.Context, sess *amqp.Session, creds transport.Credentials, tokens *common.TokenCache,
+) error {
+	send, err := sess.NewSender(ctx, "$cbs", nil)
+	if err != nil {
+		return err
+	}
+	defer send.Close(context.Background())
+
+	recv, err := sess.NewReceiver(ctx, "$cbs", nil)
+	if err != nil {
+		return err
+	}
+	defer recv.Close(context.Background())
+
+	audience := creds.GetHostName() + "/devices/" + url.PathEscape(creds.GetDeviceID())
+	sas, err := tokens.Token(audience)
+	if err != nil {
+		return err
+	}
+
+	to := "$cbs"
+	replyTo := "cbs"
+	if err = send.Send(ctx, &amqp.Message{
+		Value: sas.String(),
+		Properties: &amqp.MessageProperties{
+			To:      &to,
+			ReplyTo: &replyTo,
+		},
+		ApplicationProperties: map[string]interface{}{
+			"operation": "put-token",
+			"type":      "servicebus.windows.net:sastoken",
+			"name":      "amqps://" + audience,
+		},
+	}, &amqp.SendOptions{}); err != nil {
+		return err
+	}
+
+	msg, err := recv.Receive(ctx, &amqp.ReceiveOptions{})
+	if err != nil {
+		return err
+	}
+	if err = recv.AcceptMessage(ctx, msg); err != nil {
+		return err
+	}
+	return eventhub.CheckMessageResponse(msg)
+}
+
+// Disconnect closes device's session and links, the underlying
+// connection is closed as well unless it's shared with others.
+func (tr *Transport) Disconnect() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	tr.disconnect()
+	return nil
+}
+
+func (tr *Transport) ConnectionState() transport.ConnectionState {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.conn == nil {
+		return transport.Disconnected
+	}
+	return transport.Connected
+}
+
+func (tr *Transport) disconnect() {
+	close(tr.stop)
+	if tr.sess != nil { // nil when only a connection is set up by tests
+		_ = tr.send.Close(context.Background())
+		_ = tr.sess.Close(context.Background())
+	}
+	tr.release(tr.conn)
+	tr.conn, tr.sess, tr.send = nil, nil, nil
+	tr.logger.Debugf("disconnected")
+}
+
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	tr.mu.RLock()
+	conn, send := tr.conn, tr.send
+	tr.mu.RUnlock()
+	if send == nil {
+		return errors.New("not connected")
+	}
+	err := send.Send(ctx, toAMQPMessage(msg), &amqp.SendOptions{})
+	if err != nil {
+		tr.evictLost(conn, err)
+	}
+	return err
+}
+
+// toAMQPMessage converts the given common.Message into amqp.Message.
+func toAMQPMessage(msg *common.Message) *amqp.Message {
+	m := &amqp.Message{
+		Data:       [][]byte{msg.Payload},
+		Properties: &amqp.MessageProperties{},
+	}
+	if msg.MessageID != "" {
+		m.Properties.MessageID = msg.MessageID
+	}
+	if msg.CorrelationID != "" {
+		m.Properties.CorrelationID = msg.CorrelationID
+	}
+	if msg.UserID != "" {
+		m.Properties.UserID = []byte(msg.UserID)
+	}
+	if msg.To != "" {
+		m.Properties.To = &msg.To
+	}
+	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
+		m.Properties.AbsoluteExpiryTime = msg.ExpiryTime
+	}
+	if msg.EnqueuedTime != nil && !msg.EnqueuedTime.IsZero() {
+		m.Properties.CreationTime = msg.EnqueuedTime
+	}
+	if msg.ContentType != "" {
+		m.Properties.ContentType = &msg.ContentType
+	}
+	if msg.ContentEncoding != "" {
+		m.Properties.ContentEncoding = &msg.ContentEncoding
+	}
+	if msg.InterfaceID != "" || msg.ComponentName != "" {
+		m.Annotations = amqp.Annotations{}
+		if msg.InterfaceID != "" {
+			m.Annotations["iothub-interface-id"] = msg.InterfaceID
+		}
+		if msg.ComponentName != "" {
+			m.Annotations["dt-subject"] = msg.ComponentName
+		}
+	}
+	if len(msg.Properties) != 0 {
+		m.ApplicationProperties = make(map[string]interface{}, len(msg.Properties))
+		for k, v := range msg.Properties {
+			m.ApplicationProperties[k] = v
+		}
+	}
+	return m
+}
+
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	recv, err := tr.sess.NewReceiver(ctx,
+		"/devices/"+url.PathEscape(tr.creds.GetDeviceID())+"/messages/devicebound", nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func(stop chan struct{}) {
+		defer recv.Close(context.Background())
+
+		// stop receiving when the transport is disconnected
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			msg, err := recv.Receive(ctx, &amqp.ReceiveOptions{})
+			if err != nil {
+				if ctx.Err() == nil {
+					tr.logger.Errorf("receive error: %s", err)
+				}
+				return
+			}
+			m := iotservice.FromAMQPMessage(msg)
+			mux.Dispatch(m)
+			err = settle(ctx, recv, msg, tr.c2dDisposition)
+			if tr.c2dReport != nil {
+				tr.c2dReport(m, tr.c2dDisposition, err)
+			}
+			if err != nil {
+				tr.logger.Errorf("%s error: %s", tr.c2dDisposition, err)
+				return
+			}
+		}
+	}(tr.stop)
+	return nil
+}
+
+func settle(ctx context.Context, recv *amqp.Receiver, msg *amqp.Message, d Disposition) error {
+	switch d {
+	case Complete:
+		return recv.AcceptMessage(ctx, msg)
+	case Abandon:
+		return recv.ReleaseMessage(ctx, msg)
+	case Reject:
+		return recv.RejectMessage(ctx, msg, nil)
+	case Unsettled:
+		return nil
+	default:
+		return fmt.Errorf("unknown disposition %d", d)
+	}
+}
+
+// SubscribeInputs is not available in the AMQP transport.
+func (tr *Transport) SubscribeInputs(ctx context.Context, mux transport.MessageDispatcher) error {
+	return ErrNotImplemented
+}
+
+// RegisterDirectMethods is not available in the AMQP transport.
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	return ErrNotImplemented
+}
+
+// SubscribeTwinUpdates is not available in the AMQP transport.
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	return ErrNotImplemented
+}
+
+// RetrieveTwinProperties is not available in the AMQP transport.
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	return nil, ErrNotImplemented
+}
+
+// UpdateTwinProperties is not available in the AMQP transport.
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, b []byte) (int, error) {
+	return 0, ErrNotImplemented
+}
+
+// GetBlobSharedAccessSignature is not available in the AMQP transport.
+func (tr *Transport) GetBlobSharedAccessSignature(ctx context.Context, blobName string) (string, string, error) {
+	return "", "", ErrNotImplemented
+}
+
+// UploadToBlob is not available in the AMQP transport.
+func (tr *Transport) UploadToBlob(ctx context.Context, sasURI string, file io.Reader, size int64) error {
+	return ErrNotImplemented
+}
+
+// NotifyUploadComplete is not available in the AMQP transport.
+func (tr *Transport) NotifyUploadComplete(ctx context.Context, correlationID string, success bool, statusCode int, statusDescription string) error {
+	return ErrNotImplemented
+}
+
+// ListModules is not available in the AMQP transport.
+func (tr *Transport) ListModules(ctx context.Context) ([]*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// CreateModule is not available in the AMQP transport.
+func (tr *Transport) CreateModule(ctx context.Context, m *iotservice.Module) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// GetModule is not available in the AMQP transport.
+func (tr *Transport) GetModule(ctx context.Context, moduleID string) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// UpdateModule is not available in the AMQP transport.
+func (tr *Transport) UpdateModule(ctx context.Context, m *iotservice.Module) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// DeleteModule is not available in the AMQP transport.
+func (tr *Transport) DeleteModule(ctx context.Context, m *iotservice.Module) error {
+	return ErrNotImplemented
+}
+
+func (tr *Transport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-tr.done:
+		return nil
+	default:
+		close(tr.done)
+	}
+	if tr.conn != nil {
+		tr.disconnect()
+	}
+	return nil
+}
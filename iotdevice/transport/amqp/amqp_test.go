@@ -0,0 +1,156 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+func TestToAMQPMessage(t *testing.T) {
+	m := toAMQPMessage(&common.Message{
+		Payload:       []byte("hello"),
+		MessageID:     "mid",
+		CorrelationID: "cid",
+		InterfaceID:   "ifid",
+		Properties:    map[string]string{"foo": "bar"},
+	})
+	if string(m.GetData()) != "hello" {
+		t.Errorf("payload = %q, want %q", m.GetData(), "hello")
+	}
+	if m.Properties.MessageID != "mid" {
+		t.Errorf("message id = %v, want %q", m.Properties.MessageID, "mid")
+	}
+	if m.Properties.CorrelationID != "cid" {
+		t.Errorf("correlation id = %v, want %q", m.Properties.CorrelationID, "cid")
+	}
+	if m.Annotations["iothub-interface-id"] != "ifid" {
+		t.Errorf("annotations = %v, want iothub-interface-id=ifid", m.Annotations)
+	}
+	if m.ApplicationProperties["foo"] != "bar" {
+		t.Errorf("properties = %v, want foo=bar", m.ApplicationProperties)
+	}
+}
+
+func TestParseDisposition(t *testing.T) {
+	for _, d := range []Disposition{Complete, Abandon, Reject, Unsettled} {
+		got, err := ParseDisposition(d.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != d {
+			t.Errorf("ParseDisposition(%q) = %v, want %v", d.String(), got, d)
+		}
+	}
+	if _, err := ParseDisposition("deadletter"); err == nil {
+		t.Error("ParseDisposition(deadletter) = nil error")
+	}
+}
+
+type fakeAMQPConn struct {
+	fakeConn
+}
+
+func (c *fakeAMQPConn) NewSession(context.Context, *amqp.SessionOptions) (*amqp.Session, error) {
+	return nil, errors.New("not implemented")
+}
+
+// newRenewTransport returns a transport with fast token renewals
+// connected with a fake connection, renewal errors are sent to
+// the returned channel.
+func newRenewTransport() (*Transport, *fakeAMQPConn, <-chan error) {
+	errc := make(chan error, 1)
+	tr := New(WithTokenRenewalHandler(func(err error) {
+		errc <- err
+	}))
+	tr.SetLogger(logger.New(logger.LevelError, nil))
+	tr.renew = renewPolicy{
+		interval:   time.Millisecond,
+		attempts:   3,
+		backoff:    time.Millisecond,
+		maxBackoff: 2 * time.Millisecond,
+	}
+	conn := &fakeAMQPConn{}
+	tr.conn, tr.stop = conn, make(chan struct{})
+	return tr, conn, errc
+}
+
+func TestRenewTokensDisconnects(t *testing.T) {
+	tr, conn, errc := newRenewTransport()
+	errPut := errors.New("put-token failed")
+	var attempts int
+	tr.renewTokens(tr.stop, func() error {
+		attempts++
+		return errPut
+	})
+	if attempts != 3 {
+		t.Errorf("%d put-token attempts, want 3", attempts)
+	}
+	select {
+	case err := <-errc:
+		if err != errPut {
+			t.Errorf("renewal handler error = %v, want %v", err, errPut)
+		}
+	default:
+		t.Error("renewal handler isn't called")
+	}
+	if tr.ConnectionState() != transport.Disconnected {
+		t.Error("transport isn't disconnected")
+	}
+	if !conn.isClosed() {
+		t.Error("connection isn't closed")
+	}
+}
+
+func TestRenewTokensRetries(t *testing.T) {
+	tr, conn, errc := newRenewTransport()
+
+	// the first renewal succeeds on the last attempt,
+	// the second one stops renewals by disconnecting
+	var attempts int
+	tr.renewTokens(tr.stop, func() error {
+		attempts++
+		switch attempts {
+		case 3:
+			return nil
+		case 4:
+			if err := tr.Disconnect(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return errors.New("put-token failed")
+	})
+	if attempts != 4 {
+		t.Errorf("%d put-token attempts, want 4", attempts)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("renewal handler is called with %v after disconnecting", err)
+	default:
+	}
+	if !conn.isClosed() {
+		t.Error("connection isn't closed")
+	}
+}
+
+func TestRenewTokensReplacedConn(t *testing.T) {
+	tr, conn, errc := newRenewTransport()
+
+	// renewal of a replaced connection is failing but not stopped yet
+	tr.renewTokens(make(chan struct{}), func() error {
+		return errors.New("put-token failed")
+	})
+	select {
+	case err := <-errc:
+		t.Errorf("renewal handler is called with %v for a replaced connection", err)
+	default:
+	}
+	if tr.ConnectionState() != transport.Connected || conn.isClosed() {
+		t.Error("current connection is dropped")
+	}
+}
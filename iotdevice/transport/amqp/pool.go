@@ -0,0 +1,174 @@
+package amqp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Pool shares physical AMQP connections between transports,
+// one connection is kept per hub and it's closed when
+// the last transport using it disconnects.
+//
+// Connections are dialed without blocking transports connecting to
+// other hubs, concurrent transports connecting to the same hub wait
+// for a single dial. Connections that are found closed are evicted,
+// so the next transport dials a new one.
+type Pool struct {
+	mu    sync.Mutex
+	hosts map[string]*pooledConn   // connections by hub, including dialing ones
+	conns map[poolConn]*pooledConn // acquired connections, including evicted ones
+
+	// dial connects to the given hub, it's replaced in tests.
+	dial func(ctx context.Context, host string, tlsCfg *tls.Config) (poolConn, error)
+}
+
+// poolConn is a pooled connection, it's always *amqp.Conn but tests.
+type poolConn interface {
+	Close() error
+}
+
+type pooledConn struct {
+	host  string
+	conn  poolConn
+	refs  int
+	ready chan struct{} // closed when dialing is done
+	err   error         // dial error
+}
+
+// errPoolClosed is returned by acquire when the pool is closed while dialing.
+var errPoolClosed = errors.New("connection pool is closed")
+
+// NewPool creates a new connection pool.
+func NewPool() *Pool {
+	return &Pool{
+		hosts: map[string]*pooledConn{},
+		conns: map[poolConn]*pooledConn{},
+		dial:  dialPooled,
+	}
+}
+
+func dialPooled(ctx context.Context, host string, tlsCfg *tls.Config) (poolConn, error) {
+	return amqp.Dial(ctx, "amqps://"+host, &amqp.ConnOptions{
+		TLSConfig:  tlsCfg,
+		SASLType:   amqp.SASLTypeAnonymous(),
+		Properties: map[string]any{"com.microsoft:client-version": userAgent},
+	})
+}
+
+func (p *Pool) acquire(ctx context.Context, host string, tlsCfg *tls.Config) (*amqp.Conn, error) {
+	conn, err := p.get(ctx, host, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*amqp.Conn), nil
+}
+
+// get returns the connection to the given host incrementing its reference
+// counter, the connection is dialed when there's none, mu isn't held while
+// dialing, other callers for the same host wait for the dial to finish.
+func (p *Pool) get(ctx context.Context, host string, tlsCfg *tls.Config) (poolConn, error) {
+	for {
+		p.mu.Lock()
+		pc, ok := p.hosts[host]
+		if !ok {
+			pc = &pooledConn{host: host, ready: make(chan struct{})}
+			p.hosts[host] = pc
+			p.mu.Unlock()
+			return p.dialConn(ctx, pc, tlsCfg)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-pc.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pc.err != nil {
+			if errors.Is(pc.err, context.Canceled) || errors.Is(pc.err, context.DeadlineExceeded) {
+				continue // the dialer's context is done, dial with ours
+			}
+			return nil, pc.err
+		}
+
+		p.mu.Lock()
+		if p.hosts[host] == pc {
+			pc.refs++
+			p.mu.Unlock()
+			return pc.conn, nil
+		}
+		p.mu.Unlock() // evicted in the meantime
+	}
+}
+
+func (p *Pool) dialConn(ctx context.Context, pc *pooledConn, tlsCfg *tls.Config) (poolConn, error) {
+	conn, err := p.dial(ctx, pc.host, tlsCfg)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer close(pc.ready)
+	if err == nil && p.hosts[pc.host] != pc {
+		_ = conn.Close()
+		err = errPoolClosed
+	}
+	if err != nil {
+		pc.err = err
+		if p.hosts[pc.host] == pc {
+			delete(p.hosts, pc.host)
+		}
+		return nil, err
+	}
+	pc.conn = conn
+	pc.refs = 1
+	p.conns[conn] = pc
+	return conn, nil
+}
+
+// release decrements reference counter of the given connection,
+// it's closed when it's not used by any transport anymore.
+func (p *Pool) release(conn poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.conns[conn]
+	if !ok {
+		return // the pool is closed
+	}
+	pc.refs--
+	if pc.refs == 0 {
+		delete(p.conns, conn)
+		if p.hosts[pc.host] == pc {
+			delete(p.hosts, pc.host)
+		}
+		_ = conn.Close()
+	}
+}
+
+// evict removes the given connection from the pool when it's closed by
+// the hub or lost, it's still closed when the last transport releases it.
+func (p *Pool) evict(conn poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.conns[conn]; ok && p.hosts[pc.host] == pc {
+		delete(p.hosts, pc.host)
+	}
+}
+
+// Close closes all pooled connections regardless of whether they're in use.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for conn := range p.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(p.conns, conn)
+	}
+	for host := range p.hosts {
+		delete(p.hosts, host)
+	}
+	return err
+}
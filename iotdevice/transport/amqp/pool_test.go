@@ -0,0 +1,200 @@
+package amqp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	host   string
+	closed int32
+}
+
+func (c *fakeConn) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+func newFakePool(dial func(host string) error) (*Pool, *int32) {
+	var dials int32
+	p := NewPool()
+	p.dial = func(ctx context.Context, host string, _ *tls.Config) (poolConn, error) {
+		atomic.AddInt32(&dials, 1)
+		if dial != nil {
+			if err := dial(host); err != nil {
+				return nil, err
+			}
+		}
+		return &fakeConn{host: host}, nil
+	}
+	return p, &dials
+}
+
+func TestPoolRefCount(t *testing.T) {
+	p, dials := newFakePool(nil)
+	c1, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Fatal("connections to the same host are not shared")
+	}
+	b, err := p.get(context.Background(), "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == c1 {
+		t.Fatal("connections to different hosts are shared")
+	}
+	if n := atomic.LoadInt32(dials); n != 2 {
+		t.Errorf("dialed %d times, want 2", n)
+	}
+
+	p.release(c1)
+	if c1.(*fakeConn).isClosed() {
+		t.Fatal("connection is closed while it's still in use")
+	}
+	p.release(c2)
+	if !c1.(*fakeConn).isClosed() {
+		t.Fatal("connection is not closed when it's not used anymore")
+	}
+
+	// the closed connection is not reused
+	c3, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c1 {
+		t.Fatal("released connection is reused")
+	}
+
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.(*fakeConn).isClosed() || !c3.(*fakeConn).isClosed() {
+		t.Error("Close doesn't close connections in use")
+	}
+}
+
+func TestPoolEvict(t *testing.T) {
+	p, _ := newFakePool(nil)
+	c1, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.evict(c1)
+	c3, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c1 {
+		t.Fatal("evicted connection is reused")
+	}
+
+	// the evicted connection is closed once all its users release it
+	p.release(c1)
+	if c1.(*fakeConn).isClosed() {
+		t.Fatal("evicted connection is closed while it's still in use")
+	}
+	p.release(c2)
+	if !c1.(*fakeConn).isClosed() {
+		t.Fatal("evicted connection is not closed")
+	}
+
+	// releasing the evicted connection doesn't affect the new one
+	c4, err := p.get(context.Background(), "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c4 != c3 {
+		t.Fatal("new connection is not reused")
+	}
+}
+
+func TestPoolDialOutsideLock(t *testing.T) {
+	unblock := make(chan struct{})
+	p, dials := newFakePool(func(host string) error {
+		if host == "slow" {
+			<-unblock
+		}
+		return nil
+	})
+
+	var (
+		wg    sync.WaitGroup
+		conns = make([]poolConn, 3)
+	)
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := p.get(context.Background(), "slow", nil)
+			if err != nil {
+				t.Error(err)
+			}
+			conns[i] = c
+		}(i)
+	}
+
+	// other hosts are not blocked by the slow dial
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.get(context.Background(), "fast", nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dialing a host blocks other hosts")
+	}
+
+	close(unblock)
+	wg.Wait()
+	for _, c := range conns[1:] {
+		if c != conns[0] {
+			t.Fatal("concurrent callers got different connections")
+		}
+	}
+	if n := atomic.LoadInt32(dials); n != 2 {
+		t.Errorf("dialed %d times, want 2", n)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	errDial := errors.New("dial error")
+	p, _ := newFakePool(func(string) error {
+		return errDial
+	})
+	if _, err := p.get(context.Background(), "a", nil); err != errDial {
+		t.Fatalf("get error = %v, want %v", err, errDial)
+	}
+
+	// failed dials aren't cached
+	p.dial = func(ctx context.Context, host string, _ *tls.Config) (poolConn, error) {
+		return &fakeConn{host: host}, nil
+	}
+	if _, err := p.get(context.Background(), "a", nil); err != nil {
+		t.Fatal(err)
+	}
+}
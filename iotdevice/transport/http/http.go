@@ -61,6 +61,7 @@ type Transport struct {
 	logger logger.Logger
 	client *http.Client
 	creds  transport.Credentials
+	tokens *common.TokenCache
 	ttl    time.Duration
 	tls    *tls.Config
 }
@@ -73,28 +74,51 @@ func New(opts ...TransportOption) *Transport {
 	for _, opt := range opts {
 		opt(tr)
 	}
+	return tr
+}
+
+func (tr *Transport) SetLogger(logger logger.Logger) {
+	tr.logger = logger
+}
+
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
 	if tr.tls == nil {
-		tr.tls = &tls.Config{RootCAs: common.RootCAs()}
+		// loaded on connect, so malformed IOTHUB_ROOT_CA_FILE is reported
+		rootCAs, err := common.LoadRootCAs()
+		if err != nil {
+			return err
+		}
+		tr.tls = &tls.Config{RootCAs: rootCAs}
 	}
 	if tr.client == nil {
 		tr.client = &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs: common.RootCAs(),
-				},
+				TLSClientConfig: tr.tls,
 			},
 		}
 	}
-	return tr
+	tr.creds = creds
+	tr.tokens = common.NewTokenCache(creds.Token, tr.ttl)
+	return nil
 }
 
-func (tr *Transport) SetLogger(logger logger.Logger) {
-	tr.logger = logger
+// Disconnect forgets the current credentials.
+func (tr *Transport) Disconnect() error {
+	tr.creds = nil
+	if tr.tokens != nil {
+		tr.tokens.Close()
+		tr.tokens = nil
+	}
+	return nil
 }
 
-func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
-	tr.creds = creds
-	return nil
+// ConnectionState reports Connected when the transport has credentials,
+// HTTP is stateless so no persistent connection is maintained.
+func (tr *Transport) ConnectionState() transport.ConnectionState {
+	if tr.creds == nil {
+		return transport.Disconnected
+	}
+	return transport.Connected
 }
 
 // Send is not available in the HTTP transport.
@@ -102,6 +126,11 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 	return ErrNotImplemented
 }
 
+// SubscribeInputs is not available in the HTTP transport.
+func (tr *Transport) SubscribeInputs(ctx context.Context, mux transport.MessageDispatcher) error {
+	return ErrNotImplemented
+}
+
 // RegisterDirectMethods is not available in the HTTP transport.
 func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
 	return ErrNotImplemented
@@ -336,7 +365,7 @@ func (tr *Transport) GetBlobSharedAccessSignature(ctx context.Context, blobName
 
 func (tr *Transport) getTokenAndSendRequest(method string, target *url.URL, requestPayloadBytes []byte, headers map[string]string) (*http.Response, error) {
 	resourceURI := fmt.Sprintf("%s/%s", tr.creds.GetHostName(), tr.creds.GetDeviceID())
-	sas, err := tr.creds.Token(resourceURI, tr.ttl)
+	sas, err := tr.tokens.Token(resourceURI)
 	if err != nil {
 		return nil, err
 	}
@@ -397,7 +426,7 @@ func (tr *Transport) NotifyUploadComplete(ctx context.Context, correlationID str
 	}
 
 	resourceURI := fmt.Sprintf("%s/%s", tr.creds.GetHostName(), tr.creds.GetDeviceID())
-	sas, err := tr.creds.Token(resourceURI, tr.ttl)
+	sas, err := tr.tokens.Token(resourceURI)
 	if err != nil {
 		return err
 	}
@@ -428,6 +457,8 @@ func (tr *Transport) NotifyUploadComplete(ctx context.Context, correlationID str
 }
 
 func (tr *Transport) Close() error {
-	// NOOP
+	if tr.tokens != nil {
+		tr.tokens.Close()
+	}
 	return nil
 }
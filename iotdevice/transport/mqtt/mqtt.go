@@ -3,6 +3,7 @@ package mqtt
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -50,6 +51,53 @@ func WithClientOptionsConfig(fn func(opts *mqtt.ClientOptions)) TransportOption
 	}
 }
 
+// WithStore sets the store for QoS1 in-flight messages, so unconfirmed
+// publishes are resent after reconnecting, for this to work sessions
+// are made persistent. Messages are kept in memory by default.
+func WithStore(store mqtt.Store) TransportOption {
+	if store == nil {
+		panic("store is nil")
+	}
+	return func(tr *Transport) {
+		tr.store = store
+	}
+}
+
+// WithFileStore is WithStore that keeps in-flight messages in the named
+// directory, so they also survive process restarts on embedded devices.
+func WithFileStore(dir string) TransportOption {
+	return WithStore(mqtt.NewFileStore(dir))
+}
+
+// WithCleanSession controls whether the broker discards the session on
+// connect, clean sessions are used by default unless a store is configured.
+//
+// When a persistent session is resumed cloud-to-device messages queued
+// during downtime are delivered to already registered subscriptions,
+// messages redelivered because of unconfirmed acknowledgements are
+// deduplicated by their message id so they're dispatched only once.
+//
+// Only MQTT 3.1.1 is supported so session expiry is controlled
+// by the hub and cannot be configured.
+func WithCleanSession(clean bool) TransportOption {
+	return func(tr *Transport) {
+		tr.cleanSession = &clean
+	}
+}
+
+// WithEdgeRefreshInterval sets how often modules connected through
+// the edge gateway refresh the edge trust bundle and check whether
+// the token has to be renewed, zero disables refreshing.
+// Defaults to DefaultEdgeRefreshInterval.
+func WithEdgeRefreshInterval(d time.Duration) TransportOption {
+	if d < 0 {
+		panic("interval is negative")
+	}
+	return func(tr *Transport) {
+		tr.edgeRefresh = d
+	}
+}
+
 // WithWebSocket makes the mqtt client use MQTT over WebSockets on port 443,
 // which is great if e.g. port 8883 is blocked.
 func WithWebSocket(enable bool) TransportOption {
@@ -58,6 +106,39 @@ func WithWebSocket(enable bool) TransportOption {
 	}
 }
 
+// WithRootCAs overrides root CA certificates used for verifying
+// the hub's certificate, default is common.RootCAs.
+func WithRootCAs(pool *x509.CertPool) TransportOption {
+	return func(tr *Transport) {
+		tr.rootCAs = pool
+	}
+}
+
+// WithAutoResubscribe controls whether subscriptions are restored every
+// time the connection is established, it's enabled by default.
+//
+// When it's disabled applications restore subscriptions with
+// Resubscribe, e.g. from the WithOnReconnect hook, or not at all
+// when a persistent session is resumed.
+func WithAutoResubscribe(enable bool) TransportOption {
+	return func(tr *Transport) {
+		tr.noResubscribe = !enable
+	}
+}
+
+// WithOnReconnect sets a function that's called every time paho
+// automatically re-establishes a lost connection, after subscriptions are
+// restored unless WithAutoResubscribe is disabled, so applications can
+// recover their state, e.g. re-fetch the twin to catch up with desired
+// properties updated during the downtime.
+//
+// It's not called when the connection is established by Connect.
+func WithOnReconnect(fn func()) TransportOption {
+	return func(tr *Transport) {
+		tr.onReconnect = fn
+	}
+}
+
 // WithModelId makes the mqtt client register the specified DTDL modelID when a connection
 // is established, this is useful for Azure PNP integration.
 func WithModelID(modelID string) TransportOption {
@@ -94,8 +175,19 @@ type Transport struct {
 
 	logger logger.Logger
 	cocfg  func(opts *mqtt.ClientOptions)
+	store  mqtt.Store
+
+	tokens       *common.TokenCache // sas tokens of the current connection
+	cleanSession *bool              // nil means using the default behaviour
+	edgeRefresh  time.Duration      // edge trust bundle and token refresh interval
+	seen         *seenIDs           // recently dispatched c2d message ids, persistent sessions only
 
 	webSocket bool
+	rootCAs   *x509.CertPool
+
+	noResubscribe bool     // subscriptions are restored by the application
+	onReconnect   func()   // called when paho re-establishes the connection
+	reconnectFns  []func() // NotifyReconnect functions, protected by subm
 }
 
 type resp struct {
@@ -117,9 +209,15 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 	}
 
 	tlsCfg := &tls.Config{
-		RootCAs:       common.RootCAs(),
+		RootCAs:       tr.rootCAs,
 		Renegotiation: tls.RenegotiateOnceAsClient,
 	}
+	if tlsCfg.RootCAs == nil {
+		var err error
+		if tlsCfg.RootCAs, err = common.LoadRootCAs(); err != nil {
+			return err
+		}
+	}
 	if crt := creds.GetCertificate(); crt != nil {
 		tlsCfg.Certificates = append(tlsCfg.Certificates, *crt)
 	}
@@ -129,12 +227,13 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 		username += "&model-id=" + url.QueryEscape(tr.mid)
 	}
 
+	tokens := common.NewTokenCache(creds.Token, time.Hour)
 	o := mqtt.NewClientOptions()
 	o.SetTLSConfig(tlsCfg)
 	if tr.webSocket {
-		o.AddBroker("wss://" + creds.GetHostName() + ":443/$iothub/websocket") // https://github.com/MicrosoftDocs/azure-docs/issues/21306
+		o.AddBroker("wss://" + transport.BrokerHost(creds) + ":443/$iothub/websocket") // https://github.com/MicrosoftDocs/azure-docs/issues/21306
 	} else {
-		o.AddBroker("tls://" + creds.GetHostName() + ":8883")
+		o.AddBroker("tls://" + transport.BrokerHost(creds) + ":8883")
 	}
 	o.SetProtocolVersion(4) // 4 = MQTT 3.1.1
 	o.SetClientID(creds.GetDeviceID())
@@ -142,9 +241,9 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 		if crt := creds.GetCertificate(); crt != nil {
 			return username, ""
 		}
-		// TODO: renew token only when it expires in case an external token provider is used
-		// TODO: this can slow down the reconnect feature, so need to figure out max token lifetime
-		sas, err := creds.Token(creds.GetHostName(), time.Hour)
+		// tokens are cached and renewed in the background,
+		// so reconnects don't need to wait for external token providers
+		sas, err := tokens.Token(creds.GetHostName())
 		if err != nil {
 			tr.logger.Errorf("cannot generate token: %s", err)
 			return "", ""
@@ -153,34 +252,153 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 	})
 	o.SetWriteTimeout(30 * time.Second)
 	o.SetMaxReconnectInterval(30 * time.Second) // default is 15min, way to long
-	o.SetOnConnectHandler(func(c mqtt.Client) {
-		tr.logger.Debugf("connection established")
-		tr.subm.RLock()
-		for _, sub := range tr.subs {
-			if err := sub(); err != nil {
-				tr.logger.Debugf("on-connect error: %s", err)
-			}
-		}
-		tr.subm.RUnlock()
-	})
+	o.SetOnConnectHandler(tr.onConnect(tr.resubscribe))
 	o.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		tr.logger.Debugf("connection lost: %v", err)
 	})
 
+	if tr.store != nil {
+		// paho discards stored messages when connecting with a clean session
+		o.SetStore(tr.store)
+		o.SetCleanSession(false)
+	}
+	if tr.cleanSession != nil {
+		o.SetCleanSession(*tr.cleanSession)
+	}
+	if !o.CleanSession && tr.seen == nil {
+		tr.seen = newSeenIDs(seenIDsSize)
+	}
 	if tr.cocfg != nil {
 		tr.cocfg(o)
 	}
 
-	c := mqtt.NewClient(o)
-	if err := contextToken(ctx, c.Connect()); err != nil {
+	// on-connect handler may resubscribe before Connect returns
+	// when reconnecting, so the client has to be available
+	tr.did = creds.GetDeviceID()
+	tr.conn = mqtt.NewClient(o)
+	if err := contextToken(ctx, tr.conn.Connect()); err != nil {
+		tr.conn = nil
+		tokens.Close()
 		return err
 	}
+	tr.tokens = tokens
+	return nil
+}
 
-	tr.did = creds.GetDeviceID()
-	tr.conn = c
+// Disconnect disconnects from the broker, on-connect subscriptions are
+// preserved and restored on the next Connect call, unless automatic
+// resubscription is disabled, then it's up to Resubscribe.
+func (tr *Transport) Disconnect() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	tr.conn.Disconnect(250)
+	tr.conn = nil
+	tr.closeTokens()
+	tr.logger.Debugf("disconnected")
+	return nil
+}
+
+// closeTokens stops renewing tokens of the current connection,
+// must be called with mu held.
+func (tr *Transport) closeTokens() {
+	if tr.tokens != nil {
+		tr.tokens.Close()
+		tr.tokens = nil
+	}
+}
+
+func (tr *Transport) ConnectionState() transport.ConnectionState {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	switch {
+	case tr.conn == nil:
+		return transport.Disconnected
+	case tr.conn.IsConnectionOpen():
+		return transport.Connected
+	case tr.conn.IsConnected():
+		// paho reports connected while it's automatically reconnecting
+		return transport.Reconnecting
+	default:
+		return transport.Disconnected
+	}
+}
+
+// onConnect returns the on-connect handler of a new connection,
+// it restores subscriptions with resubscribe if it's enabled and
+// invokes the reconnect hook on all connects but the first one.
+func (tr *Transport) onConnect(resubscribe func() error) mqtt.OnConnectHandler {
+	var connected int32
+	return func(_ mqtt.Client) {
+		tr.logger.Debugf("connection established")
+		if !tr.noResubscribe {
+			if err := resubscribe(); err != nil {
+				tr.logger.Debugf("on-connect error: %s", err)
+			}
+		}
+		if atomic.CompareAndSwapInt32(&connected, 0, 1) {
+			return
+		}
+		tr.subm.RLock()
+		fns := tr.reconnectFns
+		tr.subm.RUnlock()
+		for _, fn := range fns {
+			fn()
+		}
+		if tr.onReconnect != nil {
+			tr.onReconnect()
+		}
+	}
+}
+
+// NotifyReconnect implements transport.ReconnectNotifier,
+// fn is called before the WithOnReconnect hook.
+func (tr *Transport) NotifyReconnect(fn func()) {
+	tr.subm.Lock()
+	tr.reconnectFns = append(tr.reconnectFns, fn)
+	tr.subm.Unlock()
+}
+
+// Resubscribe restores all subscriptions made by the transport,
+// that's needed only when WithAutoResubscribe is disabled.
+func (tr *Transport) Resubscribe() error {
+	if err := tr.checkConnected(); err != nil {
+		return err
+	}
+	return tr.resubscribe()
+}
+
+// checkConnected returns an error when the transport is not connected.
+func (tr *Transport) checkConnected() error {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
 	return nil
 }
 
+// resubscribe doesn't acquire mu, because the on-connect
+// handler may be called while Connect holds it.
+func (tr *Transport) resubscribe() error {
+	tr.subm.RLock()
+	defer tr.subm.RUnlock()
+	return runSubs(tr.subs)
+}
+
+// runSubs runs all subscriptions and returns the first error.
+func runSubs(subs []subFunc) error {
+	var err error
+	for _, sub := range subs {
+		if serr := sub(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
 type subFunc func() error
 
 // sub invokes the given sub function and if it passes with no error,
@@ -210,12 +428,65 @@ func (tr *Transport) subEvents(ctx context.Context, mux transport.MessageDispatc
 					tr.logger.Errorf("message parse error: %s", err)
 					return
 				}
+				if tr.isDuplicate(msg) {
+					tr.logger.Debugf("skipping duplicate message %q", msg.MessageID)
+					return
+				}
 				mux.Dispatch(msg)
 			},
 		))
 	}
 }
 
+// SubscribeInputs is available only to modules, see ModuleTransport.
+func (tr *Transport) SubscribeInputs(ctx context.Context, mux transport.MessageDispatcher) error {
+	return ErrNotImplemented
+}
+
+// isDuplicate reports whether the message has already been dispatched,
+// which may happen when a persistent session is resumed.
+func (tr *Transport) isDuplicate(msg *common.Message) bool {
+	if tr.seen == nil || msg.MessageID == "" {
+		return false
+	}
+	return !tr.seen.add(msg.MessageID)
+}
+
+// seenIDsSize is the number of remembered message ids.
+const seenIDsSize = 256
+
+// seenIDs is a fixed-size set of recently seen ids.
+type seenIDs struct {
+	mu   sync.Mutex
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newSeenIDs(size int) *seenIDs {
+	return &seenIDs{
+		ids:  make(map[string]struct{}, size),
+		ring: make([]string, size),
+	}
+}
+
+// add adds the id to the set evicting the oldest one
+// when it's full, returns false if it's already there.
+func (s *seenIDs) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if old := s.ring[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.ring[s.next] = id
+	s.ids[id] = struct{}{}
+	s.next = (s.next + 1) % len(s.ring)
+	return true
+}
+
 func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
 	return tr.sub(tr.subTwinUpdates(ctx, mux))
 }
@@ -235,8 +506,14 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newMessage(m.Payload(), p)
+}
+
+// newMessage creates a message from the payload and
+// topic properties, extracting system properties.
+func newMessage(payload []byte, p map[string]string) (*common.Message, error) {
 	e := &common.Message{
-		Payload:    m.Payload(),
+		Payload:    payload,
 		Properties: make(map[string]string, len(p)),
 	}
 	for k, v := range p {
@@ -249,6 +526,18 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 			e.UserID = v
 		case "$.to":
 			e.To = v
+		case "$.cdid":
+			e.ConnectionDeviceID = v
+		case "$.cmid":
+			e.ConnectionModuleID = v
+		case "$.ct":
+			e.ContentType = v
+		case "$.ce":
+			e.ContentEncoding = v
+		case "$.ifid":
+			e.InterfaceID = v
+		case "$.sub":
+			e.ComponentName = v
 		case "$.exp":
 			t, err := time.Parse(time.RFC3339, v)
 			if err != nil {
@@ -312,8 +601,10 @@ func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodD
 					tr.logger.Errorf("dispatch error: %s", err)
 					return
 				}
+				// the registration context may be long gone by the time
+				// a method is invoked, so it cannot be used for responding
 				dst := fmt.Sprintf("$iothub/methods/res/%d/?$rid=%s", rc, rid)
-				if err = tr.send(ctx, dst, DefaultQoS, b); err != nil {
+				if err = tr.send(context.Background(), dst, DefaultQoS, b); err != nil {
 					tr.logger.Errorf("method response error: %s", err)
 					return
 				}
@@ -416,7 +707,7 @@ func (tr *Transport) subTwinResponses(ctx context.Context) subFunc {
 			"$iothub/twin/res/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
 				rc, rid, ver, err := parseTwinPropsTopic(m.Topic())
 				if err != nil {
-					fmt.Printf("parse twin props topic error: %s", err)
+					tr.logger.Errorf("parse twin props topic error: %s", err)
 					return
 				}
 
@@ -513,6 +804,18 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 	if msg.EnqueuedTime != nil && !msg.EnqueuedTime.IsZero() {
 		u.Add("$.ctime", msg.EnqueuedTime.UTC().Format(rfc3339Milli))
 	}
+	if msg.InterfaceID != "" {
+		u.Add("$.ifid", msg.InterfaceID)
+	}
+	if msg.ComponentName != "" {
+		u.Add("$.sub", msg.ComponentName)
+	}
+	if msg.ContentType != "" {
+		u.Add("$.ct", msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		u.Add("$.ce", msg.ContentEncoding)
+	}
 	for k, v := range msg.Properties {
 		u.Add(k, v)
 	}
@@ -572,6 +875,7 @@ func (tr *Transport) Close() error {
 		tr.conn.Disconnect(250)
 		tr.logger.Debugf("disconnected")
 	}
+	tr.closeTokens()
 	return nil
 }
 
@@ -3,9 +3,12 @@ package mqtt
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/amenzhinsky/iothub/common"
@@ -18,7 +21,8 @@ import (
 func NewModuleTransport(opts ...TransportOption) *ModuleTransport {
 	tr := &ModuleTransport{
 		Transport: Transport{
-			done: make(chan struct{}),
+			done:        make(chan struct{}),
+			edgeRefresh: DefaultEdgeRefreshInterval,
 		},
 	}
 	for _, opt := range opts {
@@ -27,11 +31,25 @@ func NewModuleTransport(opts ...TransportOption) *ModuleTransport {
 	return tr
 }
 
+// DefaultEdgeRefreshInterval is the default edge trust bundle and token refresh interval.
+const DefaultEdgeRefreshInterval = 15 * time.Minute
+
+// edgeTokenLifetime is lifetime of tokens issued by the edge workload API.
+const edgeTokenLifetime = time.Hour
+
+// ModuleTransport is an MQTT transport bound to a module identity,
+// twin operations and direct methods are inherited from Transport
+// because their topics are the same as the device ones.
 type ModuleTransport struct {
 	Transport
 	mid         string // module id
 	gid         string // generation id
 	edgeGateway bool   // connect via edge gateway
+
+	trustBundle atomic.Value // *x509.CertPool, rotated by the edge refresher
+	tokenExpiry int64        // unix time the current edge token expires at
+
+	brokerSubs map[string]subFunc // edge broker subscriptions by topic filter, protected by subm
 }
 
 func (tr *ModuleTransport) Connect(ctx context.Context, creds transport.Credentials) error {
@@ -44,14 +62,23 @@ func (tr *ModuleTransport) Connect(ctx context.Context, creds transport.Credenti
 	tlsCfg := &tls.Config{}
 
 	if creds.UseEdgeGateway() {
-		if tb, err := common.TrustBundle(creds.GetWorkloadURI()); err != nil {
-			tlsCfg.InsecureSkipVerify = true // x509: certificate signed by unknown authority if missing
-			tr.logger.Warnf("error getting trust bundle: %s", err)
-		} else {
-			tlsCfg.RootCAs = tb
+		tb, err := common.TrustBundle(creds.GetWorkloadURI())
+		if err != nil {
+			return fmt.Errorf("edge trust bundle: %w", err)
 		}
+		tr.trustBundle.Store(tb)
+		// the trust bundle is rotated in the background so the default
+		// verification against a fixed pool is replaced with
+		// verifyEdgeConnection that uses the current one
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyConnection = tr.verifyEdgeConnection
+	} else if tr.rootCAs != nil {
+		tlsCfg.RootCAs = tr.rootCAs
 	} else {
-		tlsCfg.RootCAs = common.RootCAs()
+		var err error
+		if tlsCfg.RootCAs, err = common.LoadRootCAs(); err != nil {
+			return err
+		}
 	}
 
 	if crt := creds.GetCertificate(); crt != nil {
@@ -59,6 +86,14 @@ func (tr *ModuleTransport) Connect(ctx context.Context, creds transport.Credenti
 	}
 
 	username := creds.GetHostName() + "/" + creds.GetDeviceID() + "/" + creds.GetModuleID() + "/?api-version=2018-06-30"
+	gen, lifetime := common.TokenFunc(creds.Token), time.Hour
+	if creds.UseEdgeGateway() {
+		gen = func(resource string, lifetime time.Duration) (*common.SharedAccessSignature, error) {
+			return creds.TokenFromEdge(creds.GetWorkloadURI(), creds.GetModuleID(), creds.GetGenerationID(), resource, lifetime)
+		}
+		lifetime = edgeTokenLifetime
+	}
+	tokens := common.NewTokenCache(gen, lifetime)
 	o := mqtt.NewClientOptions()
 	o.SetTLSConfig(tlsCfg)
 	if tr.webSocket {
@@ -74,15 +109,16 @@ func (tr *ModuleTransport) Connect(ctx context.Context, creds transport.Credenti
 		}
 		audience := creds.GetHostName() + "/devices/" + url.QueryEscape(creds.GetDeviceID()) + "/modules/" + url.QueryEscape(creds.GetModuleID())
 		if creds.UseEdgeGateway() {
-			sas, err := creds.TokenFromEdge(creds.GetWorkloadURI(), creds.GetModuleID(), creds.GetGenerationID(), audience, time.Hour)
+			sas, err := tokens.Token(audience)
 			if err != nil {
 				tr.logger.Errorf("cannot generate token: %s", err)
 				return "", ""
 			}
+			atomic.StoreInt64(&tr.tokenExpiry, sas.Se.Unix())
 			return username, sas.String()
 		}
 
-		sas, err := creds.Token(url.QueryEscape(audience), time.Hour)
+		sas, err := tokens.Token(url.QueryEscape(audience))
 		if err != nil {
 			tr.logger.Errorf("cannot generate token: %s", err)
 			return "", ""
@@ -91,37 +127,185 @@ func (tr *ModuleTransport) Connect(ctx context.Context, creds transport.Credenti
 	})
 	o.SetWriteTimeout(30 * time.Second)
 	o.SetMaxReconnectInterval(30 * time.Second) // default is 15min, way to long
-	o.SetOnConnectHandler(func(c mqtt.Client) {
-		tr.logger.Debugf("connection established")
-		tr.subm.RLock()
-		for _, sub := range tr.subs {
-			if err := sub(); err != nil {
-				tr.logger.Debugf("on-connect error: %s", err)
-			}
-		}
-		tr.subm.RUnlock()
-	})
+	o.SetOnConnectHandler(tr.onConnect(tr.resubscribe))
 	o.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		tr.logger.Debugf("connection lost: %v", err)
 	})
 
+	if tr.store != nil {
+		// paho discards stored messages when connecting with a clean session
+		o.SetStore(tr.store)
+		o.SetCleanSession(false)
+	}
+	if tr.cleanSession != nil {
+		o.SetCleanSession(*tr.cleanSession)
+	}
+	if !o.CleanSession && tr.seen == nil {
+		tr.seen = newSeenIDs(seenIDsSize)
+	}
 	if tr.cocfg != nil {
 		tr.cocfg(o)
 	}
 
-	c := mqtt.NewClient(o)
-	if err := contextToken(ctx, c.Connect()); err != nil {
-		return err
-	}
-
+	// on-connect handler may resubscribe before Connect returns
+	// when reconnecting, so the client has to be available
 	tr.did = creds.GetDeviceID()
 	tr.mid = creds.GetModuleID()
 	tr.gid = creds.GetGenerationID()
 	tr.edgeGateway = creds.UseEdgeGateway()
-	tr.conn = c
+	tr.conn = mqtt.NewClient(o)
+	if err := contextToken(ctx, tr.conn.Connect()); err != nil {
+		tr.conn = nil
+		tokens.Close()
+		return err
+	}
+	tr.tokens = tokens
+	if creds.UseEdgeGateway() && tr.edgeRefresh != 0 {
+		go tr.refreshEdge(tr.conn, creds.GetWorkloadURI())
+	}
 	return nil
 }
 
+// Resubscribe restores all subscriptions including edge broker ones,
+// that's needed only when WithAutoResubscribe is disabled.
+func (tr *ModuleTransport) Resubscribe() error {
+	if err := tr.checkConnected(); err != nil {
+		return err
+	}
+	return tr.resubscribe()
+}
+
+func (tr *ModuleTransport) resubscribe() error {
+	tr.subm.RLock()
+	defer tr.subm.RUnlock()
+	subs := make([]subFunc, 0, len(tr.subs)+len(tr.brokerSubs))
+	subs = append(subs, tr.subs...)
+	for _, sub := range tr.brokerSubs {
+		subs = append(subs, sub)
+	}
+	return runSubs(subs)
+}
+
+// verifyEdgeConnection verifies the edge gateway certificate
+// against the current trust bundle, connections fail without it.
+func (tr *ModuleTransport) verifyEdgeConnection(cs tls.ConnectionState) error {
+	tb, _ := tr.trustBundle.Load().(*x509.CertPool)
+	if tb == nil {
+		return errors.New("edge trust bundle is not loaded")
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificates")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         tb,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, crt := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(crt)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// refreshEdge periodically refreshes the edge trust bundle and reconnects
+// to renew the token when it's about to expire before the next check.
+// It stops when the transport is closed or the given client is replaced.
+func (tr *ModuleTransport) refreshEdge(conn mqtt.Client, workloadURI string) {
+	ticker := time.NewTicker(tr.edgeRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tr.done:
+			return
+		}
+		if !tr.isCurrent(conn) {
+			return
+		}
+
+		if tb, err := common.TrustBundle(workloadURI); err != nil {
+			tr.logger.Warnf("error refreshing trust bundle: %s", err)
+		} else {
+			tr.trustBundle.Store(tb)
+			tr.logger.Debugf("trust bundle refreshed")
+		}
+
+		exp := time.Unix(atomic.LoadInt64(&tr.tokenExpiry), 0)
+		if time.Until(exp) > tr.edgeRefresh {
+			continue
+		}
+		if !tr.reconnectEdge(conn, exp) {
+			return
+		}
+	}
+}
+
+func (tr *ModuleTransport) isCurrent(conn mqtt.Client) bool {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return tr.conn == conn
+}
+
+const (
+	// edgeReconnectTimeout bounds a single edge reconnect attempt.
+	edgeReconnectTimeout = 30 * time.Second
+
+	// edgeReconnectBackoff is the initial delay between failed edge
+	// reconnect attempts, it's doubled up to edgeReconnectMaxBackoff.
+	edgeReconnectBackoff    = time.Second
+	edgeReconnectMaxBackoff = 30 * time.Second
+)
+
+// reconnectEdge reconnects the client to renew its token. paho doesn't
+// reconnect automatically after an explicit disconnect, so it retries
+// with a backoff until it succeeds, mu isn't held while dialling.
+// It returns false when the client has been replaced or the transport
+// closed in the meantime.
+func (tr *ModuleTransport) reconnectEdge(conn mqtt.Client, exp time.Time) bool {
+	if !tr.isCurrent(conn) {
+		return false
+	}
+	// the credentials provider issues a new token on connect
+	tr.logger.Debugf("token expires at %s, reconnecting", exp)
+	conn.Disconnect(250)
+
+	backoff := edgeReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), edgeReconnectTimeout)
+		err := contextToken(ctx, conn.Connect())
+		cancel()
+		if !tr.isCurrent(conn) {
+			// disconnected or closed while dialling
+			conn.Disconnect(250)
+			return false
+		}
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			// paho is still dialling, otherwise the next
+			// Connect call would succeed without connecting
+			conn.Disconnect(0)
+		}
+		tr.logger.Errorf("reconnect attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-tr.done:
+			t.Stop()
+			return false
+		}
+		if backoff *= 2; backoff > edgeReconnectMaxBackoff {
+			backoff = edgeReconnectMaxBackoff
+		}
+		if !tr.isCurrent(conn) {
+			return false
+		}
+	}
+}
+
 func (tr *ModuleTransport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
 	return tr.sub(tr.subEvents(ctx, mux))
 }
@@ -135,12 +319,84 @@ func (tr *ModuleTransport) subEvents(ctx context.Context, mux transport.MessageD
 					tr.logger.Errorf("message parse error: %s", err)
 					return
 				}
+				if tr.isDuplicate(msg) {
+					tr.logger.Debugf("skipping duplicate message %q", msg.MessageID)
+					return
+				}
 				mux.Dispatch(msg)
 			},
 		))
 	}
 }
 
+// SubscribeInputs subscribes to messages routed to the module's inputs.
+func (tr *ModuleTransport) SubscribeInputs(ctx context.Context, mux transport.MessageDispatcher) error {
+	return tr.sub(tr.subInputs(ctx, mux))
+}
+
+func (tr *ModuleTransport) subInputs(ctx context.Context, mux transport.MessageDispatcher) subFunc {
+	return func() error {
+		return contextToken(ctx, tr.conn.Subscribe(
+			"devices/"+tr.did+"/modules/"+tr.mid+"/inputs/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+				msg, err := parseInputMessage(m)
+				if err != nil {
+					tr.logger.Errorf("input message parse error: %s", err)
+					return
+				}
+				if tr.isDuplicate(msg) {
+					tr.logger.Debugf("skipping duplicate message %q", msg.MessageID)
+					return
+				}
+				mux.Dispatch(msg)
+			},
+		))
+	}
+}
+
+func parseInputMessage(m mqtt.Message) (*common.Message, error) {
+	input, p, err := parseInputTopic(m.Topic())
+	if err != nil {
+		return nil, err
+	}
+	e, err := newMessage(m.Payload(), p)
+	if err != nil {
+		return nil, err
+	}
+	e.InputName = input
+	return e, nil
+}
+
+// devices/{device}/modules/{module}/inputs/{input}/%24.mid=1&a=b
+func parseInputTopic(s string) (string, map[string]string, error) {
+	const sep = "/inputs/"
+	i := strings.Index(s, sep)
+	if i == -1 {
+		return "", nil, errors.New("malformed input topic name")
+	}
+	s = s[i+len(sep):]
+	input, props := s, ""
+	if i = strings.IndexByte(s, '/'); i != -1 {
+		input, props = s[:i], s[i+1:]
+	}
+	if input == "" {
+		return "", nil, errors.New("malformed input topic name")
+	}
+
+	// any non-URL-encoded semicolon are considered invalid
+	q, err := url.ParseQuery(strings.ReplaceAll(props, ";", "%3B"))
+	if err != nil {
+		return "", nil, err
+	}
+	p := make(map[string]string, len(q))
+	for k, v := range q {
+		if len(v) != 1 {
+			return "", nil, fmt.Errorf("unexpected number of property values: %d", len(q))
+		}
+		p[k] = v[0]
+	}
+	return input, p, nil
+}
+
 // SubscribeTwinUpdates subscribes to module desired state changes.
 func (tr *ModuleTransport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
 	return tr.sub(tr.subTwinUpdates(ctx, mux))
@@ -173,6 +429,21 @@ func (tr *ModuleTransport) Send(ctx context.Context, msg *common.Message) error
 	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
 		u["$.exp"] = []string{msg.ExpiryTime.UTC().Format(time.RFC3339)}
 	}
+	if msg.InterfaceID != "" {
+		u["$.ifid"] = []string{msg.InterfaceID}
+	}
+	if msg.ComponentName != "" {
+		u["$.sub"] = []string{msg.ComponentName}
+	}
+	if msg.OutputName != "" {
+		u["$.on"] = []string{msg.OutputName}
+	}
+	if msg.ContentType != "" {
+		u["$.ct"] = []string{msg.ContentType}
+	}
+	if msg.ContentEncoding != "" {
+		u["$.ce"] = []string{msg.ContentEncoding}
+	}
 	for k, v := range msg.Properties {
 		u[k] = []string{v}
 	}
@@ -188,3 +459,80 @@ func (tr *ModuleTransport) Send(ctx context.Context, msg *common.Message) error
 	}
 	return tr.send(ctx, dst, qos, msg.Payload)
 }
+
+// checkBrokerTopic rejects topics of the reserved namespaces,
+// such as $iothub and $edgehub, that the broker handles itself.
+func checkBrokerTopic(topic string) error {
+	if topic == "" {
+		return errors.New("topic cannot be blank")
+	}
+	if strings.HasPrefix(topic, "$") {
+		return fmt.Errorf("topic %q belongs to a reserved namespace", topic)
+	}
+	return nil
+}
+
+// Publish publishes the payload to a user-defined topic of the IoT Edge 1.2+
+// MQTT broker so modules can do pub/sub with each other locally.
+//
+// Access is controlled by edgeHub authorization policies that reference
+// the module identity as {hub}/{device}/{module} with mqtt:publish operations.
+func (tr *ModuleTransport) Publish(ctx context.Context, topic string, qos int, payload []byte) error {
+	if err := checkBrokerTopic(topic); err != nil {
+		return err
+	}
+	if qos != 0 && qos != 1 {
+		return fmt.Errorf("invalid QoS value: %d", qos)
+	}
+	return tr.send(ctx, topic, qos, payload)
+}
+
+// Subscribe subscribes to a user-defined topic filter of the IoT Edge MQTT broker,
+// the subscription is restored on reconnects until Unsubscribe is called.
+// Authorization policies must allow mqtt:subscribe for the module identity.
+func (tr *ModuleTransport) Subscribe(ctx context.Context, filter string, qos int, fn func(topic string, payload []byte)) error {
+	if err := checkBrokerTopic(filter); err != nil {
+		return err
+	}
+	if qos != 0 && qos != 1 {
+		return fmt.Errorf("invalid QoS value: %d", qos)
+	}
+	sub := func(ctx context.Context) error {
+		return contextToken(ctx, tr.conn.Subscribe(filter, byte(qos), func(_ mqtt.Client, m mqtt.Message) {
+			fn(m.Topic(), m.Payload())
+		}))
+	}
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	if err := sub(ctx); err != nil {
+		return err
+	}
+	tr.subm.Lock()
+	if tr.brokerSubs == nil {
+		tr.brokerSubs = map[string]subFunc{}
+	}
+	// the subscription context cannot be reused when resubscribing
+	tr.brokerSubs[filter] = func() error {
+		return sub(context.Background())
+	}
+	tr.subm.Unlock()
+	return nil
+}
+
+// Unsubscribe removes the broker subscription to the given topic filter.
+func (tr *ModuleTransport) Unsubscribe(ctx context.Context, filter string) error {
+	tr.subm.Lock()
+	delete(tr.brokerSubs, filter)
+	tr.subm.Unlock()
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	return contextToken(ctx, tr.conn.Unsubscribe(filter))
+}
@@ -1,9 +1,13 @@
 package mqtt
 
 import (
+	"crypto/tls"
 	"net/url"
 	"reflect"
 	"testing"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/logger"
 )
 
 func TestParseCloudToDeviceTopic(t *testing.T) {
@@ -23,6 +27,49 @@ func TestParseCloudToDeviceTopic(t *testing.T) {
 	}
 }
 
+func TestParseInputTopic(t *testing.T) {
+	s := "devices/mydev/modules/mymod/inputs/input1/%24.mid=1&a=b"
+	input, g, err := parseInputTopic(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input != "input1" {
+		t.Errorf("parseInputTopic(%q) = %q, _, _, want %q", s, input, "input1")
+	}
+
+	w := map[string]string{
+		"$.mid": "1",
+		"a":     "b",
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("parseInputTopic(%q) = _, %v, _, want %v", s, g, w)
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	m, err := newMessage([]byte("hello"), map[string]string{
+		"$.ct":   "application/json",
+		"$.ce":   "utf-8",
+		"$.ifid": "urn:iface:1",
+		"$.sub":  "thermostat1",
+		"a":      "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &common.Message{
+		Payload:         []byte("hello"),
+		ContentType:     "application/json",
+		ContentEncoding: "utf-8",
+		InterfaceID:     "urn:iface:1",
+		ComponentName:   "thermostat1",
+		Properties:      map[string]string{"a": "b"},
+	}
+	if !reflect.DeepEqual(m, w) {
+		t.Errorf("newMessage() = %+v, want %+v", m, w)
+	}
+}
+
 func TestParseDirectMethodTopic(t *testing.T) {
 	s := "$iothub/methods/POST/add/?$rid=666"
 	m, r, err := parseDirectMethodTopic(s)
@@ -70,3 +117,82 @@ func TestEncodePropertiesHandleSpaces(t *testing.T) {
 		}
 	}
 }
+
+func TestSeenIDs(t *testing.T) {
+	s := newSeenIDs(2)
+	for _, c := range []struct {
+		id   string
+		want bool
+	}{
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"c", true}, // evicts a
+		{"b", false},
+		{"a", true},
+	} {
+		if got := s.add(c.id); got != c.want {
+			t.Errorf("add(%q) = %t, want %t", c.id, got, c.want)
+		}
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	for _, auto := range []bool{true, false} {
+		var resubscribed, reconnected, notified int
+		tr := New(
+			WithLogger(logger.New(logger.LevelOff, nil)),
+			WithAutoResubscribe(auto),
+			WithOnReconnect(func() {
+				reconnected++
+			}),
+		)
+		tr.NotifyReconnect(func() {
+			notified++
+		})
+		fn := tr.onConnect(func() error {
+			resubscribed++
+			return nil
+		})
+		for i := 0; i < 3; i++ {
+			fn(nil)
+		}
+
+		want := 3
+		if !auto {
+			want = 0
+		}
+		if resubscribed != want {
+			t.Errorf("auto = %t: resubscribed %d times, want %d", auto, resubscribed, want)
+		}
+		if reconnected != 2 || notified != 2 {
+			t.Errorf("auto = %t: reconnect hook called %d times and notified %d times, want 2",
+				auto, reconnected, notified)
+		}
+	}
+}
+
+func TestResubscribeNotConnected(t *testing.T) {
+	if err := New().Resubscribe(); err == nil {
+		t.Fatal("Resubscribe error is nil")
+	}
+}
+
+func TestCheckBrokerTopic(t *testing.T) {
+	for topic, ok := range map[string]bool{
+		"sensors/temperature": true,
+		"":                    false,
+		"$edgehub/dev/mod":    false,
+		"$iothub/twin/GET":    false,
+	} {
+		if err := checkBrokerTopic(topic); (err == nil) != ok {
+			t.Errorf("checkBrokerTopic(%q) = %v, want ok = %t", topic, err, ok)
+		}
+	}
+}
+
+func TestVerifyEdgeConnectionNoTrustBundle(t *testing.T) {
+	if err := NewModuleTransport().verifyEdgeConnection(tls.ConnectionState{}); err == nil {
+		t.Fatal("verifyEdgeConnection error is nil without a trust bundle")
+	}
+}
@@ -15,9 +15,12 @@ import (
 type Transport interface {
 	SetLogger(logger logger.Logger)
 	Connect(ctx context.Context, creds Credentials) error
+	Disconnect() error
+	ConnectionState() ConnectionState
 	Send(ctx context.Context, msg *common.Message) error
 	RegisterDirectMethods(ctx context.Context, mux MethodDispatcher) error
 	SubscribeEvents(ctx context.Context, mux MessageDispatcher) error
+	SubscribeInputs(ctx context.Context, mux MessageDispatcher) error
 	SubscribeTwinUpdates(ctx context.Context, mux TwinStateDispatcher) error
 	RetrieveTwinProperties(ctx context.Context) (payload []byte, err error)
 	UpdateTwinProperties(ctx context.Context, payload []byte) (version int, err error)
@@ -32,6 +35,42 @@ type Transport interface {
 	Close() error
 }
 
+// ConnectionState is a transport connection state.
+type ConnectionState int
+
+const (
+	// Disconnected the transport is not connected or already closed.
+	Disconnected ConnectionState = iota
+
+	// Connected the transport is connected and ready for use.
+	Connected
+
+	// Reconnecting the connection has been lost and
+	// the transport is trying to restore it.
+	Reconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconnectNotifier is implemented by transports that restore lost
+// connections automatically, clients use it to keep track of them.
+type ReconnectNotifier interface {
+	// NotifyReconnect registers fn to be called every time the
+	// transport re-establishes the connection on its own.
+	NotifyReconnect(fn func())
+}
+
 // Credentials interface.
 type Credentials interface {
 	GetDeviceID() string
@@ -48,6 +87,15 @@ type Credentials interface {
 	UseEdgeGateway() bool
 }
 
+// BrokerHost returns the host a transport connects to, that is the
+// gateway when credentials are edge-scoped and the hub otherwise.
+func BrokerHost(creds Credentials) string {
+	if b := creds.GetBroker(); b != "" {
+		return b
+	}
+	return creds.GetHostName()
+}
+
 // MessageDispatcher handles incoming messages.
 type MessageDispatcher interface {
 	Dispatch(msg *common.Message)
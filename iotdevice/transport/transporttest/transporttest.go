@@ -0,0 +1,450 @@
+// Package transporttest provides an in-memory transport for unit-testing
+// applications built on iotdevice clients without connecting to a hub.
+//
+// The transport records sent messages and reported properties and lets
+// tests inject cloud-to-device messages, module inputs, desired twin
+// patches and direct method calls that go through the client's
+// subscriptions and handlers as if they were received from the hub.
+//
+//	tr := transporttest.New()
+//	c, err := iotdevice.NewFromConnectionString(tr, transporttest.ConnectionString)
+//	if err != nil {
+//		return err
+//	}
+//	// connect c and register handlers being tested
+//	rc, b, err := tr.CallMethod("reboot", map[string]interface{}{"delay": 5})
+package transporttest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+// ConnectionString is a device connection string that can
+// be used for creating clients backed by the transport.
+const ConnectionString = "HostName=transporttest.azure-devices.net;" +
+	"DeviceId=transporttest;SharedAccessKey=dHJhbnNwb3J0dGVzdA=="
+
+// ErrNotImplemented is returned by file uploads and module management.
+var ErrNotImplemented = errors.New("transporttest: not implemented")
+
+// ErrNotSubscribed is returned when injecting data
+// the client hasn't subscribed to.
+var ErrNotSubscribed = errors.New("transporttest: not subscribed")
+
+// New creates a disconnected transport.
+func New() *Transport {
+	return &Transport{
+		desired:  map[string]interface{}{},
+		reported: map[string]interface{}{},
+		sentc:    make(chan struct{}),
+	}
+}
+
+// Transport is an in-memory transport, it's safe for concurrent use.
+type Transport struct {
+	mu     sync.Mutex
+	state  transport.ConnectionState
+	creds  transport.Credentials
+	closed bool
+
+	sent    []*common.Message
+	sentc   chan struct{} // closed and replaced on each send
+	sendErr error
+	sendFn  func(ctx context.Context, msg *common.Message) error
+
+	events  transport.MessageDispatcher
+	inputs  transport.MessageDispatcher
+	methods transport.MethodDispatcher
+	twin    transport.TwinStateDispatcher
+
+	desired     map[string]interface{}
+	reported    map[string]interface{}
+	desiredVer  int
+	reportedVer int
+
+	reconnectFns []func()
+}
+
+// SetLogger implements transport.Transport, the transport doesn't log.
+func (tr *Transport) SetLogger(l logger.Logger) {}
+
+// Connect implements transport.Transport, it records the credentials.
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.closed {
+		return errors.New("transporttest: closed")
+	}
+	if tr.state == transport.Connected {
+		return errors.New("transporttest: already connected")
+	}
+	tr.creds = creds
+	tr.state = transport.Connected
+	return nil
+}
+
+// Disconnect implements transport.Transport.
+func (tr *Transport) Disconnect() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.state != transport.Connected {
+		return errors.New("transporttest: not connected")
+	}
+	tr.state = transport.Disconnected
+	return nil
+}
+
+// ConnectionState implements transport.Transport.
+func (tr *Transport) ConnectionState() transport.ConnectionState {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.state
+}
+
+// SetConnectionState changes the reported connection state,
+// e.g. to transport.Reconnecting for testing connectivity handling.
+func (tr *Transport) SetConnectionState(state transport.ConnectionState) {
+	tr.mu.Lock()
+	tr.state = state
+	tr.mu.Unlock()
+}
+
+// NotifyReconnect implements transport.ReconnectNotifier.
+func (tr *Transport) NotifyReconnect(fn func()) {
+	tr.mu.Lock()
+	tr.reconnectFns = append(tr.reconnectFns, fn)
+	tr.mu.Unlock()
+}
+
+// Reconnect simulates restoring a lost connection
+// calling NotifyReconnect functions.
+func (tr *Transport) Reconnect() {
+	tr.mu.Lock()
+	tr.state = transport.Connected
+	fns := tr.reconnectFns
+	tr.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Credentials returns the credentials of the last Connect call.
+func (tr *Transport) Credentials() transport.Credentials {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.creds
+}
+
+// Send implements transport.Transport, it records the message
+// or fails with the error set by SetSendError or SetSendHook.
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	tr.mu.Lock()
+	fn := tr.sendFn
+	tr.mu.Unlock()
+	if fn != nil {
+		if err := fn(ctx, msg); err != nil {
+			return err
+		}
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err := tr.checkConnected(); err != nil {
+		return err
+	}
+	if tr.sendErr != nil {
+		return tr.sendErr
+	}
+	tr.sent = append(tr.sent, msg)
+	close(tr.sentc)
+	tr.sentc = make(chan struct{})
+	return nil
+}
+
+// checkConnected must be called with mu held.
+func (tr *Transport) checkConnected() error {
+	if tr.state != transport.Connected {
+		return errors.New("transporttest: not connected")
+	}
+	return nil
+}
+
+// SetSendError makes subsequent sends fail with err, nil restores sending.
+func (tr *Transport) SetSendError(err error) {
+	tr.mu.Lock()
+	tr.sendErr = err
+	tr.mu.Unlock()
+}
+
+// SetSendHook sets a function that's called on every send before the
+// message is recorded, an error fails the send. It's called without
+// holding the transport lock so it can block, e.g. to simulate
+// a slow publish, nil removes the hook.
+func (tr *Transport) SetSendHook(fn func(ctx context.Context, msg *common.Message) error) {
+	tr.mu.Lock()
+	tr.sendFn = fn
+	tr.mu.Unlock()
+}
+
+// Sent returns all messages sent so far.
+func (tr *Transport) Sent() []*common.Message {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]*common.Message(nil), tr.sent...)
+}
+
+// WaitSent blocks until at least n messages are sent and returns all of them,
+// it's useful when messages are sent asynchronously, e.g. by handlers.
+func (tr *Transport) WaitSent(ctx context.Context, n int) ([]*common.Message, error) {
+	for {
+		tr.mu.Lock()
+		if len(tr.sent) >= n {
+			sent := append([]*common.Message(nil), tr.sent...)
+			tr.mu.Unlock()
+			return sent, nil
+		}
+		ch := tr.sentc
+		tr.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// RegisterDirectMethods implements transport.Transport.
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	tr.mu.Lock()
+	tr.methods = mux
+	tr.mu.Unlock()
+	return nil
+}
+
+// SubscribeEvents implements transport.Transport.
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.mu.Lock()
+	tr.events = mux
+	tr.mu.Unlock()
+	return nil
+}
+
+// SubscribeInputs implements transport.Transport.
+func (tr *Transport) SubscribeInputs(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.mu.Lock()
+	tr.inputs = mux
+	tr.mu.Unlock()
+	return nil
+}
+
+// SubscribeTwinUpdates implements transport.Transport.
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	tr.mu.Lock()
+	tr.twin = mux
+	tr.mu.Unlock()
+	return nil
+}
+
+// SendC2D delivers a cloud-to-device message to the client's event subscriptions.
+func (tr *Transport) SendC2D(msg *common.Message) error {
+	tr.mu.Lock()
+	mux := tr.events
+	tr.mu.Unlock()
+	if mux == nil {
+		return ErrNotSubscribed
+	}
+	mux.Dispatch(msg)
+	return nil
+}
+
+// SendInput delivers a message to the named module input.
+func (tr *Transport) SendInput(input string, msg *common.Message) error {
+	tr.mu.Lock()
+	mux := tr.inputs
+	tr.mu.Unlock()
+	if mux == nil {
+		return ErrNotSubscribed
+	}
+	msg.InputName = input
+	mux.Dispatch(msg)
+	return nil
+}
+
+// CallMethod invokes the named direct method handler with the JSON-encoded
+// payload and returns the response code and body the client would send back.
+func (tr *Transport) CallMethod(method string, payload interface{}) (int, []byte, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	tr.mu.Lock()
+	mux := tr.methods
+	tr.mu.Unlock()
+	if mux == nil {
+		return 0, nil, ErrNotSubscribed
+	}
+	return mux.Dispatch(method, b)
+}
+
+// PatchDesired merges the patch into desired properties, nil values
+// remove properties, and delivers it to the client's twin subscriptions
+// when there are any, it returns the new desired properties version.
+func (tr *Transport) PatchDesired(patch map[string]interface{}) (int, error) {
+	tr.mu.Lock()
+	mergePatch(tr.desired, patch)
+	tr.desiredVer++
+	ver := tr.desiredVer
+	mux := tr.twin
+	tr.mu.Unlock()
+
+	if mux == nil {
+		return ver, nil
+	}
+	b, err := json.Marshal(withVersion(patch, ver))
+	if err != nil {
+		return 0, err
+	}
+	mux.Dispatch(b)
+	return ver, nil
+}
+
+// Desired returns a copy of desired properties.
+func (tr *Transport) Desired() map[string]interface{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return withVersion(tr.desired, tr.desiredVer)
+}
+
+// Reported returns a copy of properties reported by the client.
+func (tr *Transport) Reported() map[string]interface{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return withVersion(tr.reported, tr.reportedVer)
+}
+
+// RetrieveTwinProperties implements transport.Transport.
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err := tr.checkConnected(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"desired":  withVersion(tr.desired, tr.desiredVer),
+		"reported": withVersion(tr.reported, tr.reportedVer),
+	})
+}
+
+// UpdateTwinProperties implements transport.Transport.
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(payload, &patch); err != nil {
+		return 0, err
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err := tr.checkConnected(); err != nil {
+		return 0, err
+	}
+	delete(patch, "$version")
+	mergePatch(tr.reported, patch)
+	tr.reportedVer++
+	return tr.reportedVer, nil
+}
+
+// mergePatch applies a JSON merge patch to m.
+func mergePatch(m, patch map[string]interface{}) {
+	for k, v := range patch {
+		switch pv := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			mv, ok := m[k].(map[string]interface{})
+			if !ok {
+				mv = map[string]interface{}{}
+				m[k] = mv
+			}
+			mergePatch(mv, pv)
+		default:
+			m[k] = v
+		}
+	}
+}
+
+// withVersion returns a deep copy of m with the $version key set.
+func withVersion(m map[string]interface{}, ver int) map[string]interface{} {
+	v := copyMap(m)
+	v["$version"] = ver
+	return v
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	v := make(map[string]interface{}, len(m)+1)
+	for k, p := range m {
+		if pm, ok := p.(map[string]interface{}); ok {
+			p = copyMap(pm)
+		}
+		v[k] = p
+	}
+	return v
+}
+
+// GetBlobSharedAccessSignature is not implemented.
+func (tr *Transport) GetBlobSharedAccessSignature(ctx context.Context, blobName string) (string, string, error) {
+	return "", "", ErrNotImplemented
+}
+
+// UploadToBlob is not implemented.
+func (tr *Transport) UploadToBlob(ctx context.Context, sasURI string, file io.Reader, size int64) error {
+	return ErrNotImplemented
+}
+
+// NotifyUploadComplete is not implemented.
+func (tr *Transport) NotifyUploadComplete(ctx context.Context, correlationID string, success bool, statusCode int, statusDescription string) error {
+	return ErrNotImplemented
+}
+
+// ListModules is not implemented.
+func (tr *Transport) ListModules(ctx context.Context) ([]*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// CreateModule is not implemented.
+func (tr *Transport) CreateModule(ctx context.Context, module *iotservice.Module) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// GetModule is not implemented.
+func (tr *Transport) GetModule(ctx context.Context, moduleID string) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// UpdateModule is not implemented.
+func (tr *Transport) UpdateModule(ctx context.Context, module *iotservice.Module) (*iotservice.Module, error) {
+	return nil, ErrNotImplemented
+}
+
+// DeleteModule is not implemented.
+func (tr *Transport) DeleteModule(ctx context.Context, module *iotservice.Module) error {
+	return ErrNotImplemented
+}
+
+// Close implements transport.Transport.
+func (tr *Transport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.closed = true
+	tr.state = transport.Disconnected
+	return nil
+}
+
+var _ transport.Transport = (*Transport)(nil)
@@ -0,0 +1,131 @@
+package transporttest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/transporttest"
+)
+
+func newClient(t *testing.T) (*iotdevice.Client, *transporttest.Transport) {
+	t.Helper()
+	tr := transporttest.New()
+	c, err := iotdevice.NewFromConnectionString(tr, transporttest.ConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c, tr
+}
+
+func TestSend(t *testing.T) {
+	c, tr := newClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		_ = c.SendEvent(ctx, []byte("hello"), iotdevice.WithSendProperty("a", "b"))
+	}()
+	sent, err := tr.WaitSent(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sent[0].Payload) != "hello" || sent[0].Properties["a"] != "b" {
+		t.Errorf("unexpected message: %+v", sent[0])
+	}
+
+	want := errors.New("server busy")
+	tr.SetSendError(want)
+	if err = c.SendEvent(ctx, []byte("hello")); !errors.Is(err, want) {
+		t.Errorf("err = %v, want %v", err, want)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c, tr := newClient(t)
+	if err := tr.SendC2D(&common.Message{}); !errors.Is(err, transporttest.ErrNotSubscribed) {
+		t.Fatalf("err = %v, want ErrNotSubscribed", err)
+	}
+	sub, err := c.SubscribeEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.SendC2D(&common.Message{Payload: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.C():
+		if string(msg.Payload) != "hi" {
+			t.Errorf("payload = %q, want %q", msg.Payload, "hi")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not dispatched")
+	}
+}
+
+func TestTwin(t *testing.T) {
+	c, tr := newClient(t)
+	ctx := context.Background()
+	sub, err := c.SubscribeTwinUpdates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.PatchDesired(map[string]interface{}{
+		"a": map[string]interface{}{"b": 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-sub.C():
+		if s.Version() != 1 {
+			t.Errorf("version = %d, want 1", s.Version())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("patch is not dispatched")
+	}
+
+	ver, err := c.UpdateTwinState(ctx, iotdevice.TwinState{"x": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != 1 || tr.Reported()["x"] != "y" {
+		t.Errorf("version = %d, reported = %v", ver, tr.Reported())
+	}
+	desired, reported, err := c.RetrieveTwinState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desired.Version() != 1 || reported["x"] != "y" {
+		t.Errorf("desired = %v, reported = %v", desired, reported)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	c, tr := newClient(t)
+	if err := c.RegisterMethod(context.Background(), "echo",
+		func(p map[string]interface{}) (int, map[string]interface{}, error) {
+			return 201, p, nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	rc, b, err := tr.CallMethod("echo", map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc != 201 || string(b) != `{"a":1}` {
+		t.Errorf("rc = %d, body = %s", rc, b)
+	}
+	if _, _, err = tr.CallMethod("unknown", nil); err == nil {
+		t.Error("calling an unregistered method succeeded")
+	}
+}
@@ -0,0 +1,626 @@
+package iothubtest
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+// mqtt 3.1.1 control packet types.
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+// connack return codes.
+const (
+	connAccepted       = 0
+	connBadCredentials = 4
+	connNotAuthorized  = 5
+)
+
+// maxPacketSize is the hub's limit of 256KB plus room for topics.
+const maxPacketSize = 300 * 1024
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var n, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if n > maxPacketSize {
+		return nil, fmt.Errorf("packet is too large: %d bytes", n)
+	}
+	p := &packet{typ: b >> 4, flags: b & 0x0f, body: make([]byte, n)}
+	if _, err = io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func encodePacket(typ, flags byte, body []byte) []byte {
+	b := make([]byte, 0, len(body)+5)
+	b = append(b, typ<<4|flags)
+	n := len(body)
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// decoder reads mqtt primitives from a packet body.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 2 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 1 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := int(d.uint16())
+	if d.err != nil {
+		return ""
+	}
+	if len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// session is a connected device.
+type session struct {
+	hub      *Hub
+	conn     net.Conn
+	deviceID string
+
+	wmu sync.Mutex // serializes writes
+
+	mu   sync.Mutex
+	subs []string
+}
+
+func (s *session) write(typ, flags byte, body []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(encodePacket(typ, flags, body))
+	return err
+}
+
+// subscribed reports whether the device is subscribed to the topic.
+func (s *session) subscribed(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.subs {
+		if matchTopic(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish delivers a QoS 0 message when the device is subscribed
+// to the topic and reports whether it did so.
+func (s *session) publish(topic string, payload []byte) bool {
+	if !s.subscribed(topic) {
+		return false
+	}
+	s.hub.logger.Debugf("%s <- %s", s.deviceID, topic)
+	if err := s.write(pktPublish, 0, append(appendString(nil, topic), payload...)); err != nil {
+		s.hub.logger.Warnf("%s: publish error: %s", s.deviceID, err)
+		return false
+	}
+	return true
+}
+
+// matchTopic reports whether the topic matches the filter
+// that may contain + and # wildcards.
+func matchTopic(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i == len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+func (h *Hub) serveMQTT(l net.Listener) {
+	defer h.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.serveConn(conn)
+		}()
+	}
+}
+
+func (h *Hub) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return
+	}
+	p, err := readPacket(r)
+	if err != nil || p.typ != pktConnect {
+		return
+	}
+	s := &session{hub: h, conn: conn}
+	keepAlive, rc, err := h.connect(s, p)
+	if err != nil {
+		h.logger.Warnf("connect refused: %s", err)
+	}
+	if werr := s.write(pktConnack, 0, []byte{0, rc}); werr != nil || rc != connAccepted {
+		return
+	}
+	defer h.disconnect(s)
+	h.logger.Debugf("%s connected", s.deviceID)
+
+	for {
+		var deadline time.Time
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive * 3 / 2)
+		}
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+		if p, err = readPacket(r); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				h.logger.Debugf("%s: read error: %s", s.deviceID, err)
+			}
+			return
+		}
+		switch p.typ {
+		case pktPublish:
+			err = h.handlePublish(s, p)
+		case pktPuback:
+			// outgoing messages are published with QoS 0
+		case pktSubscribe:
+			err = h.handleSubscribe(s, p)
+		case pktUnsubscribe:
+			err = h.handleUnsubscribe(s, p)
+		case pktPingreq:
+			err = s.write(pktPingresp, 0, nil)
+		case pktDisconnect:
+			return
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.typ)
+		}
+		if err != nil {
+			h.logger.Warnf("%s: %s", s.deviceID, err)
+			return
+		}
+	}
+}
+
+// connect authenticates the device and registers the session,
+// it returns the keep-alive interval and the connack return code.
+func (h *Hub) connect(s *session, p *packet) (time.Duration, byte, error) {
+	d := &decoder{b: p.body}
+	proto, level := d.string(), d.byte()
+	flags := d.byte()
+	keepAlive := time.Duration(d.uint16()) * time.Second
+	clientID := d.string()
+	if flags&0x04 != 0 { // will topic and message
+		d.string()
+		d.string()
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.string()
+	}
+	if d.err != nil {
+		return 0, connNotAuthorized, d.err
+	}
+	if proto != "MQTT" || level != 4 {
+		return 0, 1, fmt.Errorf("unsupported protocol %s %d", proto, level) // 1 = unacceptable protocol version
+	}
+
+	// username is {host}/{deviceId}/?api-version=...
+	parts := strings.SplitN(username, "/", 3)
+	if len(parts) < 2 || parts[0] != h.hostName || parts[1] != clientID {
+		return 0, connBadCredentials, fmt.Errorf("malformed username %q", username)
+	}
+	if err := h.authenticate(clientID, password); err != nil {
+		return 0, connNotAuthorized, err
+	}
+	s.deviceID = clientID
+
+	h.mu.Lock()
+	old := h.sessions[clientID]
+	h.sessions[clientID] = s
+	if d := h.devices[clientID]; d != nil {
+		d.dev.ConnectionState = iotservice.Connected
+	}
+	h.mu.Unlock()
+	if old != nil {
+		// the hub allows only one connection per device
+		old.conn.Close()
+	}
+	return keepAlive, connAccepted, nil
+}
+
+// authenticate checks the device's SAS token, that's signed
+// either for the hub host name or for the device resource.
+func (h *Hub) authenticate(deviceID, password string) error {
+	sas, err := common.ParseSharedAccessSignature(password)
+	if err != nil {
+		return err
+	}
+	if sas.Sr != h.hostName && sas.Sr != h.hostName+"/devices/"+deviceID {
+		return fmt.Errorf("%s: unexpected token resource %q", deviceID, sas.Sr)
+	}
+	if time.Now().After(sas.Se) {
+		return fmt.Errorf("%s: token expired", deviceID)
+	}
+
+	h.mu.Lock()
+	d := h.devices[deviceID]
+	var keys []string
+	disabled := false
+	if d != nil {
+		disabled = d.dev.Status == iotservice.Disabled
+		if auth := d.dev.Authentication; auth != nil && auth.SymmetricKey != nil {
+			keys = []string{auth.SymmetricKey.PrimaryKey, auth.SymmetricKey.SecondaryKey}
+		}
+	}
+	h.mu.Unlock()
+	switch {
+	case d == nil:
+		return fmt.Errorf("%s: device not found", deviceID)
+	case disabled:
+		return fmt.Errorf("%s: device is disabled", deviceID)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		want, err := common.NewSharedAccessSignature(sas.Sr, sas.Skn, key, sas.Se)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal([]byte(want.Sig), []byte(sas.Sig)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: invalid token signature", deviceID)
+}
+
+func (h *Hub) disconnect(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[s.deviceID] != s {
+		return // replaced by a newer connection
+	}
+	delete(h.sessions, s.deviceID)
+	if d := h.devices[s.deviceID]; d != nil {
+		d.dev.ConnectionState = iotservice.Disconnected
+	}
+	h.logger.Debugf("%s disconnected", s.deviceID)
+}
+
+func (h *Hub) handleSubscribe(s *session, p *packet) error {
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	var filters []string
+	var granted []byte
+	for d.err == nil && len(d.b) != 0 {
+		f, qos := d.string(), d.byte()
+		if qos > 1 {
+			qos = 1 // the hub doesn't support QoS 2
+		}
+		filters = append(filters, f)
+		granted = append(granted, qos)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	s.mu.Lock()
+	s.subs = append(s.subs, filters...)
+	s.mu.Unlock()
+	if err := s.write(pktSuback, 0, append(appendUint16(nil, id), granted...)); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if matchTopic(f, "devices/"+s.deviceID+"/messages/devicebound/x") {
+			h.flushC2D(s)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) handleUnsubscribe(s *session, p *packet) error {
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	for d.err == nil && len(d.b) != 0 {
+		f := d.string()
+		s.mu.Lock()
+		for i := range s.subs {
+			if s.subs[i] == f {
+				s.subs = append(s.subs[:i], s.subs[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return s.write(pktUnsuback, 0, appendUint16(nil, id))
+}
+
+func (h *Hub) handlePublish(s *session, p *packet) error {
+	d := &decoder{b: p.body}
+	topic := d.string()
+	qos := (p.flags >> 1) & 0x03
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if qos > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+	h.logger.Debugf("%s -> %s", s.deviceID, topic)
+
+	var err error
+	switch events := "devices/" + s.deviceID + "/messages/events/"; {
+	case strings.HasPrefix(topic, events):
+		err = h.handleEvent(s, topic[len(events):], d.b)
+	case strings.HasPrefix(topic, "$iothub/twin/GET/"):
+		err = h.handleTwinGet(s, topic)
+	case strings.HasPrefix(topic, "$iothub/twin/PATCH/properties/reported/"):
+		err = h.handleTwinReported(s, topic, d.b)
+	case strings.HasPrefix(topic, "$iothub/methods/res/"):
+		err = h.handleMethodResponse(topic, d.b)
+	default:
+		err = fmt.Errorf("publishing to %q is not allowed", topic)
+	}
+	if err != nil {
+		return err
+	}
+	if qos == 1 {
+		return s.write(pktPuback, 0, appendUint16(nil, id))
+	}
+	return nil
+}
+
+func (h *Hub) handleEvent(s *session, props string, payload []byte) error {
+	q, err := url.ParseQuery(strings.TrimSuffix(props, "/"))
+	if err != nil {
+		return fmt.Errorf("malformed event properties: %w", err)
+	}
+	now := time.Now().UTC()
+	msg := &common.Message{
+		Payload:            append([]byte(nil), payload...),
+		ConnectionDeviceID: s.deviceID,
+		EnqueuedTime:       &now,
+		Properties:         make(map[string]string, len(q)),
+	}
+	for k, v := range q {
+		switch k {
+		case "$.mid":
+			msg.MessageID = v[0]
+		case "$.cid":
+			msg.CorrelationID = v[0]
+		case "$.uid":
+			msg.UserID = v[0]
+		case "$.to":
+			msg.To = v[0]
+		case "$.ct":
+			msg.ContentType = v[0]
+		case "$.ce":
+			msg.ContentEncoding = v[0]
+		case "$.ifid":
+			msg.InterfaceID = v[0]
+		case "$.sub":
+			msg.ComponentName = v[0]
+		case "$.exp":
+			t, err := time.Parse(time.RFC3339, v[0])
+			if err != nil {
+				return fmt.Errorf("malformed expiry time: %w", err)
+			}
+			msg.ExpiryTime = &t
+		case "$.ctime":
+		default:
+			msg.Properties[k] = v[0]
+		}
+	}
+	h.events.push(msg)
+	return nil
+}
+
+func (h *Hub) handleTwinGet(s *session, topic string) error {
+	rid, err := topicParam(topic, "$rid")
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	d := h.devices[s.deviceID]
+	var b []byte
+	if d != nil {
+		b, err = json.Marshal(map[string]interface{}{
+			"desired":  d.desiredState(),
+			"reported": d.reportedState(),
+		})
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		s.publish("$iothub/twin/res/404/?$rid="+rid, nil)
+		return nil
+	}
+	s.publish("$iothub/twin/res/200/?$rid="+rid, b)
+	return nil
+}
+
+func (h *Hub) handleTwinReported(s *session, topic string, payload []byte) error {
+	rid, err := topicParam(topic, "$rid")
+	if err != nil {
+		return err
+	}
+	var patch map[string]interface{}
+	if err = json.Unmarshal(payload, &patch); err != nil || patch == nil {
+		s.publish("$iothub/twin/res/400/?$rid="+rid, nil)
+		return nil
+	}
+	delete(patch, "$version")
+	h.mu.Lock()
+	d := h.devices[s.deviceID]
+	var ver int
+	if d != nil {
+		mergePatch(d.reported, patch)
+		d.reportedVer++
+		d.touch(h)
+		ver = d.reportedVer
+	}
+	h.mu.Unlock()
+	if d == nil {
+		s.publish("$iothub/twin/res/404/?$rid="+rid, nil)
+		return nil
+	}
+	s.publish("$iothub/twin/res/204/?$rid="+rid+"&$version="+strconv.Itoa(ver), nil)
+	return nil
+}
+
+func (h *Hub) handleMethodResponse(topic string, payload []byte) error {
+	u, err := url.Parse(topic)
+	if err != nil {
+		return err
+	}
+	status, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(u.Path, "$iothub/methods/res/"), "/"))
+	if err != nil {
+		return fmt.Errorf("malformed method response topic %q", topic)
+	}
+	rid := u.Query().Get("$rid")
+	h.mu.Lock()
+	ch, ok := h.calls[rid]
+	delete(h.calls, rid)
+	h.mu.Unlock()
+	if !ok {
+		h.logger.Warnf("unknown method response rid %q", rid)
+		return nil
+	}
+	ch <- &methodResponse{status: status, payload: append([]byte(nil), payload...)}
+	return nil
+}
+
+// topicParam returns the named query parameter of the topic.
+func topicParam(topic, name string) (string, error) {
+	u, err := url.Parse(topic)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query().Get(name)
+	if v == "" {
+		return "", fmt.Errorf("%s is missing in %q", name, topic)
+	}
+	return v, nil
+}
@@ -0,0 +1,489 @@
+// Package iothubtest provides an in-process fake IoT Hub that emulates
+// the subset of the service used by this SDK, so both SDK tests and
+// applications can be tested without an Azure subscription.
+//
+// The hub runs an MQTT broker for devices that authenticate with
+// symmetric keys (telemetry, cloud-to-device messages, twins and direct
+// methods) and a REST endpoint serving the registry, twins and direct
+// method calls of iotservice clients. AMQP endpoints aren't emulated,
+// telemetry and cloud-to-device messages are accessible with
+// ReceiveEvent and SendC2D instead.
+//
+//	hub, err := iothubtest.New()
+//	if err != nil {
+//		return err
+//	}
+//	defer hub.Close()
+//
+//	dc, err := hub.NewDeviceClient("golang-device")
+//	if err != nil {
+//		return err
+//	}
+//	if err = dc.Connect(ctx); err != nil {
+//		return err
+//	}
+//	if err = dc.SendEvent(ctx, []byte("hello")); err != nil {
+//		return err
+//	}
+//	msg, err := hub.ReceiveEvent(ctx)
+package iothubtest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PolicyName is the name of the hub's only shared access policy.
+const PolicyName = "iothubowner"
+
+// Option is a hub configuration option.
+type Option func(h *Hub)
+
+// WithLogger sets the hub logger, by default
+// the level is read from $IOTHUB_TEST_LOG_LEVEL.
+func WithLogger(l logger.Logger) Option {
+	return func(h *Hub) {
+		h.logger = l
+	}
+}
+
+// WithAddr sets the address the hub listens on, default is 127.0.0.1,
+// the REST endpoint and the MQTT broker get random ports.
+func WithAddr(host string) Option {
+	return func(h *Hub) {
+		h.addr = host
+	}
+}
+
+// Hub is a fake IoT Hub.
+type Hub struct {
+	addr     string
+	hostName string // REST endpoint address that's used as the hub host name
+	mqttAddr string
+	key      string // PolicyName's key
+	pool     *x509.CertPool
+	logger   logger.Logger
+
+	ml  net.Listener
+	srv *http.Server
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	devices  map[string]*device
+	sessions map[string]*session
+	calls    map[string]chan *methodResponse
+	seq      int // request ids and etags
+
+	events queue
+}
+
+// New starts a hub listening on random ports.
+func New(opts ...Option) (*Hub, error) {
+	h := &Hub{
+		addr:     "127.0.0.1",
+		devices:  map[string]*device{},
+		sessions: map[string]*session{},
+		calls:    map[string]chan *methodResponse{},
+		events:   queue{ready: make(chan struct{}, 1)},
+		logger:   logger.NewFromString(os.Getenv("IOTHUB_TEST_LOG_LEVEL")),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	crt, err := newCertificate(h.addr)
+	if err != nil {
+		return nil, err
+	}
+	h.pool = x509.NewCertPool()
+	h.pool.AddCert(crt.Leaf)
+	if h.key, err = generateKey(); err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{*crt}}
+
+	hl, err := tls.Listen("tcp", net.JoinHostPort(h.addr, "0"), tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	h.ml, err = tls.Listen("tcp", net.JoinHostPort(h.addr, "0"), tlsCfg)
+	if err != nil {
+		hl.Close()
+		return nil, err
+	}
+	h.hostName = hl.Addr().String()
+	h.mqttAddr = h.ml.Addr().String()
+	h.srv = &http.Server{Handler: h.restHandler()}
+
+	h.wg.Add(2)
+	go h.serveMQTT(h.ml)
+	go func() {
+		defer h.wg.Done()
+		if err := h.srv.Serve(hl); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.logger.Errorf("rest server error: %s", err)
+		}
+	}()
+	return h, nil
+}
+
+// newCertificate generates a self-signed server certificate for the host.
+func newCertificate(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "iothubtest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tpl.IPAddresses = []net.IP{ip}
+	} else {
+		tpl.DNSNames = append(tpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func generateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// HostName returns the hub's host name, that's the REST endpoint address.
+func (h *Hub) HostName() string {
+	return h.hostName
+}
+
+// MQTTAddr returns the address of the MQTT broker.
+func (h *Hub) MQTTAddr() string {
+	return h.mqttAddr
+}
+
+// RootCAs returns the pool containing the hub's self-signed certificate.
+func (h *Hub) RootCAs() *x509.CertPool {
+	return h.pool
+}
+
+// ConnectionString returns the service connection string of PolicyName.
+func (h *Hub) ConnectionString() string {
+	cs, err := common.BuildConnectionString(
+		"HostName", h.hostName,
+		"SharedAccessKeyName", PolicyName,
+		"SharedAccessKey", h.key,
+	)
+	if err != nil {
+		panic(err) // never happens, all values are set
+	}
+	return cs
+}
+
+// ServiceOptions returns the options that make an iotservice client trust the hub.
+func (h *Hub) ServiceOptions() []iotservice.ClientOption {
+	return []iotservice.ClientOption{iotservice.WithRootCAs(h.pool)}
+}
+
+// NewServiceClient creates a service client connected to the hub,
+// only the REST API is available, see the package documentation.
+func (h *Hub) NewServiceClient(opts ...iotservice.ClientOption) (*iotservice.Client, error) {
+	return iotservice.NewFromConnectionString(
+		h.ConnectionString(), append(h.ServiceOptions(), opts...)...,
+	)
+}
+
+// TransportOptions returns the options that make an MQTT transport connect
+// to the hub's broker, they use mqtt.WithClientOptionsConfig so it cannot
+// be used for configuring the same transport again.
+func (h *Hub) TransportOptions() []mqtt.TransportOption {
+	broker := &url.URL{Scheme: "tls", Host: h.mqttAddr}
+	return []mqtt.TransportOption{
+		mqtt.WithRootCAs(h.pool),
+		mqtt.WithClientOptionsConfig(func(opts *paho.ClientOptions) {
+			opts.Servers = []*url.URL{broker}
+		}),
+	}
+}
+
+// DeviceConnectionString returns the primary key connection string
+// of the named device, that's created when it doesn't exist.
+func (h *Hub) DeviceConnectionString(deviceID string) (string, error) {
+	h.mu.Lock()
+	d := h.devices[deviceID]
+	if d == nil {
+		var err error
+		if d, err = h.putDevice(&iotservice.Device{DeviceID: deviceID}, ""); err != nil {
+			h.mu.Unlock()
+			return "", err
+		}
+	}
+	auth := d.dev.Authentication
+	h.mu.Unlock()
+	if auth == nil || auth.SymmetricKey == nil || auth.SymmetricKey.PrimaryKey == "" {
+		return "", fmt.Errorf("iothubtest: device %q has no symmetric key", deviceID)
+	}
+	return common.BuildConnectionString(
+		"HostName", h.hostName,
+		"DeviceId", deviceID,
+		"SharedAccessKey", auth.SymmetricKey.PrimaryKey,
+	)
+}
+
+// NewDeviceClient creates an MQTT device client for the named device,
+// that's created when it doesn't exist, the client has to be connected.
+func (h *Hub) NewDeviceClient(deviceID string, opts ...iotdevice.ClientOption) (*iotdevice.Client, error) {
+	cs, err := h.DeviceConnectionString(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return iotdevice.NewFromConnectionString(mqtt.New(h.TransportOptions()...), cs, opts...)
+}
+
+// ReceiveEvent blocks until a device-to-cloud message is available,
+// messages are queued in the order they're received by the hub.
+func (h *Hub) ReceiveEvent(ctx context.Context) (*common.Message, error) {
+	return h.events.pop(ctx)
+}
+
+// SendC2D sends a cloud-to-device message to the named device, messages
+// are queued until the device subscribes to cloud-to-device messages.
+func (h *Hub) SendC2D(deviceID string, msg *common.Message) error {
+	h.mu.Lock()
+	d := h.devices[deviceID]
+	if d == nil {
+		h.mu.Unlock()
+		return fmt.Errorf("iothubtest: device %q not found", deviceID)
+	}
+	if msg.MessageID == "" {
+		h.seq++
+		msg.MessageID = strconv.Itoa(h.seq)
+	}
+	d.c2d = append(d.c2d, msg)
+	s := h.sessions[deviceID]
+	h.mu.Unlock()
+	if s != nil {
+		h.flushC2D(s)
+	}
+	return nil
+}
+
+// flushC2D delivers queued cloud-to-device messages to the session.
+func (h *Hub) flushC2D(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d := h.devices[s.deviceID]
+	if d == nil {
+		return
+	}
+	for len(d.c2d) != 0 {
+		if !s.publish(c2dTopic(s.deviceID, d.c2d[0]), d.c2d[0].Payload) {
+			return
+		}
+		d.c2d = d.c2d[1:]
+		d.dev.CloudToDeviceMessageCount = uint(len(d.c2d))
+	}
+}
+
+func c2dTopic(deviceID string, msg *common.Message) string {
+	u := url.Values{}
+	u.Set("$.mid", msg.MessageID)
+	u.Set("$.to", "/devices/"+deviceID+"/messages/deviceBound")
+	if msg.CorrelationID != "" {
+		u.Set("$.cid", msg.CorrelationID)
+	}
+	if msg.UserID != "" {
+		u.Set("$.uid", msg.UserID)
+	}
+	if msg.ContentType != "" {
+		u.Set("$.ct", msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		u.Set("$.ce", msg.ContentEncoding)
+	}
+	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
+		u.Set("$.exp", msg.ExpiryTime.UTC().Format(time.RFC3339))
+	}
+	for k, v := range msg.Properties {
+		u.Set(k, v)
+	}
+	return "devices/" + deviceID + "/messages/devicebound/" + u.Encode()
+}
+
+// UpdateDesired applies the patch to the named device's desired
+// properties, notifies the device and returns the new version.
+func (h *Hub) UpdateDesired(deviceID string, patch map[string]interface{}) (int, error) {
+	h.mu.Lock()
+	d := h.devices[deviceID]
+	if d == nil {
+		h.mu.Unlock()
+		return 0, fmt.Errorf("iothubtest: device %q not found", deviceID)
+	}
+	h.patchDesired(d, patch)
+	ver := d.desiredVer
+	h.mu.Unlock()
+	return ver, nil
+}
+
+// patchDesired must be called with mu held.
+func (h *Hub) patchDesired(d *device, patch map[string]interface{}) {
+	mergePatch(d.desired, patch)
+	d.desiredVer++
+	d.touch(h)
+	if s := h.sessions[d.dev.DeviceID]; s != nil {
+		v := make(map[string]interface{}, len(patch)+1)
+		for k, p := range patch {
+			v[k] = p
+		}
+		v["$version"] = d.desiredVer
+		b, err := json.Marshal(v)
+		if err != nil {
+			h.logger.Errorf("desired patch encoding error: %s", err)
+			return
+		}
+		s.publish("$iothub/twin/PATCH/properties/desired/?$version="+strconv.Itoa(d.desiredVer), b)
+	}
+}
+
+// ErrDeviceNotOnline is returned when invoking methods
+// of devices that aren't connected or subscribed to methods.
+var ErrDeviceNotOnline = errors.New("iothubtest: device is not online")
+
+type methodResponse struct {
+	status  int
+	payload []byte
+}
+
+// CallMethod invokes the named direct method on the device and returns
+// the response status and payload, payload is JSON-encoded.
+func (h *Hub) CallMethod(
+	ctx context.Context, deviceID, method string, payload interface{},
+) (int, json.RawMessage, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	h.mu.Lock()
+	s := h.sessions[deviceID]
+	h.seq++
+	rid := strconv.Itoa(h.seq)
+	ch := make(chan *methodResponse, 1)
+	h.calls[rid] = ch
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.calls, rid)
+		h.mu.Unlock()
+	}()
+
+	if s == nil || !s.publish("$iothub/methods/POST/"+method+"/?$rid="+rid, b) {
+		return 0, nil, ErrDeviceNotOnline
+	}
+	select {
+	case res := <-ch:
+		if len(res.payload) == 0 {
+			res.payload = []byte("null")
+		}
+		return res.status, res.payload, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// Close stops the hub and disconnects all clients.
+func (h *Hub) Close() error {
+	err := h.srv.Close()
+	if cerr := h.ml.Close(); err == nil {
+		err = cerr
+	}
+	h.mu.Lock()
+	for _, s := range h.sessions {
+		s.conn.Close()
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+	return err
+}
+
+// queue is an unbounded message queue.
+type queue struct {
+	mu    sync.Mutex
+	msgs  []*common.Message
+	ready chan struct{}
+}
+
+func (q *queue) push(msg *common.Message) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) pop(ctx context.Context) (*common.Message, error) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) != 0 {
+			msg := q.msgs[0]
+			q.msgs = q.msgs[1:]
+			if len(q.msgs) != 0 {
+				select {
+				case q.ready <- struct{}{}:
+				default:
+				}
+			}
+			q.mu.Unlock()
+			return msg, nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package iothubtest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iothubtest"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+func newHub(t *testing.T) *iothubtest.Hub {
+	t.Helper()
+	hub, err := iothubtest.New(iothubtest.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := hub.Close(); err != nil {
+			t.Errorf("close error: %s", err)
+		}
+	})
+	return hub
+}
+
+func newDevice(t *testing.T, hub *iothubtest.Hub, deviceID string) *iotdevice.Client {
+	t.Helper()
+	dc, err := hub.NewDeviceClient(deviceID, iotdevice.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dc.Close()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = dc.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestEvents(t *testing.T) {
+	hub := newHub(t)
+	dc := newDevice(t, hub, "golang-device")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := dc.SendEvent(ctx, []byte("hello"),
+		iotdevice.WithSendMessageID("mid"),
+		iotdevice.WithSendProperty("a", "b c"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := hub.ReceiveEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != "hello" || msg.MessageID != "mid" ||
+		msg.ConnectionDeviceID != "golang-device" || msg.Properties["a"] != "b c" {
+		t.Errorf("unexpected event: %+v", msg)
+	}
+
+	sub, err := dc.SubscribeEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = hub.SendC2D("golang-device", &common.Message{
+		Payload:    []byte("hi"),
+		Properties: map[string]string{"x": "y"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg = <-sub.C():
+		if string(msg.Payload) != "hi" || msg.Properties["x"] != "y" {
+			t.Errorf("unexpected c2d message: %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestTwins(t *testing.T) {
+	hub := newHub(t)
+	dc := newDevice(t, hub, "golang-device")
+	sc, err := hub.NewServiceClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err = dc.UpdateTwinState(ctx, iotdevice.TwinState{"temp": 21.5}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := dc.SubscribeTwinUpdates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twin, err := sc.GetDeviceTwin(ctx, "golang-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twin.Properties.Reported["temp"] != 21.5 {
+		t.Errorf("reported = %v, want temp = 21.5", twin.Properties.Reported)
+	}
+	if _, err = sc.UpdateDeviceTwin(ctx, &iotservice.Twin{
+		DeviceID: "golang-device",
+		ETag:     twin.ETag,
+		Properties: &iotservice.Properties{
+			Desired: map[string]interface{}{"interval": 5},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-sub.C():
+		if s["interval"] != 5.0 || s.Version() != 1 {
+			t.Errorf("unexpected desired patch: %v", s)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	desired, _, err := dc.RetrieveTwinState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desired["interval"] != 5.0 {
+		t.Errorf("desired = %v, want interval = 5", desired)
+	}
+
+	// the etag has changed with the previous update
+	_, err = sc.UpdateDeviceTwin(ctx, &iotservice.Twin{DeviceID: "golang-device", ETag: twin.ETag})
+	var rerr *iotservice.RequestError
+	if !errors.As(err, &rerr) || rerr.Code != 412 {
+		t.Errorf("err = %v, want a precondition failed error", err)
+	}
+
+	// a retrieved twin can be sent back with its metadata
+	twin, err = sc.GetDeviceTwin(ctx, "golang-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	twin.Tags = map[string]interface{}{"env": "test"}
+	twin.Properties.Desired = map[string]interface{}{
+		"mode":      "eco",
+		"$version":  twin.Properties.Desired["$version"],
+		"$metadata": map[string]interface{}{},
+	}
+	twin, err = sc.ReplaceDeviceTwin(ctx, twin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := twin.Properties.Desired["interval"]; ok || twin.Properties.Desired["mode"] != "eco" {
+		t.Errorf("desired = %v, want only mode = eco", twin.Properties.Desired)
+	}
+	select {
+	case s := <-sub.C():
+		if _, ok := s["interval"]; !ok || s["interval"] != nil || s["mode"] != "eco" {
+			t.Errorf("unexpected desired patch: %v", s)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+}
+
+func TestMethods(t *testing.T) {
+	hub := newHub(t)
+	dc := newDevice(t, hub, "golang-device")
+	sc, err := hub.NewServiceClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err = sc.CallDeviceMethod(ctx, "golang-device", &iotservice.MethodCall{
+		MethodName: "sum",
+	}); err == nil {
+		t.Fatal("calling unregistered methods succeeded")
+	}
+	if err = dc.RegisterMethod(ctx, "sum",
+		func(p map[string]interface{}) (int, map[string]interface{}, error) {
+			a, _ := p["a"].(float64)
+			b, _ := p["b"].(float64)
+			return 200, map[string]interface{}{"sum": a + b}, nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	res, err := sc.CallDeviceMethod(ctx, "golang-device", &iotservice.MethodCall{
+		MethodName:      "sum",
+		ResponseTimeout: 5,
+		Payload:         json.RawMessage(`{"a":1,"b":2}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 200 || string(res.Payload) != `{"sum":3}` {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	status, b, err := hub.CallMethod(ctx, "golang-device", "sum", map[string]int{"a": 2, "b": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Sum int }
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 || v.Sum != 4 {
+		t.Errorf("status = %d, payload = %s", status, b)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	hub := newHub(t)
+	sc, err := hub.NewServiceClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	device, err := sc.CreateDevice(ctx, &iotservice.Device{DeviceID: "golang-device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Authentication.SymmetricKey.PrimaryKey == "" || device.Status != iotservice.Enabled {
+		t.Errorf("unexpected device: %+v", device)
+	}
+	if _, err = sc.CreateDevice(ctx, &iotservice.Device{DeviceID: "golang-device"}); err == nil {
+		t.Error("creating an existing device succeeded")
+	}
+	devices, err := sc.ListDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].DeviceID != "golang-device" {
+		t.Errorf("unexpected devices: %v", devices)
+	}
+
+	// disabled devices cannot connect
+	device.Status = iotservice.Disabled
+	if device, err = sc.UpdateDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	dc, err := hub.NewDeviceClient("golang-device", iotdevice.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	if err = dc.Connect(ctx); err == nil {
+		t.Error("disabled device connected")
+	}
+
+	if err = sc.DeleteDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sc.GetDevice(ctx, "golang-device"); err == nil {
+		t.Error("device is not deleted")
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	hub := newHub(t)
+	if _, err := hub.DeviceConnectionString("golang-device"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sc, err := iotservice.NewFromConnectionString(
+		"HostName="+hub.HostName()+";SharedAccessKeyName="+iothubtest.PolicyName+
+			";SharedAccessKey=bm90IGEga2V5", hub.ServiceOptions()...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	var rerr *iotservice.RequestError
+	if _, err = sc.GetDevice(ctx, "golang-device"); !errors.As(err, &rerr) || rerr.Code != 401 {
+		t.Errorf("err = %v, want an unauthorized error", err)
+	}
+}
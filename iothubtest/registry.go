@@ -0,0 +1,439 @@
+package iothubtest
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+// device is a registered device with its twin.
+type device struct {
+	dev         *iotservice.Device
+	tags        map[string]interface{}
+	desired     map[string]interface{}
+	reported    map[string]interface{}
+	desiredVer  int
+	reportedVer int
+	version     int // twin version
+	etag        string
+	c2d         []*common.Message // pending cloud-to-device messages
+}
+
+// touch bumps the twin version, must be called with mu held.
+func (d *device) touch(h *Hub) {
+	d.version++
+	d.etag = h.nextETag()
+}
+
+func (d *device) desiredState() map[string]interface{} {
+	return withVersion(d.desired, d.desiredVer)
+}
+
+func (d *device) reportedState() map[string]interface{} {
+	return withVersion(d.reported, d.reportedVer)
+}
+
+func withVersion(m map[string]interface{}, ver int) map[string]interface{} {
+	v := make(map[string]interface{}, len(m)+1)
+	for k, p := range m {
+		v[k] = p
+	}
+	v["$version"] = ver
+	return v
+}
+
+func (d *device) twin() *iotservice.Twin {
+	authType := "sas"
+	if d.dev.Authentication != nil && d.dev.Authentication.Type != "" {
+		authType = string(d.dev.Authentication.Type)
+	}
+	return &iotservice.Twin{
+		DeviceID:                  d.dev.DeviceID,
+		ETag:                      d.etag,
+		Status:                    d.dev.Status,
+		ConnectionState:           d.dev.ConnectionState,
+		CloudToDeviceMessageCount: d.dev.CloudToDeviceMessageCount,
+		AuthenticationType:        authType,
+		Version:                   d.version,
+		Tags:                      d.tags,
+		Properties: &iotservice.Properties{
+			Desired:  d.desiredState(),
+			Reported: d.reportedState(),
+		},
+		Capabilities: d.dev.Capabilities,
+	}
+}
+
+// mergePatch applies a JSON merge patch to m, nil values delete keys.
+func mergePatch(m, patch map[string]interface{}) {
+	for k, v := range patch {
+		if v == nil {
+			delete(m, k)
+			continue
+		}
+		if pv, ok := v.(map[string]interface{}); ok {
+			if mv, ok := m[k].(map[string]interface{}); ok {
+				mergePatch(mv, pv)
+				continue
+			}
+			mv := map[string]interface{}{}
+			mergePatch(mv, pv)
+			m[k] = mv
+			continue
+		}
+		m[k] = v
+	}
+}
+
+// nextETag must be called with mu held.
+func (h *Hub) nextETag() string {
+	h.seq++
+	return base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(h.seq)))
+}
+
+// httpError is an error with a status code, bodies mimic the hub's ones.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorCode(code int, format string, v ...interface{}) error {
+	return &httpError{code: code, msg: fmt.Sprintf(format, v...)}
+}
+
+// checkETag compares the If-Match header value with the etag.
+func checkETag(ifMatch, etag string) error {
+	if ifMatch == "" || ifMatch == "*" || strings.Trim(ifMatch, `"`) == etag {
+		return nil
+	}
+	return errorCode(http.StatusPreconditionFailed, "etag mismatch")
+}
+
+// putDevice creates or replaces a device, must be called with mu held.
+func (h *Hub) putDevice(v *iotservice.Device, ifMatch string) (*device, error) {
+	if v.DeviceID == "" {
+		return nil, errorCode(http.StatusBadRequest, "deviceId is required")
+	}
+	d := h.devices[v.DeviceID]
+	if d != nil {
+		if err := checkETag(ifMatch, d.dev.ETag); err != nil {
+			return nil, err
+		}
+	} else {
+		if ifMatch != "" {
+			// create and update requests are only distinguished by If-Match
+			return nil, errorCode(http.StatusNotFound, "device %q not found", v.DeviceID)
+		}
+		d = &device{
+			tags:     map[string]interface{}{},
+			desired:  map[string]interface{}{},
+			reported: map[string]interface{}{},
+		}
+		d.touch(h)
+		h.seq++
+		v.GenerationID = strconv.Itoa(h.seq)
+	}
+	if v.Status == "" {
+		v.Status = iotservice.Enabled
+	}
+	if v.Authentication == nil {
+		v.Authentication = &iotservice.Authentication{}
+	}
+	auth := v.Authentication
+	if auth.Type == "" {
+		auth.Type = iotservice.AuthSAS
+	}
+	if auth.Type == iotservice.AuthSAS {
+		if auth.SymmetricKey == nil {
+			auth.SymmetricKey = &iotservice.SymmetricKey{}
+		}
+		for _, key := range []*string{&auth.SymmetricKey.PrimaryKey, &auth.SymmetricKey.SecondaryKey} {
+			if *key != "" {
+				continue
+			}
+			var err error
+			if *key, err = generateKey(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	v.ConnectionState = iotservice.Disconnected
+	if s := h.sessions[v.DeviceID]; s != nil {
+		if v.Status == iotservice.Disabled {
+			s.conn.Close()
+		} else {
+			v.ConnectionState = iotservice.Connected
+		}
+	}
+	if d.dev != nil {
+		v.GenerationID = d.dev.GenerationID
+		v.CloudToDeviceMessageCount = d.dev.CloudToDeviceMessageCount
+	}
+	v.ETag = h.nextETag()
+	d.dev = v
+	h.devices[v.DeviceID] = d
+	return d, nil
+}
+
+func (h *Hub) restHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.logger.Debugf("%s %s", r.Method, r.URL)
+		if err := h.authorize(r); err != nil {
+			writeError(w, &httpError{code: http.StatusUnauthorized, msg: err.Error()})
+			return
+		}
+		v, err := h.route(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if v == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(b)
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var e *httpError
+	if errors.As(err, &e) {
+		code = e.code
+	}
+	b, _ := json.Marshal(map[string]string{
+		"Message":          err.Error(),
+		"ExceptionMessage": err.Error(),
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// authorize checks the request's shared access signature
+// that has to be signed with the PolicyName's key.
+func (h *Hub) authorize(r *http.Request) error {
+	sas, err := common.ParseSharedAccessSignature(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+	if sas.Sr != h.hostName || sas.Skn != PolicyName {
+		return fmt.Errorf("unexpected token resource %q or policy %q", sas.Sr, sas.Skn)
+	}
+	if time.Now().After(sas.Se) {
+		return errors.New("token expired")
+	}
+	want, err := common.NewSharedAccessSignature(sas.Sr, sas.Skn, h.key, sas.Se)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(want.Sig), []byte(sas.Sig)) {
+		return errors.New("invalid token signature")
+	}
+	return nil
+}
+
+// route serves the request and returns the response object,
+// nil means no content.
+func (h *Hub) route(r *http.Request) (interface{}, error) {
+	var path []string
+	for _, s := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		p, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, errorCode(http.StatusBadRequest, "malformed path: %s", err)
+		}
+		path = append(path, p)
+	}
+	ifMatch := r.Header.Get("If-Match")
+
+	switch {
+	case len(path) == 1 && path[0] == "devices" && r.Method == http.MethodGet:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		ids := make([]string, 0, len(h.devices))
+		for id := range h.devices {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		res := make([]*iotservice.Device, 0, len(ids))
+		for _, id := range ids {
+			res = append(res, h.devices[id].dev)
+		}
+		return res, nil
+	case len(path) == 2 && path[0] == "devices":
+		return h.serveDevice(r, path[1], ifMatch)
+	case len(path) == 2 && path[0] == "twins":
+		return h.serveTwin(r, path[1], ifMatch)
+	case len(path) == 3 && path[0] == "twins" && path[2] == "methods" && r.Method == http.MethodPost:
+		return h.serveMethod(r, path[1])
+	}
+	return nil, errorCode(http.StatusNotFound, "%s %s is not supported", r.Method, r.URL.Path)
+}
+
+func (h *Hub) serveDevice(r *http.Request, deviceID, ifMatch string) (interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		d := h.devices[deviceID]
+		if d == nil {
+			return nil, errorCode(http.StatusNotFound, "device %q not found", deviceID)
+		}
+		return d.dev, nil
+	case http.MethodPut:
+		var v iotservice.Device
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return nil, errorCode(http.StatusBadRequest, "malformed device: %s", err)
+		}
+		if v.DeviceID != deviceID {
+			return nil, errorCode(http.StatusBadRequest, "device id mismatch")
+		}
+		if h.devices[deviceID] != nil && ifMatch == "" {
+			return nil, errorCode(http.StatusConflict, "device %q already exists", deviceID)
+		}
+		d, err := h.putDevice(&v, ifMatch)
+		if err != nil {
+			return nil, err
+		}
+		return d.dev, nil
+	case http.MethodDelete:
+		d := h.devices[deviceID]
+		if d == nil {
+			return nil, errorCode(http.StatusNotFound, "device %q not found", deviceID)
+		}
+		if err := checkETag(ifMatch, d.dev.ETag); err != nil {
+			return nil, err
+		}
+		delete(h.devices, deviceID)
+		if s := h.sessions[deviceID]; s != nil {
+			s.conn.Close()
+		}
+		return nil, nil
+	}
+	return nil, errorCode(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+}
+
+func (h *Hub) serveTwin(r *http.Request, deviceID, ifMatch string) (interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d := h.devices[deviceID]
+	if d == nil {
+		return nil, errorCode(http.StatusNotFound, "device %q not found", deviceID)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return d.twin(), nil
+	case http.MethodPatch:
+		if err := checkETag(ifMatch, d.etag); err != nil {
+			return nil, err
+		}
+		var v iotservice.Twin
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return nil, errorCode(http.StatusBadRequest, "malformed twin: %s", err)
+		}
+		if v.Tags != nil {
+			mergePatch(d.tags, v.Tags)
+			d.touch(h)
+		}
+		if v.Properties != nil && v.Properties.Reported != nil {
+			return nil, errorCode(http.StatusBadRequest, "reported properties are read-only")
+		}
+		if v.Properties != nil && v.Properties.Desired != nil {
+			delete(v.Properties.Desired, "$version")
+			delete(v.Properties.Desired, "$metadata")
+			h.patchDesired(d, v.Properties.Desired)
+		}
+		return d.twin(), nil
+	case http.MethodPut:
+		if err := checkETag(ifMatch, d.etag); err != nil {
+			return nil, err
+		}
+		var v iotservice.Twin
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return nil, errorCode(http.StatusBadRequest, "malformed twin: %s", err)
+		}
+		if v.Properties != nil && v.Properties.Reported != nil {
+			return nil, errorCode(http.StatusBadRequest, "reported properties are read-only")
+		}
+		d.tags = map[string]interface{}{}
+		mergePatch(d.tags, v.Tags)
+		d.touch(h)
+
+		// devices receive the replacement as a patch that removes missing properties
+		patch := map[string]interface{}{}
+		if v.Properties != nil {
+			for k, p := range v.Properties.Desired {
+				if k != "$version" && k != "$metadata" {
+					patch[k] = p
+				}
+			}
+		}
+		for k := range d.desired {
+			if _, ok := patch[k]; !ok {
+				patch[k] = nil
+			}
+			delete(d.desired, k) // replace objects instead of merging them
+		}
+		h.patchDesired(d, patch)
+		return d.twin(), nil
+	}
+	return nil, errorCode(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+}
+
+func (h *Hub) serveMethod(r *http.Request, deviceID string) (interface{}, error) {
+	var v iotservice.MethodCall
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return nil, errorCode(http.StatusBadRequest, "malformed method call: %s", err)
+	}
+	if v.MethodName == "" {
+		return nil, errorCode(http.StatusBadRequest, "methodName is required")
+	}
+	timeout := 30 * time.Second
+	if v.ResponseTimeout != 0 {
+		timeout = time.Duration(v.ResponseTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	h.mu.Lock()
+	_, ok := h.devices[deviceID]
+	h.mu.Unlock()
+	if !ok {
+		return nil, errorCode(http.StatusNotFound, "device %q not found", deviceID)
+	}
+	status, payload, err := h.CallMethod(ctx, deviceID, v.MethodName, v.Payload)
+	switch {
+	case errors.Is(err, ErrDeviceNotOnline):
+		return nil, errorCode(http.StatusNotFound, "device %q is not online", deviceID)
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, errorCode(http.StatusGatewayTimeout, "timed out waiting for the response from device")
+	case err != nil:
+		return nil, err
+	}
+	return struct {
+		Status  int             `json:"status"`
+		Payload json.RawMessage `json:"payload"`
+	}{status, payload}, nil
+}
@@ -0,0 +1,70 @@
+package iotservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// AADScope is the Azure AD scope of IoT Hub service APIs.
+const AADScope = "https://iothubs.azure.net/.default"
+
+// AccessToken is an Azure AD access token.
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time
+}
+
+// TokenCredential obtains Azure AD access tokens for the given scope,
+// azidentity credentials can be adapted with a closure calling GetToken.
+type TokenCredential func(ctx context.Context, scope string) (*AccessToken, error)
+
+// WithTokenCredential makes the client authenticate with Azure AD
+// access tokens instead of shared access signatures, the identity
+// needs IoT Hub data plane roles assigned on the hub.
+//
+// Subscribing to events isn't possible since the event hub
+// endpoint requires a shared access policy key.
+func WithTokenCredential(cred TokenCredential) ClientOption {
+	return func(c *Client) {
+		c.cred = cred
+	}
+}
+
+// NewFromTokenCredential creates a client for the named hub,
+// e.g. hub.azure-devices.net, authenticated with Azure AD.
+func NewFromTokenCredential(
+	hostName string, cred TokenCredential, opts ...ClientOption,
+) (*Client, error) {
+	return New(&common.SharedAccessKey{HostName: hostName},
+		append(opts, WithTokenCredential(cred))...,
+	)
+}
+
+// bearerCache keeps an access token until it's about to expire.
+type bearerCache struct {
+	mu  sync.Mutex
+	tok *AccessToken
+}
+
+// aadTokenRenewSpan is how long before expiration tokens are renewed,
+// it exceeds putTokenContinuously's update span so CBS tokens are always fresh.
+const aadTokenRenewSpan = 15 * time.Minute
+
+func (b *bearerCache) token(ctx context.Context, cred TokenCredential) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tok == nil || time.Until(b.tok.ExpiresOn) < aadTokenRenewSpan {
+		tok, err := cred(ctx, AADScope)
+		if err != nil {
+			return "", err
+		}
+		if tok == nil || tok.Token == "" {
+			return "", errorf("token credential returned an empty token")
+		}
+		b.tok = tok
+	}
+	return b.tok.Token, nil
+}
@@ -5,16 +5,20 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/go-amqp"
@@ -33,6 +37,40 @@ func WithHTTPClient(client *http.Client) ClientOption {
 	}
 }
 
+// Default connection pool settings of the REST client, they're tuned
+// for making many concurrent registry requests to a single hub.
+const (
+	DefaultMaxIdleConnsPerHost = 16
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle REST connections
+// kept for reuse, default is DefaultMaxIdleConnsPerHost, zero means
+// net/http's default of 2. It's ignored when WithHTTPClient is used.
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(c *Client) {
+		c.maxIdleConns = n
+	}
+}
+
+// WithIdleConnTimeout sets how long idle REST connections are kept open,
+// zero means no limit, default is DefaultIdleConnTimeout.
+// It's ignored when WithHTTPClient is used.
+func WithIdleConnTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.idleConnTimeout = &d
+	}
+}
+
+// WithHTTP2 makes the REST client negotiate HTTP/2, so concurrent requests
+// are multiplexed over a single connection, HTTP/1.1 is used by default.
+// It's ignored when WithHTTPClient is used.
+func WithHTTP2(enable bool) ClientOption {
+	return func(c *Client) {
+		c.http2 = enable
+	}
+}
+
 // WithLogger sets client logger.
 func WithLogger(l logger.Logger) ClientOption {
 	return func(c *Client) {
@@ -47,8 +85,93 @@ func WithTLSConfig(config *tls.Config) ClientOption {
 	}
 }
 
+// WithRootCAs overrides root CA certificates used by REST HTTP and AMQP
+// clients, default is common.RootCAs, it's ignored when WithTLSConfig
+// or WithHTTPClient set the corresponding configuration.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *Client) {
+		c.rootCAs = pool
+	}
+}
+
+// WithSharedAccessSignature makes the client authenticate with the given
+// pre-generated token instead of signing tokens with the policy key, e.g.
+// SharedAccessSignature sr=hub.azure-devices.net&sig=...&se=...&skn=policy.
+//
+// Requests fail once the token expires and subscribing to events
+// isn't possible since the event hub endpoint requires the policy key.
+func WithSharedAccessSignature(sas string) ClientOption {
+	return func(c *Client) {
+		c.sasToken = sas
+	}
+}
+
+// WithWebSocket makes the client use AMQP over WebSockets on port 443
+// for both the hub and the event hub-compatible endpoint,
+// that is useful when port 5671 is blocked by a firewall.
+func WithWebSocket(enable bool) ClientOption {
+	return func(c *Client) {
+		c.ws = enable
+	}
+}
+
+// WithSendLinks sets the number of AMQP sender links SendEvent dispatches
+// messages over in round-robin, default is 1. More links help services
+// that send cloud-to-device messages to many devices concurrently,
+// each link is opened in its own session on first use.
+func WithSendLinks(n int) ClientOption {
+	return func(c *Client) {
+		c.sendPool = n
+	}
+}
+
+// WithSendRateLimit limits the rate of cloud-to-device messages sent
+// by SendEvent to msgsPerSecond with bursts of up to burst messages,
+// so the hub's throttling limits aren't exceeded.
+// Panics on non-positive values.
+func WithSendRateLimit(msgsPerSecond float64, burst int) ClientOption {
+	l := common.NewRateLimiter(msgsPerSecond, burst)
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
+// WithReconnectHandler sets a function that's called after the AMQP
+// connection is re-established, err is the error the lost connection
+// failed with. Connections are lost when the hub fails over to another
+// region, then the hostname is resolved again and the new connection
+// goes to the new region.
+func WithReconnectHandler(fn func(err error)) ClientOption {
+	return func(c *Client) {
+		c.onReconnect = fn
+	}
+}
+
+// WithTokenRenewalHandler sets a function that's called when renewing
+// the CBS token of the AMQP connection fails after all retries, then
+// the connection is closed so the next operation that needs it
+// reconnects and authenticates from scratch.
+func WithTokenRenewalHandler(fn func(err error)) ClientOption {
+	return func(c *Client) {
+		c.onRenewError = fn
+	}
+}
+
+// WithHeader sets a header that's sent with every REST request,
+// WithCallHeader overrides it for particular calls.
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		if c.headers == nil {
+			c.headers = http.Header{}
+		}
+		c.headers.Add(key, value)
+	}
+}
+
 const userAgent = "iothub-golang-sdk/dev"
 
+// ParseConnectionString parses a shared access policy connection string,
+// it fails when required keys are missing, unknown keys are ignored.
 func ParseConnectionString(cs string) (*common.SharedAccessKey, error) {
 	m, err := common.ParseConnectionString(
 		cs, "HostName", "SharedAccessKeyName", "SharedAccessKey",
@@ -61,7 +184,51 @@ func ParseConnectionString(cs string) (*common.SharedAccessKey, error) {
 	), nil
 }
 
+// ParseConnectionStringStrict is ParseConnectionString that
+// also fails when unknown or duplicated keys are present.
+func ParseConnectionStringStrict(cs string) (*common.SharedAccessKey, error) {
+	m, err := common.ParseConnectionStringStrict(
+		cs, []string{"HostName", "SharedAccessKeyName", "SharedAccessKey"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return common.NewSharedAccessKey(
+		m["HostName"], m["SharedAccessKeyName"], m["SharedAccessKey"],
+	), nil
+}
+
+// BuildConnectionString is the inverse of ParseConnectionString.
+func BuildConnectionString(sak *common.SharedAccessKey) (string, error) {
+	if sak.HostName == "" || sak.SharedAccessKeyName == "" || sak.SharedAccessKey == "" {
+		return "", errorf("host name, key name and key are required")
+	}
+	return common.BuildConnectionString(
+		"HostName", sak.HostName,
+		"SharedAccessKeyName", sak.SharedAccessKeyName,
+		"SharedAccessKey", sak.SharedAccessKey,
+	)
+}
+
+// NewFromConnectionString creates a client from the given connection string,
+// that either contains a policy key or a pre-generated shared access
+// signature, e.g. HostName=h;SharedAccessSignature=SharedAccessSignature sr=...
 func NewFromConnectionString(cs string, opts ...ClientOption) (*Client, error) {
+	m, err := common.ParseConnectionString(cs)
+	if err != nil {
+		return nil, err
+	}
+	if m["SharedAccessSignature"] != "" {
+		m, err = common.ParseConnectionString(cs, "HostName", "SharedAccessSignature")
+		if err != nil {
+			return nil, err
+		}
+		return New(&common.SharedAccessKey{
+			HostName:            m["HostName"],
+			SharedAccessKeyName: m["SharedAccessKeyName"],
+		}, append(opts, WithSharedAccessSignature(m["SharedAccessSignature"]))...)
+	}
+
 	sak, err := ParseConnectionString(cs)
 	if err != nil {
 		return nil, err
@@ -70,72 +237,202 @@ func NewFromConnectionString(cs string, opts ...ClientOption) (*Client, error) {
 }
 
 // New creates new iothub service client.
+//
+// sak can be nil when WithSharedAccessSignature is used,
+// then the host name is taken from the token's resource.
 func New(sak *common.SharedAccessKey, opts ...ClientOption) (*Client, error) {
 	c := &Client{
-		sak:    sak,
-		done:   make(chan struct{}),
-		logger: logger.NewFromString(os.Getenv("IOTHUB_SERVICE_LOG_LEVEL")),
+		sak:          sak,
+		done:         make(chan struct{}),
+		logger:       logger.NewFromString(os.Getenv("IOTHUB_SERVICE_LOG_LEVEL")),
+		sendPool:     1,
+		maxIdleConns: DefaultMaxIdleConnsPerHost,
+		renew:        defaultRenewPolicy,
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.sendPool < 1 {
+		return nil, errorf("number of send links must be positive")
+	}
+	if c.maxIdleConns < 0 {
+		return nil, errorf("number of idle connections is negative")
+	}
+	c.sendLinks = make([]sendLink, c.sendPool)
+	c.sendOpen = c.newSendLink
+	if c.sasToken != "" {
+		sas, err := common.ParseSharedAccessSignature(c.sasToken)
+		if err != nil {
+			return nil, err
+		}
+		c.sas = sas
+		if c.sak == nil {
+			c.sak = &common.SharedAccessKey{
+				HostName:            strings.SplitN(sas.Sr, "/", 2)[0],
+				SharedAccessKeyName: sas.Skn,
+			}
+		}
+	}
+	if c.sak == nil || c.sak.HostName == "" {
+		return nil, errorf("host name is required")
+	}
+	if c.sas == nil && c.cred == nil {
+		c.tokens = common.NewTokenCache(c.sak.Token, time.Hour)
+	}
+	if c.rootCAs == nil {
+		var err error
+		if c.rootCAs, err = common.LoadRootCAs(); err != nil {
+			return nil, errorf("root CAs: %w", err)
+		}
+	}
 	if c.tls == nil {
-		c.tls = &tls.Config{RootCAs: common.RootCAs()}
+		c.tls = &tls.Config{RootCAs: c.rootCAs}
 	}
 	if c.http == nil {
-		c.http = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					RootCAs: common.RootCAs(),
-				},
-			},
-		}
+		c.http = &http.Client{Transport: c.newHTTPTransport()}
 	}
 	return c, nil
 }
 
+// newHTTPTransport creates the default REST client transport.
+func (c *Client) newHTTPTransport() *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: c.rootCAs,
+		},
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        c.maxIdleConns,
+		MaxIdleConnsPerHost: c.maxIdleConns,
+		IdleConnTimeout:     DefaultIdleConnTimeout,
+		ForceAttemptHTTP2:   c.http2,
+	}
+	if c.idleConnTimeout != nil {
+		tr.IdleConnTimeout = *c.idleConnTimeout
+	}
+	return tr
+}
+
 // Client is IoT Hub service client.
 type Client struct {
 	mu     sync.Mutex
 	tls    *tls.Config
-	conn   *amqp.Conn
+	ws     bool
+	conn   amqpConn
+	stop   chan struct{} // closed when conn is replaced, dropped or closed
+	renew  renewPolicy
 	done   chan struct{}
 	sak    *common.SharedAccessKey
 	logger logger.Logger
 	http   *http.Client // REST client
 
-	sendMu   sync.Mutex
-	sendSess *amqp.Session
-	sendLink *amqp.Sender
+	rootCAs  *x509.CertPool                // WithRootCAs
+	sasToken string                        // WithSharedAccessSignature
+	sas      *common.SharedAccessSignature // parsed sasToken
+	tokens   *common.TokenCache            // policy key tokens
+	cred     TokenCredential               // WithTokenCredential
+	bearer   bearerCache                   // cached cred tokens
+
+	sendMu    sync.Mutex
+	sendPool  int                                         // WithSendLinks
+	sendLinks []sendLink                                  // opened lazily
+	sendNext  uint32                                      // next link index, atomic
+	sendOpen  func(ctx context.Context) (sendLink, error) // newSendLink, replaced in tests
+
+	limiter *common.RateLimiter // WithSendRateLimit
+
+	onReconnect  func(err error) // WithReconnectHandler
+	onRenewError func(err error) // WithTokenRenewalHandler
+
+	headers http.Header // WithHeader
+
+	maxIdleConns    int            // WithMaxIdleConnsPerHost
+	idleConnTimeout *time.Duration // WithIdleConnTimeout
+	http2           bool           // WithHTTP2
 
 	// TODO: figure out if it makes sense to cache feedback and file notification receivers
 }
 
+// amqpConn is an AMQP connection, it's always *amqp.Conn but tests.
+type amqpConn interface {
+	NewSession(ctx context.Context, opts *amqp.SessionOptions) (*amqp.Session, error)
+	Close() error
+}
+
+func (c *Client) dial(ctx context.Context) (*amqp.Conn, error) {
+	opts := &amqp.ConnOptions{
+		TLSConfig:  c.tls,
+		Properties: map[string]any{"com.microsoft:client-version": userAgent},
+	}
+	if !c.ws {
+		return amqp.Dial(ctx, "amqps://"+c.sak.HostName, opts)
+	}
+
+	tlsCfg := c.tls.Clone()
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = c.sak.HostName
+	}
+	nc, err := common.DialAMQPWebSocket(ctx,
+		"wss://"+c.sak.HostName+":443/$iothub/websocket", tlsCfg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts.TLSConfig = nil // TLS is terminated by the websocket connection
+	opts.HostName = c.sak.HostName
+	conn, err := amqp.NewConn(ctx, nc, opts)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ErrClosed is returned when the client is used after it's closed.
+var ErrClosed = errors.New("iotservice: client is closed")
+
 // newSession connects to IoT Hub's AMQP broker,
 // it's needed for sending C2S events and subscribing to events feedback.
 //
-// It establishes connection only once, subsequent calls return immediately.
+// It establishes connection only once, subsequent calls return immediately
+// unless the connection is lost, e.g. due to a failover, then it
+// reconnects and the new connection is authenticated from scratch.
 func (c *Client) newSession(ctx context.Context) (*amqp.Session, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	var lost error
 	if c.conn != nil {
-		return c.conn.NewSession(ctx, nil) // already connected
+		sess, err := c.conn.NewSession(ctx, nil) // already connected
+		if err == nil || !isConnLost(err) {
+			return sess, err
+		}
+		c.logger.Warnf("connection lost, reconnecting: %s", err)
+		c.closeConn()
+		lost = err
 	}
-	conn, err := amqp.Dial(ctx, "amqps://"+c.sak.HostName, &amqp.ConnOptions{
-		TLSConfig:  c.tls,
-		Properties: map[string]any{"com.microsoft:client-version": userAgent},
-	})
+	conn, err := c.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
+	stop := make(chan struct{})
 	defer func() {
 		if err != nil {
+			close(stop)
 			_ = conn.Close()
 		}
 	}()
 
 	c.logger.Debugf("connected to %s", c.sak.HostName)
-	if err = c.putTokenContinuously(ctx, conn); err != nil {
+	if err = c.putTokenContinuously(ctx, conn, stop); err != nil {
 		return nil, err
 	}
 
@@ -143,56 +440,206 @@ func (c *Client) newSession(ctx context.Context) (*amqp.Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn
+	c.conn, c.stop = conn, stop
+	if lost != nil && c.onReconnect != nil {
+		go c.onReconnect(lost)
+	}
 	return sess, nil
 }
 
-// putTokenContinuously writes token first time in blocking mode and returns
-// maintaining token updates in the background until the client is closed.
-func (c *Client) putTokenContinuously(ctx context.Context, conn *amqp.Conn) error {
-	const (
-		tokenUpdateInterval = time.Hour
-
-		// we need to update tokens before they expire to prevent disconnects
-		// from azure, without interrupting the message flow
-		tokenUpdateSpan = 10 * time.Minute
+// isConnLost reports whether err is caused by the connection,
+// the session or the link being closed either by the hub or
+// due to a network failure, so they have to be re-established.
+func isConnLost(err error) bool {
+	var (
+		connErr *amqp.ConnError
+		sessErr *amqp.SessionError
+		linkErr *amqp.LinkError
 	)
+	return errors.As(err, &connErr) || errors.As(err, &sessErr) || errors.As(err, &linkErr)
+}
+
+// token returns the pre-generated signature when it's provided
+// or a cached one-hour token signed with the policy key otherwise.
+func (c *Client) token() (*common.SharedAccessSignature, error) {
+	if c.sas == nil {
+		return c.tokens.Token(c.sak.HostName)
+	}
+	if time.Now().After(c.sas.Se) {
+		return nil, errorf("shared access signature expired at %s", c.sas.Se)
+	}
+	return c.sas, nil
+}
 
+// authorization returns the Authorization header value,
+// that is also the CBS token, either an Azure AD bearer
+// token or a shared access signature.
+func (c *Client) authorization(ctx context.Context) (string, error) {
+	if c.cred != nil {
+		tok, err := c.bearer.token(ctx, c.cred)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + tok, nil
+	}
+	sas, err := c.token()
+	if err != nil {
+		return "", err
+	}
+	return sas.String(), nil
+}
+
+// cbsToken returns the CBS put-token value and its type,
+// Azure AD access tokens are sent as is with the jwt type
+// unlike the Authorization header that carries bearer tokens.
+func (c *Client) cbsToken(ctx context.Context) (string, string, error) {
+	if c.cred != nil {
+		tok, err := c.bearer.token(ctx, c.cred)
+		if err != nil {
+			return "", "", err
+		}
+		return tok, "jwt", nil
+	}
+	sas, err := c.token()
+	if err != nil {
+		return "", "", err
+	}
+	return sas.String(), "servicebus.windows.net:sastoken", nil
+}
+
+// closeConn closes the current connection and stops its token renewal,
+// it has to be called with mu held.
+func (c *Client) closeConn() {
+	if c.conn == nil {
+		return
+	}
+	close(c.stop)
+	_ = c.conn.Close()
+	c.conn, c.stop = nil, nil
+}
+
+// putTokenContinuously writes token first time in blocking mode and returns
+// maintaining token updates in the background until stop is closed.
+func (c *Client) putTokenContinuously(
+	ctx context.Context, conn amqpConn, stop <-chan struct{},
+) error {
 	sess, err := conn.NewSession(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	if err := c.putToken(ctx, sess, tokenUpdateInterval); err != nil {
+	if err := c.putToken(ctx, sess); err != nil {
 		_ = sess.Close(context.Background())
 		return err
 	}
 
 	go func() {
-		defer sess.Close(context.Background())
-		ticker := time.NewTimer(tokenUpdateInterval - tokenUpdateSpan)
-		defer ticker.Stop()
+		defer func() {
+			if sess != nil {
+				_ = sess.Close(context.Background())
+			}
+		}()
+		c.renewTokens(conn, stop, func() error {
+			return c.renewToken(conn, &sess)
+		})
+	}()
+	return nil
+}
 
-		for {
-			select {
-			case <-ticker.C:
-				if err := c.putToken(context.Background(), sess, tokenUpdateInterval); err != nil {
-					c.logger.Errorf("put token error: %s", err)
-					return
+// renewPolicy is how often tokens are renewed and how failed renewals are retried.
+type renewPolicy struct {
+	interval   time.Duration
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// defaultRenewPolicy renews tokens ten minutes before they expire
+// to prevent disconnects without interrupting the message flow,
+// so retries have to fit into that window.
+var defaultRenewPolicy = renewPolicy{
+	interval:   time.Hour - 10*time.Minute,
+	attempts:   5,
+	backoff:    5 * time.Second,
+	maxBackoff: time.Minute,
+}
+
+// renewTimeout limits a single token renewal attempt.
+const renewTimeout = time.Minute
+
+// renewTokens calls renew according to the client's renewal policy until
+// stop is closed, conn is dropped when all attempts of a renewal fail.
+func (c *Client) renewTokens(conn amqpConn, stop <-chan struct{}, renew func() error) {
+	ticker := time.NewTimer(c.renew.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := common.Retry(
+			stop, c.renew.attempts, c.renew.backoff, c.renew.maxBackoff,
+			func(attempt int) error {
+				err := renew()
+				if err != nil {
+					c.logger.Warnf("put token attempt %d failed: %s", attempt, err)
 				}
-				ticker.Reset(tokenUpdateInterval - tokenUpdateSpan)
-				c.logger.Debugf("token updated")
-			case <-c.done:
-				return
+				return err
+			},
+		); err != nil {
+			select {
+			case <-stop:
+			default:
+				c.logger.Errorf("put token error: %s", err)
+				c.dropConn(conn, err)
 			}
+			return
 		}
-	}()
-	return nil
+		ticker.Reset(c.renew.interval)
+		c.logger.Debugf("token updated")
+	}
 }
 
-func (c *Client) putToken(
-	ctx context.Context, sess *amqp.Session, lifetime time.Duration,
-) error {
+// renewToken makes a single attempt to put a new token, the CBS
+// session is re-opened when it's lost along with its links.
+func (c *Client) renewToken(conn amqpConn, sess **amqp.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+	defer cancel()
+	if *sess == nil {
+		s, err := conn.NewSession(ctx, nil)
+		if err != nil {
+			return err
+		}
+		*sess = s
+	}
+	err := c.putToken(ctx, *sess)
+	if err != nil && isConnLost(err) {
+		_ = (*sess).Close(context.Background())
+		*sess = nil
+	}
+	return err
+}
+
+// dropConn closes conn when token renewal ultimately fails with err
+// unless it's been already replaced, so the next newSession call
+// reconnects, and reports the failure to the renewal handler.
+func (c *Client) dropConn(conn amqpConn, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	c.closeConn()
+	c.mu.Unlock()
+
+	c.resetSendLinks()
+	if c.onRenewError != nil {
+		c.onRenewError(err)
+	}
+}
+
+func (c *Client) putToken(ctx context.Context, sess *amqp.Session) error {
 	send, err := sess.NewSender(ctx, "$cbs", nil)
 	if err != nil {
 		return err
@@ -205,7 +652,7 @@ func (c *Client) putToken(
 	}
 	defer recv.Close(context.Background())
 
-	sas, err := c.sak.Token(c.sak.HostName, lifetime)
+	auth, typ, err := c.cbsToken(ctx)
 	if err != nil {
 		return err
 	}
@@ -213,14 +660,14 @@ func (c *Client) putToken(
 	to := "$cbs"
 	replyTo := "cbs"
 	if err = send.Send(ctx, &amqp.Message{
-		Value: sas.String(),
+		Value: auth,
 		Properties: &amqp.MessageProperties{
 			To:      &to,
 			ReplyTo: &replyTo,
 		},
 		ApplicationProperties: map[string]interface{}{
 			"operation": "put-token",
-			"type":      "servicebus.windows.net:sastoken",
+			"type":      typ,
 			"name":      c.sak.HostName,
 		},
 	}, &amqp.SendOptions{}); err != nil {
@@ -241,6 +688,9 @@ func (c *Client) putToken(
 // for receiving D2C events, it uses different endpoints and authentication
 // mechanisms than newSession.
 func (c *Client) connectToEventHub(ctx context.Context) (*eventhub.Client, error) {
+	if c.sak.SharedAccessKey == "" {
+		return nil, errorf("subscribing to events requires a shared access key")
+	}
 	sess, err := c.newSession(ctx)
 	if err != nil {
 		return nil, err
@@ -273,6 +723,7 @@ func (c *Client) connectToEventHub(ctx context.Context) (*eventhub.Client, error
 		eventhub.WithTLSConfig(tlsCfg),
 		eventhub.WithSASLPlain(c.sak.SharedAccessKeyName, c.sak.SharedAccessKey),
 		eventhub.WithConnOption("com.microsoft:client-version", userAgent),
+		eventhub.WithWebSocket(c.ws),
 	)
 	if err != nil {
 		return nil, err
@@ -289,10 +740,72 @@ type Event struct {
 	*common.Message
 }
 
+// SubscribeEventsOption is a SubscribeEvents option.
+type SubscribeEventsOption func(o *subscribeEventsOptions)
+
+type subscribeEventsOptions struct {
+	start      eventhub.SubscribeOption
+	group      string
+	partitions []string
+}
+
+// WithSubscribeEventsSince requests events enqueued after the given time,
+// that's the default behaviour with the current time.
+func WithSubscribeEventsSince(t time.Time) SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.start = eventhub.WithSubscribeSince(t)
+	}
+}
+
+// WithSubscribeEventsEarliest requests all events retained by the hub,
+// so previously received telemetry can be replayed.
+func WithSubscribeEventsEarliest() SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.start = eventhub.WithSubscribeEarliest()
+	}
+}
+
+// WithSubscribeEventsLatest requests only events enqueued after subscribing.
+func WithSubscribeEventsLatest() SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.start = eventhub.WithSubscribeLatest()
+	}
+}
+
+// WithSubscribeEventsOffset requests events enqueued after the given offset,
+// offsets are partition specific so it's meant to be used along with
+// WithSubscribeEventsPartitions.
+func WithSubscribeEventsOffset(offset string) SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.start = eventhub.WithSubscribeOffset(offset, false)
+	}
+}
+
+// WithSubscribeEventsPartitions limits the subscription to the named partitions.
+func WithSubscribeEventsPartitions(ids ...string) SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.partitions = ids
+	}
+}
+
+// WithSubscribeEventsConsumerGroup overrides default consumer group, default is `$Default`.
+func WithSubscribeEventsConsumerGroup(name string) SubscribeEventsOption {
+	return func(o *subscribeEventsOptions) {
+		o.group = name
+	}
+}
+
 // SubscribeEvents subscribes to D2C events.
 //
 // Event handler is blocking, handle asynchronous processing on your own.
-func (c *Client) SubscribeEvents(ctx context.Context, fn EventHandler) error {
+func (c *Client) SubscribeEvents(
+	ctx context.Context, fn EventHandler, opts ...SubscribeEventsOption,
+) error {
+	o := subscribeEventsOptions{start: eventhub.WithSubscribeSince(time.Now())}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// a new connection is established for every invocation,
 	// this made on purpose because normally an app calls the method once
 	eh, err := c.connectToEventHub(ctx)
@@ -304,7 +817,9 @@ func (c *Client) SubscribeEvents(ctx context.Context, fn EventHandler) error {
 	return eh.Subscribe(ctx, func(msg *eventhub.Event) error {
 		return fn(&Event{FromAMQPMessage(msg.Message)})
 	},
-		eventhub.WithSubscribeSince(time.Now()),
+		o.start,
+		eventhub.WithSubscribeConsumerGroup(o.group),
+		eventhub.WithSubscribePartitions(o.partitions...),
 	)
 }
 
@@ -397,6 +912,10 @@ func WithSendProperties(m map[string]string) SendOption {
 
 // SendEvent sends the given cloud-to-device message and returns its id.
 // Panics when event is nil.
+//
+// Transient failures, such as server busy and throttling errors or lost
+// connections, are retried with exponential backoff until the attempts
+// are exhausted or ctx is done, whichever happens first.
 func (c *Client) SendEvent(
 	ctx context.Context,
 	deviceID string,
@@ -415,7 +934,52 @@ func (c *Client) SendEvent(
 			return err
 		}
 	}
+	if err := msg.Validate(common.MaxC2DMessageSize); err != nil {
+		return err
+	}
 
+	// transient errors such as server busy errors or links lost along with
+	// the connection, e.g. after a failover, are retried with backoff, that
+	// means a message may be delivered twice when the link is lost after
+	// the hub received it
+	backoff := sendBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.send(ctx, msg)
+		if err == nil || attempt == sendAttempts || !isTransient(err) {
+			return err
+		}
+		c.logger.Warnf("send attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+		if isConnLost(err) {
+			c.resetSendLinks()
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > sendMaxBackoff {
+			backoff = sendMaxBackoff
+		}
+	}
+}
+
+// SendEvent retry parameters.
+const (
+	sendAttempts   = 5
+	sendBackoff    = 100 * time.Millisecond
+	sendMaxBackoff = 2 * time.Second
+)
+
+// send makes a single attempt to send the message.
+func (c *Client) send(ctx context.Context, msg *common.Message) error {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
 	send, err := c.getSendLink(ctx)
 	if err != nil {
 		return err
@@ -423,13 +987,103 @@ func (c *Client) SendEvent(
 	return send.Send(ctx, toAMQPMessage(msg), &amqp.SendOptions{})
 }
 
-// getSendLink caches sender link between calls to speed up sending events.
-func (c *Client) getSendLink(ctx context.Context) (*amqp.Sender, error) {
+// transientConditions are AMQP error conditions
+// the hub returns when it's busy or throttles requests.
+var transientConditions = map[amqp.ErrCond]bool{
+	amqp.ErrCondDetachForced:                   true,
+	amqp.ErrCondResourceLimitExceeded:          true,
+	"com.microsoft:server-busy":                true,
+	"com.microsoft:timeout":                    true,
+	"com.microsoft:device-container-throttled": true,
+}
+
+// isTransient reports whether the operation failed with err can be retried.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return transientConditions[amqpErr.Condition]
+	}
+	var linkErr *amqp.LinkError
+	if errors.As(err, &linkErr) && linkErr.RemoteErr != nil {
+		return transientConditions[linkErr.RemoteErr.Condition]
+	}
+	return isConnLost(err)
+}
+
+// resetSendLinks closes cached sender links along with
+// their sessions so they're re-established on the next send.
+func (c *Client) resetSendLinks() {
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
-	if c.sendLink != nil {
-		return c.sendLink, nil
+	for i, link := range c.sendLinks {
+		if link != nil {
+			go link.Close(context.Background())
+			c.sendLinks[i] = nil
+		}
 	}
+}
+
+// SendEventReader sends a cloud-to-device message with the payload
+// of size bytes read from r, see SendEvent. The payload is buffered
+// in memory as a whole, sizes over the hub limit are rejected
+// before anything is read.
+func (c *Client) SendEventReader(
+	ctx context.Context,
+	deviceID string,
+	r io.Reader,
+	size int64,
+	opts ...SendOption,
+) error {
+	b, err := common.ReadPayload(r, size, common.MaxC2DMessageSize)
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, deviceID, b, opts...)
+}
+
+// sendLink is a cloud-to-device sender link of the pool.
+type sendLink interface {
+	Send(ctx context.Context, msg *amqp.Message, opts *amqp.SendOptions) error
+	Close(ctx context.Context) error
+}
+
+// sessionSender is a sender link that owns its session,
+// closing it closes the session too.
+type sessionSender struct {
+	*amqp.Sender
+	sess *amqp.Session
+}
+
+func (s *sessionSender) Close(ctx context.Context) error {
+	err := s.Sender.Close(ctx)
+	if serr := s.sess.Close(ctx); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// getSendLink picks the next sender link from the pool in round-robin,
+// links are cached between calls to speed up sending events.
+func (c *Client) getSendLink(ctx context.Context) (sendLink, error) {
+	i := int((atomic.AddUint32(&c.sendNext, 1) - 1) % uint32(len(c.sendLinks)))
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendLinks[i] != nil {
+		return c.sendLinks[i], nil
+	}
+	link, err := c.sendOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.sendLinks[i] = link
+	return link, nil
+}
+
+// newSendLink opens a sender link on a new session.
+func (c *Client) newSendLink(ctx context.Context) (sendLink, error) {
 	sess, err := c.newSession(ctx)
 	if err != nil {
 		return nil, err
@@ -444,17 +1098,37 @@ func (c *Client) getSendLink(ctx context.Context) (*amqp.Sender, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	c.sendSess = sess
-	c.sendLink = link
-	return c.sendLink, nil
+	return &sessionSender{Sender: link, sess: sess}, nil
 }
 
 // FeedbackHandler handles message feedback.
 type FeedbackHandler func(f *Feedback) error
 
-// SubscribeFeedback subscribes to feedback of messages that ack was requested.
+// SubscribeFeedback subscribes to feedback of messages that ack was requested,
+// see SubscribeFeedbackBatches for delivery and ordering guarantees.
 func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackHandler) error {
+	return c.SubscribeFeedbackBatches(ctx, func(b *FeedbackBatch) error {
+		for _, f := range b.Records {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FeedbackBatchHandler handles batches of message feedback.
+type FeedbackBatchHandler func(b *FeedbackBatch) error
+
+// SubscribeFeedbackBatches subscribes to feedback batches the hub delivers.
+//
+// Batches are delivered one at a time in the order the hub enqueues them,
+// records within a batch follow the hub's order, there's no ordering
+// guarantee relative to the order messages were sent in. A batch is
+// completed once fn returns nil, when it returns an error the subscription
+// ends and the batch is redelivered to the next subscriber, so records
+// may be delivered more than once.
+func (c *Client) SubscribeFeedbackBatches(ctx context.Context, fn FeedbackBatchHandler) error {
 	sess, err := c.newSession(ctx)
 	if err != nil {
 		return err
@@ -477,15 +1151,13 @@ func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackHandler) erro
 			continue
 		}
 
-		var v []*Feedback
 		c.logger.Debugf("feedback received: %s", msg.GetData())
-		if err = json.Unmarshal(msg.GetData(), &v); err != nil {
+		b, err := parseFeedbackBatch(msg)
+		if err != nil {
 			return err
 		}
-		for _, f := range v {
-			if err := fn(f); err != nil {
-				return err
-			}
+		if err = fn(b); err != nil {
+			return err
 		}
 		if err = recv.AcceptMessage(ctx, msg); err != nil {
 			return err
@@ -493,14 +1165,58 @@ func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackHandler) erro
 	}
 }
 
+// FeedbackBatch is a batch of feedback records delivered in a single message.
+type FeedbackBatch struct {
+	EnqueuedTime time.Time // when the hub enqueued the batch
+	UserID       string    // the hub name
+	LockToken    string    // hex-encoded delivery tag
+	Records      []*Feedback
+}
+
+// parseFeedbackBatch decodes a feedback message.
+func parseFeedbackBatch(msg *amqp.Message) (*FeedbackBatch, error) {
+	b := &FeedbackBatch{LockToken: hex.EncodeToString(msg.DeliveryTag)}
+	if t, ok := msg.Annotations["iothub-enqueuedtime"].(time.Time); ok {
+		b.EnqueuedTime = t
+	}
+	if msg.Properties != nil {
+		b.UserID = string(msg.Properties.UserID)
+	}
+	if err := json.Unmarshal(msg.GetData(), &b.Records); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// FeedbackStatus is a cloud-to-device message outcome.
+type FeedbackStatus string
+
+const (
+	// FeedbackSuccess means the device completed the message.
+	FeedbackSuccess FeedbackStatus = "Success"
+
+	// FeedbackExpired means the message expired before the device received it.
+	FeedbackExpired FeedbackStatus = "Expired"
+
+	// FeedbackDeliveryCountExceeded means the device abandoned
+	// the message more times than the hub's max delivery count.
+	FeedbackDeliveryCountExceeded FeedbackStatus = "DeliveryCountExceeded"
+
+	// FeedbackRejected means the device rejected the message.
+	FeedbackRejected FeedbackStatus = "Rejected"
+
+	// FeedbackPurged means the message was purged from the device queue.
+	FeedbackPurged FeedbackStatus = "Purged"
+)
+
 // Feedback is message feedback.
 type Feedback struct {
-	OriginalMessageID  string    `json:"originalMessageId"`
-	Description        string    `json:"description"`
-	DeviceGenerationID string    `json:"deviceGenerationId"`
-	DeviceID           string    `json:"deviceId"`
-	EnqueuedTimeUTC    time.Time `json:"enqueuedTimeUtc"`
-	StatusCode         string    `json:"statusCode"`
+	OriginalMessageID  string         `json:"originalMessageId"`
+	Description        string         `json:"description"`
+	DeviceGenerationID string         `json:"deviceGenerationId"`
+	DeviceID           string         `json:"deviceId"`
+	EnqueuedTimeUTC    time.Time      `json:"enqueuedTimeUtc"`
+	StatusCode         FeedbackStatus `json:"statusCode"`
 }
 
 // FileNotification is emitted once a blob file is uploaded to the hub.
@@ -708,6 +1424,10 @@ func (c *Client) CreateDevice(ctx context.Context, device *Device) (*Device, err
 	return &res, nil
 }
 
+// MaxBulkDevices is the maximum number of devices
+// a single bulk registry operation can contain.
+const MaxBulkDevices = 100
+
 // CreateDevices creates array of devices in bulk mode.
 func (c *Client) CreateDevices(
 	ctx context.Context, devices []*Device,
@@ -843,18 +1563,124 @@ func (c *Client) DeleteDevice(ctx context.Context, device *Device) error {
 // ListDevices lists all registered devices.
 func (c *Client) ListDevices(ctx context.Context) ([]*Device, error) {
 	var res []*Device
+	if err := c.RangeDevices(ctx, func(d *Device) error {
+		res = append(res, d)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RangeDevices calls fn for every device in the registry as soon as
+// it's decoded from the response, so large registries don't have to
+// be held in memory. Iteration stops when fn returns an error.
+func (c *Client) RangeDevices(ctx context.Context, fn func(d *Device) error) error {
+	return c.rangeList(ctx, "devices", func(d *json.Decoder) error {
+		var v Device
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		return fn(&v)
+	})
+}
+
+// SetParent makes the IoT Edge device parentID the parent of the named device,
+// leaf devices get the parent's device scope and edge devices its parent scope.
+func (c *Client) SetParent(ctx context.Context, deviceID, parentID string) (*Device, error) {
+	parent, err := c.GetDevice(ctx, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.IsEdge() || parent.DeviceScope == "" {
+		return nil, errorf("%q is not an IoT Edge device", parentID)
+	}
+	device, err := c.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !device.IsEdge() {
+		device.DeviceScope = parent.DeviceScope
+	}
+	device.ParentScopes = []string{parent.DeviceScope}
+	return c.UpdateDevice(ctx, device)
+}
+
+// RemoveParent detaches the named device from its parent edge device.
+func (c *Client) RemoveParent(ctx context.Context, deviceID string) (*Device, error) {
+	device, err := c.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !device.IsEdge() {
+		device.DeviceScope = ""
+	}
+	device.ParentScopes = nil
+
+	// empty scopes are omitted from devices, but they have to be
+	// sent explicitly, otherwise the hub keeps the current ones
+	var res Device
 	if _, err := c.call(
 		ctx,
-		http.MethodGet,
-		"devices",
-		nil,
-		nil,
+		http.MethodPut,
+		pathf("devices/%s", device.DeviceID),
 		nil,
+		ifMatchHeader(device.ETag),
+		&struct {
+			*Device
+			DeviceScope  string   `json:"deviceScope"`
+			ParentScopes []string `json:"parentScopes"`
+		}{device, device.DeviceScope, []string{}},
 		&res,
 	); err != nil {
 		return nil, err
 	}
-	return res, nil
+	return &res, nil
+}
+
+// ListChildren lists ids of devices whose parent is the named edge device.
+func (c *Client) ListChildren(ctx context.Context, parentID string) ([]string, error) {
+	parent, err := c.GetDevice(ctx, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.IsEdge() || parent.DeviceScope == "" {
+		return nil, errorf("%q is not an IoT Edge device", parentID)
+	}
+	var ids []string
+	if err = c.QueryDevices(ctx, fmt.Sprintf(
+		"SELECT * FROM devices WHERE deviceScope = '%s' OR capabilities.iotEdge = true",
+		parent.DeviceScope,
+	), func(v map[string]interface{}) error {
+		if id, ok := childOf(v, parentID, parent.DeviceScope); ok {
+			ids = append(ids, id)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// childOf reports whether the queried device is a child of
+// the parent with the given scope and returns its id.
+func childOf(v map[string]interface{}, parentID, scope string) (string, bool) {
+	id, _ := v["deviceId"].(string)
+	if id == "" || id == parentID {
+		return "", false
+	}
+	scopes, _ := v["parentScopes"].([]interface{})
+	for _, s := range scopes {
+		if s == scope {
+			return id, true
+		}
+	}
+	// leaf devices may be returned without parent scopes
+	caps, _ := v["capabilities"].(map[string]interface{})
+	if edge, _ := caps["iotEdge"].(bool); !edge {
+		return id, v["deviceScope"] == scope
+	}
+	return "", false
 }
 
 // ListModules list all the registered modules on the named device.
@@ -874,6 +1700,47 @@ func (c *Client) ListModules(ctx context.Context, deviceID string) ([]*Module, e
 	return res, nil
 }
 
+// ListAllModules lists twins of all modules in the registry across all
+// devices with the devices.modules query, so module deployments can be
+// audited without listing modules of every device one by one.
+func (c *Client) ListAllModules(ctx context.Context) ([]*ModuleTwin, error) {
+	var res []*ModuleTwin
+	if err := c.RangeAllModules(ctx, func(t *ModuleTwin) error {
+		res = append(res, t)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RangeAllModules calls fn for every module twin in the registry page by page,
+// so large registries don't have to be held in memory. Iteration stops
+// when fn returns an error.
+func (c *Client) RangeAllModules(ctx context.Context, fn func(t *ModuleTwin) error) error {
+	var res []*ModuleTwin
+	return c.query(
+		ctx,
+		http.MethodPost,
+		"devices/query",
+		nil,
+		map[string]string{
+			"Query": "SELECT * FROM devices.modules",
+		},
+		&res,
+		func() error {
+			for _, t := range res {
+				if err := fn(t); err != nil {
+					return err
+				}
+			}
+			// the decoder reuses pointers of the slice elements
+			res = nil
+			return nil
+		},
+	)
+}
+
 // CreateModule adds the given module to the registry.
 func (c *Client) CreateModule(ctx context.Context, module *Module) (*Module, error) {
 	var res Module
@@ -976,7 +1843,8 @@ func (c *Client) GetModuleTwin(ctx context.Context, deviceID, moduleID string) (
 	return &res, nil
 }
 
-// UpdateDeviceTwin updates the named twin desired properties.
+// UpdateDeviceTwin updates the named twin tags and desired properties,
+// read-only fields are not sent, see Twin.Patch.
 func (c *Client) UpdateDeviceTwin(ctx context.Context, twin *Twin) (*Twin, error) {
 	var res Twin
 	if _, err := c.call(
@@ -985,7 +1853,7 @@ func (c *Client) UpdateDeviceTwin(ctx context.Context, twin *Twin) (*Twin, error
 		pathf("twins/%s", twin.DeviceID),
 		nil,
 		ifMatchHeader(twin.ETag),
-		twin,
+		twin.Patch(),
 		&res,
 	); err != nil {
 		return nil, err
@@ -1004,7 +1872,45 @@ func (c *Client) UpdateModuleTwin(ctx context.Context, twin *ModuleTwin) (
 		pathf("twins/%s/modules/%s", twin.DeviceID, twin.ModuleID),
 		nil,
 		ifMatchHeader(twin.ETag),
-		twin,
+		twin.Patch(),
+		&res,
+	); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ReplaceDeviceTwin replaces the named twin tags and desired properties
+// as a whole, unlike UpdateDeviceTwin that merges them in, so properties
+// missing in the given twin are removed. Read-only fields are not sent.
+func (c *Client) ReplaceDeviceTwin(ctx context.Context, twin *Twin) (*Twin, error) {
+	var res Twin
+	if _, err := c.call(
+		ctx,
+		http.MethodPut,
+		pathf("twins/%s", twin.DeviceID),
+		nil,
+		ifMatchHeader(twin.ETag),
+		twin.Patch(),
+		&res,
+	); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ReplaceModuleTwin is ReplaceDeviceTwin for module twins.
+func (c *Client) ReplaceModuleTwin(ctx context.Context, twin *ModuleTwin) (
+	*ModuleTwin, error,
+) {
+	var res ModuleTwin
+	if _, err := c.call(
+		ctx,
+		http.MethodPut,
+		pathf("twins/%s/modules/%s", twin.DeviceID, twin.ModuleID),
+		nil,
+		ifMatchHeader(twin.ETag),
+		twin.Patch(),
 		&res,
 	); err != nil {
 		return nil, err
@@ -1115,20 +2021,28 @@ func (c *Client) callDigitalTwin(ctx context.Context,
 // ListConfigurations gets all available configurations from the registry.
 func (c *Client) ListConfigurations(ctx context.Context) ([]*Configuration, error) {
 	var res []*Configuration
-	if _, err := c.call(
-		ctx,
-		http.MethodGet,
-		"configurations",
-		nil,
-		nil,
-		nil,
-		&res,
-	); err != nil {
+	if err := c.RangeConfigurations(ctx, func(config *Configuration) error {
+		res = append(res, config)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
+// RangeConfigurations is RangeDevices for configurations.
+func (c *Client) RangeConfigurations(
+	ctx context.Context, fn func(config *Configuration) error,
+) error {
+	return c.rangeList(ctx, "configurations", func(d *json.Decoder) error {
+		var v Configuration
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		return fn(&v)
+	})
+}
+
 // CreateConfiguration adds the given configuration to the registry.
 func (c *Client) CreateConfiguration(ctx context.Context, config *Configuration) (
 	*Configuration, error,
@@ -1241,6 +2155,38 @@ func (c *Client) QueryDevices(
 	)
 }
 
+// QueryDevicesPage executes the query and returns a single page of results
+// of at most pageSize items, zero means the hub's default page size.
+//
+// next is the continuation token for requesting the following page,
+// it's empty when there are no more results.
+func (c *Client) QueryDevicesPage(
+	ctx context.Context, query string, pageSize int, continuation string,
+) (items []map[string]interface{}, next string, err error) {
+	h := http.Header{}
+	if pageSize != 0 {
+		h.Set("x-ms-max-item-count", strconv.Itoa(pageSize))
+	}
+	if continuation != "" {
+		h.Set("x-ms-continuation", continuation)
+	}
+	header, err := c.call(
+		ctx,
+		http.MethodPost,
+		"devices/query",
+		nil,
+		h,
+		map[string]string{
+			"Query": query,
+		},
+		&items,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return items, header.Get("x-ms-continuation"), nil
+}
+
 func (c *Client) query(
 	ctx context.Context,
 	method string,
@@ -1467,6 +2413,71 @@ func (c *Client) call(
 	headers http.Header,
 	r, v interface{}, // request and response objects
 ) (http.Header, error) {
+	res, err := c.do(ctx, method, path, vals, headers, r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return res.Header, nil
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return res.Header, json.Unmarshal(body, v)
+}
+
+// rangeList requests the JSON array at path and calls
+// next to decode every element of it from the response body.
+func (c *Client) rangeList(
+	ctx context.Context, path string, next func(d *json.Decoder) error,
+) error {
+	res, err := c.do(ctx, http.MethodGet, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return decodeArray(res.Body, next)
+}
+
+// decodeArray decodes a JSON array from r element by element, next
+// is called for every element to decode it with d, null is an empty array.
+func decodeArray(r io.Reader, next func(d *json.Decoder) error) error {
+	d := json.NewDecoder(r)
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '[' {
+		return errorf("unexpected %v token, want an array", t)
+	}
+	for d.More() {
+		if err = next(d); err != nil {
+			return err
+		}
+	}
+	_, err = d.Token()
+	return err
+}
+
+// do sends the request and returns responses of successful requests,
+// that is 200 and 204, with the body left unread for decoding,
+// the caller has to close it. Other responses are returned as errors.
+func (c *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	vals url.Values,
+	headers http.Header,
+	r interface{}, // request object
+) (*http.Response, error) {
 	var br io.Reader
 	if r != nil {
 		var b []byte
@@ -1494,49 +2505,61 @@ func (c *Client) call(
 	if err != nil {
 		return nil, err
 	}
-	sas, err := c.sak.Token(c.sak.HostName, time.Hour)
+	auth, err := c.authorization(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Authorization", sas.String())
-	req.Header.Set("Request-Id", genID())
+	req.Header.Set("Authorization", auth)
+	rid := requestID(ctx)
+	req.Header.Set("Request-Id", rid)
+	req.Header.Set("x-ms-client-request-id", rid)
 	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept-Encoding", "gzip")
+	c.setCustomHeaders(ctx, req)
 	for k, v := range headers {
 		for i := range v {
 			req.Header.Add(k, v[i])
 		}
 	}
 
-	c.logger.Debugf("%s", (*requestOutDump)(req))
+	// dumping reads bodies into memory, skip it unless it's printed
+	debug := logger.Enabled(c.logger, logger.LevelDebug)
+	if debug {
+		c.logger.Debugf("request id %s\n%s", rid, (*requestOutDump)(req))
+	}
 	res, err := c.http.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Body.Close()
-	c.logger.Debugf("%s", (*responseDump)(res))
+	if err = decompress(res); err != nil {
+		return nil, err
+	}
+	if debug {
+		c.logger.Debugf("request id %s\n%s", rid, (*responseDump)(res))
+	}
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNoContent {
+		return res, nil
+	}
 
+	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
-
 	switch res.StatusCode {
-	case http.StatusNoContent:
-		return res.Header, nil
-	case http.StatusOK:
-		return res.Header, json.Unmarshal(body, v)
 	case http.StatusBadRequest:
 		// try to decode a registry error, because some operations like
 		// bulk requests may return the bad request code along with a valid body
 		var e BadRequestError
 		if err = json.Unmarshal(body, &e); err == nil && e.Message != "" {
+			e.RequestID = rid
 			return nil, &e
 		}
 	}
-	return nil, &RequestError{Code: res.StatusCode, Body: body}
+	return nil, &RequestError{Code: res.StatusCode, Body: body, RequestID: rid}
 }
 
 // RequestError is an API request error.
@@ -1546,9 +2569,15 @@ func (c *Client) call(
 type RequestError struct {
 	Code int
 	Body []byte
+
+	// RequestID is the x-ms-client-request-id of the failed request.
+	RequestID string
 }
 
 func (e *RequestError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("code = %d, body = %q, request id = %s", e.Code, e.Body, e.RequestID)
+	}
 	return fmt.Sprintf("code = %d, body = %q", e.Code, e.Body)
 }
 
@@ -1562,6 +2591,9 @@ func genID() string {
 
 // Close closes transport.
 func (c *Client) Close() error {
+	// links are closed after mu is released, getSendLink
+	// acquires mu through newSession while holding sendMu
+	defer c.resetSendLinks()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	select {
@@ -1570,10 +2602,16 @@ func (c *Client) Close() error {
 	default:
 		close(c.done)
 	}
+	if c.tokens != nil {
+		c.tokens.Close()
+	}
 	if c.conn == nil {
 		return nil
 	}
-	return c.conn.Close()
+	close(c.stop)
+	err := c.conn.Close()
+	c.conn, c.stop = nil, nil
+	return err
 }
 
 func pathf(format string, s ...string) string {
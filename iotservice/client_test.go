@@ -2,12 +2,19 @@ package iotservice
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/amenzhinsky/iothub/common"
 )
 
 func TestSendWithNegativeFeedback(t *testing.T) {
@@ -154,53 +161,6 @@ func TestRegistryError(t *testing.T) {
 	}
 }
 
-func TestListDevices(t *testing.T) {
-	client := newClient(t)
-	device := newDevice(t, client)
-	devices, err := client.ListDevices(context.Background())
-	if err != nil {
-		t.Fatal(err)
-	}
-	for _, dev := range devices {
-		if dev.DeviceID == device.DeviceID {
-			return
-		}
-	}
-	t.Fatal("device not found", device)
-}
-
-func TestGetDevice(t *testing.T) {
-	client := newClient(t)
-	device := newDevice(t, client)
-	if _, err := client.GetDevice(context.Background(), device.DeviceID); err != nil {
-		t.Fatal(err)
-	}
-}
-
-func TestUpdateDevice(t *testing.T) {
-	client := newClient(t)
-	device := newDevice(t, client)
-	device.Status = Disabled
-	dev, err := client.UpdateDevice(context.Background(), device)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if dev.Status != device.Status {
-		t.Fatal("device is not updated")
-	}
-}
-
-func TestDeleteDevice(t *testing.T) {
-	client := newClient(t)
-	device := newDevice(t, client)
-	if err := client.DeleteDevice(context.Background(), device); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := client.GetDevice(context.Background(), device.DeviceID); err == nil {
-		t.Fatal("device found but should be removed")
-	}
-}
-
 func TestDeviceConnectionString(t *testing.T) {
 	client := newClient(t)
 	device := newDevice(t, client)
@@ -566,3 +526,479 @@ func newConfiguration(t *testing.T, c *Client) *Configuration {
 	})
 	return config
 }
+
+func TestNewFromConnectionStringSAS(t *testing.T) {
+	sas, err := common.NewSharedAccessSignature(
+		"test.azure-devices.net", "service", "c2VjcmV0", time.Now().Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFromConnectionString(
+		"HostName=test.azure-devices.net;SharedAccessSignature=" + sas.String(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.HostName() != "test.azure-devices.net" {
+		t.Fatalf("HostName() = %q", c.HostName())
+	}
+	have, err := c.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.String() != sas.String() {
+		t.Fatalf("token = %q, want %q", have, sas)
+	}
+}
+
+func TestWithSendLinks(t *testing.T) {
+	sak := common.NewSharedAccessKey("test.azure-devices.net", "service", "c2VjcmV0")
+	c, err := New(sak, WithSendLinks(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if len(c.sendLinks) != 4 {
+		t.Errorf("len(sendLinks) = %d, want 4", len(c.sendLinks))
+	}
+	if _, err = New(sak, WithSendLinks(0)); err == nil {
+		t.Error("zero send links are accepted")
+	}
+}
+
+type fakeSendLink struct {
+	id     int
+	closed chan struct{}
+}
+
+func (l *fakeSendLink) Send(context.Context, *amqp.Message, *amqp.SendOptions) error {
+	return nil
+}
+
+func (l *fakeSendLink) Close(context.Context) error {
+	close(l.closed)
+	return nil
+}
+
+func newFakeSendLinks(c *Client) *[]*fakeSendLink {
+	var opened []*fakeSendLink
+	c.sendOpen = func(context.Context) (sendLink, error) {
+		l := &fakeSendLink{id: len(opened), closed: make(chan struct{})}
+		opened = append(opened, l)
+		return l, nil
+	}
+	return &opened
+}
+
+func waitLinksClosed(t *testing.T, links []*fakeSendLink) {
+	t.Helper()
+	for _, l := range links {
+		select {
+		case <-l.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("link %d is not closed", l.id)
+		}
+	}
+}
+
+func TestSendLinksRoundRobin(t *testing.T) {
+	sak := common.NewSharedAccessKey("test.azure-devices.net", "service", "c2VjcmV0")
+	c, err := New(sak, WithSendLinks(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	opened := newFakeSendLinks(c)
+
+	for i := 0; i < 7; i++ {
+		link, err := c.getSendLink(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := link.(*fakeSendLink).id; id != i%3 {
+			t.Errorf("call %d picked link %d, want %d", i, id, i%3)
+		}
+	}
+	if len(*opened) != 3 {
+		t.Errorf("opened %d links, want 3", len(*opened))
+	}
+}
+
+func TestResetSendLinks(t *testing.T) {
+	sak := common.NewSharedAccessKey("test.azure-devices.net", "service", "c2VjcmV0")
+	c, err := New(sak, WithSendLinks(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := newFakeSendLinks(c)
+
+	for i := 0; i < 2; i++ {
+		if _, err = c.getSendLink(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.resetSendLinks()
+	waitLinksClosed(t, *opened)
+
+	// links are reopened on demand after a reset
+	for i := 0; i < 2; i++ {
+		link, err := c.getSendLink(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := link.(*fakeSendLink).id; id != i+2 {
+			t.Errorf("got link %d, want a new link %d", id, i+2)
+		}
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitLinksClosed(t, (*opened)[2:])
+}
+
+func TestRemoveParent(t *testing.T) {
+	var body map[string]interface{}
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"deviceId":"leaf","etag":"1",` +
+				`"deviceScope":"ms-azure-iot-edge://parent-1","parentScopes":["ms-azure-iot-edge://parent-1"]}`))
+		case http.MethodPut:
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.Write([]byte(`{"deviceId":"leaf","etag":"2"}`))
+		}
+	}))
+	if _, err := c.RemoveParent(context.Background(), "leaf"); err != nil {
+		t.Fatal(err)
+	}
+	if scope, ok := body["deviceScope"]; !ok || scope != "" {
+		t.Errorf("deviceScope = %v (%t), want it empty", scope, ok)
+	}
+	if scopes, ok := body["parentScopes"].([]interface{}); !ok || len(scopes) != 0 {
+		t.Errorf("parentScopes = %v, want it empty", body["parentScopes"])
+	}
+	if body["deviceId"] != "leaf" || body["etag"] != "1" {
+		t.Errorf("body = %v, want the device", body)
+	}
+}
+
+func TestChildOf(t *testing.T) {
+	const scope = "ms-azure-iot-edge://parent-1"
+	for _, tc := range []struct {
+		twin map[string]interface{}
+		want bool
+	}{
+		{map[string]interface{}{"deviceId": "parent", "deviceScope": scope}, false},
+		{map[string]interface{}{"deviceId": "leaf", "deviceScope": scope}, true},
+		{map[string]interface{}{"deviceId": "leaf", "deviceScope": "other"}, false},
+		{map[string]interface{}{
+			"deviceId":     "edge",
+			"deviceScope":  "ms-azure-iot-edge://edge-2",
+			"parentScopes": []interface{}{scope},
+			"capabilities": map[string]interface{}{"iotEdge": true},
+		}, true},
+		{map[string]interface{}{
+			"deviceId":     "edge",
+			"deviceScope":  scope,
+			"capabilities": map[string]interface{}{"iotEdge": true},
+		}, false},
+	} {
+		if _, have := childOf(tc.twin, "parent", scope); have != tc.want {
+			t.Errorf("childOf(%v) = %t, want %t", tc.twin, have, tc.want)
+		}
+	}
+}
+
+func TestTokenCredential(t *testing.T) {
+	var calls int
+	expires := time.Now().Add(time.Hour)
+	c, err := NewFromTokenCredential("hub.azure-devices.net",
+		func(ctx context.Context, scope string) (*AccessToken, error) {
+			if scope != AADScope {
+				t.Errorf("scope = %q, want %q", scope, AADScope)
+			}
+			calls++
+			return &AccessToken{Token: strconv.Itoa(calls), ExpiresOn: expires}, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, want := range []string{"Bearer 1", "Bearer 1"} {
+		auth, err := c.authorization(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != want {
+			t.Errorf("authorization #%d = %q, want %q", i, auth, want)
+		}
+	}
+
+	// tokens that are about to expire are renewed
+	expires = time.Now().Add(time.Minute)
+	c.bearer.tok.ExpiresOn = expires
+	for i, want := range []string{"Bearer 2", "Bearer 3"} {
+		auth, err := c.authorization(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != want {
+			t.Errorf("authorization #%d = %q, want %q", i, auth, want)
+		}
+	}
+
+	// CBS tokens are raw jwts
+	tok, typ, err := c.cbsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok != "4" || typ != "jwt" {
+		t.Errorf("cbs token = %q (%s), want %q (jwt)", tok, typ, "4")
+	}
+}
+
+func TestNewRootCAsError(t *testing.T) {
+	t.Setenv(common.RootCAsFileEnv, filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := NewFromTokenCredential("hub.azure-devices.net",
+		func(ctx context.Context, scope string) (*AccessToken, error) {
+			return nil, nil
+		},
+	); err == nil {
+		t.Fatal("New error is nil with malformed root CAs file")
+	}
+}
+
+func TestIsConnLost(t *testing.T) {
+	for err, want := range map[error]bool{
+		&amqp.ConnError{}:                            true,
+		&amqp.SessionError{}:                         true,
+		fmt.Errorf("send: %w", &amqp.LinkError{}):    true,
+		errors.New("amqp: connection closed"):        false,
+		context.DeadlineExceeded:                     false,
+		&amqp.Error{Condition: amqp.ErrCondNotFound}: false,
+	} {
+		if have := isConnLost(err); have != want {
+			t.Errorf("isConnLost(%v) = %t, want %t", err, have, want)
+		}
+	}
+}
+
+func TestNewSessionClosed(t *testing.T) {
+	c, err := New(common.NewSharedAccessKey("test.azure-devices.net", "service", "c2VjcmV0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err = c.newSession(context.Background()); err != ErrClosed {
+		t.Errorf("newSession error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		&amqp.Error{Condition: "com.microsoft:server-busy"}:                          true,
+		&amqp.Error{Condition: amqp.ErrCondResourceLimitExceeded}:                    true,
+		&amqp.LinkError{RemoteErr: &amqp.Error{Condition: amqp.ErrCondDetachForced}}: true,
+		&amqp.LinkError{}: true,
+		&amqp.ConnError{}: true,
+		&amqp.Error{Condition: amqp.ErrCondUnauthorizedAccess}:                   false,
+		&amqp.LinkError{RemoteErr: &amqp.Error{Condition: amqp.ErrCondNotFound}}: false,
+		fmt.Errorf("%w: %v", context.DeadlineExceeded, &amqp.ConnError{}):        false,
+		errors.New("message is too large"):                                       false,
+	} {
+		if have := isTransient(err); have != want {
+			t.Errorf("isTransient(%v) = %t, want %t", err, have, want)
+		}
+	}
+}
+
+func TestHTTPTransportOptions(t *testing.T) {
+	sak := common.NewSharedAccessKey("golang.azure-devices.net", "service", "c2VjcmV0")
+	c, err := New(sak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tr := c.http.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost ||
+		tr.IdleConnTimeout != DefaultIdleConnTimeout || tr.ForceAttemptHTTP2 {
+		t.Errorf("unexpected default transport settings: %d, %s, %t",
+			tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.ForceAttemptHTTP2)
+	}
+
+	c, err = New(sak,
+		WithMaxIdleConnsPerHost(64),
+		WithIdleConnTimeout(0),
+		WithHTTP2(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tr = c.http.Transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 64 || tr.IdleConnTimeout != 0 || !tr.ForceAttemptHTTP2 {
+		t.Errorf("options aren't applied: %d, %s, %t",
+			tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.ForceAttemptHTTP2)
+	}
+
+	if _, err = New(sak, WithMaxIdleConnsPerHost(-1)); err == nil {
+		t.Error("negative number of idle connections is accepted")
+	}
+}
+
+func TestSendEventWithAckValidates(t *testing.T) {
+	c, err := New(common.NewSharedAccessKey("golang.azure-devices.net", "service", "c2VjcmV0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// the closed client fails only after the message is validated
+	if err = c.SendEvent(context.Background(), "golang", []byte("hello"),
+		WithSendAck(AckFull),
+	); err != ErrClosed {
+		t.Fatalf("SendEvent error = %v, want %v", err, ErrClosed)
+	}
+}
+
+type fakeConn struct {
+	closed chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) NewSession(context.Context, *amqp.SessionOptions) (*amqp.Session, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// newRenewClient returns a client with fast token renewals connected
+// with the given connection, renewal errors are sent to the returned channel.
+func newRenewClient(t *testing.T, conn amqpConn) (*Client, <-chan error) {
+	t.Helper()
+	errc := make(chan error, 1)
+	sak := common.NewSharedAccessKey("test.azure-devices.net", "service", "c2VjcmV0")
+	c, err := New(sak, WithTokenRenewalHandler(func(err error) {
+		errc <- err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.renew = renewPolicy{
+		interval:   time.Millisecond,
+		attempts:   3,
+		backoff:    time.Millisecond,
+		maxBackoff: 2 * time.Millisecond,
+	}
+	c.conn, c.stop = conn, make(chan struct{})
+	return c, errc
+}
+
+func TestRenewTokensDropsConn(t *testing.T) {
+	conn := newFakeConn()
+	c, errc := newRenewClient(t, conn)
+	defer c.Close()
+	newFakeSendLinks(c)
+	link, err := c.getSendLink(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errPut := errors.New("put-token failed")
+	var attempts int
+	c.renewTokens(conn, c.stop, func() error {
+		attempts++
+		return errPut
+	})
+	if attempts != 3 {
+		t.Errorf("%d put-token attempts, want 3", attempts)
+	}
+	select {
+	case err := <-errc:
+		if err != errPut {
+			t.Errorf("renewal handler error = %v, want %v", err, errPut)
+		}
+	default:
+		t.Error("renewal handler isn't called")
+	}
+	if !conn.isClosed() {
+		t.Error("connection isn't closed")
+	}
+	if c.conn != nil {
+		t.Error("connection isn't dropped")
+	}
+	waitLinksClosed(t, []*fakeSendLink{link.(*fakeSendLink)})
+}
+
+func TestRenewTokensRetries(t *testing.T) {
+	conn := newFakeConn()
+	c, errc := newRenewClient(t, conn)
+	defer c.Close()
+
+	// the first renewal succeeds on the last attempt,
+	// the second one stops renewals with the connection
+	stop := c.stop
+	var attempts int
+	c.renewTokens(conn, stop, func() error {
+		attempts++
+		switch attempts {
+		case 3:
+			return nil
+		case 4:
+			c.mu.Lock()
+			c.closeConn()
+			c.mu.Unlock()
+		}
+		return errors.New("put-token failed")
+	})
+	if attempts != 4 {
+		t.Errorf("%d put-token attempts, want 4", attempts)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("renewal handler is called with %v after the connection is closed", err)
+	default:
+	}
+}
+
+func TestRenewTokensReplacedConn(t *testing.T) {
+	old, cur := newFakeConn(), newFakeConn()
+	c, errc := newRenewClient(t, cur)
+	defer c.Close()
+
+	// renewal of a replaced connection is failing but not stopped yet
+	c.renewTokens(old, make(chan struct{}), func() error {
+		return errors.New("put-token failed")
+	})
+	select {
+	case err := <-errc:
+		t.Errorf("renewal handler is called with %v for a replaced connection", err)
+	default:
+	}
+	if c.conn != cur || cur.isClosed() {
+		t.Error("current connection is dropped")
+	}
+}
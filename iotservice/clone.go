@@ -0,0 +1,69 @@
+package iotservice
+
+import "context"
+
+// CloneDevice creates the dstID device with authentication type, status,
+// capabilities and scopes of the srcID device, e.g. when replacing failed
+// hardware. With includeTwin tags and desired properties are copied too.
+//
+// Symmetric keys are not copied, the hub generates new ones so the
+// replaced hardware cannot connect as the new device, self-signed
+// certificate thumbprints are copied and need to be updated when
+// the new hardware comes with a different certificate.
+//
+// When copying the twin fails the created device is left in the registry.
+func (c *Client) CloneDevice(
+	ctx context.Context, srcID, dstID string, includeTwin bool,
+) (*Device, error) {
+	if srcID == dstID {
+		return nil, errorf("source and destination device ids are the same")
+	}
+	src, err := c.GetDevice(ctx, srcID)
+	if err != nil {
+		return nil, err
+	}
+	dst := &Device{
+		DeviceID:     dstID,
+		Status:       src.Status,
+		StatusReason: src.StatusReason,
+		Capabilities: src.Capabilities,
+		ParentScopes: src.ParentScopes,
+	}
+	if !src.IsEdge() {
+		// edge devices own their scopes, leaf devices
+		// carry the scope of their parent
+		dst.DeviceScope = src.DeviceScope
+	}
+	if src.Authentication != nil {
+		dst.Authentication = &Authentication{Type: src.Authentication.Type}
+		if src.Authentication.Type == AuthSelfSigned {
+			dst.Authentication.X509Thumbprint = src.Authentication.X509Thumbprint
+		}
+	}
+	if dst, err = c.CreateDevice(ctx, dst); err != nil {
+		return nil, err
+	}
+	if !includeTwin {
+		return dst, nil
+	}
+
+	twin, err := c.GetDeviceTwin(ctx, srcID)
+	if err != nil {
+		return nil, err
+	}
+	if len(twin.Tags) == 0 && (twin.Properties == nil || len(stripReserved(twin.Properties.Desired)) == 0) {
+		return dst, nil
+	}
+	var desired map[string]interface{}
+	if twin.Properties != nil {
+		desired = twin.Properties.Desired
+	}
+	if _, err = c.UpdateDeviceTwin(ctx, &Twin{
+		DeviceID:   dstID,
+		Tags:       twin.Tags,
+		Properties: &Properties{Desired: desired},
+	}); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
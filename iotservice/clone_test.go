@@ -0,0 +1,66 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCloneDevice(t *testing.T) {
+	var (
+		created *Device
+		patch   *Twin
+	)
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "GET /devices/old":
+			_, _ = w.Write([]byte(`{
+				"deviceId": "old",
+				"status": "enabled",
+				"deviceScope": "ms-azure-iot-edge://gateway-1",
+				"authentication": {
+					"type": "sas",
+					"symmetricKey": {"primaryKey": "a2V5MQ==", "secondaryKey": "a2V5Mg=="}
+				}
+			}`))
+		case "PUT /devices/new":
+			created = &Device{}
+			if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(created)
+		case "GET /twins/old":
+			_, _ = w.Write([]byte(`{
+				"deviceId": "old",
+				"tags": {"site": "a"},
+				"properties": {"desired": {"fw": "2.0", "$version": 3}}
+			}`))
+		case "PATCH /twins/new":
+			patch = &Twin{}
+			if err := json.NewDecoder(r.Body).Decode(patch); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(patch)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	if _, err := c.CloneDevice(context.Background(), "old", "new", true); err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != Enabled || created.DeviceScope != "ms-azure-iot-edge://gateway-1" ||
+		created.Authentication.Type != AuthSAS || created.Authentication.SymmetricKey != nil {
+		t.Errorf("created device = %+v", created)
+	}
+	if patch == nil || patch.Tags["site"] != "a" || patch.Properties.Desired["fw"] != "2.0" {
+		t.Fatalf("twin patch = %+v", patch)
+	}
+	if _, ok := patch.Properties.Desired["$version"]; ok {
+		t.Error("reserved properties are copied")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 )
 
 type requestOutDump http.Request
@@ -26,14 +27,23 @@ func (r *responseDump) String() string {
 	return prefix(b, "< ")
 }
 
+// bufPool reuses buffers for prefixing dumps.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
 func prefix(b []byte, prefix string) string {
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+	buf.Grow(len(b) + (bytes.Count(b, []byte{'\n'})+1)*len(prefix))
+
 	off := 0
-	buf := bytes.NewBuffer(make([]byte, 0,
-		len(b)+(bytes.Count(b, []byte{'\n'})*len(prefix)+len(prefix))),
-	)
 	buf.WriteString(prefix)
 	for {
-		i := bytes.Index(b[off:], []byte{'\n'})
+		i := bytes.IndexByte(b[off:], '\n')
 		if i < 0 {
 			buf.Write(b[off:])
 			break
@@ -0,0 +1,57 @@
+package iotservice
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+func TestPrefix(t *testing.T) {
+	for s, want := range map[string]string{
+		"":        "> ",
+		"a":       "> a",
+		"a\nb":    "> a\n> b",
+		"a\r\n\n": "> a\r\n> \n> ",
+	} {
+		if have := prefix([]byte(s), "> "); have != want {
+			t.Errorf("prefix(%q) = %q, want %q", s, have, want)
+		}
+	}
+}
+
+// countingLogger counts debug messages and reports the debug level enabled when debug is set.
+type countingLogger struct {
+	logger.Logger
+	debug bool
+	n     int
+}
+
+func (l *countingLogger) Enabled(lvl logger.Level) bool {
+	return lvl < logger.LevelDebug || l.debug
+}
+
+func (l *countingLogger) Debugf(format string, v ...interface{}) {
+	l.n++
+}
+
+func TestDumpOnlyWhenDebug(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"totalDeviceCount":1}`))
+	})
+	for _, debug := range []bool{false, true} {
+		l := &countingLogger{Logger: logger.New(logger.LevelOff, nil), debug: debug}
+		c := newTestClient(t, h, WithLogger(l))
+		stats, err := c.DeviceStats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalDeviceCount != 1 {
+			t.Errorf("debug = %t: response body is consumed by dumping", debug)
+		}
+		if want := map[bool]int{false: 0, true: 2}[debug]; l.n != want {
+			t.Errorf("debug = %t: %d messages logged, want %d", debug, l.n, want)
+		}
+	}
+}
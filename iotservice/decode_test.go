@@ -0,0 +1,96 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// newTestClient creates a client of a local TLS server served by h.
+func newTestClient(t *testing.T, h http.Handler, opts ...ClientOption) *Client {
+	t.Helper()
+	s := httptest.NewTLSServer(h)
+	t.Cleanup(s.Close)
+	c, err := New(
+		common.NewSharedAccessKey(strings.TrimPrefix(s.URL, "https://"), "service", "c2VjcmV0"),
+		append([]ClientOption{WithHTTPClient(s.Client())}, opts...)...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+func TestRangeDevices(t *testing.T) {
+	const n = 1000
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "[")
+		for i := 0; i < n; i++ {
+			if i != 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"deviceId":"device-%d","status":"enabled"}`, i)
+		}
+		fmt.Fprint(w, "]")
+	}))
+
+	ctx := context.Background()
+	devices, err := c.ListDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != n || devices[n-1].DeviceID != fmt.Sprintf("device-%d", n-1) {
+		t.Errorf("unexpected devices: %d", len(devices))
+	}
+
+	stop := errors.New("stop")
+	var i int
+	if err = c.RangeDevices(ctx, func(d *Device) error {
+		if i++; i == 10 {
+			return stop
+		}
+		return nil
+	}); err != stop || i != 10 {
+		t.Errorf("RangeDevices = %v after %d devices, want %v after 10", err, i, stop)
+	}
+}
+
+func TestRangeConfigurations(t *testing.T) {
+	for body, want := range map[string]int{
+		`[{"id":"a"},{"id":"b"}]`: 2,
+		`[]`:                      0,
+		`null`:                    0,
+		`{"id":"a"}`:              -1,
+		`[{"id":"a"}`:             -1,
+	} {
+		body := body
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		configs, err := c.ListConfigurations(context.Background())
+		if want < 0 {
+			if err == nil {
+				t.Errorf("%s: error is nil", body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", body, err)
+		} else if len(configs) != want {
+			t.Errorf("%s: %d configurations, want %d", body, len(configs), want)
+		}
+	}
+}
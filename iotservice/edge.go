@@ -0,0 +1,156 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// EdgeAgentModuleID is the module id of the IoT Edge agent
+// that implements the built-in edge direct methods.
+const EdgeAgentModuleID = "$edgeAgent"
+
+// edgeSchemaVersion is the schema version of built-in method payloads.
+const edgeSchemaVersion = "1.0"
+
+// Log encodings and content types of GetModuleLogs and UploadModuleLogs.
+const (
+	LogEncodingNone = "none"
+	LogEncodingGzip = "gzip"
+
+	LogContentText = "text"
+	LogContentJSON = "json"
+)
+
+// ModuleLogsItem selects logs of modules which ids match
+// the ID regular expression, e.g. "edgeAgent" or ".*".
+type ModuleLogsItem struct {
+	ID     string            `json:"id"`
+	Filter *ModuleLogsFilter `json:"filter,omitempty"`
+}
+
+// ModuleLogsFilter narrows log lines down, Since and Until are either
+// RFC3339 timestamps, unix timestamps or durations like 10m,
+// LogLevel is a syslog severity level.
+type ModuleLogsFilter struct {
+	Tail     int    `json:"tail,omitempty"`
+	Since    string `json:"since,omitempty"`
+	Until    string `json:"until,omitempty"`
+	LogLevel *int   `json:"loglevel,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+}
+
+// GetModuleLogsRequest is the GetModuleLogs method request.
+type GetModuleLogsRequest struct {
+	Items       []*ModuleLogsItem `json:"items"`
+	Encoding    string            `json:"encoding,omitempty"`    // LogEncoding*
+	ContentType string            `json:"contentType,omitempty"` // LogContent*
+}
+
+// ModuleLogs are logs of a single module, Payload is a JSON string with
+// log lines for the text content type, an array of log objects for
+// the json content type or a base64 string for the gzip encoding.
+type ModuleLogs struct {
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// UploadModuleLogsRequest is the UploadModuleLogs method request,
+// logs are uploaded to the blob container of the SAS URL.
+type UploadModuleLogsRequest struct {
+	SASURL      string            `json:"sasUrl"`
+	Items       []*ModuleLogsItem `json:"items"`
+	Encoding    string            `json:"encoding,omitempty"`    // LogEncoding*
+	ContentType string            `json:"contentType,omitempty"` // LogContent*
+}
+
+// EdgeTaskStatus is the status of a long-running edge agent task,
+// such as UploadModuleLogs.
+type EdgeTaskStatus struct {
+	Status        string `json:"status"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// EdgeMethodError is returned when the edge agent responds
+// to a built-in method call with a non-2xx status.
+type EdgeMethodError struct {
+	Method  string
+	Status  int
+	Payload json.RawMessage
+}
+
+func (e *EdgeMethodError) Error() string {
+	return fmt.Sprintf("iotservice: %s failed with status %d: %s", e.Method, e.Status, e.Payload)
+}
+
+// RestartModule restarts the named module on the edge device.
+func (c *Client) RestartModule(ctx context.Context, deviceID, moduleID string) error {
+	return c.callEdgeAgent(ctx, deviceID, "RestartModule", &struct {
+		SchemaVersion string `json:"schemaVersion"`
+		ID            string `json:"id"`
+	}{edgeSchemaVersion, moduleID}, nil)
+}
+
+// GetModuleLogs retrieves logs of modules running on the edge device.
+func (c *Client) GetModuleLogs(
+	ctx context.Context, deviceID string, req *GetModuleLogsRequest,
+) ([]*ModuleLogs, error) {
+	var logs []*ModuleLogs
+	if err := c.callEdgeAgent(ctx, deviceID, "GetModuleLogs", &struct {
+		SchemaVersion string `json:"schemaVersion"`
+		*GetModuleLogsRequest
+	}{edgeSchemaVersion, req}, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// UploadModuleLogs makes the edge device upload logs of its modules to
+// Azure blob storage, the upload is performed in the background and
+// the returned status is of the just started task.
+func (c *Client) UploadModuleLogs(
+	ctx context.Context, deviceID string, req *UploadModuleLogsRequest,
+) (*EdgeTaskStatus, error) {
+	var status EdgeTaskStatus
+	if err := c.callEdgeAgent(ctx, deviceID, "UploadModuleLogs", &struct {
+		SchemaVersion string `json:"schemaVersion"`
+		*UploadModuleLogsRequest
+	}{edgeSchemaVersion, req}, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// PingEdgeAgent checks that the edge agent of the device is running.
+func (c *Client) PingEdgeAgent(ctx context.Context, deviceID string) error {
+	return c.callEdgeAgent(ctx, deviceID, "ping", nil, nil)
+}
+
+// callEdgeAgent calls the named built-in method of the edge agent
+// and decodes the result payload into res unless it's nil.
+func (c *Client) callEdgeAgent(
+	ctx context.Context, deviceID, method string, req, res interface{},
+) error {
+	call := &MethodCall{MethodName: method}
+	if req != nil {
+		if err := call.SetPayload(req); err != nil {
+			return err
+		}
+	}
+	result, err := c.CallModuleMethod(ctx, deviceID, EdgeAgentModuleID, call)
+	if err != nil {
+		return err
+	}
+	if result.Status < 200 || result.Status > 299 {
+		return &EdgeMethodError{
+			Method:  method,
+			Status:  result.Status,
+			Payload: result.Payload,
+		}
+	}
+	if res == nil {
+		return nil
+	}
+	return result.DecodePayload(res)
+}
@@ -0,0 +1,88 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestEdgeAgentMethods(t *testing.T) {
+	var calls []map[string]interface{}
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/twins/edge/modules/$edgeAgent/methods" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var call MethodCall
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]interface{}
+		if len(call.Payload) != 0 {
+			if err := json.Unmarshal(call.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		calls = append(calls, payload)
+
+		switch call.MethodName {
+		case "ping":
+			w.Write([]byte(`{"status":200,"payload":null}`))
+		case "RestartModule":
+			if payload["id"] == "missing" {
+				w.Write([]byte(`{"status":400,"payload":{"message":"no such module"}}`))
+				return
+			}
+			w.Write([]byte(`{"status":200,"payload":{}}`))
+		case "GetModuleLogs":
+			w.Write([]byte(`{"status":200,"payload":[{"id":"sensor","payload":"line\n"}]}`))
+		case "UploadModuleLogs":
+			w.Write([]byte(`{"status":200,"payload":{"status":"NotStarted","correlationId":"1"}}`))
+		}
+	}))
+
+	ctx := context.Background()
+	if err := c.PingEdgeAgent(ctx, "edge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartModule(ctx, "edge", "sensor"); err != nil {
+		t.Fatal(err)
+	}
+	if calls[1]["schemaVersion"] != "1.0" || calls[1]["id"] != "sensor" {
+		t.Errorf("RestartModule payload = %v", calls[1])
+	}
+	var methodErr *EdgeMethodError
+	if err := c.RestartModule(ctx, "edge", "missing"); !errors.As(err, &methodErr) ||
+		methodErr.Status != 400 {
+		t.Errorf("RestartModule error = %v, want *EdgeMethodError", err)
+	}
+
+	logs, err := c.GetModuleLogs(ctx, "edge", &GetModuleLogsRequest{
+		Items: []*ModuleLogsItem{{ID: "sensor", Filter: &ModuleLogsFilter{Tail: 10}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].ID != "sensor" || string(logs[0].Payload) != `"line\n"` {
+		t.Errorf("GetModuleLogs = %v", logs)
+	}
+	if calls[3]["schemaVersion"] != "1.0" || calls[3]["items"] == nil {
+		t.Errorf("GetModuleLogs payload = %v", calls[3])
+	}
+
+	status, err := c.UploadModuleLogs(ctx, "edge", &UploadModuleLogsRequest{
+		SASURL: "https://blob",
+		Items:  []*ModuleLogsItem{{ID: ".*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "NotStarted" || status.CorrelationID != "1" {
+		t.Errorf("UploadModuleLogs = %+v", status)
+	}
+	if calls[4]["sasUrl"] != "https://blob" {
+		t.Errorf("UploadModuleLogs payload = %v", calls[4])
+	}
+}
@@ -0,0 +1,45 @@
+package iotservice
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decompress makes the response body transparently decompressed when it's
+// gzip-encoded. net/http does it on its own only unless Accept-Encoding
+// is set explicitly, but then custom transports set by WithHTTPClient
+// wouldn't benefit from compression.
+func decompress(res *http.Response) error {
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(res.Body)
+	switch err {
+	case nil:
+		res.Body = &gzipBody{Reader: zr, body: res.Body}
+	case io.EOF:
+		// bodies of e.g. 204 responses are empty
+		res.Body = http.NoBody
+	default:
+		res.Body.Close()
+		return err
+	}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return nil
+}
+
+// gzipBody closes both the decompressor and the underlying body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
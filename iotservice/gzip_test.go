@@ -0,0 +1,47 @@
+package iotservice
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/devices":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+		zw := gzip.NewWriter(w)
+		if r.URL.Path == "/devices" {
+			_, _ = zw.Write([]byte(`[{"deviceId":"a"},{"deviceId":"b"}]`))
+		} else {
+			_, _ = zw.Write([]byte(`{"Message":"not found"}`))
+		}
+		zw.Close()
+	}))
+
+	devices, err := c.ListDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].DeviceID != "a" || devices[1].DeviceID != "b" {
+		t.Errorf("devices = %v, want a and b", devices)
+	}
+
+	_, err = c.GetDevice(context.Background(), "missing")
+	var re *RequestError
+	if !errors.As(err, &re) || string(re.Body) != `{"Message":"not found"}` {
+		t.Errorf("error body isn't decompressed: %v", err)
+	}
+}
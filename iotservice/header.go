@@ -0,0 +1,32 @@
+package iotservice
+
+import (
+	"context"
+	"net/http"
+)
+
+type callHeaderKey struct{}
+
+// WithCallHeader returns a copy of ctx that makes REST requests made with it
+// carry the given header, e.g. for routing requests through a custom gateway
+// or A/B testing against private endpoints. It overrides headers set with
+// the WithHeader client option, calling it multiple times adds headers up.
+func WithCallHeader(ctx context.Context, key, value string) context.Context {
+	h := http.Header{}
+	if prev, ok := ctx.Value(callHeaderKey{}).(http.Header); ok {
+		h = prev.Clone()
+	}
+	h.Add(key, value)
+	return context.WithValue(ctx, callHeaderKey{}, h)
+}
+
+// setCustomHeaders sets client-level and ctx headers on the request.
+func (c *Client) setCustomHeaders(ctx context.Context, req *http.Request) {
+	for k, v := range c.headers {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	h, _ := ctx.Value(callHeaderKey{}).(http.Header)
+	for k, v := range h {
+		req.Header[k] = append([]string(nil), v...)
+	}
+}
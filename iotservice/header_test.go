@@ -0,0 +1,36 @@
+package iotservice
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCustomHeaders(t *testing.T) {
+	var got http.Header
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"deviceId":"golang"}`))
+	}), WithHeader("x-gateway-route", "blue"), WithHeader("x-tenant", "a"))
+
+	if _, err := c.GetDevice(context.Background(), "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("X-Gateway-Route") != "blue" || got.Get("X-Tenant") != "a" {
+		t.Errorf("client headers aren't sent: %v", got)
+	}
+
+	ctx := WithCallHeader(context.Background(), "x-gateway-route", "green")
+	ctx = WithCallHeader(ctx, "x-experiment", "1")
+	if _, err := c.GetDevice(ctx, "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Values("X-Gateway-Route"); !reflect.DeepEqual(v, []string{"green"}) {
+		t.Errorf("X-Gateway-Route = %v, want [green]", v)
+	}
+	if got.Get("X-Experiment") != "1" || got.Get("X-Tenant") != "a" {
+		t.Errorf("call headers aren't sent: %v", got)
+	}
+}
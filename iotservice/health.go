@@ -0,0 +1,49 @@
+package iotservice
+
+import "context"
+
+// HealthCheckOption is a CheckHealth configuration option.
+type HealthCheckOption func(o *healthCheckOptions)
+
+type healthCheckOptions struct {
+	amqp bool
+}
+
+// WithHealthCheckAMQP controls whether CheckHealth verifies AMQP connectivity,
+// it's enabled by default, services that only use REST methods may disable it.
+func WithHealthCheckAMQP(enable bool) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.amqp = enable
+	}
+}
+
+// CheckHealth verifies that the client can make authenticated REST calls
+// by retrieving service statistics and that it can connect to the AMQP
+// endpoint, that's needed for sending and receiving messages, so it's
+// suitable for readiness probes of services embedding the client.
+//
+// The AMQP connection is established only once, so following
+// calls are cheap and reuse it unless it's been lost.
+func (c *Client) CheckHealth(ctx context.Context, opts ...HealthCheckOption) error {
+	o := &healthCheckOptions{amqp: true}
+	for _, opt := range opts {
+		opt(o)
+	}
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if _, err := c.ServiceStats(ctx); err != nil {
+		return errorf("REST check failed: %w", err)
+	}
+	if !o.amqp {
+		return nil
+	}
+	sess, err := c.newSession(ctx)
+	if err != nil {
+		return errorf("AMQP check failed: %w", err)
+	}
+	_ = sess.Close(ctx)
+	return nil
+}
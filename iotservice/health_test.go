@@ -0,0 +1,37 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckHealth(t *testing.T) {
+	healthy := true
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/statistics/service" || !healthy {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"connectedDeviceCount":1}`))
+	}))
+
+	ctx := context.Background()
+	if err := c.CheckHealth(ctx, WithHealthCheckAMQP(false)); err != nil {
+		t.Fatal(err)
+	}
+
+	healthy = false
+	var re *RequestError
+	if err := c.CheckHealth(ctx, WithHealthCheckAMQP(false)); !errors.As(err, &re) ||
+		re.Code != http.StatusUnauthorized {
+		t.Errorf("CheckHealth error = %v, want the request error", err)
+	}
+
+	c.Close()
+	if err := c.CheckHealth(ctx); err != ErrClosed {
+		t.Errorf("CheckHealth error = %v, want %v", err, ErrClosed)
+	}
+}
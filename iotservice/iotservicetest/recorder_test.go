@@ -0,0 +1,99 @@
+package iotservicetest
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/iothubtest"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+func TestRecordReplay(t *testing.T) {
+	hub, err := iothubtest.New(iothubtest.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	fixture := filepath.Join(t.TempDir(), "testdata", "devices.json")
+
+	rec, err := NewRecorder(fixture, Record, WithTransport(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: hub.RootCAs()},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := iotservice.NewFromConnectionString(hub.ConnectionString(),
+		iotservice.WithHTTPClient(rec.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := createAndGet(t, sc)
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{
+		created.Authentication.SymmetricKey.PrimaryKey,
+		created.Authentication.SymmetricKey.SecondaryKey,
+		"SharedAccessSignature",
+	} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("fixture contains %q", secret)
+		}
+	}
+
+	// the hub isn't needed for replaying
+	hub.Close()
+	sc = NewClient(t, fixture)
+	replayed := createAndGet(t, sc)
+	if replayed.DeviceID != created.DeviceID ||
+		replayed.Authentication.SymmetricKey.PrimaryKey != ScrubbedKey {
+		t.Errorf("unexpected replayed device: %+v", replayed)
+	}
+	if _, err = sc.GetDevice(context.Background(), "golang-device"); err == nil {
+		t.Error("replaying an unrecorded request succeeded")
+	}
+}
+
+func createAndGet(t *testing.T, sc *iotservice.Client) *iotservice.Device {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := sc.CreateDevice(ctx, &iotservice.Device{DeviceID: "golang-device"}); err != nil {
+		t.Fatal(err)
+	}
+	device, err := sc.GetDevice(ctx, "golang-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestReplayMismatch(t *testing.T) {
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+	if err := os.WriteFile(fixture, []byte(`[
+  {"method": "GET", "url": "/devices/a?api-version=2020-09-30", "status": 200, "body": "{}"}
+]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := NewRecorder(fixture, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rec.Client().Get("https://hub/devices/b?api-version=2020-09-30"); err == nil {
+		t.Error("mismatched request is replayed")
+	}
+	if err = rec.Close(); err == nil {
+		t.Error("Close error is nil when interactions weren't replayed")
+	}
+}
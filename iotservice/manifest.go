@@ -0,0 +1,401 @@
+package iotservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Default system module images used by NewDeploymentManifest.
+const (
+	DefaultEdgeAgentImage = "mcr.microsoft.com/azureiotedge-agent:1.4"
+	DefaultEdgeHubImage   = "mcr.microsoft.com/azureiotedge-hub:1.4"
+)
+
+// Module statuses, restart and image pull policies of deployment manifests.
+const (
+	ModuleRunning = "running"
+	ModuleStopped = "stopped"
+
+	RestartNever       = "never"
+	RestartOnFailure   = "on-failure"
+	RestartOnUnhealthy = "on-unhealthy"
+	RestartAlways      = "always"
+
+	PullOnCreate = "on-create"
+	PullNever    = "never"
+)
+
+// manifestSchemaVersion is the schema version of the edge
+// agent and hub desired properties the manifest produces.
+const manifestSchemaVersion = "1.1"
+
+// createOptionsChunk is the maximum length of a single createOptions
+// value, longer options are split into createOptions01..07 chunks.
+const (
+	createOptionsChunk     = 512
+	createOptionsMaxChunks = 8
+)
+
+// EdgeRuntime is the container runtime configuration of edge devices.
+type EdgeRuntime struct {
+	MinDockerVersion    string
+	LoggingOptions      string
+	RegistryCredentials map[string]*RegistryCredential
+}
+
+// RegistryCredential is a container registry credential,
+// Address is the registry host, e.g. myregistry.azurecr.io.
+type RegistryCredential struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// EdgeModule is a module of a deployment manifest, only the Image is
+// required, Status and RestartPolicy default to running and always.
+type EdgeModule struct {
+	Image           string
+	CreateOptions   map[string]interface{} // docker container create options
+	Env             map[string]string
+	Status          string // Module*
+	RestartPolicy   string // Restart*
+	ImagePullPolicy string // Pull*
+	StartupOrder    *uint
+	Version         string
+
+	// DesiredProperties are the module twin's desired properties.
+	DesiredProperties map[string]interface{}
+}
+
+// DeploymentManifest builds modules content of IoT Edge deployments,
+// see ModulesContent, instead of composing untyped maps manually.
+//
+// Layered manifests only contain modules, routes and desired properties
+// and are applied on top of a base deployment, so Runtime, system
+// modules and the store and forward configuration are ignored.
+type DeploymentManifest struct {
+	Layered         bool
+	Runtime         *EdgeRuntime
+	EdgeAgent       *EdgeModule
+	EdgeHub         *EdgeModule
+	Modules         map[string]*EdgeModule
+	Routes          map[string]string
+	StoreAndForward time.Duration // messages time to live, 2h when zero
+}
+
+// NewDeploymentManifest returns a manifest with the default
+// runtime and system modules and without custom modules.
+func NewDeploymentManifest() *DeploymentManifest {
+	return &DeploymentManifest{
+		Runtime: &EdgeRuntime{MinDockerVersion: "v1.25"},
+		EdgeAgent: &EdgeModule{
+			Image: DefaultEdgeAgentImage,
+		},
+		EdgeHub: &EdgeModule{
+			Image: DefaultEdgeHubImage,
+			CreateOptions: map[string]interface{}{
+				"HostConfig": map[string]interface{}{
+					"PortBindings": map[string]interface{}{
+						"8883/tcp": []map[string]string{{"HostPort": "8883"}},
+						"5671/tcp": []map[string]string{{"HostPort": "5671"}},
+						"443/tcp":  []map[string]string{{"HostPort": "443"}},
+					},
+				},
+			},
+		},
+		Modules: map[string]*EdgeModule{},
+		Routes:  map[string]string{},
+	}
+}
+
+// NewLayeredDeploymentManifest returns an empty layered manifest.
+func NewLayeredDeploymentManifest() *DeploymentManifest {
+	return &DeploymentManifest{
+		Layered: true,
+		Modules: map[string]*EdgeModule{},
+		Routes:  map[string]string{},
+	}
+}
+
+// AddModule adds or replaces the named module.
+func (m *DeploymentManifest) AddModule(name string, module *EdgeModule) *DeploymentManifest {
+	if m.Modules == nil {
+		m.Modules = map[string]*EdgeModule{}
+	}
+	m.Modules[name] = module
+	return m
+}
+
+// AddRoute adds or replaces the named edge hub route,
+// e.g. FROM /messages/modules/sensor/* INTO $upstream.
+func (m *DeploymentManifest) AddRoute(name, route string) *DeploymentManifest {
+	if m.Routes == nil {
+		m.Routes = map[string]string{}
+	}
+	m.Routes[name] = route
+	return m
+}
+
+// Validate checks the manifest against the deployment schema.
+func (m *DeploymentManifest) Validate() error {
+	_, err := m.ModulesContent()
+	return err
+}
+
+// ModulesContent validates the manifest and returns it in the form of
+// ConfigurationContent.ModulesContent.
+func (m *DeploymentManifest) ModulesContent() (map[string]interface{}, error) {
+	modules := make(map[string]interface{}, len(m.Modules))
+	content := map[string]interface{}{}
+	for name, module := range m.Modules {
+		if err := validateModuleName(name); err != nil {
+			return nil, err
+		}
+		v, err := module.agentSettings(name, false)
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = v
+		if len(module.DesiredProperties) != 0 {
+			content[name] = desiredContent(m.Layered, "", module.DesiredProperties)
+		}
+	}
+	for name, route := range m.Routes {
+		if name == "" {
+			return nil, manifestErrorf("route name is empty")
+		}
+		if err := validateRoute(route); err != nil {
+			return nil, manifestErrorf("route %q: %s", name, err)
+		}
+	}
+
+	if m.Layered {
+		if len(modules) != 0 {
+			content["$edgeAgent"] = desiredContent(true, "modules.", modules)
+		}
+		if len(m.Routes) != 0 {
+			routes := make(map[string]interface{}, len(m.Routes))
+			for k, v := range m.Routes {
+				routes[k] = v
+			}
+			content["$edgeHub"] = desiredContent(true, "routes.", routes)
+		}
+		return content, nil
+	}
+
+	if m.EdgeAgent == nil || m.EdgeHub == nil {
+		return nil, manifestErrorf("edgeAgent and edgeHub system modules are required")
+	}
+	agent, err := m.EdgeAgent.agentSettings("edgeAgent", true)
+	if err != nil {
+		return nil, err
+	}
+	hub, err := m.EdgeHub.agentSettings("edgeHub", true)
+	if err != nil {
+		return nil, err
+	}
+	runtime := m.Runtime
+	if runtime == nil {
+		runtime = &EdgeRuntime{}
+	}
+	ttl := m.StoreAndForward
+	if ttl == 0 {
+		ttl = 2 * time.Hour
+	}
+	if ttl < time.Second {
+		return nil, manifestErrorf("store and forward time to live is less than a second")
+	}
+
+	content["$edgeAgent"] = map[string]interface{}{
+		"properties.desired": map[string]interface{}{
+			"schemaVersion": manifestSchemaVersion,
+			"runtime":       runtime.settings(),
+			"systemModules": map[string]interface{}{
+				"edgeAgent": agent,
+				"edgeHub":   hub,
+			},
+			"modules": modules,
+		},
+	}
+	routes := m.Routes
+	if routes == nil {
+		routes = map[string]string{}
+	}
+	content["$edgeHub"] = map[string]interface{}{
+		"properties.desired": map[string]interface{}{
+			"schemaVersion": manifestSchemaVersion,
+			"routes":        routes,
+			"storeAndForwardConfiguration": map[string]interface{}{
+				"timeToLiveSecs": int64(ttl / time.Second),
+			},
+		},
+	}
+	return content, nil
+}
+
+// desiredContent returns desired properties in the form of a module's
+// content, layered manifests cannot replace the whole desired section,
+// so every property gets its own path prefixed with prefix.
+func desiredContent(layered bool, prefix string, v map[string]interface{}) map[string]interface{} {
+	if !layered {
+		return map[string]interface{}{"properties.desired": v}
+	}
+	m := make(map[string]interface{}, len(v))
+	for k, p := range v {
+		m["properties.desired."+prefix+k] = p
+	}
+	return m
+}
+
+func (r *EdgeRuntime) settings() map[string]interface{} {
+	settings := map[string]interface{}{}
+	if r.MinDockerVersion != "" {
+		settings["minDockerVersion"] = r.MinDockerVersion
+	}
+	if r.LoggingOptions != "" {
+		settings["loggingOptions"] = r.LoggingOptions
+	}
+	if len(r.RegistryCredentials) != 0 {
+		settings["registryCredentials"] = r.RegistryCredentials
+	}
+	return map[string]interface{}{
+		"type":     "docker",
+		"settings": settings,
+	}
+}
+
+// agentSettings returns the edge agent's representation of the module,
+// the edge agent system module has no status and restart policy
+// and the edge hub one has to be always running.
+func (e *EdgeModule) agentSettings(name string, system bool) (map[string]interface{}, error) {
+	if e == nil {
+		return nil, manifestErrorf("module %q is nil", name)
+	}
+	if e.Image == "" {
+		return nil, manifestErrorf("module %q: image is empty", name)
+	}
+	settings := map[string]interface{}{"image": e.Image}
+	if len(e.CreateOptions) != 0 {
+		b, err := json.Marshal(e.CreateOptions)
+		if err != nil {
+			return nil, manifestErrorf("module %q: create options: %s", name, err)
+		}
+		if err = splitCreateOptions(settings, string(b)); err != nil {
+			return nil, manifestErrorf("module %q: %s", name, err)
+		}
+	} else {
+		settings["createOptions"] = ""
+	}
+
+	v := map[string]interface{}{
+		"type":     "docker",
+		"settings": settings,
+	}
+	if len(e.Env) != 0 {
+		env := make(map[string]interface{}, len(e.Env))
+		for k, s := range e.Env {
+			env[k] = map[string]string{"value": s}
+		}
+		v["env"] = env
+	}
+	switch e.ImagePullPolicy {
+	case "":
+	case PullOnCreate, PullNever:
+		v["imagePullPolicy"] = e.ImagePullPolicy
+	default:
+		return nil, manifestErrorf("module %q: unknown image pull policy %q", name, e.ImagePullPolicy)
+	}
+	if name == "edgeAgent" && system {
+		return v, nil
+	}
+
+	status, restart := e.Status, e.RestartPolicy
+	if status == "" {
+		status = ModuleRunning
+	}
+	if restart == "" {
+		restart = RestartAlways
+	}
+	switch status {
+	case ModuleRunning, ModuleStopped:
+	default:
+		return nil, manifestErrorf("module %q: unknown status %q", name, status)
+	}
+	switch restart {
+	case RestartNever, RestartOnFailure, RestartOnUnhealthy, RestartAlways:
+	default:
+		return nil, manifestErrorf("module %q: unknown restart policy %q", name, restart)
+	}
+	if system && (status != ModuleRunning || restart != RestartAlways) {
+		return nil, manifestErrorf("module %q has to be running and always restarted", name)
+	}
+	v["status"] = status
+	v["restartPolicy"] = restart
+	if e.StartupOrder != nil {
+		v["startupOrder"] = *e.StartupOrder
+	}
+	if e.Version != "" && !system {
+		v["version"] = e.Version
+	}
+	return v, nil
+}
+
+// splitCreateOptions sets the createOptions setting splitting
+// it into chunks when it exceeds the maximum length.
+func splitCreateOptions(settings map[string]interface{}, s string) error {
+	for i := 0; ; i++ {
+		if i == createOptionsMaxChunks {
+			return fmt.Errorf("create options exceed %d bytes",
+				createOptionsChunk*createOptionsMaxChunks)
+		}
+		n := len(s)
+		if n > createOptionsChunk {
+			n = createOptionsChunk
+		}
+		key := "createOptions"
+		if i != 0 {
+			key = fmt.Sprintf("createOptions%02d", i)
+		}
+		settings[key] = s[:n]
+		if s = s[n:]; s == "" {
+			return nil
+		}
+	}
+}
+
+func validateModuleName(name string) error {
+	switch {
+	case name == "":
+		return manifestErrorf("module name is empty")
+	case len(name) > 128:
+		return manifestErrorf("module name %q is longer than 128 characters", name)
+	case name[0] == '$':
+		return manifestErrorf("module name %q starts with $", name)
+	case name == "edgeAgent" || name == "edgeHub":
+		return manifestErrorf("module name %q is reserved by a system module", name)
+	case strings.ContainsAny(name, " /\\"):
+		return manifestErrorf("module name %q contains spaces or slashes", name)
+	}
+	return nil
+}
+
+// validateRoute checks that the route is
+// of the form FROM <source> [WHERE <condition>] INTO <sink>.
+func validateRoute(route string) error {
+	fields := strings.Fields(strings.ToUpper(route))
+	if len(fields) < 4 || fields[0] != "FROM" {
+		return fmt.Errorf("route doesn't start with FROM <source>")
+	}
+	for i := 2; i < len(fields)-1; i++ {
+		if fields[i] == "INTO" {
+			return nil
+		}
+	}
+	return fmt.Errorf("route doesn't have INTO <sink>")
+}
+
+func manifestErrorf(format string, v ...interface{}) error {
+	return errorf("manifest: "+format, v...)
+}
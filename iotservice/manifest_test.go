@@ -0,0 +1,130 @@
+package iotservice
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeploymentManifest(t *testing.T) {
+	m := NewDeploymentManifest().
+		AddModule("sensor", &EdgeModule{
+			Image:             "sensor:1.0",
+			Env:               map[string]string{"LEVEL": "debug"},
+			CreateOptions:     map[string]interface{}{"Cmd": []string{strings.Repeat("x", 1000)}},
+			DesiredProperties: map[string]interface{}{"interval": 10},
+		}).
+		AddRoute("upstream", "FROM /messages/modules/sensor/* INTO $upstream")
+	m.StoreAndForward = time.Minute
+	content, err := m.ModulesContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Agent struct {
+			Desired struct {
+				SchemaVersion string `json:"schemaVersion"`
+				SystemModules map[string]struct {
+					Status   string            `json:"status"`
+					Settings map[string]string `json:"settings"`
+				} `json:"systemModules"`
+				Modules map[string]struct {
+					Status        string                       `json:"status"`
+					RestartPolicy string                       `json:"restartPolicy"`
+					Settings      map[string]string            `json:"settings"`
+					Env           map[string]map[string]string `json:"env"`
+				} `json:"modules"`
+			} `json:"properties.desired"`
+		} `json:"$edgeAgent"`
+		Hub struct {
+			Desired struct {
+				Routes          map[string]string `json:"routes"`
+				StoreAndForward struct {
+					TTL int `json:"timeToLiveSecs"`
+				} `json:"storeAndForwardConfiguration"`
+			} `json:"properties.desired"`
+		} `json:"$edgeHub"`
+		Sensor struct {
+			Desired map[string]int `json:"properties.desired"`
+		} `json:"sensor"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	agent := v.Agent.Desired
+	if agent.SchemaVersion != "1.1" ||
+		agent.SystemModules["edgeAgent"].Settings["image"] != DefaultEdgeAgentImage ||
+		agent.SystemModules["edgeAgent"].Status != "" ||
+		agent.SystemModules["edgeHub"].Status != ModuleRunning {
+		t.Errorf("unexpected system modules: %s", b)
+	}
+	sensor := agent.Modules["sensor"]
+	if sensor.Status != ModuleRunning || sensor.RestartPolicy != RestartAlways ||
+		sensor.Env["LEVEL"]["value"] != "debug" {
+		t.Errorf("unexpected sensor module: %+v", sensor)
+	}
+	opts := sensor.Settings["createOptions"] + sensor.Settings["createOptions01"] +
+		sensor.Settings["createOptions02"]
+	if len(sensor.Settings["createOptions"]) != 512 || !json.Valid([]byte(opts)) {
+		t.Errorf("create options aren't split into chunks: %v", sensor.Settings)
+	}
+	if v.Hub.Desired.Routes["upstream"] == "" || v.Hub.Desired.StoreAndForward.TTL != 60 {
+		t.Errorf("unexpected edge hub content: %s", b)
+	}
+	if v.Sensor.Desired["interval"] != 10 {
+		t.Errorf("unexpected sensor content: %s", b)
+	}
+}
+
+func TestLayeredDeploymentManifest(t *testing.T) {
+	content, err := NewLayeredDeploymentManifest().
+		AddModule("sensor", &EdgeModule{
+			Image:             "sensor:1.0",
+			DesiredProperties: map[string]interface{}{"interval": 10},
+		}).
+		AddRoute("upstream", "FROM /messages/* INTO $upstream").
+		ModulesContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range [][2]string{
+		{"$edgeAgent", "properties.desired.modules.sensor"},
+		{"$edgeHub", "properties.desired.routes.upstream"},
+		{"sensor", "properties.desired.interval"},
+	} {
+		m, _ := content[path[0]].(map[string]interface{})
+		if _, ok := m[path[1]]; !ok || len(m) != 1 {
+			t.Errorf("%s content = %v, want only %s", path[0], m, path[1])
+		}
+	}
+}
+
+func TestDeploymentManifestValidate(t *testing.T) {
+	for name, m := range map[string]*DeploymentManifest{
+		"empty image":       NewDeploymentManifest().AddModule("sensor", &EdgeModule{}),
+		"reserved name":     NewDeploymentManifest().AddModule("edgeHub", &EdgeModule{Image: "hub"}),
+		"dollar name":       NewDeploymentManifest().AddModule("$sensor", &EdgeModule{Image: "sensor"}),
+		"unknown status":    NewDeploymentManifest().AddModule("sensor", &EdgeModule{Image: "sensor", Status: "paused"}),
+		"unknown restart":   NewDeploymentManifest().AddModule("sensor", &EdgeModule{Image: "sensor", RestartPolicy: "sometimes"}),
+		"malformed route":   NewDeploymentManifest().AddRoute("r", "INTO $upstream"),
+		"no sink":           NewDeploymentManifest().AddRoute("r", "FROM /messages/* WHERE true"),
+		"stopped edge hub":  func() *DeploymentManifest { m := NewDeploymentManifest(); m.EdgeHub.Status = ModuleStopped; return m }(),
+		"no system modules": {},
+		"huge create options": NewDeploymentManifest().AddModule("sensor", &EdgeModule{
+			Image:         "sensor",
+			CreateOptions: map[string]interface{}{"Cmd": strings.Repeat("x", 8*512)},
+		}),
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("%s: Validate error is nil", name)
+		}
+	}
+	if err := NewDeploymentManifest().Validate(); err != nil {
+		t.Errorf("default manifest is invalid: %s", err)
+	}
+}
@@ -30,6 +30,12 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.To = *msg.Properties.To
 		}
 		m.ExpiryTime = msg.Properties.AbsoluteExpiryTime
+		if msg.Properties.ContentType != nil {
+			m.ContentType = *msg.Properties.ContentType
+		}
+		if msg.Properties.ContentEncoding != nil {
+			m.ContentEncoding = *msg.Properties.ContentEncoding
+		}
 	}
 	for k, v := range msg.Annotations {
 		switch k {
@@ -38,6 +44,8 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.EnqueuedTime = &t
 		case "iothub-connection-device-id":
 			m.ConnectionDeviceID = v.(string)
+		case "iothub-connection-module-id":
+			m.ConnectionModuleID = v.(string)
 		case "iothub-connection-auth-generation-id":
 			m.ConnectionDeviceGenerationID = v.(string)
 		case "iothub-connection-auth-method":
@@ -49,6 +57,10 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.ConnectionAuthMethod = &am
 		case "iothub-message-source":
 			m.MessageSource = v.(string)
+		case "iothub-interface-id":
+			m.InterfaceID = v.(string)
+		case "dt-subject":
+			m.ComponentName = v.(string)
 		default:
 			m.Properties[k.(string)] = fmt.Sprint(v)
 		}
@@ -64,7 +76,41 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 	return m
 }
 
-// toAMQPMessage converts amqp.Message into common.Message.
+// ToAMQPMessage is the inverse of FromAMQPMessage, unlike messages sent to
+// devices it preserves system properties set by IoT Hub as annotations,
+// so messages can be persisted in or replayed through AMQP brokers.
+func ToAMQPMessage(msg *common.Message) (*amqp.Message, error) {
+	m := toAMQPMessage(msg)
+	if msg.ExpiryTime == nil {
+		m.Properties.AbsoluteExpiryTime = nil
+	}
+	m.Annotations = amqp.Annotations{}
+	if msg.EnqueuedTime != nil {
+		m.Annotations["iothub-enqueuedtime"] = *msg.EnqueuedTime
+	}
+	for k, v := range map[string]string{
+		"iothub-connection-device-id":          msg.ConnectionDeviceID,
+		"iothub-connection-module-id":          msg.ConnectionModuleID,
+		"iothub-connection-auth-generation-id": msg.ConnectionDeviceGenerationID,
+		"iothub-message-source":                msg.MessageSource,
+		"iothub-interface-id":                  msg.InterfaceID,
+		"dt-subject":                           msg.ComponentName,
+	} {
+		if v != "" {
+			m.Annotations[k] = v
+		}
+	}
+	if msg.ConnectionAuthMethod != nil {
+		b, err := json.Marshal(msg.ConnectionAuthMethod)
+		if err != nil {
+			return nil, err
+		}
+		m.Annotations["iothub-connection-auth-method"] = string(b)
+	}
+	return m, nil
+}
+
+// toAMQPMessage converts common.Message into amqp.Message.
 func toAMQPMessage(msg *common.Message) *amqp.Message {
 	props := make(map[string]interface{}, len(msg.Properties))
 	for k, v := range msg.Properties {
@@ -74,7 +120,7 @@ func toAMQPMessage(msg *common.Message) *amqp.Message {
 	if msg.ExpiryTime != nil {
 		expiryTime = *msg.ExpiryTime
 	}
-	return &amqp.Message{
+	m := &amqp.Message{
 		Data: [][]byte{msg.Payload},
 		Properties: &amqp.MessageProperties{
 			To:                 &msg.To,
@@ -85,4 +131,11 @@ func toAMQPMessage(msg *common.Message) *amqp.Message {
 		},
 		ApplicationProperties: props,
 	}
+	if msg.ContentType != "" {
+		m.Properties.ContentType = &msg.ContentType
+	}
+	if msg.ContentEncoding != "" {
+		m.Properties.ContentEncoding = &msg.ContentEncoding
+	}
+	return m
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Azure/go-amqp"
 	"github.com/amenzhinsky/iothub/common"
 )
 
@@ -16,6 +17,7 @@ func TestToFromAMQPMessage(t *testing.T) {
 		ExpiryTime:    &now,
 		CorrelationID: "id",
 		UserID:        "admin",
+		ContentType:   "application/json",
 		Properties:    map[string]string{"k": "v"},
 		Payload:       []byte("hello"),
 	}
@@ -23,3 +25,52 @@ func TestToFromAMQPMessage(t *testing.T) {
 		t.Fatalf("FromAMQPMessage(toAMQPMessage(want)) = %v, want = %v", have, want)
 	}
 }
+
+func TestToAMQPMessageAnnotations(t *testing.T) {
+	now := time.Now()
+	want := &common.Message{
+		MessageID:          "1",
+		EnqueuedTime:       &now,
+		ConnectionDeviceID: "dev",
+		ConnectionModuleID: "mod",
+		ConnectionAuthMethod: &common.ConnectionAuthMethod{
+			Scope: "device", Type: "sas", Issuer: "iothub",
+		},
+		MessageSource: "Telemetry",
+		InterfaceID:   "urn:azureiot:Security:SecurityAgent:1",
+		ComponentName: "thermostat1",
+		Properties:    map[string]string{"k": "v"},
+		Payload:       []byte("hello"),
+	}
+	m, err := ToAMQPMessage(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := FromAMQPMessage(m); !reflect.DeepEqual(have, want) {
+		t.Fatalf("FromAMQPMessage(ToAMQPMessage(want)) = %+v, want = %+v", have, want)
+	}
+}
+
+func TestParseFeedbackBatch(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, err := parseFeedbackBatch(&amqp.Message{
+		DeliveryTag: []byte{0xca, 0xfe},
+		Annotations: amqp.Annotations{"iothub-enqueuedtime": now},
+		Properties:  &amqp.MessageProperties{UserID: []byte("golang-hub")},
+		Data: [][]byte{[]byte(`[
+  {"originalMessageId": "1", "deviceId": "dev", "statusCode": "Success"},
+  {"originalMessageId": "2", "deviceId": "dev", "statusCode": "Expired"}
+]`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.EnqueuedTime.Equal(now) || b.UserID != "golang-hub" || b.LockToken != "cafe" {
+		t.Errorf("unexpected batch metadata: %+v", b)
+	}
+	if len(b.Records) != 2 ||
+		b.Records[0].StatusCode != FeedbackSuccess ||
+		b.Records[1].StatusCode != FeedbackExpired {
+		t.Errorf("unexpected records: %v", b.Records)
+	}
+}
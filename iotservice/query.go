@@ -0,0 +1,81 @@
+package iotservice
+
+import (
+	"context"
+	"io"
+)
+
+// QueryOption is a Query configuration option.
+type QueryOption func(it *QueryIterator)
+
+// WithQueryPageSize sets the maximum number of rows fetched
+// at a time, default is the hub's default page size.
+func WithQueryPageSize(n int) QueryOption {
+	return func(it *QueryIterator) {
+		it.pageSize = n
+	}
+}
+
+// Query executes the registry query and returns an iterator over its
+// results, it's an alternative to QueryDevices that's easier to combine
+// with pipelines and to stop early. The first page is fetched right away
+// so malformed queries are reported by Query, following pages are fetched
+// lazily by Next.
+func (c *Client) Query(ctx context.Context, query string, opts ...QueryOption) (
+	*QueryIterator, error,
+) {
+	it := &QueryIterator{c: c, query: query}
+	for _, opt := range opts {
+		opt(it)
+	}
+	if err := it.fetch(ctx); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// QueryIterator iterates over query results, it's not safe for concurrent use.
+type QueryIterator struct {
+	c        *Client
+	query    string
+	pageSize int
+
+	rows []map[string]interface{} // rest of the current page
+	next string                   // continuation token
+	last bool                     // the current page is the last one
+}
+
+func (it *QueryIterator) fetch(ctx context.Context) error {
+	rows, next, err := it.c.QueryDevicesPage(ctx, it.query, it.pageSize, it.next)
+	if err != nil {
+		return err
+	}
+	it.rows, it.next, it.last = rows, next, next == ""
+	return nil
+}
+
+// Next returns the next row, it returns io.EOF when there are no more rows.
+//
+// When fetching a page fails the error is returned and
+// the following Next call retries fetching the same page.
+func (it *QueryIterator) Next(ctx context.Context) (map[string]interface{}, error) {
+	for len(it.rows) == 0 {
+		if it.last {
+			return nil, io.EOF
+		}
+		if err := it.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	v := it.rows[0]
+	it.rows[0] = nil
+	it.rows = it.rows[1:]
+	return v, nil
+}
+
+// Continuation returns the continuation token of the page following
+// the current one, it can be passed to QueryDevicesPage to resume
+// the query later, it's empty when the current page is the last one.
+func (it *QueryIterator) Continuation() string {
+	return it.next
+}
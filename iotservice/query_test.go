@@ -0,0 +1,105 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	pages := map[string]struct {
+		rows string
+		next string
+	}{
+		"":   {`[{"deviceId":"a"},{"deviceId":"b"}]`, "p2"},
+		"p2": {`[]`, "p3"},
+		"p3": {`[{"deviceId":"c"}]`, ""},
+	}
+	var fetched int
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct{ Query string }
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil || v.Query != "SELECT * FROM devices" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/devices/query" || r.Header.Get("x-ms-max-item-count") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fetched++
+		page := pages[r.Header.Get("x-ms-continuation")]
+		if page.next != "" {
+			w.Header().Set("x-ms-continuation", page.next)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(page.rows))
+	}))
+
+	ctx := context.Background()
+	it, err := c.Query(ctx, "SELECT * FROM devices", WithQueryPageSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 1 || it.Continuation() != "p2" {
+		t.Errorf("fetched = %d, continuation = %q after Query", fetched, it.Continuation())
+	}
+	var ids []string
+	for {
+		v, err := it.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, v["deviceId"].(string))
+	}
+	if strings.Join(ids, ",") != "a,b,c" || fetched != 3 {
+		t.Errorf("ids = %v, fetched = %d, want [a b c], 3", ids, fetched)
+	}
+	if _, err = it.Next(ctx); err != io.EOF {
+		t.Errorf("Next after the end = %v, want io.EOF", err)
+	}
+
+	if _, err = c.Query(ctx, "SELECT * FROM modules"); err == nil {
+		t.Error("failed query returns nil error")
+	}
+}
+
+func TestListAllModules(t *testing.T) {
+	pages := map[string]struct {
+		rows string
+		next string
+	}{
+		"":   {`[{"deviceId":"a","moduleId":"$edgeAgent"},{"deviceId":"a","moduleId":"m"}]`, "p2"},
+		"p2": {`[{"deviceId":"b","moduleId":"$edgeAgent"}]`, ""},
+	}
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct{ Query string }
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil || v.Query != "SELECT * FROM devices.modules" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page := pages[r.Header.Get("x-ms-continuation")]
+		if page.next != "" {
+			w.Header().Set("x-ms-continuation", page.next)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(page.rows))
+	}))
+
+	modules, err := c.ListAllModules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range modules {
+		ids = append(ids, m.DeviceID+"/"+m.ModuleID)
+	}
+	if got, want := strings.Join(ids, ","), "a/$edgeAgent,a/m,b/$edgeAgent"; got != want {
+		t.Errorf("modules = %s, want %s", got, want)
+	}
+}
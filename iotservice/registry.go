@@ -1,20 +1,57 @@
 package iotservice
 
 import (
+	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 )
 
+// MethodCall is a direct method invocation request,
+// Payload is passed to the method handler as is.
 type MethodCall struct {
-	MethodName      string                 `json:"methodName,omitempty"`
-	ConnectTimeout  uint                   `json:"connectTimeoutInSeconds,omitempty"`
-	ResponseTimeout uint                   `json:"responseTimeoutInSeconds,omitempty"`
-	Payload         map[string]interface{} `json:"payload,omitempty"`
+	MethodName      string          `json:"methodName,omitempty"`
+	ConnectTimeout  uint            `json:"connectTimeoutInSeconds,omitempty"`
+	ResponseTimeout uint            `json:"responseTimeoutInSeconds,omitempty"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
 }
 
+// SetPayload sets the call payload to JSON encoding of v,
+// e.g. map[string]interface{} or a struct.
+func (c *MethodCall) SetPayload(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Payload = b
+	return nil
+}
+
+// MethodResult is a direct method invocation result,
+// Payload is the JSON response returned by the method handler.
 type MethodResult struct {
-	Status  int                    `json:"status,omitempty"`
-	Payload map[string]interface{} `json:"payload,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// DecodePayload unmarshals the result payload into v,
+// it's a no-op when the payload is empty.
+func (r *MethodResult) DecodePayload(v interface{}) error {
+	if len(r.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Payload, v)
+}
+
+// PayloadMap returns the result payload decoded into a map the way
+// it was represented before payloads became raw JSON, numbers are float64,
+// use DecodePayload for payloads that aren't objects or need precision.
+func (r *MethodResult) PayloadMap() (map[string]interface{}, error) {
+	var v map[string]interface{}
+	if err := r.DecodePayload(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
 }
 
 type DeviceStatus string
@@ -46,6 +83,20 @@ type Device struct {
 	Capabilities               map[string]interface{} `json:"capabilities,omitempty"`
 	Tags                       map[string]interface{} `json:"tags,omitempty"`
 	Properties                 *Properties            `json:"properties,omitempty"`
+
+	// DeviceScope is the scope of an IoT Edge device, leaf devices
+	// carry the scope of their parent edge device.
+	DeviceScope string `json:"deviceScope,omitempty"`
+
+	// ParentScopes are scopes of the device's parents, it's
+	// the scope of the only parent in nested edge hierarchies.
+	ParentScopes []string `json:"parentScopes,omitempty"`
+}
+
+// IsEdge reports whether the device is an IoT Edge device.
+func (d *Device) IsEdge() bool {
+	edge, _ := d.Capabilities["iotEdge"].(bool)
+	return edge
 }
 
 type PurgeMessageQueueResult struct {
@@ -115,6 +166,19 @@ type Twin struct {
 	Capabilities              map[string]interface{} `json:"capabilities,omitempty"`
 }
 
+// Patch returns a copy of the twin that has only fields that can be
+// updated, that is tags and desired properties without reserved $-prefixed
+// ones such as $metadata and $version, along with the device id and etag.
+// UpdateDeviceTwin sends patches so retrieved twins can be sent back.
+func (t *Twin) Patch() *Twin {
+	return &Twin{
+		DeviceID:   t.DeviceID,
+		ETag:       t.ETag,
+		Tags:       t.Tags,
+		Properties: t.Properties.patch(),
+	}
+}
+
 type ModuleTwin struct {
 	DeviceID           string                 `json:"deviceId,omitempty"`
 	ModuleID           string                 `json:"moduleId,omitempty"`
@@ -131,11 +195,47 @@ type ModuleTwin struct {
 	Properties         *Properties            `json:"properties,omitempty"`
 }
 
+// Patch is Twin.Patch for module twins.
+func (t *ModuleTwin) Patch() *ModuleTwin {
+	return &ModuleTwin{
+		DeviceID:   t.DeviceID,
+		ModuleID:   t.ModuleID,
+		ETag:       t.ETag,
+		Tags:       t.Tags,
+		Properties: t.Properties.patch(),
+	}
+}
+
 type Properties struct {
 	Desired  map[string]interface{} `json:"desired,omitempty"`
 	Reported map[string]interface{} `json:"reported,omitempty"`
 }
 
+// patch returns desired properties without reserved ones,
+// reported properties are omitted since they're read-only.
+func (p *Properties) patch() *Properties {
+	if p == nil || p.Desired == nil {
+		return nil
+	}
+	return &Properties{Desired: stripReserved(p.Desired)}
+}
+
+// stripReserved returns a copy of m without $-prefixed
+// properties, nested objects are stripped as well.
+func stripReserved(m map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			v = stripReserved(sub)
+		}
+		res[k] = v
+	}
+	return res
+}
+
 type DeviceStats struct {
 	DisabledDeviceCount uint `json:"disabledDeviceCount,omitempty"`
 	EnabledDeviceCount  uint `json:"enabledDeviceCount,omitempty"`
@@ -239,9 +339,15 @@ type DeviceMethodParams struct {
 type BadRequestError struct {
 	Message          string `json:"Message"`
 	ExceptionMessage string `json:"ExceptionMessage"`
+
+	// RequestID is the x-ms-client-request-id of the failed request.
+	RequestID string `json:"-"`
 }
 
 func (e *BadRequestError) Error() string {
+	if e.RequestID != "" {
+		return "bad request: " + e.Message + " (request id " + e.RequestID + ")"
+	}
 	return "bad request: " + e.Message
 }
 
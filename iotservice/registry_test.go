@@ -0,0 +1,83 @@
+package iotservice
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMethodPayload(t *testing.T) {
+	var call MethodCall
+	if err := call.SetPayload(map[string]int64{"id": 9007199254740993}); err != nil {
+		t.Fatal(err)
+	}
+	if string(call.Payload) != `{"id":9007199254740993}` {
+		t.Errorf("call payload = %s", call.Payload)
+	}
+
+	var res MethodResult
+	if err := json.Unmarshal([]byte(`{"status":200,"payload":{"id":9007199254740993}}`), &res); err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ ID int64 }
+	if err := res.DecodePayload(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 9007199254740993 {
+		t.Errorf("id = %d, want %d", v.ID, int64(9007199254740993))
+	}
+	m, err := res.PayloadMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["id"].(float64); !ok {
+		t.Errorf("PayloadMap id = %T, want float64", m["id"])
+	}
+
+	res = MethodResult{}
+	if m, err = res.PayloadMap(); err != nil || m != nil {
+		t.Errorf("PayloadMap of empty payload = %v, %v", m, err)
+	}
+}
+
+func TestTwinPatch(t *testing.T) {
+	var twin Twin
+	if err := json.Unmarshal([]byte(`{
+  "deviceId": "golang",
+  "etag": "AAAAAAAAAAE=",
+  "deviceEtag": "NDg5MjE2NjQ4",
+  "status": "enabled",
+  "version": 3,
+  "tags": {"location": "here"},
+  "properties": {
+    "desired": {
+      "a": 1,
+      "b": {"c": 2, "$metadata": {}},
+      "$metadata": {"$lastUpdated": "2021-01-01T00:00:00Z"},
+      "$version": 2
+    },
+    "reported": {"d": 3, "$version": 1}
+  }
+}`), &twin); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(twin.Patch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"deviceId":"golang","etag":"AAAAAAAAAAE=","tags":{"location":"here"},` +
+		`"properties":{"desired":{"a":1,"b":{"c":2}}}}`
+	if string(b) != want {
+		t.Errorf("patch = %s, want %s", b, want)
+	}
+	if _, ok := twin.Properties.Desired["$version"]; !ok {
+		t.Error("Patch modifies the twin")
+	}
+
+	b, err = json.Marshal((&ModuleTwin{DeviceID: "golang", ModuleID: "mod", Version: 1}).Patch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want = `{"deviceId":"golang","moduleId":"mod"}`; string(b) != want {
+		t.Errorf("module patch = %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,30 @@
+package iotservice
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that makes REST requests made with it
+// carry the given correlation id in the x-ms-client-request-id header,
+// so particular operations can be referenced in support cases.
+//
+// The id is also printed in debug logs and attached to returned
+// RequestError and BadRequestError values. When no id is set
+// a random one is generated for every request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id set by WithRequestID.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// requestID returns the context's request id or generates a new one.
+func requestID(ctx context.Context) string {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		return id
+	}
+	return genID()
+}
@@ -0,0 +1,47 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var got []string
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("x-ms-client-request-id"))
+		switch r.URL.Path {
+		case "/devices/bad":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"Message":"malformed"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	ctx := WithRequestID(context.Background(), "golang-request")
+	_, err := c.GetDevice(ctx, "missing")
+	var re *RequestError
+	if !errors.As(err, &re) {
+		t.Fatalf("err = %v, want *RequestError", err)
+	}
+	if re.RequestID != "golang-request" || !strings.Contains(err.Error(), "golang-request") {
+		t.Errorf("request id isn't attached to error: %v", err)
+	}
+
+	_, err = c.GetDevice(ctx, "bad")
+	var be *BadRequestError
+	if !errors.As(err, &be) || be.RequestID != "golang-request" {
+		t.Errorf("request id isn't attached to bad request error: %v", err)
+	}
+
+	_, err = c.GetDevice(context.Background(), "missing")
+	if !errors.As(err, &re) || re.RequestID == "" || re.RequestID != got[2] {
+		t.Errorf("generated request id isn't attached to error: %v", err)
+	}
+	if got[0] != "golang-request" || got[1] != "golang-request" {
+		t.Errorf("x-ms-client-request-id = %q, want golang-request", got[:2])
+	}
+}
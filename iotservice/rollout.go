@@ -0,0 +1,90 @@
+package iotservice
+
+import (
+	"context"
+	"io"
+)
+
+// System metrics of configurations and edge deployments.
+const (
+	MetricTargeted           = "targetedCount"
+	MetricApplied            = "appliedCount"
+	MetricReportedSuccessful = "reportedSuccessfulCount"
+	MetricReportedFailed     = "reportedFailedCount"
+)
+
+// ConfigurationStatus is the live rollout status of a configuration,
+// counts are numbers of devices returned by the metric queries.
+//
+// Successful and Failed are only reported for edge deployments,
+// automatic device configurations report them via custom metrics.
+type ConfigurationStatus struct {
+	ConfigurationID string         `json:"configurationId"`
+	Targeted        int            `json:"targeted"`
+	Applied         int            `json:"applied"`
+	Successful      int            `json:"successful"`
+	Failed          int            `json:"failed"`
+	SystemMetrics   map[string]int `json:"systemMetrics"`
+	Metrics         map[string]int `json:"metrics"` // custom metrics
+}
+
+// GetConfigurationStatus runs system and custom metric queries of the
+// named configuration and returns the numbers of matching devices.
+//
+// Unlike metric results returned by GetConfiguration, that the hub only
+// recomputes every few minutes, counts are up to date, but every query
+// is a full registry query, so they shouldn't be polled too often.
+func (c *Client) GetConfigurationStatus(ctx context.Context, configID string) (
+	*ConfigurationStatus, error,
+) {
+	config, err := c.GetConfiguration(ctx, configID)
+	if err != nil {
+		return nil, err
+	}
+	status := &ConfigurationStatus{
+		ConfigurationID: config.ID,
+		SystemMetrics:   map[string]int{},
+		Metrics:         map[string]int{},
+	}
+	for _, m := range []struct {
+		metrics *ConfigurationMetrics
+		counts  map[string]int
+	}{
+		{config.SystemMetrics, status.SystemMetrics},
+		{config.Metrics, status.Metrics},
+	} {
+		if m.metrics == nil {
+			continue
+		}
+		for name, query := range m.metrics.Queries {
+			n, err := c.countQuery(ctx, query)
+			if err != nil {
+				return nil, errorf("metric %s: %w", name, err)
+			}
+			m.counts[name] = n
+		}
+	}
+	status.Targeted = status.SystemMetrics[MetricTargeted]
+	status.Applied = status.SystemMetrics[MetricApplied]
+	status.Successful = status.SystemMetrics[MetricReportedSuccessful]
+	status.Failed = status.SystemMetrics[MetricReportedFailed]
+	return status, nil
+}
+
+// countQuery returns the number of rows the query returns.
+func (c *Client) countQuery(ctx context.Context, query string) (int, error) {
+	it, err := c.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for {
+		if _, err = it.Next(ctx); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return 0, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,57 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetConfigurationStatus(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/configurations/rollout":
+			w.Write([]byte(`{
+  "id": "rollout",
+  "systemMetrics": {
+    "results": {"targetedCount": 1, "appliedCount": 1},
+    "queries": {"targetedCount": "targeted", "appliedCount": "applied"}
+  },
+  "metrics": {"queries": {"successful": "successful"}}
+}`))
+		case "/devices/query":
+			var q struct{ Query string }
+			if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+				t.Fatal(err)
+			}
+			n := map[string]int{"targeted": 5, "applied": 3, "successful": 2}[q.Query]
+			// split rows into pages to check all of them are counted
+			if r.Header.Get("x-ms-continuation") == "" && n > 1 {
+				w.Header().Set("x-ms-continuation", "next")
+				w.Write([]byte(`[{"deviceId":"0"}]`))
+				return
+			}
+			if r.Header.Get("x-ms-continuation") != "" {
+				n--
+			}
+			rows := make([]string, n)
+			for i := range rows {
+				rows[i] = fmt.Sprintf(`{"deviceId":"%d"}`, i)
+			}
+			w.Write([]byte("[" + strings.Join(rows, ",") + "]"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	status, err := c.GetConfigurationStatus(context.Background(), "rollout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ConfigurationID != "rollout" || status.Targeted != 5 || status.Applied != 3 ||
+		status.Successful != 0 || status.Metrics["successful"] != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
@@ -0,0 +1,265 @@
+package iotservice
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// ScheduledEvent is a cloud-to-device message waiting for delivery.
+type ScheduledEvent struct {
+	ID       string          `json:"id"`
+	DeviceID string          `json:"deviceId"`
+	At       time.Time       `json:"at"`
+	Message  *common.Message `json:"message"`
+}
+
+// ScheduleStore persists scheduled events, so they survive restarts
+// of the process that runs the scheduler. Implementations have to be
+// safe for concurrent use.
+type ScheduleStore interface {
+	// Save stores the event, it's called when it's scheduled.
+	Save(ctx context.Context, ev *ScheduledEvent) error
+
+	// Delete removes the event, it's called when it's sent,
+	// failed to be sent or cancelled.
+	Delete(ctx context.Context, id string) error
+
+	// Load returns all stored events, it's called once by Run.
+	Load(ctx context.Context) ([]*ScheduledEvent, error)
+}
+
+// SchedulerOption is a scheduler configuration option.
+type SchedulerOption func(s *Scheduler)
+
+// WithScheduleStore sets the store scheduled events are persisted in,
+// by default they're kept in memory only.
+func WithScheduleStore(store ScheduleStore) SchedulerOption {
+	return func(s *Scheduler) {
+		s.store = store
+	}
+}
+
+// WithSchedulerErrorHandler sets a function that's called when
+// a due event cannot be sent or removed from the store,
+// events that failed to be sent are discarded.
+func WithSchedulerErrorHandler(fn func(ev *ScheduledEvent, err error)) SchedulerOption {
+	return func(s *Scheduler) {
+		s.onError = fn
+	}
+}
+
+// NewScheduler creates a scheduler that delivers cloud-to-device
+// messages at the given time, IoT Hub doesn't support delayed
+// delivery so messages wait on the client side until Run sends them.
+func NewScheduler(c *Client, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		send: c.SendEvent,
+		wake: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Scheduler is a client-side delayed delivery queue of cloud-to-device messages.
+type Scheduler struct {
+	send    func(ctx context.Context, deviceID string, payload []byte, opts ...SendOption) error
+	store   ScheduleStore
+	onError func(ev *ScheduledEvent, err error)
+
+	mu     sync.Mutex
+	events []*ScheduledEvent // sorted by At
+	wake   chan struct{}
+}
+
+// ScheduleEvent queues a cloud-to-device message to be sent to the named
+// device at the given time and returns its id that can be cancelled.
+// Send options are applied right away, so e.g. WithSendExpiryTime
+// is relative to the moment the event is scheduled.
+func (s *Scheduler) ScheduleEvent(
+	ctx context.Context, deviceID string, payload []byte, at time.Time, opts ...SendOption,
+) (string, error) {
+	if deviceID == "" {
+		return "", errorf("device id is empty")
+	}
+	msg := &common.Message{Payload: payload}
+	for _, opt := range opts {
+		if err := opt(msg); err != nil {
+			return "", err
+		}
+	}
+	if err := msg.Validate(common.MaxC2DMessageSize); err != nil {
+		return "", err
+	}
+	ev := &ScheduledEvent{
+		ID:       genID(),
+		DeviceID: deviceID,
+		At:       at.UTC(),
+		Message:  msg,
+	}
+	if s.store != nil {
+		if err := s.store.Save(ctx, ev); err != nil {
+			return "", err
+		}
+	}
+	s.push(ev)
+	return ev.ID, nil
+}
+
+// CancelEvent removes the scheduled event unless it's been sent already.
+func (s *Scheduler) CancelEvent(ctx context.Context, id string) error {
+	s.mu.Lock()
+	i := s.index(id)
+	if i == -1 {
+		s.mu.Unlock()
+		return errorf("scheduled event %q not found", id)
+	}
+	s.events = append(s.events[:i], s.events[i+1:]...)
+	s.mu.Unlock()
+	if s.store != nil {
+		return s.store.Delete(ctx, id)
+	}
+	return nil
+}
+
+// Pending returns events waiting for delivery ordered by their time.
+func (s *Scheduler) Pending() []*ScheduledEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ScheduledEvent(nil), s.events...)
+}
+
+// Run loads persisted events and sends events as they become due
+// until ctx is done, overdue events are sent right away.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if s.store != nil {
+		events, err := s.store.Load(ctx)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			s.mu.Lock()
+			known := s.index(ev.ID) != -1
+			s.mu.Unlock()
+			if !known {
+				s.push(ev)
+			}
+		}
+	}
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		due := s.due(time.Now())
+		for i, ev := range due {
+			if err := s.deliver(ctx, ev); err != nil {
+				// keep the rest for the next run
+				for _, ev := range due[i:] {
+					s.push(ev)
+				}
+				return err
+			}
+		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		if next, ok := s.next(); ok {
+			t.Reset(time.Until(next))
+		}
+		select {
+		case <-t.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// deliver sends the event and removes it from the store,
+// only ctx errors are returned, others are passed to onError.
+func (s *Scheduler) deliver(ctx context.Context, ev *ScheduledEvent) error {
+	msg := ev.Message
+	if err := s.send(ctx, ev.DeviceID, msg.Payload, func(m *common.Message) error {
+		to := m.To
+		*m = *msg
+		m.To = to
+		return nil
+	}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.notify(ev, err)
+	}
+	if s.store != nil {
+		if err := s.store.Delete(ctx, ev.ID); err != nil {
+			s.notify(ev, err)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) notify(ev *ScheduledEvent, err error) {
+	if s.onError != nil {
+		s.onError(ev, err)
+	}
+}
+
+// push inserts the event keeping events sorted and wakes Run up.
+func (s *Scheduler) push(ev *ScheduledEvent) {
+	s.mu.Lock()
+	i := sort.Search(len(s.events), func(i int) bool {
+		return s.events[i].At.After(ev.At)
+	})
+	s.events = append(s.events, nil)
+	copy(s.events[i+1:], s.events[i:])
+	s.events[i] = ev
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes and returns events that are due at the given time.
+func (s *Scheduler) due(now time.Time) []*ScheduledEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.events), func(i int) bool {
+		return s.events[i].At.After(now)
+	})
+	if i == 0 {
+		return nil
+	}
+	due := append([]*ScheduledEvent(nil), s.events[:i]...)
+	s.events = append(s.events[:0], s.events[i:]...)
+	return due
+}
+
+// next returns the time of the earliest event.
+func (s *Scheduler) next() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return time.Time{}, false
+	}
+	return s.events[0].At, true
+}
+
+// index must be called with mu held.
+func (s *Scheduler) index(id string) int {
+	for i, ev := range s.events {
+		if ev.ID == id {
+			return i
+		}
+	}
+	return -1
+}
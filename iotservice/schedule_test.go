@@ -0,0 +1,118 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+type memScheduleStore struct {
+	mu     sync.Mutex
+	events map[string]*ScheduledEvent
+}
+
+func (s *memScheduleStore) Save(ctx context.Context, ev *ScheduledEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[ev.ID] = ev
+	return nil
+}
+
+func (s *memScheduleStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+	return nil
+}
+
+func (s *memScheduleStore) Load(ctx context.Context) ([]*ScheduledEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*ScheduledEvent
+	for _, ev := range s.events {
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+func (s *memScheduleStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func TestScheduler(t *testing.T) {
+	store := &memScheduleStore{events: map[string]*ScheduledEvent{}}
+	sent := make(chan string, 10)
+	s := NewScheduler(&Client{}, WithScheduleStore(store),
+		WithSchedulerErrorHandler(func(ev *ScheduledEvent, err error) {
+			t.Errorf("%s: %s", ev.ID, err)
+		}),
+	)
+	s.send = func(ctx context.Context, deviceID string, payload []byte, opts ...SendOption) error {
+		msg := &common.Message{Payload: payload}
+		for _, opt := range opts {
+			if err := opt(msg); err != nil {
+				return err
+			}
+		}
+		if msg.Properties["cmd"] != string(payload) {
+			return errors.New("properties are not restored")
+		}
+		sent <- deviceID + ":" + string(payload)
+		return nil
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	if _, err := s.ScheduleEvent(ctx, "golang", []byte("late"), now.Add(200*time.Millisecond),
+		WithSendProperty("cmd", "late"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := s.ScheduleEvent(ctx, "golang", []byte("cancelled"), now.Add(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CancelEvent(ctx, cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ScheduleEvent(ctx, "golang", []byte("overdue"), now.Add(-time.Hour),
+		WithSendProperty("cmd", "overdue"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.len(); n != 2 {
+		t.Fatalf("stored %d events, want 2", n)
+	}
+
+	// a new scheduler picks up persisted events
+	s2 := NewScheduler(&Client{}, WithScheduleStore(store))
+	s2.send = s.send
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- s2.Run(ctx)
+	}()
+	for _, want := range []string{"golang:overdue", "golang:late"} {
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Errorf("sent %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q is not sent", want)
+		}
+	}
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Fatalf("Run error = %v", err)
+	}
+	if n := store.len(); n != 0 || len(s2.Pending()) != 0 {
+		t.Errorf("events left after delivery: %d stored, %d pending", n, len(s2.Pending()))
+	}
+}
@@ -0,0 +1,51 @@
+package iotservice
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestExportSnapshot(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/devices/query":
+			// twins are paged
+			id := "a"
+			if r.Header.Get("x-ms-continuation") == "" {
+				w.Header().Set("x-ms-continuation", "next")
+			} else {
+				id = "b"
+			}
+			_, _ = w.Write([]byte(`[{"deviceId":"` + id + `","tags":{"env":"prod"}}]`))
+		case "/devices/a", "/devices/b":
+			_, _ = w.Write([]byte(`{"deviceId":"` + r.URL.Path[len("/devices/"):] + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	var buf bytes.Buffer
+	if err := c.ExportSnapshot(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		var e SnapshotEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Device.DeviceID != e.Twin.DeviceID || e.Twin.Tags["env"] != "prod" {
+			t.Errorf("entry = %+v, %+v", e.Device, e.Twin)
+		}
+		ids = append(ids, e.Device.DeviceID)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("ids = %v, want [a b]", ids)
+	}
+}
@@ -0,0 +1,163 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ExportConfigurations writes all configurations, including IoT Edge
+// deployments, to w as newline-delimited JSON that ImportConfigurations
+// accepts, e.g. for promoting them from a development hub to production.
+//
+// Hub-specific fields like etags, timestamps and metric results
+// are omitted, metric queries are kept.
+func (c *Client) ExportConfigurations(ctx context.Context, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return c.RangeConfigurations(ctx, func(config *Configuration) error {
+		return enc.Encode(portableConfiguration(config))
+	})
+}
+
+// portableConfiguration returns a copy of the configuration
+// without fields that cannot be applied to another hub.
+func portableConfiguration(config *Configuration) *Configuration {
+	v := *config
+	v.ETag = ""
+	v.CreatedTimeUTC = nil
+	v.LastUpdatedTimeUTC = nil
+	v.SystemMetrics = nil
+	if v.Metrics != nil && len(v.Metrics.Queries) != 0 {
+		v.Metrics = &ConfigurationMetrics{Queries: v.Metrics.Queries}
+	} else {
+		v.Metrics = nil
+	}
+	return &v
+}
+
+// ImportConfigurations creates configurations read from r in the format
+// of ExportConfigurations. All of them are read and checked, including
+// target conditions and metric queries, before making any changes.
+//
+// Existing configurations with the same ids fail the import unless
+// replace is true, then they're deleted and created again, because
+// the content of configurations cannot be updated.
+//
+// Replacement is not atomic: when a configuration cannot be created
+// the deleted one is restored, but configurations imported before it
+// stay and devices may observe the gap between deletion and creation.
+func (c *Client) ImportConfigurations(ctx context.Context, r io.Reader, replace bool) error {
+	var configs []*Configuration
+	seen := map[string]bool{}
+	d := json.NewDecoder(r)
+	for {
+		var config Configuration
+		if err := d.Decode(&config); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if config.ID == "" {
+			return errorf("configuration %d: id is empty", len(configs)+1)
+		}
+		if seen[config.ID] {
+			return errorf("configuration %q is duplicated", config.ID)
+		}
+		if config.Content == nil ||
+			len(config.Content.ModulesContent) == 0 && len(config.Content.DeviceContent) == 0 {
+			return errorf("configuration %q: content is empty", config.ID)
+		}
+		seen[config.ID] = true
+		configs = append(configs, portableConfiguration(&config))
+	}
+	for _, config := range configs {
+		if err := c.checkConfigurationQueries(ctx, config); err != nil {
+			return err
+		}
+	}
+
+	existing := map[string]*Configuration{}
+	if err := c.RangeConfigurations(ctx, func(config *Configuration) error {
+		if seen[config.ID] {
+			existing[config.ID] = config
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !replace && len(existing) != 0 {
+		ids := make([]string, 0, len(existing))
+		for id := range existing {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return errorf("configurations already exist: %s", strings.Join(ids, ", "))
+	}
+
+	for _, config := range configs {
+		old, ok := existing[config.ID]
+		if ok {
+			if err := c.DeleteConfiguration(ctx, old); err != nil {
+				return err
+			}
+		}
+		if _, err := c.CreateConfiguration(ctx, config); err != nil {
+			if !ok {
+				return err
+			}
+			if _, rerr := c.CreateConfiguration(ctx, portableConfiguration(old)); rerr != nil {
+				return errorf("configuration %q is deleted and cannot be restored: %s (import error: %s)",
+					config.ID, rerr, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConfigurationQueries validates the target condition and
+// metric queries of the configuration without applying it.
+func (c *Client) checkConfigurationQueries(ctx context.Context, config *Configuration) error {
+	req := struct {
+		TargetCondition     string            `json:"targetCondition,omitempty"`
+		CustomMetricQueries map[string]string `json:"customMetricQueries,omitempty"`
+	}{TargetCondition: config.TargetCondition}
+	if config.Metrics != nil {
+		req.CustomMetricQueries = config.Metrics.Queries
+	}
+	if req.TargetCondition == "" && len(req.CustomMetricQueries) == 0 {
+		return nil
+	}
+	var res struct {
+		TargetConditionError    string            `json:"targetConditionError"`
+		CustomMetricQueryErrors map[string]string `json:"customMetricQueryErrors"`
+	}
+	if _, err := c.call(
+		ctx,
+		http.MethodPost,
+		"configurations/testQueries",
+		nil,
+		nil,
+		&req,
+		&res,
+	); err != nil {
+		return err
+	}
+	if res.TargetConditionError != "" {
+		return errorf("configuration %q: target condition: %s", config.ID, res.TargetConditionError)
+	}
+	names := make([]string, 0, len(res.CustomMetricQueryErrors))
+	for name := range res.CustomMetricQueryErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if msg := res.CustomMetricQueryErrors[name]; msg != "" {
+			return errorf("configuration %q: metric %q: %s", config.ID, name, msg)
+		}
+	}
+	return nil
+}
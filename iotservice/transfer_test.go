@@ -0,0 +1,165 @@
+package iotservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// configRegistry is a fake configurations endpoint.
+type configRegistry struct {
+	mu      sync.Mutex
+	configs map[string]*Configuration
+	deleted []string
+	reject  string // priority of configurations that cannot be created
+}
+
+func (reg *configRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.TrimPrefix(r.URL.Path, "/configurations/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/configurations/testQueries":
+		var req struct {
+			TargetCondition string `json:"targetCondition"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res := map[string]string{}
+		if strings.Contains(req.TargetCondition, "==") {
+			res["targetConditionError"] = "syntax error"
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet && r.URL.Path == "/configurations":
+		list := []*Configuration{}
+		for _, config := range reg.configs {
+			list = append(list, config)
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut:
+		var config Configuration
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := reg.configs[id]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if reg.reject != "" && strconv.Itoa(int(config.Priority)) == reg.reject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		config.ETag = "etag-" + id
+		reg.configs[id] = &config
+		_ = json.NewEncoder(w).Encode(&config)
+	case r.Method == http.MethodDelete:
+		if r.Header.Get("If-Match") != `"etag-`+id+`"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(reg.configs, id)
+		reg.deleted = append(reg.deleted, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestExportImportConfigurations(t *testing.T) {
+	src := newTestClient(t, &configRegistry{configs: map[string]*Configuration{
+		"deployment": {
+			ID:              "deployment",
+			TargetCondition: "tags.env='prod'",
+			Priority:        10,
+			Content: &ConfigurationContent{
+				ModulesContent: map[string]interface{}{"$edgeAgent": map[string]interface{}{}},
+			},
+			Metrics: &ConfigurationMetrics{
+				Results: map[string]uint{"reporting": 3},
+				Queries: map[string]string{"reporting": "SELECT deviceId FROM devices"},
+			},
+			SystemMetrics: &ConfigurationMetrics{Results: map[string]uint{"targetedCount": 3}},
+			ETag:          "etag-deployment",
+		},
+	}})
+
+	var buf bytes.Buffer
+	ctx := context.Background()
+	if err := src.ExportConfigurations(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"etag", "systemMetrics", "results"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("export contains %s: %s", s, buf.String())
+		}
+	}
+	exported := buf.String()
+
+	dst := &configRegistry{configs: map[string]*Configuration{}}
+	c := newTestClient(t, dst)
+	if err := c.ImportConfigurations(ctx, strings.NewReader(exported), false); err != nil {
+		t.Fatal(err)
+	}
+	config := dst.configs["deployment"]
+	if config == nil || config.TargetCondition != "tags.env='prod'" || config.Priority != 10 ||
+		config.Metrics.Queries["reporting"] == "" {
+		t.Fatalf("imported configuration = %+v", config)
+	}
+
+	if err := c.ImportConfigurations(ctx, strings.NewReader(exported), false); err == nil ||
+		!strings.Contains(err.Error(), "deployment") {
+		t.Errorf("importing existing configuration error = %v", err)
+	}
+	if err := c.ImportConfigurations(ctx, strings.NewReader(exported), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.deleted) != 1 || dst.configs["deployment"] == nil {
+		t.Errorf("configuration isn't replaced, deleted = %v", dst.deleted)
+	}
+}
+
+func TestImportConfigurationsReplaceFailure(t *testing.T) {
+	dst := &configRegistry{configs: map[string]*Configuration{
+		"deployment": {
+			ID:       "deployment",
+			Priority: 10,
+			Content:  &ConfigurationContent{DeviceContent: map[string]interface{}{"a": 1}},
+			ETag:     "etag-deployment",
+		},
+	}}
+	c := newTestClient(t, dst)
+	ctx := context.Background()
+
+	// invalid queries fail the import before anything is deleted
+	invalid := `{"id":"deployment","priority":20,"targetCondition":"tags.env=='prod'",` +
+		`"content":{"deviceContent":{"a":2}}}`
+	if err := c.ImportConfigurations(ctx, strings.NewReader(invalid), true); err == nil ||
+		!strings.Contains(err.Error(), "target condition") {
+		t.Fatalf("import error = %v, want a target condition error", err)
+	}
+	if err := c.ImportConfigurations(ctx, strings.NewReader(`{"id":"deployment"}`), true); err == nil {
+		t.Fatal("importing a configuration without content error is nil")
+	}
+	if len(dst.deleted) != 0 {
+		t.Fatalf("deleted = %v, want nothing", dst.deleted)
+	}
+
+	// configurations that cannot be created are restored
+	dst.reject = "20"
+	rejected := `{"id":"deployment","priority":20,"content":{"deviceContent":{"a":2}}}`
+	if err := c.ImportConfigurations(ctx, strings.NewReader(rejected), true); err == nil {
+		t.Fatal("import error is nil")
+	}
+	if config := dst.configs["deployment"]; config == nil || config.Priority != 10 {
+		t.Fatalf("configuration isn't restored: %+v", config)
+	}
+}
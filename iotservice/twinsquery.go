@@ -0,0 +1,132 @@
+package iotservice
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+// UpdateTwinsOption is an UpdateTwinsWhere configuration option.
+type UpdateTwinsOption func(o *updateTwinsOptions)
+
+type updateTwinsOptions struct {
+	concurrency int
+}
+
+// DefaultUpdateTwinsConcurrency is the default number
+// of twins UpdateTwinsWhere updates at the same time.
+const DefaultUpdateTwinsConcurrency = 8
+
+// WithUpdateTwinsConcurrency sets the maximum number of twins
+// updated at the same time, default is DefaultUpdateTwinsConcurrency.
+func WithUpdateTwinsConcurrency(n int) UpdateTwinsOption {
+	if n < 1 {
+		panic("concurrency must be positive")
+	}
+	return func(o *updateTwinsOptions) {
+		o.concurrency = n
+	}
+}
+
+// TwinUpdateResult is the result of updating a single twin.
+type TwinUpdateResult struct {
+	DeviceID string `json:"deviceId"`
+	Error    string `json:"error,omitempty"`
+}
+
+// TwinsUpdateReport is the UpdateTwinsWhere report,
+// Results are ordered by device id.
+type TwinsUpdateReport struct {
+	Total     int                 `json:"total"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []*TwinUpdateResult `json:"results"`
+}
+
+// UpdateTwinsWhere patches desired properties of all devices matching the
+// query condition, e.g. "tags.location = 'plant-1'", an empty condition
+// matches all devices. Twins are updated one by one with bounded
+// concurrency as the query results are paged through, so it's a lighter
+// alternative to scheduled twin update jobs for small and medium fleets.
+//
+// Failed updates are listed in the report rather than returned as errors,
+// the error is returned only when the query fails, then the report covers
+// devices processed so far.
+func (c *Client) UpdateTwinsWhere(
+	ctx context.Context, condition string, patch map[string]interface{}, opts ...UpdateTwinsOption,
+) (*TwinsUpdateReport, error) {
+	o := &updateTwinsOptions{concurrency: DefaultUpdateTwinsConcurrency}
+	for _, opt := range opts {
+		opt(o)
+	}
+	query := "SELECT deviceId FROM devices"
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		report = &TwinsUpdateReport{Results: []*TwinUpdateResult{}}
+		ids    = make(chan string)
+	)
+	for i := 0; i < o.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				res := &TwinUpdateResult{DeviceID: id}
+				if _, err := c.UpdateDeviceTwin(ctx, &Twin{
+					DeviceID:   id,
+					Properties: &Properties{Desired: patch},
+				}); err != nil {
+					res.Error = err.Error()
+				}
+				mu.Lock()
+				report.Results = append(report.Results, res)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := c.rangeDeviceIDs(ctx, query, func(id string) {
+		ids <- id
+	})
+	close(ids)
+	wg.Wait()
+
+	sort.Slice(report.Results, func(i, j int) bool {
+		return report.Results[i].DeviceID < report.Results[j].DeviceID
+	})
+	for _, res := range report.Results {
+		if res.Error != "" {
+			report.Failed++
+		}
+	}
+	report.Total = len(report.Results)
+	report.Succeeded = report.Total - report.Failed
+	return report, err
+}
+
+// rangeDeviceIDs calls fn with device ids returned by the query.
+func (c *Client) rangeDeviceIDs(ctx context.Context, query string, fn func(id string)) error {
+	it, err := c.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	for {
+		row, err := it.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, _ := row["deviceId"].(string)
+		if id == "" {
+			return errorf("query row has no deviceId: %v", row)
+		}
+		fn(id)
+	}
+}
@@ -0,0 +1,72 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdateTwinsWhere(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		patched = map[string]interface{}{}
+	)
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/devices/query":
+			var v struct{ Query string }
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil ||
+				v.Query != "SELECT deviceId FROM devices WHERE tags.site = 'a'" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.Header.Get("x-ms-continuation") == "" {
+				w.Header().Set("x-ms-continuation", "p2")
+				_, _ = w.Write([]byte(`[{"deviceId":"d1"},{"deviceId":"d2"}]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[{"deviceId":"d3"}]`))
+		case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/twins/"):
+			id := strings.TrimPrefix(r.URL.Path, "/twins/")
+			if id == "d2" {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			var twin Twin
+			if err := json.NewDecoder(r.Body).Decode(&twin); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			patched[id] = twin.Properties.Desired["fw"]
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"deviceId":"` + id + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	report, err := c.UpdateTwinsWhere(context.Background(), "tags.site = 'a'",
+		map[string]interface{}{"fw": "2.0"},
+		WithUpdateTwinsConcurrency(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 3 || report.Succeeded != 2 || report.Failed != 1 {
+		t.Errorf("report = %d/%d/%d, want 3/2/1", report.Total, report.Succeeded, report.Failed)
+	}
+	for i, id := range []string{"d1", "d2", "d3"} {
+		res := report.Results[i]
+		if res.DeviceID != id || (res.Error != "") != (id == "d2") {
+			t.Errorf("result %d = %+v", i, res)
+		}
+	}
+	if patched["d1"] != "2.0" || patched["d3"] != "2.0" || len(patched) != 2 {
+		t.Errorf("patched = %v", patched)
+	}
+}
@@ -14,6 +14,21 @@ type Logger interface {
 	Debugf(format string, v ...interface{})
 }
 
+// LevelEnabler is implemented by loggers that can tell whether messages of
+// a level are printed, so building expensive messages can be skipped.
+type LevelEnabler interface {
+	Enabled(lvl Level) bool
+}
+
+// Enabled reports whether l prints messages of the level,
+// it's true for loggers that don't implement LevelEnabler.
+func Enabled(l Logger, lvl Level) bool {
+	if e, ok := l.(LevelEnabler); ok {
+		return e.Enabled(lvl)
+	}
+	return true
+}
+
 // Level is logging severity.
 type Level uint8
 
@@ -88,6 +103,11 @@ type LevelLogger struct {
 	out OutputFunc
 }
 
+// Enabled implements LevelEnabler.
+func (l *LevelLogger) Enabled(lvl Level) bool {
+	return lvl <= l.lvl
+}
+
 func (l *LevelLogger) Errorf(format string, v ...interface{}) {
 	l.logf(LevelError, format, v...)
 }
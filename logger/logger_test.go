@@ -21,3 +21,13 @@ func TestLogger(t *testing.T) {
 		t.Fatalf("logger output = %q, want %q", have, want)
 	}
 }
+
+func TestEnabled(t *testing.T) {
+	l := New(LevelWarn, func(Level, string) {})
+	if !Enabled(l, LevelError) || !Enabled(l, LevelWarn) || Enabled(l, LevelDebug) {
+		t.Error("unexpected enabled levels")
+	}
+	if !Enabled(struct{ Logger }{l}, LevelDebug) {
+		t.Error("loggers that don't implement LevelEnabler have to be enabled")
+	}
+}
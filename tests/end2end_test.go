@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
@@ -265,8 +266,8 @@ func testCloudToDevice(t *testing.T, sc *iotservice.Client, dc *iotdevice.Client
 					if fb.OriginalMessageID != mid {
 						continue
 					}
-					if fb.StatusCode != "Success" {
-						t.Errorf("feedback status = %q, want %q", fb.StatusCode, "Success")
+					if fb.StatusCode != iotservice.FeedbackSuccess {
+						t.Errorf("feedback status = %q, want %q", fb.StatusCode, iotservice.FeedbackSuccess)
 					}
 					break Outer
 				case <-time.After(15 * time.Second):
@@ -385,10 +386,7 @@ func testDirectMethod(t *testing.T, sc *iotservice.Client, dc *iotdevice.Client)
 			MethodName:      "sum",
 			ConnectTimeout:  5,
 			ResponseTimeout: 5,
-			Payload: map[string]interface{}{
-				"a": 1.5,
-				"b": 3,
-			},
+			Payload:         json.RawMessage(`{"a":1.5,"b":3}`),
 		})
 		if err != nil {
 			errc <- err
@@ -398,14 +396,13 @@ func testDirectMethod(t *testing.T, sc *iotservice.Client, dc *iotdevice.Client)
 
 	select {
 	case v := <-resc:
-		w := &iotservice.MethodResult{
-			Status: 222,
-			Payload: map[string]interface{}{
-				"result": 4.5,
-			},
+		p, err := v.PayloadMap()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !reflect.DeepEqual(v, w) {
-			t.Errorf("direct-method result = %v, want %v", v, w)
+		w := map[string]interface{}{"result": 4.5}
+		if v.Status != 222 || !reflect.DeepEqual(p, w) {
+			t.Errorf("direct-method result = %d %v, want %d %v", v.Status, p, 222, w)
 		}
 	case err := <-errc:
 		t.Fatal(err)
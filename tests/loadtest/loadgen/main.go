@@ -0,0 +1,138 @@
+// Command loadgen provisions virtual devices on the hub of
+// $TEST_IOTHUB_SERVICE_CONNECTION_STRING, sends telemetry
+// at the target rate and prints the loadtest report.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/amqp"
+	"github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+	"github.com/amenzhinsky/iothub/iotservice"
+	"github.com/amenzhinsky/iothub/tests/loadtest"
+)
+
+var transports = map[string]func() transport.Transport{
+	"mqtt":    func() transport.Transport { return mqtt.New() },
+	"mqtt-ws": func() transport.Transport { return mqtt.New(mqtt.WithWebSocket(true)) },
+	"amqp":    func() transport.Transport { return amqp.New() },
+}
+
+var (
+	devicesFlag   int
+	rateFlag      float64
+	durationFlag  time.Duration
+	sizeFlag      int
+	qosFlag       int
+	transportFlag string
+	prefixFlag    string
+	certFlag      string
+	keyFlag       string
+	keepFlag      bool
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flag.IntVar(&devicesFlag, "devices", 10, "number of virtual devices")
+	flag.Float64Var(&rateFlag, "rate", 10, "target messages per second across all devices")
+	flag.DurationVar(&durationFlag, "duration", time.Minute, "test duration")
+	flag.IntVar(&sizeFlag, "size", 256, "payload size in bytes")
+	flag.IntVar(&qosFlag, "qos", mqtt.DefaultQoS, "QoS value, 0 or 1 (mqtt only)")
+	flag.StringVar(&transportFlag, "transport", "mqtt", "transport to use <mqtt|mqtt-ws|amqp>")
+	flag.StringVar(&prefixFlag, "prefix", "golang-iothub-load", "virtual device id prefix")
+	flag.StringVar(&certFlag, "cert", "", "self-signed x509 certificate file, symmetric keys are used when empty")
+	flag.StringVar(&keyFlag, "key", "", "x509 private key file")
+	flag.BoolVar(&keepFlag, "keep", false, "don't delete virtual devices when done")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	mktransport, ok := transports[transportFlag]
+	if !ok {
+		return fmt.Errorf("unknown transport %q", transportFlag)
+	}
+	cs := os.Getenv("TEST_IOTHUB_SERVICE_CONNECTION_STRING")
+	if cs == "" {
+		return errors.New("$TEST_IOTHUB_SERVICE_CONNECTION_STRING is empty")
+	}
+	var crt *tls.Certificate
+	if certFlag != "" || keyFlag != "" {
+		c, err := tls.LoadX509KeyPair(certFlag, keyFlag)
+		if err != nil {
+			return err
+		}
+		crt = &c
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	sc, err := iotservice.NewFromConnectionString(cs)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	if err = loadtest.Provision(ctx, sc, prefixFlag, devicesFlag, crt); err != nil {
+		return err
+	}
+	if !keepFlag {
+		defer func() {
+			if err := loadtest.Deprovision(context.Background(), sc, prefixFlag, devicesFlag); err != nil {
+				fmt.Fprintf(os.Stderr, "deprovision error: %s\n", err)
+			}
+		}()
+	}
+
+	cfg := &loadtest.Config{
+		Devices:  devicesFlag,
+		Rate:     rateFlag,
+		Duration: durationFlag,
+		Payload:  make([]byte, sizeFlag),
+		NewClient: func(i int) (*iotdevice.Client, error) {
+			id := loadtest.DeviceID(prefixFlag, i)
+			if crt != nil {
+				return iotdevice.NewFromX509Cert(mktransport(), id, sc.HostName(), crt)
+			}
+			device, err := sc.GetDevice(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			dcs, err := sc.DeviceConnectionString(device, false)
+			if err != nil {
+				return nil, err
+			}
+			return iotdevice.NewFromConnectionString(mktransport(), dcs)
+		},
+	}
+	if transportFlag != "amqp" {
+		cfg.SendOptions = append(cfg.SendOptions, iotdevice.WithSendQoS(qosFlag))
+	}
+	report, err := loadtest.Run(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
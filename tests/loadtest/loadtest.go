@@ -0,0 +1,247 @@
+// Package loadtest is a load-generation harness that sends telemetry on
+// behalf of a number of virtual devices at a target rate and reports
+// send latency percentiles, so performance of transports can be measured
+// against a real hub, see the loadgen command.
+package loadtest
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iotservice"
+)
+
+// Config is a load test configuration.
+type Config struct {
+	// Devices is the number of virtual devices, each of them
+	// has its own client and connection, 1 when zero.
+	Devices int
+
+	// Rate is the target number of messages per second across
+	// all devices, every device sends Rate/Devices messages per second.
+	Rate float64
+
+	// Duration is the period messages are sent for.
+	Duration time.Duration
+
+	// Payload is the message payload.
+	Payload []byte
+
+	// NewClient creates a client of the i-th virtual device,
+	// it's connected by the harness and closed when the test is done.
+	NewClient func(i int) (*iotdevice.Client, error)
+
+	// SendOptions are passed to every SendEvent call.
+	SendOptions []iotdevice.SendOption
+}
+
+// Report is a load test summary, latency is the time it takes
+// a message to be sent and acknowledged by the hub.
+type Report struct {
+	Devices    int     `json:"devices"`
+	Sent       int     `json:"sent"`
+	Failed     int     `json:"failed"`
+	Elapsed    string  `json:"elapsed"`
+	TargetRate float64 `json:"targetRate"`
+	Rate       float64 `json:"rate"` // achieved messages per second
+	P50        string  `json:"p50"`
+	P90        string  `json:"p90"`
+	P99        string  `json:"p99"`
+	Max        string  `json:"max"`
+	Error      string  `json:"lastError,omitempty"`
+}
+
+// Run connects all virtual devices and sends messages until the duration
+// elapses or the context is done, sends are scheduled on a fixed interval
+// so when they take longer than the interval the achieved rate drops.
+func Run(ctx context.Context, cfg *Config) (*Report, error) {
+	if cfg.Rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+	if cfg.Duration <= 0 {
+		return nil, errors.New("duration must be positive")
+	}
+	if cfg.NewClient == nil {
+		return nil, errors.New("NewClient is required")
+	}
+	n := cfg.Devices
+	if n < 1 {
+		n = 1
+	}
+
+	clients := make([]*iotdevice.Client, 0, n)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c, err := cfg.NewClient(i)
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %w", i, err)
+		}
+		clients = append(clients, c)
+		if err = c.Connect(ctx); err != nil {
+			return nil, fmt.Errorf("device %d: connect: %w", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	interval := time.Duration(float64(time.Second) * float64(n) / cfg.Rate)
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    int
+		lastErr   error
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *iotdevice.Client) {
+			defer wg.Done()
+
+			// stagger devices so sends are evenly spread over the interval
+			select {
+			case <-time.After(interval * time.Duration(i) / time.Duration(n)):
+			case <-ctx.Done():
+				return
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				t := time.Now()
+				err := c.SendEvent(ctx, cfg.Payload, cfg.SendOptions...)
+				d := time.Since(t)
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				if err != nil {
+					failed++
+					lastErr = err
+				} else {
+					latencies = append(latencies, d)
+				}
+				mu.Unlock()
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	r := &Report{
+		Devices:    n,
+		Sent:       len(latencies),
+		Failed:     failed,
+		Elapsed:    elapsed.Round(time.Millisecond).String(),
+		TargetRate: cfg.Rate,
+		Rate:       float64(len(latencies)) / elapsed.Seconds(),
+		P50:        percentile(latencies, 50).String(),
+		P90:        percentile(latencies, 90).String(),
+		P99:        percentile(latencies, 99).String(),
+		Max:        percentile(latencies, 100).String(),
+	}
+	if lastErr != nil {
+		r.Error = lastErr.Error()
+	}
+	return r, nil
+}
+
+// percentile returns the p-th percentile of sorted durations
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+// DeviceID returns the id of the i-th virtual device.
+func DeviceID(prefix string, i int) string {
+	return fmt.Sprintf("%s-%d", prefix, i)
+}
+
+// Provision creates n virtual devices named with DeviceID that
+// authenticate with symmetric keys or, when crt isn't nil, with the
+// self-signed certificate's thumbprint, existing devices are replaced.
+func Provision(
+	ctx context.Context, sc *iotservice.Client, prefix string, n int, crt *tls.Certificate,
+) error {
+	if err := Deprovision(ctx, sc, prefix, n); err != nil {
+		return err
+	}
+	auth := &iotservice.Authentication{Type: iotservice.AuthSAS}
+	if crt != nil {
+		if len(crt.Certificate) == 0 {
+			return errors.New("certificate is empty")
+		}
+		thumb := strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(crt.Certificate[0])))
+		auth = &iotservice.Authentication{
+			Type: iotservice.AuthSelfSigned,
+			X509Thumbprint: &iotservice.X509Thumbprint{
+				PrimaryThumbprint:   thumb,
+				SecondaryThumbprint: thumb,
+			},
+		}
+	}
+	return bulk(prefix, n, func(devices []*iotservice.Device) (*iotservice.BulkResult, error) {
+		for _, d := range devices {
+			d.Authentication = auth
+		}
+		return sc.CreateDevices(ctx, devices)
+	})
+}
+
+// Deprovision deletes virtual devices created by Provision.
+func Deprovision(ctx context.Context, sc *iotservice.Client, prefix string, n int) error {
+	return bulk(prefix, n, func(devices []*iotservice.Device) (*iotservice.BulkResult, error) {
+		return sc.DeleteDevices(ctx, devices, true)
+	})
+}
+
+// bulk calls fn with chunks of virtual devices that fit into a bulk request.
+func bulk(
+	prefix string, n int,
+	fn func(devices []*iotservice.Device) (*iotservice.BulkResult, error),
+) error {
+	for off := 0; off < n; off += iotservice.MaxBulkDevices {
+		devices := make([]*iotservice.Device, 0, iotservice.MaxBulkDevices)
+		for i := off; i < n && i < off+iotservice.MaxBulkDevices; i++ {
+			devices = append(devices, &iotservice.Device{DeviceID: DeviceID(prefix, i)})
+		}
+		res, err := fn(devices)
+		if err != nil {
+			return err
+		}
+		for _, e := range res.Errors {
+			// deleting devices that don't exist isn't an error, 404xxx codes
+			if e.ErrorCode/1000 != 404 {
+				return fmt.Errorf("%s: %s (%d)", e.DeviceID, e.ErrorStatus, e.ErrorCode)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package loadtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+	"github.com/amenzhinsky/iothub/iothubtest"
+	"github.com/amenzhinsky/iothub/logger"
+)
+
+func TestRun(t *testing.T) {
+	hub, err := iothubtest.New(iothubtest.WithLogger(logger.New(logger.LevelOff, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	report, err := Run(context.Background(), &Config{
+		Devices:  3,
+		Rate:     30,
+		Duration: time.Second,
+		Payload:  []byte("hello"),
+		NewClient: func(i int) (*iotdevice.Client, error) {
+			return hub.NewDeviceClient(DeviceID("load", i),
+				iotdevice.WithLogger(logger.New(logger.LevelOff, nil)),
+			)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Devices != 3 || report.Failed != 0 || report.Sent < 15 || report.Sent > 35 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if report.P50 == "0s" {
+		t.Errorf("p50 is zero")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < report.Sent; i++ {
+		if _, err = hub.ReceiveEvent(ctx); err != nil {
+			t.Fatalf("%d of %d messages received: %s", i, report.Sent, err)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d []time.Duration
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i))
+	}
+	for p, want := range map[int]time.Duration{50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := percentile(d, p); got != want {
+			t.Errorf("percentile(%d) = %d, want %d", p, got, want)
+		}
+	}
+	if got := percentile(d[:1], 50); got != 1 {
+		t.Errorf("percentile of one = %d, want 1", got)
+	}
+}